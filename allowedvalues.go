@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const codeUnknownValue = "unknown_value"
+
+// allowedValueFields are the categorical employee columns that can have a
+// managed list of values.
+var allowedValueFields = map[string]bool{"gender": true, "department": true}
+
+// AllowedValue is one value a tenant accepts for a categorical field, with
+// the spellings it is written as. Once a field has any allowed values,
+// records must use one of them; a field without any takes anything.
+type AllowedValue struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	TenantID string `gorm:"size:64;not null;uniqueIndex:idx_allowed_values_tenant_field_value" json:"tenant_id"`
+	Field    string `gorm:"size:32;not null;uniqueIndex:idx_allowed_values_tenant_field_value" json:"field"`
+	// Value is the canonical spelling records are stored with.
+	Value string `gorm:"size:128;not null;uniqueIndex:idx_allowed_values_tenant_field_value" json:"value"`
+	// Aliases are other spellings rewritten to Value, such as "Eng" for
+	// "Engineering". Case and spacing never matter.
+	Aliases   []string  `gorm:"type:text;serializer:json" json:"aliases"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// valueKey is what spellings are compared by: lowercase, with runs of
+// spaces collapsed.
+func valueKey(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
+
+// valueLists maps each restricted field to its spellings, by valueKey, and
+// the canonical value each stands for.
+type valueLists map[string]map[string]string
+
+// loadValueLists reads the tenant's allowed values.
+func loadValueLists(ctx context.Context, tenantID string) (valueLists, error) {
+	var values []AllowedValue
+	if err := db.WithContext(ctx).Where("tenant_id = ?", tenantID).Find(&values).Error; err != nil {
+		return nil, err
+	}
+	lists := valueLists{}
+	for _, v := range values {
+		if lists[v.Field] == nil {
+			lists[v.Field] = map[string]string{}
+		}
+		lists[v.Field][valueKey(v.Value)] = v.Value
+		for _, alias := range v.Aliases {
+			lists[v.Field][valueKey(alias)] = v.Value
+		}
+	}
+	return lists, nil
+}
+
+// normalize rewrites e's categorical fields to their canonical values and
+// returns an error for each that is not allowed. Blank values are left
+// alone.
+func (l valueLists) normalize(e *Employee) validationErrors {
+	var errs validationErrors
+	fields := []struct {
+		column, key string
+		value       *string
+	}{{"gender", "Gender", &e.Gender}, {"department", "Department", &e.Department}}
+	for _, f := range fields {
+		field, value, list := f.column, f.value, l[f.column]
+		if list == nil || strings.TrimSpace(*value) == "" {
+			continue
+		}
+		canonical, ok := list[valueKey(*value)]
+		if !ok {
+			errs = append(errs, validationError{Field: f.key, Code: codeUnknownValue, Message: fmt.Sprintf("%s %q is not an allowed value", field, *value)})
+			continue
+		}
+		*value = canonical
+	}
+	return errs
+}
+
+type valueCount struct {
+	Value string `json:"value"`
+	Count int64  `json:"count"`
+}
+
+type allowedValueRequest struct {
+	Field   string   `json:"field" binding:"required"`
+	Value   string   `json:"value" binding:"required"`
+	Aliases []string `json:"aliases"`
+}
+
+// apply validates req and copies it onto v, trimming the spellings and
+// dropping aliases that are the value itself or repeat one another.
+func (req allowedValueRequest) apply(v *AllowedValue) error {
+	field := strings.ToLower(strings.TrimSpace(req.Field))
+	if !allowedValueFields[field] {
+		return errors.New("field must be gender or department")
+	}
+	value := strings.Join(strings.Fields(req.Value), " ")
+	if value == "" || len(value) > 128 {
+		return errors.New("value must be 1-128 characters")
+	}
+	seen := map[string]bool{valueKey(value): true}
+	aliases := []string{}
+	for _, alias := range req.Aliases {
+		if key := valueKey(alias); key != "" && !seen[key] {
+			seen[key] = true
+			aliases = append(aliases, strings.TrimSpace(alias))
+		}
+	}
+	v.Field, v.Value, v.Aliases = field, value, aliases
+	return nil
+}
+
+// saveAllowedValue creates or updates a value, answering 409 if any of its
+// spellings already stands for another value of the field.
+func saveAllowedValue(c *gin.Context, v *AllowedValue, status int) {
+	var others []AllowedValue
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).
+		Where("field = ? AND id <> ?", v.Field, v.ID).Find(&others).Error; err != nil {
+		logCtx(c).Errorf("Error reading allowed values: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save allowed value"})
+		return
+	}
+	taken := map[string]AllowedValue{}
+	for _, o := range others {
+		taken[valueKey(o.Value)] = o
+		for _, alias := range o.Aliases {
+			taken[valueKey(alias)] = o
+		}
+	}
+	for _, spelling := range append([]string{v.Value}, v.Aliases...) {
+		if o, ok := taken[valueKey(spelling)]; ok {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%q already stands for %q", spelling, o.Value), "id": o.ID})
+			return
+		}
+	}
+	if err := db.WithContext(c.Request.Context()).Save(v).Error; err != nil {
+		logCtx(c).Errorf("Error saving allowed value %s %q: %v", v.Field, v.Value, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save allowed value"})
+		return
+	}
+	logCtx(c).Infof("Saved allowed %s %q for tenant %s", v.Field, v.Value, v.TenantID)
+	c.JSON(status, v)
+}
+
+func createAllowedValue(c *gin.Context) {
+	var req allowedValueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	v := AllowedValue{TenantID: tenantID(c), CreatedBy: c.GetString(ctxActor)}
+	if err := req.apply(&v); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	saveAllowedValue(c, &v, http.StatusCreated)
+}
+
+func listAllowedValues(c *gin.Context) {
+	query := db.WithContext(c.Request.Context()).Scopes(tenantScope(c))
+	if field := c.Query("field"); field != "" {
+		if !allowedValueFields[field] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid field, expected gender or department"})
+			return
+		}
+		query = query.Where("field = ?", field)
+	}
+	values := []AllowedValue{}
+	if err := query.Order("field").Order("value").Find(&values).Error; err != nil {
+		logCtx(c).Errorf("Error listing allowed values: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list allowed values"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"values": values})
+}
+
+// updateAllowedValue replaces a value and its aliases. Records already
+// stored with the old value keep it.
+func updateAllowedValue(c *gin.Context) {
+	var req allowedValueRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var v AllowedValue
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&v, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Allowed value not found"})
+		return
+	}
+	if err := req.apply(&v); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	saveAllowedValue(c, &v, http.StatusOK)
+}
+
+// deleteAllowedValue removes a value. Deleting a field's last value lifts
+// the restriction on it.
+func deleteAllowedValue(c *gin.Context) {
+	result := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Delete(&AllowedValue{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		logCtx(c).Errorf("Error deleting allowed value %s: %v", c.Param("id"), result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete allowed value"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Allowed value not found"})
+		return
+	}
+	setRowsAffected(c, result.RowsAffected)
+	logCtx(c).Infof("Deleted allowed value %s", c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "Allowed value deleted"})
+}
+
+// listUnknownValues reports the values stored records have for a field
+// that are not the canonical spelling of an allowed value, with how many
+// records have each, to clean up records written before the list existed.
+func listUnknownValues(c *gin.Context) {
+	field := c.Query("field")
+	if !allowedValueFields[field] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid field, expected gender or department"})
+		return
+	}
+	lists, err := loadValueLists(c.Request.Context(), tenantID(c))
+	if err != nil {
+		logCtx(c).Errorf("Error loading allowed values: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list unknown values"})
+		return
+	}
+	var counts []valueCount
+	query := db.WithContext(c.Request.Context()).Model(&Employee{}).Scopes(tenantScope(c)).
+		Select("gender AS value, COUNT(*) AS count").Where("gender <> ''").Group("gender")
+	if field == "department" {
+		query = db.WithContext(c.Request.Context()).Table("departments").Scopes(tenantScope(c)).
+			Select("name AS value, (SELECT COUNT(*) FROM employees WHERE employees.department_id = departments.id AND employees.deleted_at IS NULL) AS count")
+	}
+	if err := query.Order("count DESC").Scan(&counts).Error; err != nil {
+		logCtx(c).Errorf("Error counting %s values: %v", field, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list unknown values"})
+		return
+	}
+	unknown := []valueCount{}
+	for _, v := range counts {
+		if v.Count == 0 {
+			continue
+		}
+		if canonical, ok := lists[field][valueKey(v.Value)]; !ok || canonical != v.Value {
+			unknown = append(unknown, v)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"field": field, "restricted": lists[field] != nil, "values": unknown})
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// salaryGrouping maps a ?group_by= value of /analytics/salary to the
+// expression naming each group, and the column grouped by when that is not
+// the expression itself.
+func salaryGrouping(tx *gorm.DB, groupBy string) (expr, column string, ok bool) {
+	switch groupBy {
+	case "none":
+		return "''", "", true
+	case "department":
+		return "(SELECT name FROM departments WHERE departments.id = employees.department_id)", "department_id", true
+	case "company":
+		return "(SELECT name FROM companies WHERE companies.id = employees.company_id)", "company_id", true
+	case "currency":
+		return "currency", "", true
+	case "tenure":
+		expr = tenureExpr(tx, nil)
+		return expr, expr, true
+	case "age_band":
+		expr = ageBandExpr()
+		return expr, expr, true
+	}
+	return "", "", false
+}
+
+type salaryGroup struct {
+	Group string `json:"group"`
+	// Currency is set when amounts are not converted.
+	Currency string  `json:"currency,omitempty"`
+	Count    int64   `json:"count"`
+	Total    float64 `json:"total"`
+	Average  float64 `json:"average"`
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+}
+
+// salaryAnalytics summarizes the tenant's salaries by ?group_by=. Amounts
+// are converted to ?currency=, by default currency.reporting, through
+// currency.rates; salaries in a currency without a rate are counted under
+// "unconverted" instead. Without a currency to convert to, each group is
+// reported per currency. Grouping by tenure gives full years since joining,
+// by age_band the bands of analytics.age_bands; employees without a join
+// date form an empty tenure group. Takes the ?department= and ?company= filters of
+// /records.
+func salaryAnalytics(c *gin.Context) {
+	if _, redacted := redactionPolicy(c)["salary"]; redacted {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Salaries are redacted for your role"})
+		return
+	}
+	tx := db.WithContext(c.Request.Context())
+	groupBy := c.DefaultQuery("group_by", "none")
+	groupExpr, groupColumn, ok := salaryGrouping(tx, groupBy)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group_by, expected none, department, company, currency, tenure or age_band"})
+		return
+	}
+	target := strings.ToUpper(c.DefaultQuery("currency", cfg.Currency.Reporting))
+	var targetRate float64
+	if target != "" {
+		if targetRate, ok = currencyRate(target); !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("No rate to convert to %s", target)})
+			return
+		}
+	}
+	refs, err := referenceFilterScope(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var rows []struct {
+		Grp      *string
+		Currency string
+		Count    int64
+		Total    float64
+		Min      float64
+		Max      float64
+	}
+	groupColumns := "currency"
+	if groupColumn != "" {
+		groupColumns = groupColumn + ", currency"
+	}
+	err = tx.Model(&Employee{}).Scopes(tenantScope(c), refs).
+		Select(groupExpr + " AS grp, currency, COUNT(*) AS count, SUM(salary) AS total, MIN(salary) AS min, MAX(salary) AS max").
+		Group(groupColumns).Scan(&rows).Error
+	if err != nil {
+		logCtx(c).Errorf("Error summarizing salaries: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to summarize salaries"})
+		return
+	}
+
+	groups := map[string]*salaryGroup{}
+	unconverted := map[string]int64{}
+	for _, r := range rows {
+		name := ""
+		if r.Grp != nil {
+			name = *r.Grp
+		}
+		factor, key := 1.0, name+"\x00"+r.Currency
+		if target != "" {
+			rate, ok := currencyRate(r.Currency)
+			if !ok {
+				unconverted[r.Currency] += r.Count
+				continue
+			}
+			factor, key = rate/targetRate, name
+		}
+		g := groups[key]
+		if g == nil {
+			g = &salaryGroup{Group: name, Min: r.Min * factor, Max: r.Max * factor}
+			if target == "" {
+				g.Currency = r.Currency
+			}
+			groups[key] = g
+		}
+		g.Count += r.Count
+		g.Total += r.Total * factor
+		if r.Min*factor < g.Min {
+			g.Min = r.Min * factor
+		}
+		if r.Max*factor > g.Max {
+			g.Max = r.Max * factor
+		}
+	}
+
+	list := make([]salaryGroup, 0, len(groups))
+	for _, g := range groups {
+		currency := target
+		if currency == "" {
+			currency = g.Currency
+		}
+		g.Average = roundAmount(g.Total/float64(g.Count), currency)
+		g.Total = roundAmount(g.Total, currency)
+		g.Min, g.Max = roundAmount(g.Min, currency), roundAmount(g.Max, currency)
+		list = append(list, *g)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Group != list[j].Group {
+			return list[i].Group < list[j].Group
+		}
+		return list[i].Currency < list[j].Currency
+	})
+	response := gin.H{"group_by": groupBy, "groups": list}
+	if target != "" {
+		response["currency"] = target
+		response["unconverted"] = unconverted
+	}
+	c.JSON(http.StatusOK, response)
+}
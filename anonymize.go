@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// anonymizeChunk is how many records an anonymization scrubs per statement.
+const anonymizeChunk = 500
+
+// anonymizeRecords irreversibly scrubs the personal data of the records
+// the filter selects: names, emails and the extra attributes of
+// records.pii_extra are cleared, in the records, their versions and the
+// audit log, and the records marked anonymized. Department, company,
+// salary, age and dates are kept, so analytics still count them. The
+// filter is that of GET /records (?department=, ?company=, ?extra.<name>=,
+// ?updated_since=) and the body's "ids" and "emails"; an email also
+// selects records that had it before, and records merged into others. At
+// least one filter is required, and "dry_run" only counts the records.
+func anonymizeRecords(c *gin.Context) {
+	var req struct {
+		IDs    []uint   `json:"ids"`
+		Emails []string `json:"emails"`
+		DryRun bool     `json:"dry_run"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	since, err := updatedSinceScope(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	refs, err := referenceFilterScope(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	extra, err := extraFilterScope(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filtered := len(req.IDs) > 0 || len(req.Emails) > 0 || c.Query("updated_since") != ""
+	for key := range c.Request.URL.Query() {
+		if key == "department" || key == "company" || key == "department_id" || key == "company_id" || strings.HasPrefix(key, "extra.") {
+			filtered = true
+		}
+	}
+	if !filtered {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A filter is required; anonymizing every record takes one that selects them all"})
+		return
+	}
+	for i, email := range req.Emails {
+		req.Emails[i] = strings.ToLower(strings.TrimSpace(email))
+	}
+
+	ctx := c.Request.Context()
+	query := db.WithContext(ctx).Unscoped().Model(&Employee{}).Scopes(tenantScope(c), since, refs, extra).
+		Where("anonymized_at IS NULL")
+	if len(req.IDs) > 0 {
+		query = query.Where("id IN ?", req.IDs)
+	}
+	if len(req.Emails) > 0 {
+		query = query.Where("email IN ? OR id IN (SELECT employee_id FROM employee_versions WHERE tenant_id = ? AND email IN ?)",
+			req.Emails, tenantID(c), req.Emails)
+	}
+	var ids []uint
+	if err := query.Pluck("id", &ids).Error; err != nil {
+		logCtx(c).Errorf("Error selecting records to anonymize: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to anonymize records"})
+		return
+	}
+	if req.DryRun {
+		c.JSON(http.StatusOK, gin.H{"matched": len(ids), "dry_run": true})
+		return
+	}
+
+	var versions, audits int64
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for start := 0; start < len(ids); start += anonymizeChunk {
+			chunk := ids[start:min(start+anonymizeChunk, len(ids))]
+			v, a, err := scrubRecords(tx, tenantID(c), chunk)
+			if err != nil {
+				return err
+			}
+			versions += v
+			audits += a
+		}
+		return nil
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error anonymizing records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to anonymize records"})
+		return
+	}
+	setRowsAffected(c, int64(len(ids)))
+	setAuditEvent(c, "record.anonymize", fmt.Sprintf("%d records", len(ids)))
+	c.JSON(http.StatusOK, gin.H{"anonymized": len(ids), "versions": versions, "audit_entries": audits})
+}
+
+// scrubRecords anonymizes the tenant's records of ids, and returns how
+// many versions and audit entries it scrubbed. Emails found in the audit
+// log, in query parameters and details, are replaced with "[anonymized]".
+func scrubRecords(tx *gorm.DB, tenantID string, ids []uint) (versions, audits int64, err error) {
+	var emails []string
+	err = tx.Model(&EmployeeVersion{}).Distinct("email").
+		Where("tenant_id = ? AND employee_id IN ? AND email IS NOT NULL AND email <> ''", tenantID, ids).Pluck("email", &emails).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	var current []string
+	err = tx.Unscoped().Model(&Employee{}).Where("id IN ? AND email IS NOT NULL AND email <> ''", ids).Pluck("email", &current).Error
+	if err != nil {
+		return 0, 0, err
+	}
+	emails = append(emails, current...)
+
+	now := time.Now().UTC()
+	scrubbed := map[string]interface{}{"first_name": "", "last_name": "", "email": nil, "anonymized_at": now}
+	if len(cfg.Records.PIIExtra) == 0 {
+		if err := tx.Unscoped().Model(&Employee{}).Where("tenant_id = ? AND id IN ?", tenantID, ids).Updates(scrubbed).Error; err != nil {
+			return 0, 0, err
+		}
+	} else {
+		// Each record keeps the extra attributes that aren't personal.
+		var records []Employee
+		if err := tx.Unscoped().Select("id", "extra").Where("tenant_id = ? AND id IN ?", tenantID, ids).Find(&records).Error; err != nil {
+			return 0, 0, err
+		}
+		for i := range records {
+			scrubbed["extra"] = scrubExtra(records[i].Extra)
+			if err := tx.Unscoped().Model(&records[i]).Updates(scrubbed).Error; err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+
+	res := tx.Model(&EmployeeVersion{}).Where("tenant_id = ? AND employee_id IN ?", tenantID, ids).
+		Updates(map[string]interface{}{"first_name": "", "last_name": "", "email": nil})
+	if res.Error != nil {
+		return 0, 0, res.Error
+	}
+	versions = res.RowsAffected
+	if len(cfg.Records.PIIExtra) > 0 {
+		var batch []EmployeeVersion
+		err := tx.Select("id", "extra").Where("tenant_id = ? AND employee_id IN ?", tenantID, ids).
+			FindInBatches(&batch, 1000, func(_ *gorm.DB, _ int) error {
+				for _, v := range batch {
+					if err := tx.Model(&EmployeeVersion{ID: v.ID}).Update("extra", scrubExtra(v.Extra)).Error; err != nil {
+						return err
+					}
+				}
+				return nil
+			}).Error
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, email := range emails {
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		like := "%" + likeEscaper.Replace(email) + "%"
+		res := tx.Model(&AuditEntry{}).Where("tenant_id = ? AND (params LIKE ? ESCAPE '!' OR detail LIKE ? ESCAPE '!')", tenantID, like, like).
+			Updates(map[string]interface{}{
+				"params": gorm.Expr("REPLACE(params, ?, ?)", email, "[anonymized]"),
+				"detail": gorm.Expr("REPLACE(detail, ?, ?)", email, "[anonymized]"),
+			})
+		if res.Error != nil {
+			return 0, 0, res.Error
+		}
+		audits += res.RowsAffected
+	}
+	return versions, audits, nil
+}
+
+// scrubExtra drops the extra attributes of records.pii_extra.
+func scrubExtra(extra extraAttributes) extraAttributes {
+	if len(extra) == 0 || len(cfg.Records.PIIExtra) == 0 {
+		return extra
+	}
+	kept := extraAttributes{}
+	for k, v := range extra {
+		kept[k] = v
+	}
+	for _, name := range cfg.Records.PIIExtra {
+		delete(kept, name)
+	}
+	if len(kept) == 0 {
+		return nil
+	}
+	return kept
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAnonymizeScrubsRecordVersionsAndAudit(t *testing.T) {
+	tenant, key := newTestTenant(t)
+	oldEmail, newEmail := "old@"+tenant+".example.com", "new@"+tenant+".example.com"
+	id := createTestRecord(t, key, oldEmail)
+	kept := createTestRecord(t, key, "kept@"+tenant+".example.com")
+	decodeResponse(t, testCall(t, http.MethodPut, fmt.Sprintf("/records/%d", id), bearer(key), testRecordBody(newEmail)), http.StatusOK, nil)
+	for _, e := range []AuditEntry{
+		{Time: time.Now(), TenantID: tenant, Route: "/records", Params: "email=" + oldEmail},
+		{Time: time.Now(), TenantID: tenant, Route: "/records", Detail: "merged into " + newEmail},
+	} {
+		if err := db.Create(&e).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var resp struct {
+		Anonymized   int   `json:"anonymized"`
+		Versions     int64 `json:"versions"`
+		AuditEntries int64 `json:"audit_entries"`
+	}
+	w := testCall(t, http.MethodPost, "/records/anonymize", bearer(key), gin.H{"emails": []string{oldEmail}})
+	decodeResponse(t, w, http.StatusOK, &resp)
+	if resp.Anonymized != 1 || resp.Versions < 2 || resp.AuditEntries < 2 {
+		t.Errorf("response = %+v, want 1 record with its 2 versions and 2 audit entries", resp)
+	}
+
+	var e Employee
+	if err := db.Unscoped().First(&e, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	if e.FirstName != "" || e.LastName != "" || e.Email != "" || e.AnonymizedAt == nil {
+		t.Errorf("record not scrubbed: %+v", e)
+	}
+	if e.DepartmentID == nil || e.CompanyID == nil || e.Salary != 50000 || e.Age != 30 {
+		t.Errorf("record lost its aggregate fields: %+v", e)
+	}
+
+	var left int64
+	db.Model(&EmployeeVersion{}).Where("employee_id = ? AND (first_name <> '' OR last_name <> '' OR email <> '')", id).Count(&left)
+	if left > 0 {
+		t.Errorf("%d versions of the record still hold personal data", left)
+	}
+	db.Model(&EmployeeVersion{}).Where("employee_id = ? AND email <> ''", kept).Count(&left)
+	if left == 0 {
+		t.Error("versions of a record left out of the filter were scrubbed")
+	}
+	for _, email := range []string{oldEmail, newEmail} {
+		db.Model(&AuditEntry{}).Where("tenant_id = ? AND (params LIKE ? OR detail LIKE ?)", tenant, "%"+email+"%", "%"+email+"%").Count(&left)
+		if left > 0 {
+			t.Errorf("%d audit entries still mention %s", left, email)
+		}
+	}
+}
+
+func TestAnonymizedRecordRefusesChanges(t *testing.T) {
+	tenant, key := newTestTenant(t)
+	id := createTestRecord(t, key, "gone@"+tenant+".example.com")
+	other := createTestRecord(t, key, "other@"+tenant+".example.com")
+	w := testCall(t, http.MethodPost, "/records/anonymize", bearer(key), gin.H{"ids": []uint{id}})
+	decodeResponse(t, w, http.StatusOK, nil)
+
+	w = testCall(t, http.MethodPut, fmt.Sprintf("/records/%d", id), bearer(key), testRecordBody("back@"+tenant+".example.com"))
+	decodeResponse(t, w, http.StatusConflict, nil)
+	w = testCall(t, http.MethodPost, "/records/merge", bearer(key), gin.H{"survivor_id": other, "duplicate_ids": []uint{id}})
+	decodeResponse(t, w, http.StatusConflict, nil)
+	w = testCall(t, http.MethodPost, "/records/merge", bearer(key), gin.H{"survivor_id": id, "duplicate_ids": []uint{other}})
+	decodeResponse(t, w, http.StatusConflict, nil)
+}
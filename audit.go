@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ctxActor        = "actor"
+	ctxRowsAffected = "rows_affected"
+	ctxAuditEvent   = "audit_event"
+	ctxAuditDetail  = "audit_detail"
+	ctxAuditRecord  = "audit_record"
+)
+
+type AuditEntry struct {
+	ID       uint      `gorm:"primaryKey" json:"id"`
+	Time     time.Time `gorm:"index" json:"time"`
+	TenantID string    `gorm:"size:64;index" json:"tenant_id"`
+	Actor    string    `gorm:"index" json:"actor"`
+	Event    string    `gorm:"size:64;index" json:"event,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	// RecordID is the employee record a write was to. A merge moves the
+	// entries of the records merged to the one kept.
+	RecordID     *uint  `gorm:"index" json:"record_id,omitempty"`
+	ClientIP     string `json:"client_ip"`
+	Method       string `json:"method"`
+	Route        string `gorm:"index" json:"route"`
+	Path         string `json:"path"`
+	Params       string `json:"params"`
+	Status       int    `json:"status"`
+	RowsAffected int64  `json:"rows_affected"`
+	DurationMs   int64  `json:"duration_ms"`
+}
+
+func (AuditEntry) TableName() string {
+	return "api_audit"
+}
+
+func setRowsAffected(c *gin.Context, n int64) {
+	c.Set(ctxRowsAffected, n)
+}
+
+// setAuditEvent names the request's audit entry and says what it returned,
+// for requests that read data worth tracing, such as logs and exports.
+func setAuditEvent(c *gin.Context, event, detail string) {
+	c.Set(ctxAuditEvent, event)
+	c.Set(ctxAuditDetail, detail)
+}
+
+// setAuditRecord ties the request's audit entry to the employee record it
+// wrote, so the record's history can be listed.
+func setAuditRecord(c *gin.Context, id uint) {
+	c.Set(ctxAuditRecord, id)
+}
+
+// recordAuditEvent stores a security event that isn't a plain request, such as
+// an account lockout, alongside the request audit trail.
+func recordAuditEvent(c *gin.Context, event, detail string) {
+	entry := AuditEntry{
+		Time:     time.Now().UTC(),
+		TenantID: tenantID(c),
+		Actor:    c.GetString(ctxActor),
+		Event:    event,
+		Detail:   detail,
+		ClientIP: c.ClientIP(),
+		Method:   c.Request.Method,
+		Route:    c.FullPath(),
+		Path:     c.Request.URL.Path,
+	}
+	if entry.Actor == "" {
+		entry.Actor = "anonymous"
+	}
+	if err := db.Create(&entry).Error; err != nil {
+		logCtx(c).Errorf("Error writing audit event %s: %v", event, err)
+	}
+}
+
+func auditMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if unauditedPaths[c.Request.URL.Path] {
+			c.Next()
+			return
+		}
+		start := time.Now()
+		c.Next()
+
+		actor := c.GetString(ctxActor)
+		if actor == "" {
+			actor = "anonymous"
+		}
+		params, _ := json.Marshal(c.Request.URL.Query())
+		entry := AuditEntry{
+			Time:         start.UTC(),
+			TenantID:     tenantID(c),
+			Actor:        actor,
+			Event:        c.GetString(ctxAuditEvent),
+			Detail:       c.GetString(ctxAuditDetail),
+			ClientIP:     c.ClientIP(),
+			Method:       c.Request.Method,
+			Route:        c.FullPath(),
+			Path:         c.Request.URL.Path,
+			Params:       string(params),
+			Status:       c.Writer.Status(),
+			RowsAffected: c.GetInt64(ctxRowsAffected),
+			DurationMs:   time.Since(start).Milliseconds(),
+		}
+		if id := c.GetUint(ctxAuditRecord); id != 0 {
+			entry.RecordID = &id
+		}
+		if err := db.Create(&entry).Error; err != nil {
+			logCtx(c).Errorf("Error writing audit entry for %s %s: %v", entry.Method, entry.Path, err)
+		}
+	}
+}
+
+func getAuditEntries(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 50
+	}
+
+	query := db.WithContext(c.Request.Context()).Model(&AuditEntry{}).Scopes(tenantScope(c))
+	if actor := c.Query("actor"); actor != "" {
+		query = query.Where("actor = ?", actor)
+	}
+	if route := c.Query("route"); route != "" {
+		query = query.Where("route = ?", route)
+	}
+	if event := c.Query("event"); event != "" {
+		query = query.Where("event = ?", event)
+	}
+	if method := c.Query("method"); method != "" {
+		query = query.Where("method = ?", method)
+	}
+	if recordID := c.Query("record_id"); recordID != "" {
+		query = query.Where("record_id = ?", recordID)
+	}
+	if startDate := c.Query("start_date"); startDate != "" {
+		start, err := parseDay(startDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date, expected YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("time >= ?", start)
+	}
+	if endDate := c.Query("end_date"); endDate != "" {
+		end, err := parseDay(endDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date, expected YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("time < ?", end.AddDate(0, 0, 1))
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logCtx(c).Errorf("Error counting audit entries: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query audit log"})
+		return
+	}
+
+	var entries []AuditEntry
+	if err := query.Order("time desc").Limit(limit).Offset((page - 1) * limit).Find(&entries).Error; err != nil {
+		logCtx(c).Errorf("Error retrieving audit entries: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"total": total, "page": page, "limit": limit, "entries": entries})
+}
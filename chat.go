@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	chatSlack   = "slack"
+	chatTeams   = "teams"
+	chatGeneric = "generic"
+)
+
+// chatAlert is one message for the chat webhook.
+type chatAlert struct {
+	Event string `json:"event"`
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	URL   string `json:"url,omitempty"`
+}
+
+// chatPayload renders an alert in the shape chat.format expects. Slack and
+// Teams incoming webhooks both take a message; generic receivers get the
+// alert as is.
+func chatPayload(format string, alert chatAlert) interface{} {
+	text := alert.Text
+	if alert.URL != "" {
+		text += "\n" + alert.URL
+	}
+	switch format {
+	case chatSlack:
+		return map[string]string{"text": "*" + alert.Title + "*\n" + text}
+	case chatTeams:
+		return map[string]string{
+			"@type":    "MessageCard",
+			"@context": "https://schema.org/extensions",
+			"summary":  alert.Title,
+			"title":    alert.Title,
+			"text":     text,
+		}
+	}
+	return alert
+}
+
+// sendChatAlert posts alert to chat.webhook_url in the background.
+func sendChatAlert(ctx context.Context, alert chatAlert) {
+	conf := cfg.Chat
+	if conf.WebhookURL == "" {
+		return
+	}
+	postChatAlert(ctx, conf.WebhookURL, conf.Format, alert)
+}
+
+// postChatAlert posts alert to webhookURL in format in the background.
+func postChatAlert(ctx context.Context, webhookURL, format string, alert chatAlert) {
+	body, err := json.Marshal(chatPayload(format, alert))
+	if err != nil {
+		logCtx(ctx).Errorf("Error encoding %s chat alert: %v", alert.Event, err)
+		return
+	}
+	policy := retryPolicy{attempts: 3, base: 2 * time.Second, max: 30 * time.Second, exponential: true}
+	go func() {
+		err := policy.do(ctx, "Posting "+alert.Event+" chat alert", anyError, func() error {
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := webhookClient.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("chat webhook returned %s", resp.Status)
+			}
+			return nil
+		})
+		if err != nil {
+			logCtx(ctx).Errorf("Giving up on %s chat alert: %v", alert.Event, err)
+		}
+	}()
+}
+
+// chatJobAlert reports imports that failed outright or rejected at least
+// chat.failed_rows_threshold rows.
+func chatJobAlert(ctx context.Context, event jobEvent) {
+	threshold := cfg.Chat.FailedRowsThreshold
+	switch {
+	case event.Status == jobFailed:
+	case event.Status == jobCompleted && threshold > 0 && event.RowsFailed >= threshold:
+	default:
+		return
+	}
+	text := fmt.Sprintf("%s (tenant %s): %d of %d rows inserted, %d updated, %d skipped, %d failed.",
+		event.FileName, event.TenantID, event.RowsInserted, event.RowsRead, event.RowsUpdated, event.RowsSkipped, event.RowsFailed)
+	if event.Error != "" {
+		text += "\n" + event.Error
+	}
+	sendChatAlert(ctx, chatAlert{
+		Event: event.Event,
+		Title: fmt.Sprintf("Import %s %s", event.JobID, event.Status),
+		Text:  text,
+		URL:   event.JobURL,
+	})
+}
+
+// startErrorRateMonitor checks the share of 5xx responses in the access log
+// every minute and alerts once when it crosses chat.error_rate.threshold,
+// then again only after it has recovered.
+func startErrorRateMonitor() {
+	go func() {
+		breached := false
+		for range time.Tick(time.Minute) {
+			conf := cfg.Chat
+			if conf.WebhookURL == "" || conf.ErrorRate.Threshold == 0 {
+				breached = false
+				continue
+			}
+			total, failed, err := countAccessErrors(time.Now().Add(-conf.ErrorRate.Window))
+			if err != nil {
+				logr.Errorf("Error reading access log for error rate: %v", err)
+				continue
+			}
+			if total < int64(conf.ErrorRate.MinRequests) {
+				continue
+			}
+			rate := float64(failed) / float64(total)
+			switch {
+			case rate >= conf.ErrorRate.Threshold && !breached:
+				breached = true
+				logr.Warnf("Error rate %.1f%% over the last %s crossed the %.1f%% threshold", rate*100, conf.ErrorRate.Window, conf.ErrorRate.Threshold*100)
+				sendChatAlert(context.Background(), chatAlert{
+					Event: "error_rate.breached",
+					Title: "Error rate above threshold",
+					Text: fmt.Sprintf("%d of %d requests (%.1f%%) failed with 5xx over the last %s; threshold is %.1f%%.",
+						failed, total, rate*100, conf.ErrorRate.Window, conf.ErrorRate.Threshold*100),
+				})
+			case rate < conf.ErrorRate.Threshold && breached:
+				breached = false
+				sendChatAlert(context.Background(), chatAlert{
+					Event: "error_rate.recovered",
+					Title: "Error rate back below threshold",
+					Text:  fmt.Sprintf("%d of %d requests (%.1f%%) failed with 5xx over the last %s.", failed, total, rate*100, conf.ErrorRate.Window),
+				})
+			}
+		}
+	}()
+}
+
+// countAccessErrors counts access log entries since the given time and how
+// many of them were 5xx. Only the active log file and the newest backup are
+// read, which covers any window shorter than a rotation.
+func countAccessErrors(since time.Time) (total, failed int64, err error) {
+	segments, err := logSegments()
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(segments) > 2 {
+		segments = segments[len(segments)-2:]
+	}
+	for _, segment := range segments {
+		f, err := openLogSegment(segment)
+		if err != nil {
+			return 0, 0, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var entry struct {
+				Source string    `json:"source"`
+				Status int       `json:"status"`
+				Time   time.Time `json:"time"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &entry) != nil || entry.Source != "access" || entry.Time.Before(since) {
+				continue
+			}
+			total++
+			if entry.Status >= http.StatusInternalServerError {
+				failed++
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	return total, failed, nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const cliUsage = `Usage: main [command] [flags]
+
+Commands:
+  serve              Run the HTTP server (default)
+  migrate [up|down|status|partitions]
+                     Apply, roll back or list database migrations, or
+                     repartition employees by db.partition_by
+  import <file>      Import a CSV file without starting the server
+  config validate    Check the configuration and exit
+  version            Print build information
+
+Run "main <command> -h" for the flags of a command.
+`
+
+func runCLI(args []string) int {
+	cmd := "serve"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "serve":
+		return serve(args)
+	case "migrate":
+		return migrateCommand(args)
+	case "import":
+		return importCommand(args)
+	case "config":
+		return configCommand(args)
+	case "version":
+		info := buildInfo()
+		fmt.Printf("%s (commit %s, built %s, %s)\n", info["version"], info["commit"], info["build_date"], info["go_version"])
+		return 0
+	case "help":
+		fmt.Print(cliUsage)
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, cliUsage)
+	return 2
+}
+
+// setupCLI loads configuration and mirrors log output to stderr so one-off
+// commands report progress in CI logs as well as the log file.
+func setupCLI(fs *flag.FlagSet, args []string) bool {
+	var err error
+	cfg, err = loadConfig(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", err)
+		return false
+	}
+	initLogger()
+	logr.SetOutput(io.MultiWriter(logr.Out, os.Stderr))
+	return true
+}
+
+func migrateCommand(args []string) int {
+	action := "up"
+	if len(args) > 0 && args[0] != "" && args[0][0] != '-' {
+		action, args = args[0], args[1:]
+	}
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	to := fs.String("to", "", "migrate up or roll back to this migration ID instead of all the way")
+	if !setupCLI(fs, args) {
+		return 1
+	}
+	connectDB()
+
+	m := newMigrator()
+	var err error
+	switch action {
+	case "up":
+		if *to != "" {
+			err = m.MigrateTo(*to)
+		} else {
+			err = m.Migrate()
+		}
+	case "down":
+		if *to != "" {
+			err = m.RollbackTo(*to)
+		} else {
+			err = m.RollbackLast()
+		}
+	case "partitions":
+		err = db.Transaction(func(tx *gorm.DB) error {
+			return repartitionEmployees(tx, cfg.DB.PartitionBy)
+		})
+	case "status":
+		pending, unknown, err := schemaStatus()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read migration status: %v\n", err)
+			return 1
+		}
+		for _, mig := range migrations {
+			state := "applied"
+			if slices.Contains(pending, mig.ID) {
+				state = "pending"
+			}
+			fmt.Printf("%-8s %s\n", state, mig.ID)
+		}
+		for _, id := range unknown {
+			fmt.Printf("%-8s %s\n", "unknown", id)
+		}
+		return 0
+	default:
+		fmt.Fprintln(os.Stderr, "usage: main migrate [up|down|status|partitions] [-to ID] [flags]")
+		return 2
+	}
+	if err != nil {
+		logr.Errorf("Migration %s failed: %v", action, err)
+		return 1
+	}
+	logr.Infof("Migration %s completed", action)
+	return 0
+}
+
+func importCommand(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	tenant := fs.String("tenant", defaultTenantID, "tenant that will own the imported rows")
+	if !setupCLI(fs, args) {
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: main import [flags] <file>")
+		return 2
+	}
+	path := fs.Arg(0)
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read %s: %v\n", path, err)
+		return 1
+	}
+
+	connectDB()
+	if err := requireCurrentSchema(); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if err := loadEmployeePartitioning(); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read employee partitioning: %v\n", err)
+		return 1
+	}
+	var exists int64
+	if err := db.Model(&Tenant{}).Where("id = ?", *tenant).Count(&exists).Error; err != nil || exists == 0 {
+		fmt.Fprintf(os.Stderr, "Unknown tenant %q\n", *tenant)
+		return 1
+	}
+
+	checksum, err := fileChecksum(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot read %s: %v\n", path, err)
+		return 1
+	}
+	job := ImportJob{
+		ID:           uuid.NewString(),
+		TenantID:     *tenant,
+		CreatedBy:    "cli",
+		OriginalName: filepath.Base(path),
+		StoredPath:   path,
+		Size:         info.Size(),
+		Checksum:     checksum,
+		Priority:     defaultImportPriority,
+	}
+	if err := db.Create(&job).Error; err != nil {
+		logr.Errorf("Error recording import job for %s: %v", path, err)
+		return 1
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	uploads = localStore{dir: filepath.Dir(path)}
+	logr.Infof("Importing %s as job %s", path, job.ID)
+	processCSV(ctx, job)
+	return 0
+}
+
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "usage: main config validate [flags]")
+		return 2
+	}
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	if _, err := loadConfig(fs, args[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "Configuration is invalid:\n%v\n", err)
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
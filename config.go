@@ -0,0 +1,1435 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is assembled in increasing order of precedence from built-in
+// defaults, an optional YAML/TOML file, environment variables and flags.
+type Config struct {
+	// Profile names the deployment (e.g. staging, production) for /version.
+	Profile string `yaml:"profile"`
+	// TimeZone is the IANA zone used to interpret dates without an offset
+	// and, unless db.timezone is set, for database sessions.
+	TimeZone string `yaml:"timezone"`
+	location *time.Location
+	// PublicURL is the base URL clients reach the API at, used for links in
+	// notifications. Links are relative when it is empty.
+	PublicURL string `yaml:"public_url"`
+
+	Server ServerConfig `yaml:"server"`
+	Log    LogConfig    `yaml:"log"`
+	Upload UploadConfig `yaml:"upload"`
+	Import ImportConfig `yaml:"import"`
+	Queue  QueueConfig  `yaml:"queue"`
+
+	CORS CORSConfig `yaml:"cors"`
+	TLS  TLSConfig  `yaml:"tls"`
+	Auth AuthConfig `yaml:"auth"`
+	DB   DBConfig   `yaml:"db"`
+	OIDC OIDCConfig `yaml:"oidc"`
+	JWT  JWTConfig  `yaml:"jwt"`
+
+	LoginGuard LoginGuardConfig `yaml:"login_guard"`
+
+	Redaction RedactionConfig `yaml:"redaction"`
+	Exports   ExportConfig    `yaml:"exports"`
+	Tracing   TracingConfig   `yaml:"tracing"`
+	Webhooks  WebhookConfig   `yaml:"webhooks"`
+	Email     EmailConfig     `yaml:"email"`
+	Chat      ChatConfig      `yaml:"chat"`
+	Schedules ScheduleConfig  `yaml:"schedules"`
+	Currency  CurrencyConfig  `yaml:"currency"`
+	Analytics AnalyticsConfig `yaml:"analytics"`
+	Records   RecordsConfig   `yaml:"records"`
+
+	// Features sets feature flags for this environment; overrides made
+	// through /admin/features take precedence.
+	Features map[string]bool `yaml:"features"`
+
+	TrustedProxies []string       `yaml:"trusted_proxies"`
+	AdminIPFilter  IPFilterConfig `yaml:"admin_ip_filter"`
+}
+
+type ServerConfig struct {
+	Addr            string        `yaml:"addr"`
+	MaxBodyBytes    int64         `yaml:"max_body_bytes"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// StartupProbe binds the listener before connecting to the database.
+	StartupProbe bool `yaml:"startup_probe"`
+	// ShutdownDelay keeps serving (with /readyz failing) after SIGTERM so
+	// load balancers stop routing to the pod before connections are closed.
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+	// TerminationGracePeriod, when set, caps the whole shutdown sequence to
+	// fit the pod's terminationGracePeriodSeconds.
+	TerminationGracePeriod time.Duration `yaml:"termination_grace_period"`
+}
+
+type LogConfig struct {
+	File       string `yaml:"file"`
+	Level      string `yaml:"level"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+	MaxBackups int    `yaml:"max_backups"`
+	Compress   bool   `yaml:"compress"`
+	// Database also stores entries in the logs table, and /logs then
+	// queries it instead of scanning the files.
+	Database LogDatabaseConfig `yaml:"database"`
+	// Ship sends entries to Loki, Elasticsearch, syslog and/or GELF as well.
+	Ship LogShipConfig `yaml:"ship"`
+	// Redact scrubs personal data from entries before they are written
+	// anywhere.
+	Redact LogRedactConfig `yaml:"redact"`
+	// Retention bounds what old entries are kept, beyond what lumberjack
+	// removes when it rotates.
+	Retention LogRetentionConfig `yaml:"retention"`
+}
+
+// LogRetentionConfig is applied every Interval (0 leaves it to POST
+// /admin/logs/cleanup). Rotated files older than max_age_days are removed
+// even when the log hasn't rotated lately, and the oldest are removed while
+// all the files together take more than MaxTotalMB. Entries in the logs table
+// older than DatabaseMaxAge, or beyond the newest DatabaseMaxRows, are
+// deleted. 0 disables a limit.
+type LogRetentionConfig struct {
+	Interval        time.Duration `yaml:"interval"`
+	MaxTotalMB      int           `yaml:"max_total_mb"`
+	DatabaseMaxAge  time.Duration `yaml:"database_max_age"`
+	DatabaseMaxRows int64         `yaml:"database_max_rows"`
+}
+
+// LogRedactConfig maps field names to mask, hash, null or drop, as
+// redaction.roles does for records. Matches of Patterns in messages and in
+// the other fields are masked or hashed, per PatternAction. Hashes use
+// redaction.hash_salt, so a hashed value can still be followed across
+// entries.
+type LogRedactConfig struct {
+	Fields        map[string]string `yaml:"fields"`
+	Patterns      []string          `yaml:"patterns"`
+	PatternAction string            `yaml:"pattern_action"`
+}
+
+// LogDatabaseConfig tunes how log entries are written to the database: in
+// batches every FlushInterval, with up to BufferSize entries waiting. When
+// the buffer is full, entries are only written to the file.
+type LogDatabaseConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	BufferSize    int           `yaml:"buffer_size"`
+}
+
+// LogShipConfig sends log entries to the backends that have a URL or
+// address set, in batches every FlushInterval. Each backend buffers up to
+// BufferSize entries; while it is unreachable or behind, further entries are
+// only written to the file.
+type LogShipConfig struct {
+	Loki          LokiConfig          `yaml:"loki"`
+	Elasticsearch ElasticsearchConfig `yaml:"elasticsearch"`
+	Syslog        SyslogConfig        `yaml:"syslog"`
+	GELF          GELFConfig          `yaml:"gelf"`
+	FlushInterval time.Duration       `yaml:"flush_interval"`
+	BufferSize    int                 `yaml:"buffer_size"`
+}
+
+// LokiConfig pushes to {URL}/loki/api/v1/push. Entries are labelled with
+// Labels plus their level.
+type LokiConfig struct {
+	URL      string            `yaml:"url"`
+	Labels   map[string]string `yaml:"labels"`
+	TenantID string            `yaml:"tenant_id"`
+	Username string            `yaml:"username"`
+	Password string            `yaml:"password"`
+}
+
+// ElasticsearchConfig indexes entries into Index through {URL}/_bulk,
+// authenticating with APIKey or Username and Password.
+type ElasticsearchConfig struct {
+	URL      string `yaml:"url"`
+	Index    string `yaml:"index"`
+	APIKey   string `yaml:"api_key"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// SyslogConfig sends RFC 5424 messages, with the JSON entry as the message,
+// to Address: udp://host:port, or tcp://host:port with octet-counted
+// framing.
+type SyslogConfig struct {
+	Address  string `yaml:"address"`
+	Facility string `yaml:"facility"`
+	AppName  string `yaml:"app_name"`
+}
+
+// GELFConfig sends GELF 1.1 messages to a Graylog input at Address:
+// udp://host:port (chunked when large) or tcp://host:port. Host is the
+// source reported; it defaults to the machine's host name.
+type GELFConfig struct {
+	Address string `yaml:"address"`
+	Host    string `yaml:"host"`
+}
+
+type UploadConfig struct {
+	// Backend is local (Dir) or s3. Use s3 on ephemeral containers so queued
+	// and interrupted imports keep their files across restarts.
+	Backend string         `yaml:"backend"`
+	Dir     string         `yaml:"dir"`
+	S3      UploadS3Config `yaml:"s3"`
+}
+
+type UploadS3Config struct {
+	Bucket string `yaml:"bucket"`
+	Prefix string `yaml:"prefix"`
+	Region string `yaml:"region"`
+	// Endpoint and PathStyle point the client at S3-compatible stores such
+	// as MinIO.
+	Endpoint  string `yaml:"endpoint"`
+	PathStyle bool   `yaml:"path_style"`
+}
+
+type ImportConfig struct {
+	BatchSize int `yaml:"batch_size"`
+	// Workers is the size of the insert pool shared by all imports. Running
+	// imports use the new size after a reload or PUT /admin/workers.
+	Workers int `yaml:"workers"`
+	// QueueSize is how many batches each import may queue beyond Workers.
+	QueueSize int `yaml:"queue_size"`
+	// MaxConcurrentJobs caps imports running at once; others wait as queued.
+	MaxConcurrentJobs int           `yaml:"max_concurrent_jobs"`
+	DrainTimeout      time.Duration `yaml:"drain_timeout"`
+	// CheckpointInterval is how often a running job's progress is saved as
+	// batches commit; 0 saves after every batch.
+	CheckpointInterval time.Duration `yaml:"checkpoint_interval"`
+	// Uploads of at most SmallFileMaxBytes and SmallFileMaxRows rows are
+	// imported within the upload request, outside the import slots, and
+	// answered with the finished job. 0 bytes turns this off; 0 rows sets
+	// no row limit.
+	SmallFileMaxBytes int64 `yaml:"small_file_max_bytes"`
+	SmallFileMaxRows  int64 `yaml:"small_file_max_rows"`
+	// OnDuplicateEmail decides what happens to an imported row whose email
+	// the tenant already has: skip it, update the existing record, or fail
+	// the row.
+	OnDuplicateEmail string `yaml:"on_duplicate_email"`
+}
+
+// QueueConfig selects where imports run. With the local backend a job runs
+// on the instance it was uploaded to; with redis, jobs go through a shared
+// queue and any instance with a free slot picks them up. A job whose
+// instance stops renewing its lease for LeaseTTL is resumed elsewhere.
+type QueueConfig struct {
+	Backend   string        `yaml:"backend"`
+	RedisURL  string        `yaml:"redis_url"`
+	KeyPrefix string        `yaml:"key_prefix"`
+	LeaseTTL  time.Duration `yaml:"lease_ttl"`
+}
+
+type CORSConfig struct {
+	AllowedOrigins   []string      `yaml:"allowed_origins"`
+	AllowedMethods   []string      `yaml:"allowed_methods"`
+	AllowedHeaders   []string      `yaml:"allowed_headers"`
+	ExposedHeaders   []string      `yaml:"exposed_headers"`
+	AllowCredentials bool          `yaml:"allow_credentials"`
+	MaxAge           time.Duration `yaml:"max_age"`
+}
+
+type TLSConfig struct {
+	Addr             string   `yaml:"addr"`
+	CertFile         string   `yaml:"cert_file"`
+	KeyFile          string   `yaml:"key_file"`
+	AutocertDomains  []string `yaml:"autocert_domains"`
+	AutocertCacheDir string   `yaml:"autocert_cache_dir"`
+	AutocertEmail    string   `yaml:"autocert_email"`
+	RedirectHTTP     bool     `yaml:"redirect_http"`
+}
+
+type AuthConfig struct {
+	AdminToken string `yaml:"admin_token"`
+}
+
+type DBConfig struct {
+	Driver               string        `yaml:"driver"`
+	Host                 string        `yaml:"host"`
+	Port                 string        `yaml:"port"`
+	Name                 string        `yaml:"name"`
+	SSLMode              string        `yaml:"sslmode"`
+	TimeZone             string        `yaml:"timezone"`
+	AutoMigrate          bool          `yaml:"auto_migrate"`
+	SQLitePath           string        `yaml:"sqlite_path"`
+	Replicas             []string      `yaml:"replicas"`
+	User                 string        `yaml:"user"`
+	Password             string        `yaml:"password"`
+	PasswordFile         string        `yaml:"password_file"`
+	SecretsBackend       string        `yaml:"secrets_backend"`
+	SecretsRefresh       time.Duration `yaml:"secrets_refresh"`
+	VaultAddr            string        `yaml:"vault_addr"`
+	VaultToken           string        `yaml:"vault_token"`
+	VaultSecretPath      string        `yaml:"vault_secret_path"`
+	AWSSecretID          string        `yaml:"aws_secret_id"`
+	AWSRegion            string        `yaml:"aws_region"`
+	MaxOpenConns         int           `yaml:"max_open_conns"`
+	MaxIdleConns         int           `yaml:"max_idle_conns"`
+	ConnMaxLifetime      time.Duration `yaml:"conn_max_lifetime"`
+	ConnMaxIdleTime      time.Duration `yaml:"conn_max_idle_time"`
+	ConnectAttempts      int           `yaml:"connect_attempts"`
+	ConnectRetryInterval time.Duration `yaml:"connect_retry_interval"`
+	ConnectBackoff       string        `yaml:"connect_backoff"`
+	ConnectMaxInterval   time.Duration `yaml:"connect_max_interval"`
+	ConnectJitter        float64       `yaml:"connect_jitter"`
+	ConnectTimeout       time.Duration `yaml:"connect_timeout"`
+	// SlowQueryThreshold is how long a query may take before it is logged
+	// as a slow query; 0 disables slow-query logging.
+	SlowQueryThreshold time.Duration `yaml:"slow_query_threshold"`
+	// PartitionBy partitions employees on Postgres by company or join_year;
+	// empty keeps it one table. See "main migrate partitions".
+	PartitionBy string `yaml:"partition_by"`
+}
+
+// DSN is the Postgres connection string; MySQL is configured in mysqlConfig.
+func (d DBConfig) DSN() string {
+	return fmt.Sprintf("host=%s port=%s dbname=%s sslmode=%s TimeZone=%s", d.Host, d.port(), d.Name, d.SSLMode, d.TimeZone)
+}
+
+// port defaults to the standard port of the driver.
+func (d DBConfig) port() string {
+	switch {
+	case d.Port != "":
+		return d.Port
+	case d.Driver == driverMySQL:
+		return "3306"
+	}
+	return "5432"
+}
+
+type IPFilterConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+type OIDCConfig struct {
+	IssuerURL     string            `yaml:"issuer_url"`
+	ClientID      string            `yaml:"client_id"`
+	ClientSecret  string            `yaml:"client_secret"`
+	RedirectURL   string            `yaml:"redirect_url"`
+	ExtraScopes   []string          `yaml:"scopes"`
+	GroupsClaim   string            `yaml:"groups_claim"`
+	GroupRoles    map[string]string `yaml:"group_roles"`
+	GroupScopes   map[string]string `yaml:"group_scopes"`
+	DefaultRole   string            `yaml:"default_role"`
+	TenantClaim   string            `yaml:"tenant_claim"`
+	DefaultTenant string            `yaml:"default_tenant"`
+}
+
+type RedactionConfig struct {
+	HashSalt string `yaml:"hash_salt"`
+	// Roles maps a role to field -> action (mask, hash, null or drop).
+	Roles map[string]map[string]string `yaml:"roles"`
+}
+
+type ExportConfig struct {
+	Dir        string        `yaml:"dir"`
+	SigningKey string        `yaml:"signing_key"`
+	URLTTL     time.Duration `yaml:"url_ttl"`
+}
+
+// WebhookConfig governs job callbacks. Deliveries are signed with
+// HMAC-SHA256 of "<X-Webhook-Timestamp>.<body>" under SigningSecret;
+// callbacks are refused while it is unset.
+type WebhookConfig struct {
+	SigningSecret string   `yaml:"signing_secret"`
+	AllowedHosts  []string `yaml:"allowed_hosts"`
+	Attempts      int      `yaml:"attempts"`
+}
+
+// EmailConfig mails import summaries to To when SMTPHost is set. The
+// connection is upgraded with STARTTLS when the server offers it.
+type EmailConfig struct {
+	SMTPHost string   `yaml:"smtp_host"`
+	SMTPPort int      `yaml:"smtp_port"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	// NotifyOn is all, or failures to skip imports that had no failed rows.
+	NotifyOn string `yaml:"notify_on"`
+}
+
+// ChatConfig posts alerts to a Slack, Microsoft Teams or generic JSON
+// incoming webhook when WebhookURL is set: failed imports, imports that
+// rejected FailedRowsThreshold or more rows (0 disables), and 5xx error
+// rates above ErrorRate.Threshold. Rules alert on log entries as they are
+// written.
+type ChatConfig struct {
+	WebhookURL          string               `yaml:"webhook_url"`
+	Format              string               `yaml:"format"`
+	FailedRowsThreshold int64                `yaml:"failed_rows_threshold"`
+	ErrorRate           ErrorRateAlertConfig `yaml:"error_rate"`
+	Rules               []LogAlertRule       `yaml:"rules"`
+}
+
+// LogAlertRule fires when more than Threshold log entries matching it are
+// written within Window; a Threshold of 0 fires on every match. Entries
+// match at Level or more severe, and only when they come from Source and
+// contain Message (case-insensitive) if those are set. After firing, the
+// rule stays quiet for Cooldown. Alerts go to WebhookURL in Format when it
+// is set, otherwise to chat.webhook_url; with neither, the rule is off.
+type LogAlertRule struct {
+	Name       string        `yaml:"name"`
+	Level      string        `yaml:"level"`
+	Source     string        `yaml:"source"`
+	Message    string        `yaml:"message"`
+	Threshold  int           `yaml:"threshold"`
+	Window     time.Duration `yaml:"window"`
+	Cooldown   time.Duration `yaml:"cooldown"`
+	WebhookURL string        `yaml:"webhook_url"`
+	Format     string        `yaml:"format"`
+}
+
+// ErrorRateAlertConfig alerts when at least Threshold (0-1, 0 disables) of
+// the requests in the access log over Window were 5xx, once MinRequests
+// requests have been seen.
+type ErrorRateAlertConfig struct {
+	Threshold   float64       `yaml:"threshold"`
+	Window      time.Duration `yaml:"window"`
+	MinRequests int           `yaml:"min_requests"`
+}
+
+// ScheduleConfig governs scheduled imports. Sources are http(s) URLs,
+// limited to AllowedHosts when it is set, s3:// locations when uploads are
+// stored in S3, or files under SourceDir.
+type ScheduleConfig struct {
+	// PollInterval is how often this instance checks for due schedules; 0
+	// leaves scheduling to other instances.
+	PollInterval time.Duration `yaml:"poll_interval"`
+	// MisfireGrace is how late a run may start before the schedule's misfire
+	// policy applies.
+	MisfireGrace time.Duration `yaml:"misfire_grace"`
+	SourceDir    string        `yaml:"source_dir"`
+	AllowedHosts []string      `yaml:"allowed_hosts"`
+}
+
+// CurrencyConfig sets the currency of imported salaries that name none, and
+// how salary analytics convert between currencies.
+type CurrencyConfig struct {
+	Default string `yaml:"default"`
+	// Reporting is the currency analytics total salaries in; empty reports
+	// each currency apart.
+	Reporting string `yaml:"reporting"`
+	// Rates are what one unit of each currency is worth in Reporting.
+	// Salaries in a currency without a rate are left out of converted
+	// totals.
+	Rates map[string]float64 `yaml:"rates"`
+}
+
+// AnalyticsConfig shapes the fields computed for records and grouped by in
+// analytics, and the outliers flagged for review.
+type AnalyticsConfig struct {
+	// AgeBands are the ages each band after the first starts at: 25, 35
+	// gives "under 25", "25-34" and "35+".
+	AgeBands []int `yaml:"age_bands"`
+	// OutlierSigma is how many standard deviations from the mean of its
+	// department and currency a salary must be to be flagged, among groups
+	// of at least OutlierMinGroup salaries.
+	OutlierSigma    float64 `yaml:"outlier_sigma"`
+	OutlierMinGroup int     `yaml:"outlier_min_group"`
+}
+
+// RecordsConfig shapes the cleanup of employee records.
+type RecordsConfig struct {
+	// MergePrecedence is which record a field of a merge is taken from by
+	// default: survivor keeps the surviving record's values and fills in
+	// its blank ones, newest takes each from the last updated record that
+	// has one.
+	MergePrecedence string `yaml:"merge_precedence"`
+	// PIIExtra are the extra attributes holding personal data, scrubbed
+	// with names and emails when records are anonymized.
+	PIIExtra []string `yaml:"pii_extra"`
+	// CertificateKey signs the deletion certificates of POST
+	// /records/forget, which is refused while it is unset.
+	CertificateKey string `yaml:"certificate_key"`
+	// RetentionInterval is how often this instance applies the tenants'
+	// retention policies; 0 leaves them to other instances. Changing it
+	// takes a restart.
+	RetentionInterval time.Duration `yaml:"retention_interval"`
+}
+
+// TracingConfig enables OpenTelemetry export when Endpoint (an OTLP/HTTP URL
+// such as http://collector:4318) is set.
+type TracingConfig struct {
+	Endpoint    string  `yaml:"endpoint"`
+	ServiceName string  `yaml:"service_name"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+type JWTConfig struct {
+	Secret     string        `yaml:"secret"`
+	Issuer     string        `yaml:"issuer"`
+	AccessTTL  time.Duration `yaml:"access_ttl"`
+	RefreshTTL time.Duration `yaml:"refresh_ttl"`
+}
+
+// LoginGuardConfig limits failed logins. The counts are kept in memory, so
+// each instance applies the limits on its own: behind a load balancer over
+// n instances an attacker gets up to n times max_attempts per window.
+type LoginGuardConfig struct {
+	MaxAttempts      int           `yaml:"max_attempts"`
+	MaxAttemptsPerIP int           `yaml:"max_attempts_per_ip"`
+	Window           time.Duration `yaml:"window"`
+	LockoutBase      time.Duration `yaml:"lockout_base"`
+	LockoutMax       time.Duration `yaml:"lockout_max"`
+	ResetAfter       time.Duration `yaml:"reset_after"`
+}
+
+var cfg *Config
+
+func defaultRedaction() map[string]string {
+	return map[string]string{"email": redactMask, "salary": redactNull}
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Profile:  "default",
+		TimeZone: "UTC",
+		Server: ServerConfig{
+			Addr:            ":8080",
+			MaxBodyBytes:    50 << 30, // 50GB
+			ShutdownTimeout: 15 * time.Second,
+			StartupProbe:    true,
+		},
+		Log: LogConfig{
+			File:       "logs/app.log",
+			Level:      "info",
+			MaxSizeMB:  100,
+			MaxAgeDays: 30,
+			MaxBackups: 10,
+			Compress:   true,
+			Database: LogDatabaseConfig{
+				FlushInterval: time.Second,
+				BufferSize:    10000,
+			},
+			Retention: LogRetentionConfig{
+				Interval:       time.Hour,
+				MaxTotalMB:     2048,
+				DatabaseMaxAge: 30 * 24 * time.Hour,
+			},
+			Redact: LogRedactConfig{
+				Patterns:      []string{emailPattern},
+				PatternAction: redactMask,
+			},
+			Ship: LogShipConfig{
+				Loki:          LokiConfig{Labels: map[string]string{"service": "mini-project"}},
+				Elasticsearch: ElasticsearchConfig{Index: "mini-project-logs"},
+				Syslog:        SyslogConfig{Facility: "local0", AppName: "mini-project"},
+				FlushInterval: 2 * time.Second,
+				BufferSize:    10000,
+			},
+		},
+		Upload: UploadConfig{
+			Backend: storageLocal,
+			Dir:     "./uploads",
+			S3:      UploadS3Config{Prefix: "uploads/"},
+		},
+		Import: ImportConfig{
+			BatchSize:          100,
+			Workers:            10,
+			QueueSize:          10,
+			MaxConcurrentJobs:  2,
+			DrainTimeout:       time.Minute,
+			CheckpointInterval: 5 * time.Second,
+			SmallFileMaxBytes:  256 << 10,
+			SmallFileMaxRows:   1000,
+			OnDuplicateEmail:   duplicateSkip,
+		},
+		Queue: QueueConfig{
+			Backend:   queueLocal,
+			KeyPrefix: "mini-project:",
+			LeaseTTL:  30 * time.Second,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+			AllowedHeaders: []string{"Origin", "Content-Type", "Accept", "Authorization", requestIDHeader, idempotencyKeyHeader},
+			ExposedHeaders: []string{requestIDHeader},
+			MaxAge:         12 * time.Hour,
+		},
+		TLS: TLSConfig{
+			Addr:             ":8443",
+			AutocertCacheDir: "./certs",
+			RedirectHTTP:     true,
+		},
+		DB: DBConfig{
+			Host:                 "postgres",
+			Driver:               driverPostgres,
+			SQLitePath:           "./data/mini_project.db",
+			Name:                 "CSV_db",
+			SSLMode:              "disable",
+			SecretsBackend:       "env",
+			SecretsRefresh:       5 * time.Minute,
+			MaxOpenConns:         25,
+			MaxIdleConns:         10,
+			ConnMaxLifetime:      30 * time.Minute,
+			ConnMaxIdleTime:      5 * time.Minute,
+			ConnectAttempts:      10,
+			ConnectRetryInterval: time.Second,
+			ConnectBackoff:       backoffExponential,
+			ConnectMaxInterval:   30 * time.Second,
+			ConnectJitter:        0.2,
+			ConnectTimeout:       2 * time.Minute,
+			SlowQueryThreshold:   200 * time.Millisecond,
+		},
+		OIDC: OIDCConfig{
+			GroupsClaim:   "groups",
+			DefaultTenant: defaultTenantID,
+		},
+		JWT: JWTConfig{
+			Issuer:     "mini-project",
+			AccessTTL:  15 * time.Minute,
+			RefreshTTL: 30 * 24 * time.Hour,
+		},
+		LoginGuard: LoginGuardConfig{
+			MaxAttempts:      5,
+			MaxAttemptsPerIP: 20,
+			Window:           15 * time.Minute,
+			LockoutBase:      time.Minute,
+			LockoutMax:       time.Hour,
+			ResetAfter:       24 * time.Hour,
+		},
+		Redaction: RedactionConfig{
+			Roles: map[string]map[string]string{
+				roleViewer: defaultRedaction(),
+				roleEditor: defaultRedaction(),
+				roleAdmin:  defaultRedaction(),
+			},
+		},
+		Exports: ExportConfig{
+			Dir:    "./exports",
+			URLTTL: 24 * time.Hour,
+		},
+		Webhooks: WebhookConfig{
+			Attempts: 5,
+		},
+		Email: EmailConfig{
+			SMTPPort: 587,
+			NotifyOn: emailNotifyAll,
+		},
+		Schedules: ScheduleConfig{
+			PollInterval: 30 * time.Second,
+			MisfireGrace: 10 * time.Minute,
+		},
+		Currency: CurrencyConfig{Default: "USD"},
+		Analytics: AnalyticsConfig{
+			AgeBands:        []int{25, 35, 45, 55, 65},
+			OutlierSigma:    5,
+			OutlierMinGroup: 10,
+		},
+		Records: RecordsConfig{
+			MergePrecedence:   mergeSurvivor,
+			RetentionInterval: time.Hour,
+		},
+		Chat: ChatConfig{
+			Format:              chatSlack,
+			FailedRowsThreshold: 100,
+			ErrorRate: ErrorRateAlertConfig{
+				Threshold:   0.05,
+				Window:      5 * time.Minute,
+				MinRequests: 20,
+			},
+		},
+		Tracing: TracingConfig{
+			ServiceName: "mini-project",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// loadConfig builds the configuration from args (flags), the environment and
+// the optional config file named by -config or CONFIG_FILE. Subcommands may
+// register extra flags on fs before parsing; positional arguments are left in
+// fs.Args().
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	c := defaultConfig()
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "path to a YAML or TOML config file")
+	for _, f := range configFlags {
+		fs.String(f.name, "", f.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadConfigFile(*configFile, c); err != nil {
+			return nil, err
+		}
+	}
+
+	env := &envReader{}
+	env.apply(c)
+
+	errs := env.errs
+	fs.Visit(func(f *flag.Flag) {
+		for _, override := range configFlags {
+			if override.name == f.Name {
+				if err := override.apply(c, f.Value.String()); err != nil {
+					errs = append(errs, fmt.Errorf("flag -%s: %w", f.Name, err))
+				}
+			}
+		}
+	})
+	if c.DB.TimeZone == "" {
+		c.DB.TimeZone = c.TimeZone
+	}
+	if err := c.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	c.location, _ = time.LoadLocation(c.TimeZone)
+	return c, nil
+}
+
+// Location is the service time zone.
+func (c *Config) Location() *time.Location {
+	if c.location == nil {
+		return time.UTC
+	}
+	return c.location
+}
+
+// loadConfigFile overlays the file onto c. TOML is converted to YAML first so
+// both formats share the yaml tags and duration parsing.
+func loadConfigFile(path string, c *Config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	case ".toml":
+		var raw map[string]interface{}
+		if err := toml.Unmarshal(data, &raw); err != nil {
+			return fmt.Errorf("parsing %s: %w", path, err)
+		}
+		if data, err = yaml.Marshal(raw); err != nil {
+			return fmt.Errorf("converting %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("unsupported config file type %q, expected .yaml, .yml or .toml", filepath.Ext(path))
+	}
+
+	dec := yaml.NewDecoder(strings.NewReader(string(data)))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+	return nil
+}
+
+type configFlag struct {
+	name  string
+	usage string
+	apply func(c *Config, v string) error
+}
+
+var configFlags = []configFlag{
+	{"addr", "HTTP listen address", func(c *Config, v string) error { c.Server.Addr = v; return nil }},
+	{"log-file", "path of the JSON log file", func(c *Config, v string) error { c.Log.File = v; return nil }},
+	{"log-level", "log level (debug, info, warn, error)", func(c *Config, v string) error { c.Log.Level = v; return nil }},
+	{"upload-dir", "directory for uploaded files", func(c *Config, v string) error { c.Upload.Dir = v; return nil }},
+	{"db-driver", "database driver (postgres, mysql or sqlite)", func(c *Config, v string) error { c.DB.Driver = v; return nil }},
+	{"db-host", "database host", func(c *Config, v string) error { c.DB.Host = v; return nil }},
+	{"db-port", "database port", func(c *Config, v string) error { c.DB.Port = v; return nil }},
+	{"db-name", "database name", func(c *Config, v string) error { c.DB.Name = v; return nil }},
+	{"import-workers", "insert workers shared by all imports", func(c *Config, v string) error { return parseIntInto(v, &c.Import.Workers) }},
+	{"import-batch-size", "rows per insert batch", func(c *Config, v string) error { return parseIntInto(v, &c.Import.BatchSize) }},
+}
+
+func parseIntInto(v string, dst *int) error {
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid integer %q", v)
+	}
+	*dst = n
+	return nil
+}
+
+// envReader overrides config values from environment variables that are set
+// and collects parse errors instead of failing on the first one.
+type envReader struct {
+	errs []error
+}
+
+func (e *envReader) lookup(key string) (string, bool) {
+	v, ok := os.LookupEnv(key)
+	if !ok || strings.TrimSpace(v) == "" {
+		return "", false
+	}
+	return v, true
+}
+
+func (e *envReader) String(key string, dst *string) {
+	if v, ok := e.lookup(key); ok {
+		*dst = v
+	}
+}
+
+func (e *envReader) List(key string, dst *[]string) {
+	if v, ok := e.lookup(key); ok {
+		*dst = splitList(v)
+	}
+}
+
+// Map parses "key1=value1,key2=value2" pairs.
+func (e *envReader) Map(key string, dst *map[string]string) {
+	v, ok := e.lookup(key)
+	if !ok {
+		return
+	}
+	m := make(map[string]string)
+	for _, item := range splitList(v) {
+		k, val, ok := strings.Cut(item, "=")
+		if !ok {
+			e.errs = append(e.errs, fmt.Errorf("%s: malformed entry %q, expected key=value", key, item))
+			continue
+		}
+		m[strings.TrimSpace(k)] = strings.TrimSpace(val)
+	}
+	*dst = m
+}
+
+func (e *envReader) Bool(key string, dst *bool) {
+	if v, ok := e.lookup(key); ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid boolean %q", key, v))
+			return
+		}
+		*dst = b
+	}
+}
+
+// Flags parses "name1=true,name2=false" pairs.
+func (e *envReader) Flags(key string, dst *map[string]bool) {
+	var pairs map[string]string
+	e.Map(key, &pairs)
+	if pairs == nil {
+		return
+	}
+	m := make(map[string]bool, len(pairs))
+	for k, v := range pairs {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid boolean %q for %s", key, v, k))
+			continue
+		}
+		m[k] = b
+	}
+	*dst = m
+}
+
+func (e *envReader) Int(key string, dst *int) {
+	if v, ok := e.lookup(key); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid integer %q", key, v))
+			return
+		}
+		*dst = n
+	}
+}
+
+// Ints parses a comma-separated list of integers.
+func (e *envReader) Ints(key string, dst *[]int) {
+	var items []string
+	e.List(key, &items)
+	if items == nil {
+		return
+	}
+	list := make([]int, 0, len(items))
+	for _, item := range items {
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid integer %q", key, item))
+			return
+		}
+		list = append(list, n)
+	}
+	*dst = list
+}
+
+func (e *envReader) Int64(key string, dst *int64) {
+	if v, ok := e.lookup(key); ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid integer %q", key, v))
+			return
+		}
+		*dst = n
+	}
+}
+
+func (e *envReader) Float(key string, dst *float64) {
+	if v, ok := e.lookup(key); ok {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid number %q", key, v))
+			return
+		}
+		*dst = f
+	}
+}
+
+// Rates parses "code1=rate1,code2=rate2" pairs.
+func (e *envReader) Rates(key string, dst *map[string]float64) {
+	var pairs map[string]string
+	e.Map(key, &pairs)
+	if pairs == nil {
+		return
+	}
+	m := make(map[string]float64, len(pairs))
+	for k, v := range pairs {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid number %q for %s", key, v, k))
+			continue
+		}
+		m[k] = f
+	}
+	*dst = m
+}
+
+func (e *envReader) Duration(key string, dst *time.Duration) {
+	if v, ok := e.lookup(key); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("%s: invalid duration %q", key, v))
+			return
+		}
+		*dst = d
+	}
+}
+
+// Redaction reads a role's policy, e.g. "email=mask,salary=null". The value
+// "none" disables redaction for the role.
+func (e *envReader) Redaction(key string, dst map[string]map[string]string, role string) {
+	v, ok := e.lookup(key)
+	if !ok {
+		return
+	}
+	if strings.EqualFold(strings.TrimSpace(v), "none") {
+		dst[role] = map[string]string{}
+		return
+	}
+	policy := dst[role]
+	e.Map(key, &policy)
+	dst[role] = policy
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func (e *envReader) apply(c *Config) {
+	e.String("APP_PROFILE", &c.Profile)
+	e.String("APP_TIMEZONE", &c.TimeZone)
+	e.String("PUBLIC_URL", &c.PublicURL)
+	e.String("SERVER_ADDR", &c.Server.Addr)
+	e.Int64("SERVER_MAX_BODY_BYTES", &c.Server.MaxBodyBytes)
+	e.Duration("SERVER_SHUTDOWN_TIMEOUT", &c.Server.ShutdownTimeout)
+	e.Bool("SERVER_STARTUP_PROBE", &c.Server.StartupProbe)
+	e.Duration("SERVER_SHUTDOWN_DELAY", &c.Server.ShutdownDelay)
+	e.Duration("SERVER_TERMINATION_GRACE_PERIOD", &c.Server.TerminationGracePeriod)
+	e.String("LOG_FILE", &c.Log.File)
+	e.String("LOG_LEVEL", &c.Log.Level)
+	e.Int("LOG_MAX_SIZE_MB", &c.Log.MaxSizeMB)
+	e.Int("LOG_MAX_AGE_DAYS", &c.Log.MaxAgeDays)
+	e.Int("LOG_MAX_BACKUPS", &c.Log.MaxBackups)
+	e.Bool("LOG_COMPRESS", &c.Log.Compress)
+	e.Bool("LOG_DB_ENABLED", &c.Log.Database.Enabled)
+	e.Duration("LOG_DB_FLUSH_INTERVAL", &c.Log.Database.FlushInterval)
+	e.Int("LOG_DB_BUFFER_SIZE", &c.Log.Database.BufferSize)
+	e.Duration("LOG_RETENTION_INTERVAL", &c.Log.Retention.Interval)
+	e.Int("LOG_RETENTION_MAX_TOTAL_MB", &c.Log.Retention.MaxTotalMB)
+	e.Duration("LOG_RETENTION_DB_MAX_AGE", &c.Log.Retention.DatabaseMaxAge)
+	e.Int64("LOG_RETENTION_DB_MAX_ROWS", &c.Log.Retention.DatabaseMaxRows)
+	e.Map("LOG_REDACT_FIELDS", &c.Log.Redact.Fields)
+	e.String("LOG_REDACT_PATTERN_ACTION", &c.Log.Redact.PatternAction)
+	e.String("LOKI_URL", &c.Log.Ship.Loki.URL)
+	e.Map("LOKI_LABELS", &c.Log.Ship.Loki.Labels)
+	e.String("LOKI_TENANT_ID", &c.Log.Ship.Loki.TenantID)
+	e.String("LOKI_USERNAME", &c.Log.Ship.Loki.Username)
+	e.String("LOKI_PASSWORD", &c.Log.Ship.Loki.Password)
+	e.String("ELASTICSEARCH_URL", &c.Log.Ship.Elasticsearch.URL)
+	e.String("ELASTICSEARCH_INDEX", &c.Log.Ship.Elasticsearch.Index)
+	e.String("ELASTICSEARCH_API_KEY", &c.Log.Ship.Elasticsearch.APIKey)
+	e.String("ELASTICSEARCH_USERNAME", &c.Log.Ship.Elasticsearch.Username)
+	e.String("ELASTICSEARCH_PASSWORD", &c.Log.Ship.Elasticsearch.Password)
+	e.String("SYSLOG_ADDRESS", &c.Log.Ship.Syslog.Address)
+	e.String("SYSLOG_FACILITY", &c.Log.Ship.Syslog.Facility)
+	e.String("SYSLOG_APP_NAME", &c.Log.Ship.Syslog.AppName)
+	e.String("GELF_ADDRESS", &c.Log.Ship.GELF.Address)
+	e.String("GELF_HOST", &c.Log.Ship.GELF.Host)
+	e.Duration("LOG_SHIP_FLUSH_INTERVAL", &c.Log.Ship.FlushInterval)
+	e.Int("LOG_SHIP_BUFFER_SIZE", &c.Log.Ship.BufferSize)
+	e.String("UPLOAD_BACKEND", &c.Upload.Backend)
+	e.String("UPLOAD_DIR", &c.Upload.Dir)
+	e.String("UPLOAD_S3_BUCKET", &c.Upload.S3.Bucket)
+	e.String("UPLOAD_S3_PREFIX", &c.Upload.S3.Prefix)
+	e.String("UPLOAD_S3_REGION", &c.Upload.S3.Region)
+	e.String("UPLOAD_S3_ENDPOINT", &c.Upload.S3.Endpoint)
+	e.Bool("UPLOAD_S3_PATH_STYLE", &c.Upload.S3.PathStyle)
+	e.Int("IMPORT_BATCH_SIZE", &c.Import.BatchSize)
+	e.Int("IMPORT_WORKERS", &c.Import.Workers)
+	e.Int("IMPORT_QUEUE_SIZE", &c.Import.QueueSize)
+	e.Int("IMPORT_MAX_CONCURRENT_JOBS", &c.Import.MaxConcurrentJobs)
+	e.Duration("IMPORT_DRAIN_TIMEOUT", &c.Import.DrainTimeout)
+	e.Duration("IMPORT_CHECKPOINT_INTERVAL", &c.Import.CheckpointInterval)
+	e.Int64("IMPORT_SMALL_FILE_MAX_BYTES", &c.Import.SmallFileMaxBytes)
+	e.Int64("IMPORT_SMALL_FILE_MAX_ROWS", &c.Import.SmallFileMaxRows)
+	e.String("IMPORT_ON_DUPLICATE_EMAIL", &c.Import.OnDuplicateEmail)
+	e.String("QUEUE_BACKEND", &c.Queue.Backend)
+	e.String("REDIS_URL", &c.Queue.RedisURL)
+	e.String("QUEUE_KEY_PREFIX", &c.Queue.KeyPrefix)
+	e.Duration("QUEUE_LEASE_TTL", &c.Queue.LeaseTTL)
+
+	e.List("CORS_ALLOWED_ORIGINS", &c.CORS.AllowedOrigins)
+	e.List("CORS_ALLOWED_METHODS", &c.CORS.AllowedMethods)
+	e.List("CORS_ALLOWED_HEADERS", &c.CORS.AllowedHeaders)
+	e.List("CORS_EXPOSED_HEADERS", &c.CORS.ExposedHeaders)
+	e.Bool("CORS_ALLOW_CREDENTIALS", &c.CORS.AllowCredentials)
+	e.Duration("CORS_MAX_AGE", &c.CORS.MaxAge)
+
+	e.String("TLS_ADDR", &c.TLS.Addr)
+	e.String("TLS_CERT_FILE", &c.TLS.CertFile)
+	e.String("TLS_KEY_FILE", &c.TLS.KeyFile)
+	e.List("TLS_AUTOCERT_DOMAINS", &c.TLS.AutocertDomains)
+	e.String("TLS_AUTOCERT_CACHE_DIR", &c.TLS.AutocertCacheDir)
+	e.String("TLS_AUTOCERT_EMAIL", &c.TLS.AutocertEmail)
+	e.Bool("TLS_REDIRECT_HTTP", &c.TLS.RedirectHTTP)
+
+	e.String("ADMIN_TOKEN", &c.Auth.AdminToken)
+
+	e.String("DB_DRIVER", &c.DB.Driver)
+	e.String("DB_HOST", &c.DB.Host)
+	e.String("DB_PORT", &c.DB.Port)
+	e.String("DB_NAME", &c.DB.Name)
+	e.String("DB_SSLMODE", &c.DB.SSLMode)
+	e.String("DB_TIMEZONE", &c.DB.TimeZone)
+	e.Bool("DB_AUTO_MIGRATE", &c.DB.AutoMigrate)
+	e.String("DB_SQLITE_PATH", &c.DB.SQLitePath)
+	e.List("DB_REPLICAS", &c.DB.Replicas)
+	e.String("DB_USER", &c.DB.User)
+	e.String("DB_PASSWORD", &c.DB.Password)
+	e.String("DB_PASSWORD_FILE", &c.DB.PasswordFile)
+	e.String("DB_SECRETS_BACKEND", &c.DB.SecretsBackend)
+	e.Duration("DB_SECRETS_REFRESH", &c.DB.SecretsRefresh)
+	e.String("VAULT_ADDR", &c.DB.VaultAddr)
+	e.String("VAULT_TOKEN", &c.DB.VaultToken)
+	e.String("VAULT_SECRET_PATH", &c.DB.VaultSecretPath)
+	e.String("AWS_SECRET_ID", &c.DB.AWSSecretID)
+	e.String("AWS_REGION", &c.DB.AWSRegion)
+	e.Int("DB_MAX_OPEN_CONNS", &c.DB.MaxOpenConns)
+	e.Int("DB_MAX_IDLE_CONNS", &c.DB.MaxIdleConns)
+	e.Duration("DB_CONN_MAX_LIFETIME", &c.DB.ConnMaxLifetime)
+	e.Duration("DB_CONN_MAX_IDLE_TIME", &c.DB.ConnMaxIdleTime)
+	e.Int("DB_CONNECT_ATTEMPTS", &c.DB.ConnectAttempts)
+	e.Duration("DB_CONNECT_RETRY_INTERVAL", &c.DB.ConnectRetryInterval)
+	e.String("DB_CONNECT_BACKOFF", &c.DB.ConnectBackoff)
+	e.Duration("DB_CONNECT_MAX_INTERVAL", &c.DB.ConnectMaxInterval)
+	e.Float("DB_CONNECT_JITTER", &c.DB.ConnectJitter)
+	e.Duration("DB_CONNECT_TIMEOUT", &c.DB.ConnectTimeout)
+	e.Duration("DB_SLOW_QUERY_THRESHOLD", &c.DB.SlowQueryThreshold)
+	e.String("DB_PARTITION_BY", &c.DB.PartitionBy)
+
+	e.String("OIDC_ISSUER_URL", &c.OIDC.IssuerURL)
+	e.String("OIDC_CLIENT_ID", &c.OIDC.ClientID)
+	e.String("OIDC_CLIENT_SECRET", &c.OIDC.ClientSecret)
+	e.String("OIDC_REDIRECT_URL", &c.OIDC.RedirectURL)
+	e.List("OIDC_SCOPES", &c.OIDC.ExtraScopes)
+	e.String("OIDC_GROUPS_CLAIM", &c.OIDC.GroupsClaim)
+	e.Map("OIDC_GROUP_ROLES", &c.OIDC.GroupRoles)
+	e.Map("OIDC_GROUP_SCOPES", &c.OIDC.GroupScopes)
+	e.String("OIDC_DEFAULT_ROLE", &c.OIDC.DefaultRole)
+	e.String("OIDC_TENANT_CLAIM", &c.OIDC.TenantClaim)
+	e.String("OIDC_DEFAULT_TENANT", &c.OIDC.DefaultTenant)
+
+	e.String("JWT_SECRET", &c.JWT.Secret)
+	e.String("JWT_ISSUER", &c.JWT.Issuer)
+	e.Duration("JWT_ACCESS_TTL", &c.JWT.AccessTTL)
+	e.Duration("JWT_REFRESH_TTL", &c.JWT.RefreshTTL)
+
+	e.Int("LOGIN_MAX_ATTEMPTS", &c.LoginGuard.MaxAttempts)
+	e.Int("LOGIN_MAX_ATTEMPTS_PER_IP", &c.LoginGuard.MaxAttemptsPerIP)
+	e.Duration("LOGIN_ATTEMPT_WINDOW", &c.LoginGuard.Window)
+	e.Duration("LOGIN_LOCKOUT_BASE", &c.LoginGuard.LockoutBase)
+	e.Duration("LOGIN_LOCKOUT_MAX", &c.LoginGuard.LockoutMax)
+	e.Duration("LOGIN_LOCKOUT_RESET_AFTER", &c.LoginGuard.ResetAfter)
+
+	e.String("REDACTION_HASH_SALT", &c.Redaction.HashSalt)
+	if c.Redaction.Roles == nil {
+		c.Redaction.Roles = make(map[string]map[string]string)
+	}
+	e.Redaction("REDACT_FIELDS_VIEWER", c.Redaction.Roles, roleViewer)
+	e.Redaction("REDACT_FIELDS_EDITOR", c.Redaction.Roles, roleEditor)
+	e.Redaction("REDACT_FIELDS_ADMIN", c.Redaction.Roles, roleAdmin)
+
+	e.String("EXPORT_DIR", &c.Exports.Dir)
+	e.String("EXPORT_SIGNING_KEY", &c.Exports.SigningKey)
+	e.Duration("EXPORT_URL_TTL", &c.Exports.URLTTL)
+
+	e.String("OTEL_EXPORTER_OTLP_ENDPOINT", &c.Tracing.Endpoint)
+	e.String("OTEL_SERVICE_NAME", &c.Tracing.ServiceName)
+	e.Float("TRACING_SAMPLE_RATIO", &c.Tracing.SampleRatio)
+	e.String("WEBHOOK_SIGNING_SECRET", &c.Webhooks.SigningSecret)
+	e.List("WEBHOOK_ALLOWED_HOSTS", &c.Webhooks.AllowedHosts)
+	e.Int("WEBHOOK_ATTEMPTS", &c.Webhooks.Attempts)
+	e.String("SMTP_HOST", &c.Email.SMTPHost)
+	e.Int("SMTP_PORT", &c.Email.SMTPPort)
+	e.String("SMTP_USERNAME", &c.Email.Username)
+	e.String("SMTP_PASSWORD", &c.Email.Password)
+	e.String("EMAIL_FROM", &c.Email.From)
+	e.List("EMAIL_TO", &c.Email.To)
+	e.String("EMAIL_NOTIFY_ON", &c.Email.NotifyOn)
+	e.String("CHAT_WEBHOOK_URL", &c.Chat.WebhookURL)
+	e.String("CHAT_FORMAT", &c.Chat.Format)
+	e.Int64("CHAT_FAILED_ROWS_THRESHOLD", &c.Chat.FailedRowsThreshold)
+	e.Float("CHAT_ERROR_RATE_THRESHOLD", &c.Chat.ErrorRate.Threshold)
+	e.Duration("CHAT_ERROR_RATE_WINDOW", &c.Chat.ErrorRate.Window)
+	e.Int("CHAT_ERROR_RATE_MIN_REQUESTS", &c.Chat.ErrorRate.MinRequests)
+	e.Duration("SCHEDULE_POLL_INTERVAL", &c.Schedules.PollInterval)
+	e.Duration("SCHEDULE_MISFIRE_GRACE", &c.Schedules.MisfireGrace)
+	e.String("SCHEDULE_SOURCE_DIR", &c.Schedules.SourceDir)
+	e.List("SCHEDULE_ALLOWED_HOSTS", &c.Schedules.AllowedHosts)
+	e.String("CURRENCY_DEFAULT", &c.Currency.Default)
+	e.String("CURRENCY_REPORTING", &c.Currency.Reporting)
+	e.Rates("CURRENCY_RATES", &c.Currency.Rates)
+	e.Ints("ANALYTICS_AGE_BANDS", &c.Analytics.AgeBands)
+	e.Float("ANALYTICS_OUTLIER_SIGMA", &c.Analytics.OutlierSigma)
+	e.Int("ANALYTICS_OUTLIER_MIN_GROUP", &c.Analytics.OutlierMinGroup)
+	e.String("RECORDS_MERGE_PRECEDENCE", &c.Records.MergePrecedence)
+	e.List("RECORDS_PII_EXTRA", &c.Records.PIIExtra)
+	e.String("RECORDS_CERTIFICATE_KEY", &c.Records.CertificateKey)
+	e.Duration("RECORDS_RETENTION_INTERVAL", &c.Records.RetentionInterval)
+	e.Flags("FEATURES", &c.Features)
+
+	e.List("TRUSTED_PROXIES", &c.TrustedProxies)
+	e.List("ADMIN_IP_ALLOWLIST", &c.AdminIPFilter.Allow)
+	e.List("ADMIN_IP_DENYLIST", &c.AdminIPFilter.Deny)
+}
+
+// Validate reports every configuration problem at once so a bad deployment
+// can be fixed in a single pass.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	validAddr := func(addr string) bool {
+		_, _, err := net.SplitHostPort(addr)
+		return err == nil
+	}
+
+	_, err := time.LoadLocation(c.TimeZone)
+	check(c.TimeZone != "" && err == nil, "timezone %q is not a valid IANA time zone", c.TimeZone)
+	if c.DB.TimeZone != c.TimeZone {
+		_, err = time.LoadLocation(c.DB.TimeZone)
+		check(err == nil, "db.timezone %q is not a valid IANA time zone", c.DB.TimeZone)
+	}
+	check(validAddr(c.Server.Addr), "server.addr %q must be host:port", c.Server.Addr)
+	check(c.Server.MaxBodyBytes > 0, "server.max_body_bytes must be positive")
+	if c.CORS.AllowCredentials {
+		for _, o := range c.CORS.AllowedOrigins {
+			check(o != "*", "cors.allowed_origins must list origins, not *, when cors.allow_credentials is set")
+		}
+	}
+	check(c.Log.File != "", "log.file must not be empty")
+	_, err = logrus.ParseLevel(c.Log.Level)
+	check(err == nil, "log.level %q is not a valid level", c.Log.Level)
+	check(c.Log.MaxSizeMB > 0, "log.max_size_mb must be at least 1")
+	check(c.Log.MaxAgeDays >= 0 && c.Log.MaxBackups >= 0, "log.max_age_days and log.max_backups must not be negative (0 keeps all)")
+	check(c.Log.Retention.Interval >= 0 && c.Log.Retention.MaxTotalMB >= 0 &&
+		c.Log.Retention.DatabaseMaxAge >= 0 && c.Log.Retention.DatabaseMaxRows >= 0,
+		"log.retention settings must not be negative (0 disables them)")
+	for field, action := range c.Log.Redact.Fields {
+		check(validRedactionAction(action), "log.redact.fields: unknown action %q for %s", action, field)
+	}
+	for _, pattern := range c.Log.Redact.Patterns {
+		_, err := regexp.Compile(pattern)
+		check(err == nil, "log.redact.patterns: %q is not a valid regular expression", pattern)
+	}
+	check(c.Log.Redact.PatternAction == redactMask || c.Log.Redact.PatternAction == redactHash,
+		"log.redact.pattern_action %q must be mask or hash", c.Log.Redact.PatternAction)
+	if c.Log.Database.Enabled {
+		check(c.Log.Database.FlushInterval > 0, "log.database.flush_interval must be positive")
+		check(c.Log.Database.BufferSize > 0, "log.database.buffer_size must be at least 1")
+	}
+	for name, raw := range map[string]string{"loki": c.Log.Ship.Loki.URL, "elasticsearch": c.Log.Ship.Elasticsearch.URL} {
+		if raw == "" {
+			continue
+		}
+		u, err := url.Parse(raw)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"log.ship.%s.url must be an http(s) URL", name)
+		check(c.Log.Ship.FlushInterval > 0, "log.ship.flush_interval must be positive")
+		check(c.Log.Ship.BufferSize > 0, "log.ship.buffer_size must be at least 1")
+	}
+	if c.Log.Ship.Elasticsearch.URL != "" {
+		check(c.Log.Ship.Elasticsearch.Index != "", "log.ship.elasticsearch.index must be set")
+	}
+	for name, raw := range map[string]string{"syslog": c.Log.Ship.Syslog.Address, "gelf": c.Log.Ship.GELF.Address} {
+		if raw == "" {
+			continue
+		}
+		_, _, err := parseLogAddress(raw)
+		check(err == nil, "log.ship.%s.address must be udp://host:port or tcp://host:port", name)
+		check(c.Log.Ship.FlushInterval > 0, "log.ship.flush_interval must be positive")
+		check(c.Log.Ship.BufferSize > 0, "log.ship.buffer_size must be at least 1")
+	}
+	if c.Log.Ship.Syslog.Address != "" {
+		_, ok := syslogFacilities[c.Log.Ship.Syslog.Facility]
+		check(ok, "log.ship.syslog.facility %q is not a syslog facility", c.Log.Ship.Syslog.Facility)
+		check(c.Log.Ship.Syslog.AppName != "", "log.ship.syslog.app_name must be set")
+	}
+	switch c.Upload.Backend {
+	case storageLocal:
+		check(c.Upload.Dir != "", "upload.dir must not be empty")
+	case storageS3:
+		check(c.Upload.S3.Bucket != "", "upload.s3.bucket is required with the s3 backend")
+		if c.Upload.S3.Endpoint != "" {
+			u, err := url.Parse(c.Upload.S3.Endpoint)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+				"upload.s3.endpoint %q must be an http(s) URL", c.Upload.S3.Endpoint)
+		}
+	default:
+		errs = append(errs, fmt.Errorf("upload.backend %q must be local or s3", c.Upload.Backend))
+	}
+	check(c.Import.BatchSize > 0, "import.batch_size must be at least 1")
+	check(c.Import.Workers > 0, "import.workers must be at least 1")
+	check(c.Import.QueueSize >= 0, "import.queue_size must not be negative")
+	check(c.Import.MaxConcurrentJobs >= 0, "import.max_concurrent_jobs must not be negative (0 means no limit)")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout must be positive")
+	check(c.Server.ShutdownDelay >= 0, "server.shutdown_delay must not be negative")
+	check(c.Server.TerminationGracePeriod == 0 || c.Server.TerminationGracePeriod > c.Server.ShutdownDelay,
+		"server.termination_grace_period must be longer than server.shutdown_delay")
+	check(c.Import.DrainTimeout >= 0, "import.drain_timeout must not be negative")
+	check(c.Import.CheckpointInterval >= 0, "import.checkpoint_interval must not be negative")
+	check(c.Import.SmallFileMaxBytes >= 0, "import.small_file_max_bytes must not be negative (0 turns it off)")
+	check(c.Import.SmallFileMaxRows >= 0, "import.small_file_max_rows must not be negative (0 means no limit)")
+	switch c.Import.OnDuplicateEmail {
+	case duplicateSkip, duplicateUpdate, duplicateError:
+	default:
+		errs = append(errs, fmt.Errorf("import.on_duplicate_email %q must be skip, update or error", c.Import.OnDuplicateEmail))
+	}
+	switch c.Queue.Backend {
+	case queueLocal:
+	case queueRedis:
+		if c.Queue.RedisURL == "" {
+			errs = append(errs, errors.New("queue.redis_url is required with queue.backend redis"))
+		} else {
+			_, err = redis.ParseURL(c.Queue.RedisURL)
+			check(err == nil, "queue.redis_url: %v", err)
+		}
+		check(c.Import.MaxConcurrentJobs > 0, "import.max_concurrent_jobs must be set with queue.backend redis")
+		check(c.Queue.LeaseTTL >= 3*time.Second, "queue.lease_ttl must be at least 3s")
+	default:
+		errs = append(errs, fmt.Errorf("queue.backend %q must be local or redis", c.Queue.Backend))
+	}
+
+	check((c.TLS.CertFile == "") == (c.TLS.KeyFile == ""), "tls.cert_file and tls.key_file must be set together")
+	if c.TLS.Enabled() {
+		check(validAddr(c.TLS.Addr), "tls.addr %q must be host:port", c.TLS.Addr)
+	}
+
+	switch c.DB.Driver {
+	case driverPostgres, driverMySQL:
+		check(c.DB.Host != "", "db.host must not be empty")
+		check(c.DB.Name != "", "db.name must not be empty")
+	case driverSQLite:
+		check(c.DB.SQLitePath != "", "db.sqlite_path must not be empty")
+		check(len(c.DB.Replicas) == 0, "db.replicas is not supported with sqlite")
+	default:
+		errs = append(errs, fmt.Errorf("db.driver %q must be postgres, mysql or sqlite", c.DB.Driver))
+	}
+	check(c.DB.ConnectAttempts > 0, "db.connect_attempts must be at least 1")
+	check(c.DB.ConnectRetryInterval > 0, "db.connect_retry_interval must be positive")
+	check(c.DB.ConnectBackoff == backoffConstant || c.DB.ConnectBackoff == backoffExponential,
+		"db.connect_backoff %q must be constant or exponential", c.DB.ConnectBackoff)
+	check(c.DB.ConnectMaxInterval >= c.DB.ConnectRetryInterval, "db.connect_max_interval must not be shorter than db.connect_retry_interval")
+	check(c.DB.ConnectJitter >= 0 && c.DB.ConnectJitter < 1, "db.connect_jitter must be at least 0 and below 1")
+	check(c.DB.ConnectTimeout >= 0, "db.connect_timeout must not be negative (0 means no limit)")
+	check(c.DB.SlowQueryThreshold >= 0, "db.slow_query_threshold must not be negative (0 disables it)")
+	if c.DB.PartitionBy != "" {
+		_, ok := partitionSchemes[c.DB.PartitionBy]
+		check(ok, "db.partition_by %q must be company or join_year", c.DB.PartitionBy)
+		check(c.DB.Driver == driverPostgres, "db.partition_by is only supported with postgres")
+	}
+	check(c.DB.MaxOpenConns >= 0, "db.max_open_conns must not be negative (0 means unlimited)")
+	check(c.DB.MaxIdleConns >= 0, "db.max_idle_conns must not be negative")
+	check(c.DB.MaxOpenConns == 0 || c.DB.MaxIdleConns <= c.DB.MaxOpenConns, "db.max_idle_conns must not exceed db.max_open_conns")
+	check(c.DB.ConnMaxLifetime >= 0 && c.DB.ConnMaxIdleTime >= 0, "db.conn_max_lifetime and db.conn_max_idle_time must not be negative")
+	check(c.DB.SecretsRefresh > 0, "db.secrets_refresh must be positive")
+	switch c.DB.SecretsBackend {
+	case "env", "vault", "aws":
+	default:
+		errs = append(errs, fmt.Errorf("db.secrets_backend %q must be env, vault or aws", c.DB.SecretsBackend))
+	}
+
+	if c.OIDC.IssuerURL != "" {
+		check(c.OIDC.ClientID != "", "oidc.client_id is required when oidc.issuer_url is set")
+	}
+	for group, role := range c.OIDC.GroupRoles {
+		check(validRole(role), "oidc.group_roles: group %q maps to unknown role %q", group, role)
+	}
+	check(c.OIDC.DefaultRole == "" || validRole(c.OIDC.DefaultRole), "oidc.default_role %q is not a valid role", c.OIDC.DefaultRole)
+
+	if c.JWT.Secret != "" {
+		check(len(c.JWT.Secret) >= 32, "jwt.secret must be at least 32 characters")
+	}
+	check(c.JWT.AccessTTL > 0, "jwt.access_ttl must be positive")
+	check(c.JWT.RefreshTTL > c.JWT.AccessTTL, "jwt.refresh_ttl must be longer than jwt.access_ttl")
+
+	check(c.LoginGuard.MaxAttempts > 0, "login_guard.max_attempts must be at least 1")
+	check(c.LoginGuard.MaxAttemptsPerIP > 0, "login_guard.max_attempts_per_ip must be at least 1")
+	check(c.LoginGuard.LockoutBase > 0 && c.LoginGuard.LockoutMax >= c.LoginGuard.LockoutBase,
+		"login_guard.lockout_base must be positive and no larger than lockout_max")
+
+	for role, policy := range c.Redaction.Roles {
+		check(validRole(role), "redaction.roles: unknown role %q", role)
+		for field, action := range policy {
+			check(validRedactionAction(action), "redaction.roles.%s: unknown action %q for %s", role, action, field)
+		}
+	}
+	// An unkeyed hash of an email or salary is undone by hashing the few
+	// values it can take.
+	hashed := c.Log.Redact.PatternAction == redactHash && len(c.Log.Redact.Patterns) > 0
+	for _, action := range c.Log.Redact.Fields {
+		hashed = hashed || action == redactHash
+	}
+	for _, policy := range c.Redaction.Roles {
+		for _, action := range policy {
+			hashed = hashed || action == redactHash
+		}
+	}
+	if hashed {
+		check(len(c.Redaction.HashSalt) >= 32, "redaction.hash_salt must be at least 32 characters when a redaction rule hashes")
+	}
+
+	check(c.Exports.Dir != "", "exports.dir must not be empty")
+	check(c.Exports.URLTTL > 0, "exports.url_ttl must be positive")
+
+	if c.Tracing.Endpoint != "" {
+		u, err := url.Parse(c.Tracing.Endpoint)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"tracing.endpoint %q must be an http(s) URL", c.Tracing.Endpoint)
+	}
+	check(c.Tracing.ServiceName != "", "tracing.service_name must not be empty")
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing.sample_ratio must be between 0 and 1")
+
+	if c.PublicURL != "" {
+		u, err := url.Parse(c.PublicURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"public_url %q must be an http(s) URL", c.PublicURL)
+	}
+	if c.Webhooks.SigningSecret != "" {
+		check(len(c.Webhooks.SigningSecret) >= 32, "webhooks.signing_secret must be at least 32 characters")
+	}
+	check(c.Webhooks.Attempts > 0, "webhooks.attempts must be at least 1")
+	if c.Email.SMTPHost != "" {
+		check(c.Email.SMTPPort > 0 && c.Email.SMTPPort <= 65535, "email.smtp_port %d is out of range", c.Email.SMTPPort)
+		_, err = mail.ParseAddress(c.Email.From)
+		check(err == nil, "email.from %q must be an email address", c.Email.From)
+		for _, to := range c.Email.To {
+			_, err = mail.ParseAddress(to)
+			check(err == nil, "email.to: %q is not an email address", to)
+		}
+	}
+	check(c.Email.NotifyOn == emailNotifyAll || c.Email.NotifyOn == emailNotifyFailures,
+		"email.notify_on %q must be all or failures", c.Email.NotifyOn)
+	if c.Chat.WebhookURL != "" {
+		u, err := url.Parse(c.Chat.WebhookURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+			"chat.webhook_url must be an http(s) URL")
+	}
+	check(c.Chat.Format == chatSlack || c.Chat.Format == chatTeams || c.Chat.Format == chatGeneric,
+		"chat.format %q must be slack, teams or generic", c.Chat.Format)
+	check(c.Chat.FailedRowsThreshold >= 0, "chat.failed_rows_threshold must not be negative")
+	check(c.Chat.ErrorRate.Threshold >= 0 && c.Chat.ErrorRate.Threshold <= 1, "chat.error_rate.threshold must be between 0 and 1")
+	check(c.Chat.ErrorRate.Window > 0, "chat.error_rate.window must be positive")
+	check(c.Chat.ErrorRate.MinRequests >= 0, "chat.error_rate.min_requests must not be negative")
+	ruleNames := map[string]bool{}
+	for i, r := range c.Chat.Rules {
+		check(r.Name != "" && !ruleNames[r.Name], "chat.rules[%d].name must be set and unique", i)
+		ruleNames[r.Name] = true
+		_, err := logrus.ParseLevel(r.Level)
+		check(err == nil, "chat.rules[%d].level %q is not a log level", i, r.Level)
+		check(r.Threshold >= 0, "chat.rules[%d].threshold must not be negative", i)
+		check(r.Window > 0 || r.Threshold == 0, "chat.rules[%d].window must be positive", i)
+		check(r.Cooldown >= 0, "chat.rules[%d].cooldown must not be negative", i)
+		if r.WebhookURL != "" {
+			u, err := url.Parse(r.WebhookURL)
+			check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "",
+				"chat.rules[%d].webhook_url must be an http(s) URL", i)
+			check(r.Format == "" || r.Format == chatSlack || r.Format == chatTeams || r.Format == chatGeneric,
+				"chat.rules[%d].format %q must be slack, teams or generic", i, r.Format)
+		}
+	}
+	check(c.Schedules.PollInterval >= 0, "schedules.poll_interval must not be negative")
+	check(c.Schedules.MisfireGrace >= 0, "schedules.misfire_grace must not be negative")
+	check(validCurrency(c.Currency.Default), "currency.default %q must be a 3-letter currency code", c.Currency.Default)
+	check(c.Currency.Reporting == "" || validCurrency(c.Currency.Reporting),
+		"currency.reporting %q must be a 3-letter currency code", c.Currency.Reporting)
+	for code, rate := range c.Currency.Rates {
+		check(validCurrency(code), "currency.rates: %q must be a 3-letter currency code", code)
+		check(rate > 0, "currency.rates.%s must be positive", code)
+	}
+	check(len(c.Currency.Rates) == 0 || c.Currency.Reporting != "", "currency.rates needs currency.reporting")
+	for i, age := range c.Analytics.AgeBands {
+		check(age > 0 && (i == 0 || age > c.Analytics.AgeBands[i-1]),
+			"analytics.age_bands must be positive and increasing")
+	}
+	check(c.Analytics.OutlierSigma > 0, "analytics.outlier_sigma must be positive")
+	check(c.Analytics.OutlierMinGroup >= 2, "analytics.outlier_min_group must be at least 2")
+	check(validMergePrecedence(c.Records.MergePrecedence), "records.merge_precedence %q must be %s or %s",
+		c.Records.MergePrecedence, mergeSurvivor, mergeNewest)
+	if c.Records.CertificateKey != "" {
+		check(len(c.Records.CertificateKey) >= 32, "records.certificate_key must be at least 32 characters")
+	}
+	check(c.Records.RetentionInterval >= 0, "records.retention_interval must not be negative")
+
+	for name := range c.Features {
+		_, ok := featureFlags[name]
+		check(ok, "features: unknown feature flag %q", name)
+	}
+
+	_, err = parseCIDRs(c.TrustedProxies)
+	check(err == nil, "trusted_proxies: %v", err)
+	_, err = parseCIDRs(c.AdminIPFilter.Allow)
+	check(err == nil, "admin_ip_filter.allow: %v", err)
+	_, err = parseCIDRs(c.AdminIPFilter.Deny)
+	check(err == nil, "admin_ip_filter.deny: %v", err)
+
+	return errors.Join(errs...)
+}
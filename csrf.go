@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCookie    = "session"
+	csrfHeader       = "X-CSRF-Token"
+	csrfFormField    = "csrf_token"
+	ctxCookieSession = "cookie_session"
+)
+
+// csrfToken is bound to the session's token ID, so it cannot be reused with a
+// different session and needs no server-side storage.
+func csrfToken(jti string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.JWT.Secret))
+	mac.Write([]byte("csrf:" + jti))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	return false
+}
+
+// csrfProtect only applies to requests authenticated by the session cookie;
+// bearer tokens and API keys are not sent automatically by browsers.
+func csrfProtect() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool(ctxCookieSession) || isSafeMethod(c.Request.Method) {
+			c.Next()
+			return
+		}
+		token := c.GetHeader(csrfHeader)
+		if token == "" {
+			token = c.PostForm(csrfFormField)
+		}
+		expected := csrfToken(c.GetString(ctxTokenID))
+		if token == "" || !hmac.Equal([]byte(token), []byte(expected)) {
+			logCtx(c).Warnf("Rejected %s %s from %s: missing or invalid CSRF token", c.Request.Method, c.Request.URL.Path, c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Missing or invalid CSRF token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+func getCSRFToken(c *gin.Context) {
+	if !c.GetBool(ctxCookieSession) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "CSRF tokens are only needed for cookie sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"csrf_token": csrfToken(c.GetString(ctxTokenID))})
+}
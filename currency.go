@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// currencySymbols are the symbols salaries may be written with, for the
+// currency each usually means.
+var currencySymbols = map[string]string{
+	"$": "USD", "US$": "USD", "C$": "CAD", "A$": "AUD",
+	"€": "EUR", "£": "GBP", "¥": "JPY", "₹": "INR",
+}
+
+// zeroDecimalCurrencies have no minor unit, so amounts are whole.
+var zeroDecimalCurrencies = map[string]bool{"JPY": true, "KRW": true}
+
+// salaryPattern splits a salary into a code or symbol before the amount,
+// the amount, and a code or symbol after it: "$1,200.50", "EUR 900",
+// "900 eur".
+var salaryPattern = regexp.MustCompile(`^(US\$|C\$|A\$|[$€£¥₹]|[A-Za-z]{3})?\s*(-?\d[\d,]*(?:\.\d+)?)\s*([$€£¥₹]|[A-Za-z]{3})?$`)
+
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, r := range code {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseSalary reads a salary and the currency it names, defaulting to
+// defaultCurrency. Commas are read as thousands separators. The amount is
+// rounded to the currency's minor unit.
+func parseSalary(s, defaultCurrency string) (float64, string, error) {
+	m := salaryPattern.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return 0, "", fmt.Errorf("salary %q is not an amount", s)
+	}
+	currency := ""
+	for _, mark := range []string{m[1], m[3]} {
+		if mark == "" {
+			continue
+		}
+		code, ok := currencySymbols[mark]
+		if !ok {
+			code = strings.ToUpper(mark)
+		}
+		if currency != "" && code != currency {
+			return 0, "", fmt.Errorf("salary %q names two currencies", s)
+		}
+		currency = code
+	}
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	amount, err := strconv.ParseFloat(strings.ReplaceAll(m[2], ",", ""), 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("salary %q is not an amount", s)
+	}
+	return roundAmount(amount, currency), currency, nil
+}
+
+func roundAmount(amount float64, currency string) float64 {
+	if zeroDecimalCurrencies[currency] {
+		return math.Round(amount)
+	}
+	return math.Round(amount*100) / 100
+}
+
+// currencyRate is what one unit of currency is worth in the reporting
+// currency, and false when there is no rate for it.
+func currencyRate(currency string) (float64, bool) {
+	if currency == cfg.Currency.Reporting {
+		return 1, true
+	}
+	rate, ok := cfg.Currency.Rates[currency]
+	return rate, ok
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	gormmysql "gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
+)
+
+const (
+	driverPostgres = "postgres"
+	driverMySQL    = "mysql"
+	driverSQLite   = "sqlite"
+)
+
+// Both Postgres and MySQL cap a prepared statement at 65535 placeholders,
+// SQLite at 32766. MySQL statements are additionally kept small enough to fit
+// the 1MB max_allowed_packet some MariaDB installations still default to.
+const (
+	maxPlaceholders       = 65535
+	maxSQLitePlaceholders = 32766
+	maxMySQLBulkRows      = 1000
+)
+
+// openDatabase returns a pool for the driver of d. Credentials are
+// fetched from dbCredentials on every new connection so rotations apply
+// without a restart.
+func openDatabase(d DBConfig) (*sql.DB, gorm.Dialector, error) {
+	switch d.Driver {
+	case driverMySQL:
+		mc, err := mysqlConfig(d)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := mc.Apply(mysql.BeforeConnect(dbCredentials.beforeConnectMySQL)); err != nil {
+			return nil, nil, err
+		}
+		connector, err := mysql.NewConnector(mc)
+		if err != nil {
+			return nil, nil, err
+		}
+		sqlDB := sql.OpenDB(connector)
+		return sqlDB, gormmysql.New(gormmysql.Config{Conn: sqlDB}), nil
+	case driverSQLite:
+		if d.SQLitePath != ":memory:" {
+			if err := os.MkdirAll(filepath.Dir(d.SQLitePath), os.ModePerm); err != nil {
+				return nil, nil, err
+			}
+		}
+		sqlDB, err := sql.Open(sqlite.DriverName, sqliteDSN(d.SQLitePath))
+		if err != nil {
+			return nil, nil, err
+		}
+		return sqlDB, sqlite.Dialector{Conn: sqlDB}, nil
+	default:
+		connCfg, err := pgx.ParseConfig(d.DSN())
+		if err != nil {
+			return nil, nil, err
+		}
+		sqlDB := stdlib.OpenDB(*connCfg, stdlib.OptionBeforeConnect(dbCredentials.beforeConnect))
+		return sqlDB, postgres.New(postgres.Config{Conn: sqlDB}), nil
+	}
+}
+
+// mysqlConfig maps the shared settings onto the MySQL driver. sslmode uses the
+// Postgres vocabulary: disable, require (unverified) or verify-full.
+func mysqlConfig(d DBConfig) (*mysql.Config, error) {
+	loc, err := time.LoadLocation(d.TimeZone)
+	if err != nil {
+		return nil, fmt.Errorf("db.timezone: %w", err)
+	}
+	mc := mysql.NewConfig()
+	mc.Net = "tcp"
+	mc.Addr = net.JoinHostPort(d.Host, d.port())
+	mc.DBName = d.Name
+	mc.ParseTime = true
+	mc.Loc = loc
+	mc.Collation = "utf8mb4_unicode_ci"
+	switch d.SSLMode {
+	case "", "disable":
+	case "require":
+		mc.TLS = &tls.Config{InsecureSkipVerify: true}
+	default:
+		mc.TLS = &tls.Config{ServerName: d.Host}
+	}
+	return mc, nil
+}
+
+// replica returns the settings for a read replica given as host or host:port;
+// everything else, including credentials, is shared with the primary.
+func (d DBConfig) replica(addr string) DBConfig {
+	r := d
+	r.Host, r.Port = addr, ""
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		r.Host, r.Port = host, port
+	}
+	return r
+}
+
+// replicaDBs are the read replica pools, reported by /readyz.
+var replicaDBs []*sql.DB
+
+// connectReplicas routes reads of the large tables (employees, audit log) to
+// the configured replicas so exports and analytics don't contend with imports
+// on the primary. Writes, and reads inside transactions, stay on the primary;
+// everything else reads from the primary to avoid replication lag on auth.
+func connectReplicas() {
+	if len(cfg.DB.Replicas) == 0 {
+		return
+	}
+	var dialectors []gorm.Dialector
+	for _, addr := range cfg.DB.Replicas {
+		conf := cfg.DB.replica(addr)
+		sqlDB, dialector, err := openDatabase(conf)
+		if err != nil {
+			logr.Fatalf("Invalid database replica %s: %v", addr, err)
+		}
+		configurePool(sqlDB, conf)
+		replicaDBs = append(replicaDBs, sqlDB)
+		dialectors = append(dialectors, dialector)
+	}
+	resolver := dbresolver.Register(dbresolver.Config{
+		Replicas: dialectors,
+		Policy:   dbresolver.RandomPolicy{},
+	}, &Employee{}, &AuditEntry{})
+	if err := db.Use(resolver); err != nil {
+		logr.Fatalf("Failed to configure database replicas: %v", err)
+	}
+	logr.Infof("Reading employees and audit entries from %d replica(s)", len(dialectors))
+}
+
+// sqliteDSN waits on locks instead of failing with SQLITE_BUSY, since import
+// workers write concurrently, and enables WAL so reads don't block on them.
+func sqliteDSN(path string) string {
+	if path == ":memory:" {
+		return path
+	}
+	return "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=foreign_keys(1)"
+}
+
+// bulkInsert creates rows (a slice of models) using as few statements as the
+// dialect allows, and returns the rows affected.
+func bulkInsert(tx *gorm.DB, rows interface{}) (int64, error) {
+	stmt := &gorm.Statement{DB: tx}
+	if err := stmt.Parse(rows); err != nil {
+		return 0, err
+	}
+	size := maxPlaceholders / len(stmt.Schema.DBNames)
+	switch cfg.DB.Driver {
+	case driverMySQL:
+		size = min(size, maxMySQLBulkRows)
+	case driverSQLite:
+		size = maxSQLitePlaceholders / len(stmt.Schema.DBNames)
+	}
+	res := tx.CreateInBatches(rows, size)
+	return res.RowsAffected, res.Error
+}
@@ -0,0 +1,531 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Dataset column types.
+const (
+	columnString  = "string"
+	columnInteger = "integer"
+	columnNumber  = "number"
+	columnBoolean = "boolean"
+	columnDate    = "date"
+	columnEmail   = "email"
+)
+
+const (
+	maxDatasetColumns = 100
+	// maxDatasetRowErrors caps the row errors an upload reports.
+	maxDatasetRowErrors = 100
+)
+
+var datasetNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,62}$`)
+
+// datasetReservedColumns are kept on every dataset row.
+var datasetReservedColumns = map[string]bool{"id": true, "created_at": true}
+
+// Dataset is a tenant's registered schema for records other than employees,
+// such as customers or assets. Registering one provisions a table of its
+// own; its columns can't be changed afterwards, so a new shape is a new
+// dataset.
+type Dataset struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	TenantID string `gorm:"size:64;not null;uniqueIndex:idx_datasets_tenant_name" json:"tenant_id"`
+	// Name identifies the dataset in its endpoints.
+	Name      string          `gorm:"size:63;not null;uniqueIndex:idx_datasets_tenant_name" json:"name"`
+	Columns   []datasetColumn `gorm:"type:text;serializer:json" json:"columns"`
+	DataTable string          `gorm:"size:64;not null" json:"-"`
+	CreatedBy string          `json:"created_by"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// datasetColumn is one column of a dataset, and the checks its values
+// pass. Min and Max bound numbers; Pattern applies to text.
+type datasetColumn struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required,omitempty"`
+	Min      *float64 `json:"min,omitempty"`
+	Max      *float64 `json:"max,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+}
+
+// validate checks the column definition, returning its compiled pattern.
+func (col datasetColumn) validate() (*regexp.Regexp, error) {
+	if !datasetNamePattern.MatchString(col.Name) || datasetReservedColumns[col.Name] {
+		return nil, fmt.Errorf("column %q: name must be lowercase letters, digits and _, and not id or created_at", col.Name)
+	}
+	switch col.Type {
+	case columnString, columnEmail:
+		if col.Min != nil || col.Max != nil {
+			return nil, fmt.Errorf("column %s: min and max apply to integer and number columns", col.Name)
+		}
+		if col.Pattern == "" {
+			return nil, nil
+		}
+		if len(col.Pattern) > maxRulePatternLen {
+			return nil, fmt.Errorf("column %s: pattern must be at most %d characters", col.Name, maxRulePatternLen)
+		}
+		re, err := regexp.Compile(col.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: pattern: %v", col.Name, err)
+		}
+		return re, nil
+	case columnInteger, columnNumber:
+		if col.Min != nil && col.Max != nil && *col.Min > *col.Max {
+			return nil, fmt.Errorf("column %s: min must not be above max", col.Name)
+		}
+	case columnBoolean, columnDate:
+		if col.Min != nil || col.Max != nil {
+			return nil, fmt.Errorf("column %s: min and max apply to integer and number columns", col.Name)
+		}
+	default:
+		return nil, fmt.Errorf("column %s: type must be string, integer, number, boolean, date or email", col.Name)
+	}
+	if col.Pattern != "" {
+		return nil, fmt.Errorf("column %s: pattern applies to string and email columns", col.Name)
+	}
+	return nil, nil
+}
+
+// goType is the Go type GORM maps the column to; nil pointers store NULL
+// for blank values.
+func (col datasetColumn) goType() reflect.Type {
+	switch col.Type {
+	case columnInteger:
+		return reflect.TypeOf((*int64)(nil))
+	case columnNumber:
+		return reflect.TypeOf((*float64)(nil))
+	case columnBoolean:
+		return reflect.TypeOf((*bool)(nil))
+	case columnDate:
+		return reflect.TypeOf((*time.Time)(nil))
+	}
+	return reflect.TypeOf((*string)(nil))
+}
+
+// convert reads a CSV value or query parameter as the column's type,
+// checking it. Blank values are nil.
+func (col datasetColumn) convert(s string, re *regexp.Regexp) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		if col.Required {
+			return nil, fmt.Errorf("%s is required", col.Name)
+		}
+		return nil, nil
+	}
+	var number float64
+	var value interface{}
+	switch col.Type {
+	case columnInteger:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q is not an integer", col.Name, s)
+		}
+		number, value = float64(n), n
+	case columnNumber:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q is not a number", col.Name, s)
+		}
+		number, value = f, f
+	case columnBoolean:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s %q is not true or false", col.Name, s)
+		}
+		return b, nil
+	case columnDate:
+		t, err := parseDate(s, dateFormatAuto)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", col.Name, err)
+		}
+		return t, nil
+	case columnEmail:
+		s = strings.ToLower(s)
+		if !validEmail(s) {
+			return nil, fmt.Errorf("%s %q is not a valid email address", col.Name, s)
+		}
+		value = s
+	default:
+		value = s
+	}
+	if col.Min != nil && number < *col.Min {
+		return nil, fmt.Errorf("%s %v is below %v", col.Name, number, *col.Min)
+	}
+	if col.Max != nil && number > *col.Max {
+		return nil, fmt.Errorf("%s %v is above %v", col.Name, number, *col.Max)
+	}
+	if re != nil && !re.MatchString(s) {
+		return nil, fmt.Errorf("%s %q does not match %s", col.Name, s, col.Pattern)
+	}
+	return value, nil
+}
+
+// model builds a struct with a field per column, for GORM to create the
+// dataset's table from.
+func (d Dataset) model() interface{} {
+	fields := []reflect.StructField{
+		{Name: "ID", Type: reflect.TypeOf(uint(0)), Tag: `gorm:"primaryKey"`},
+		{Name: "CreatedAt", Type: reflect.TypeOf(time.Time{}), Tag: `gorm:"index"`},
+	}
+	for i, col := range d.Columns {
+		tag := fmt.Sprintf(`gorm:"column:%s"`, col.Name)
+		if col.Required {
+			tag = fmt.Sprintf(`gorm:"column:%s;not null"`, col.Name)
+		}
+		fields = append(fields, reflect.StructField{Name: fmt.Sprintf("C%d", i), Type: col.goType(), Tag: reflect.StructTag(tag)})
+	}
+	return reflect.New(reflect.StructOf(fields)).Interface()
+}
+
+func (d Dataset) column(name string) (datasetColumn, bool) {
+	for _, col := range d.Columns {
+		if col.Name == name {
+			return col, true
+		}
+	}
+	return datasetColumn{}, false
+}
+
+type datasetRequest struct {
+	Name    string          `json:"name" binding:"required"`
+	Columns []datasetColumn `json:"columns" binding:"required"`
+}
+
+// createDataset registers a dataset and provisions its table, in one
+// transaction where the database runs DDL transactionally.
+func createDataset(c *gin.Context) {
+	var req datasetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !datasetNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name must be lowercase letters, digits and _, starting with a letter"})
+		return
+	}
+	if len(req.Columns) == 0 || len(req.Columns) > maxDatasetColumns {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("a dataset needs 1-%d columns", maxDatasetColumns)})
+		return
+	}
+	seen := map[string]bool{}
+	for _, col := range req.Columns {
+		if _, err := col.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if seen[col.Name] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("column %s is defined twice", col.Name)})
+			return
+		}
+		seen[col.Name] = true
+	}
+
+	d := Dataset{TenantID: tenantID(c), Name: req.Name, Columns: req.Columns, CreatedBy: c.GetString(ctxActor)}
+	err := db.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&Dataset{}).Scopes(tenantScope(c)).Where("name = ?", d.Name).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return errDatasetExists
+		}
+		// The table is named after the row's ID, which is only known once
+		// it is inserted.
+		d.DataTable = "pending"
+		if err := tx.Create(&d).Error; err != nil {
+			return err
+		}
+		d.DataTable = fmt.Sprintf("dataset_%d", d.ID)
+		if err := tx.Model(&d).Update("data_table", d.DataTable).Error; err != nil {
+			return err
+		}
+		return tx.Table(d.DataTable).Migrator().CreateTable(d.model())
+	})
+	if errors.Is(err, errDatasetExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "A dataset with this name exists"})
+		return
+	}
+	if err != nil {
+		logCtx(c).Errorf("Error creating dataset %s: %v", d.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create dataset"})
+		return
+	}
+	setAuditEvent(c, "dataset.create", fmt.Sprintf("dataset %s (%d columns)", d.Name, len(d.Columns)))
+	logCtx(c).Infof("Created dataset %s for tenant %s in table %s", d.Name, d.TenantID, d.DataTable)
+	c.JSON(http.StatusCreated, d)
+}
+
+var errDatasetExists = errors.New("dataset exists")
+
+func listDatasets(c *gin.Context) {
+	datasets := []Dataset{}
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Order("name").Find(&datasets).Error; err != nil {
+		logCtx(c).Errorf("Error listing datasets: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list datasets"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"datasets": datasets})
+}
+
+func findDataset(c *gin.Context) (Dataset, bool) {
+	var d Dataset
+	err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Where("name = ?", c.Param("name")).Take(&d).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Dataset not found"})
+		} else {
+			logCtx(c).Errorf("Error reading dataset %s: %v", c.Param("name"), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read dataset"})
+		}
+		return d, false
+	}
+	return d, true
+}
+
+func getDataset(c *gin.Context) {
+	d, ok := findDataset(c)
+	if !ok {
+		return
+	}
+	var rows int64
+	if err := db.WithContext(c.Request.Context()).Table(d.DataTable).Count(&rows).Error; err != nil {
+		logCtx(c).Errorf("Error counting rows of dataset %s: %v", d.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read dataset"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"dataset": d, "rows": rows})
+}
+
+// deleteDataset drops a dataset's table along with every row in it.
+func deleteDataset(c *gin.Context) {
+	d, ok := findDataset(c)
+	if !ok {
+		return
+	}
+	err := db.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&d).Error; err != nil {
+			return err
+		}
+		return tx.Migrator().DropTable(d.DataTable)
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error deleting dataset %s: %v", d.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete dataset"})
+		return
+	}
+	setAuditEvent(c, "dataset.delete", "dataset "+d.Name)
+	logCtx(c).Infof("Deleted dataset %s and table %s", d.Name, d.DataTable)
+	c.JSON(http.StatusOK, gin.H{"message": "Dataset deleted"})
+}
+
+type datasetRowError struct {
+	Row   int64  `json:"row"`
+	Error string `json:"error"`
+}
+
+// uploadDatasetRows imports a CSV into a dataset, matching its header to
+// the dataset's columns by name. Unlike employee uploads it runs within
+// the request: valid rows are inserted in batches of import.batch_size
+// and invalid ones reported, up to maxDatasetRowErrors of them.
+func uploadDatasetRows(c *gin.Context) {
+	d, ok := findDataset(c)
+	if !ok {
+		return
+	}
+	fh, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
+		return
+	}
+	file, err := fh.Open()
+	if err != nil {
+		logCtx(c).Errorf("Error opening upload: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	header, err := reader.Read()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to read header"})
+		return
+	}
+	index := map[string]int{}
+	var ignored []string
+	for i, h := range header {
+		name := strings.ToLower(strings.TrimSpace(h))
+		if _, ok := d.column(name); ok {
+			index[name] = i
+		} else {
+			ignored = append(ignored, h)
+		}
+	}
+	patterns := make([]*regexp.Regexp, len(d.Columns))
+	for i, col := range d.Columns {
+		if _, ok := index[col.Name]; !ok && col.Required {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The file has no %s column", col.Name)})
+			return
+		}
+		patterns[i], _ = col.validate()
+	}
+
+	var inserted, failed, rowsRead int64
+	var insertErr error
+	var rowErrs []datasetRowError
+	fail := func(err error) {
+		failed++
+		if len(rowErrs) < maxDatasetRowErrors {
+			rowErrs = append(rowErrs, datasetRowError{Row: rowsRead, Error: err.Error()})
+		}
+	}
+	now := time.Now().UTC()
+	batch := make([]map[string]interface{}, 0, cfg.Import.BatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := db.WithContext(c.Request.Context()).Table(d.DataTable).Create(&batch).Error; err != nil {
+			return err
+		}
+		inserted += int64(len(batch))
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		rowsRead++
+		if err != nil {
+			fail(err)
+			continue
+		}
+		if blankRecord(record) {
+			continue
+		}
+		row := map[string]interface{}{"created_at": now}
+		var rowErr error
+		for i, col := range d.Columns {
+			s := ""
+			if j, ok := index[col.Name]; ok && j < len(record) {
+				s = record[j]
+			}
+			v, err := col.convert(s, patterns[i])
+			if err != nil {
+				rowErr = err
+				break
+			}
+			row[col.Name] = v
+		}
+		if rowErr != nil {
+			fail(rowErr)
+			continue
+		}
+		batch = append(batch, row)
+		if len(batch) >= cfg.Import.BatchSize {
+			if insertErr = flush(); insertErr != nil {
+				break
+			}
+		}
+	}
+	if insertErr == nil {
+		insertErr = flush()
+	}
+	setRowsAffected(c, inserted)
+	setAuditEvent(c, "dataset.upload", fmt.Sprintf("dataset %s: %d rows inserted, %d failed", d.Name, inserted, failed))
+	if insertErr != nil {
+		logCtx(c).Errorf("Error inserting rows into dataset %s: %v", d.Name, insertErr)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to insert rows", "rows_inserted": inserted})
+		return
+	}
+	logCtx(c).Infof("Imported %d rows into dataset %s (%d failed)", inserted, d.Name, failed)
+	c.JSON(http.StatusOK, gin.H{
+		"rows_read": rowsRead, "rows_inserted": inserted, "rows_failed": failed,
+		"errors": rowErrs, "ignored_columns": ignored,
+	})
+}
+
+// getDatasetRows pages through a dataset's rows. Any column can be sorted
+// by, and filtered on with ?<column>=<value>.
+func getDatasetRows(c *gin.Context) {
+	d, ok := findDataset(c)
+	if !ok {
+		return
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 50
+	}
+	columns := map[string]string{"id": "id", "created_at": "created_at"}
+	for _, col := range d.Columns {
+		columns[col.Name] = col.Name
+	}
+	orderBy, err := parseSort(c, columns, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	query := db.WithContext(c.Request.Context()).Table(d.DataTable)
+	for _, col := range d.Columns {
+		s, ok := c.GetQuery(col.Name)
+		if !ok {
+			continue
+		}
+		col.Required = false
+		v, err := col.convert(s, nil)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid filter: " + err.Error()})
+			return
+		}
+		if v == nil {
+			query = query.Where(clause.Expr{SQL: "? IS NULL", Vars: []interface{}{clause.Column{Name: col.Name}}})
+		} else {
+			query = query.Where(clause.Eq{Column: clause.Column{Name: col.Name}, Value: v})
+		}
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logCtx(c).Errorf("Error counting rows of dataset %s: %v", d.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read dataset rows"})
+		return
+	}
+	rows := []map[string]interface{}{}
+	if err := query.Order(orderBy).Limit(limit).Offset((page - 1) * limit).Find(&rows).Error; err != nil {
+		logCtx(c).Errorf("Error reading rows of dataset %s: %v", d.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read dataset rows"})
+		return
+	}
+	// SQLite and MySQL hand booleans back as numbers.
+	for _, row := range rows {
+		for _, col := range d.Columns {
+			if n, ok := row[col.Name].(int64); ok && col.Type == columnBoolean {
+				row[col.Name] = n != 0
+			}
+		}
+	}
+	setRowsAffected(c, int64(len(rows)))
+	c.JSON(http.StatusOK, gin.H{"data": rows, "page": page, "limit": limit, "total": total})
+}
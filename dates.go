@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dayLayout = "2006-01-02"
+
+// parseDay parses a YYYY-MM-DD date as midnight in the service time zone.
+func parseDay(s string) (time.Time, error) {
+	return time.ParseInLocation(dayLayout, s, cfg.Location())
+}
+
+// parseDayOrTime parses a YYYY-MM-DD date as midnight in loc, or a timestamp:
+// RFC3339, or without an offset to be read in loc. day reports whether s
+// was a date.
+func parseDayOrTime(s string, loc *time.Location) (t time.Time, day bool, err error) {
+	if t, err = time.ParseInLocation(dayLayout, s, loc); err == nil {
+		return t, true, nil
+	}
+	if t, err = time.Parse(time.RFC3339, s); err == nil {
+		return t, false, nil
+	}
+	t, err = time.ParseInLocation("2006-01-02T15:04:05", s, loc)
+	return t, false, err
+}
+
+// Date formats an upload can name in date_format. Without one, dates are
+// read as ISO when they start with the year, MM/DD/YYYY with slashes,
+// DD-MM-YYYY or DD.MM.YYYY otherwise, and as Excel serial dates when they
+// are a plain number.
+const (
+	dateFormatAuto  = "auto"
+	dateFormatISO   = "iso"
+	dateFormatMDY   = "mdy"
+	dateFormatDMY   = "dmy"
+	dateFormatExcel = "excel"
+)
+
+var dateLayouts = map[string][]string{
+	dateFormatISO: {dayLayout, time.RFC3339, "2006-01-02 15:04:05", "2006/1/2"},
+	dateFormatMDY: {"1/2/2006", "1-2-2006"},
+	dateFormatDMY: {"2-1-2006", "2/1/2006", "2.1.2006"},
+}
+
+// excelEpoch is day 0 of Excel's 1900 date system. It is a day early so
+// that, counting Excel's nonexistent 1900-02-29, serials from March 1900 on
+// come out right.
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+func validDateFormat(format string) bool {
+	_, ok := dateLayouts[format]
+	return ok || format == dateFormatAuto || format == dateFormatExcel
+}
+
+// parseDate reads a date in the given format, or guesses it when format is
+// "" or auto. It returns the day as midnight UTC, dropping any time of day.
+func parseDate(s, format string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if format == "" || format == dateFormatAuto {
+		format = guessDateFormat(s)
+	}
+	if format == dateFormatExcel {
+		serial, err := strconv.ParseFloat(s, 64)
+		if err != nil || serial < 1 || serial >= 2958466 {
+			return time.Time{}, fmt.Errorf("invalid Excel serial date %q", s)
+		}
+		return excelEpoch.AddDate(0, 0, int(serial)), nil
+	}
+	for _, layout := range dateLayouts[format] {
+		if t, err := time.Parse(layout, s); err == nil {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q, expected %s", s, dateFormatNames[format])
+}
+
+var dateFormatNames = map[string]string{
+	dateFormatISO: "YYYY-MM-DD",
+	dateFormatMDY: "MM/DD/YYYY",
+	dateFormatDMY: "DD-MM-YYYY",
+}
+
+func guessDateFormat(s string) string {
+	switch {
+	case len(s) >= 5 && (s[4] == '-' || s[4] == '/'):
+		return dateFormatISO
+	case strings.Contains(s, "/"):
+		return dateFormatMDY
+	case strings.ContainsAny(s, "-."):
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return dateFormatExcel
+		}
+		return dateFormatDMY
+	}
+	return dateFormatExcel
+}
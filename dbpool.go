@@ -0,0 +1,48 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func configurePool(sqlDB *sql.DB, conf DBConfig) {
+	sqlDB.SetMaxOpenConns(conf.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(conf.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(conf.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(conf.ConnMaxIdleTime)
+	// Every connection to ":memory:" is a separate empty database.
+	if conf.Driver == driverSQLite && conf.SQLitePath == ":memory:" {
+		sqlDB.SetMaxOpenConns(1)
+		sqlDB.SetMaxIdleConns(1)
+		sqlDB.SetConnMaxLifetime(0)
+		sqlDB.SetConnMaxIdleTime(0)
+	}
+}
+
+func getDBStats(c *gin.Context) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		logCtx(c).Errorf("Error accessing database pool: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read pool statistics"})
+		return
+	}
+	stats := sqlDB.Stats()
+	c.JSON(http.StatusOK, gin.H{
+		"config": gin.H{
+			"max_open_conns":     cfg.DB.MaxOpenConns,
+			"max_idle_conns":     cfg.DB.MaxIdleConns,
+			"conn_max_lifetime":  cfg.DB.ConnMaxLifetime.String(),
+			"conn_max_idle_time": cfg.DB.ConnMaxIdleTime.String(),
+		},
+		"open_connections":     stats.OpenConnections,
+		"in_use":               stats.InUse,
+		"idle":                 stats.Idle,
+		"wait_count":           stats.WaitCount,
+		"wait_duration":        stats.WaitDuration.String(),
+		"max_idle_closed":      stats.MaxIdleClosed,
+		"max_idle_time_closed": stats.MaxIdleTimeClosed,
+		"max_lifetime_closed":  stats.MaxLifetimeClosed,
+	})
+}
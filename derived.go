@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// tenureExpr is the SQL for an employee's full years since DateJoined on
+// day, or today when day is nil, NULL when it is unknown.
+func tenureExpr(tx *gorm.DB, day *time.Time) string {
+	// The day is formatted here, so safe to write inline.
+	var on string
+	if day != nil {
+		on = "'" + day.Format(dayLayout) + "'"
+	}
+	switch tx.Dialector.Name() {
+	case driverPostgres:
+		if on == "" {
+			on = "CURRENT_DATE"
+		} else {
+			on = "DATE " + on
+		}
+		return "CAST(EXTRACT(YEAR FROM AGE(" + on + ", employees.date_joined)) AS INTEGER)"
+	case driverMySQL:
+		if on == "" {
+			on = "CURDATE()"
+		} else {
+			on = "DATE " + on
+		}
+		return "TIMESTAMPDIFF(YEAR, employees.date_joined, " + on + ")"
+	}
+	if on == "" {
+		on = "'now'"
+	}
+	// A year is counted once its anniversary has passed.
+	return "(CAST(strftime('%Y', " + on + ") AS INTEGER) - CAST(strftime('%Y', employees.date_joined) AS INTEGER)" +
+		" - (strftime('%m-%d', " + on + ") < strftime('%m-%d', employees.date_joined)))"
+}
+
+// ageBandExpr is the SQL naming an employee's band of analytics.age_bands,
+// such as "under 25", "25-34" or "65+".
+func ageBandExpr() string {
+	bounds := cfg.Analytics.AgeBands
+	if len(bounds) == 0 {
+		return "'all'"
+	}
+	var b strings.Builder
+	b.WriteString("CASE")
+	// The bounds are integers from the config, so safe to write inline.
+	fmt.Fprintf(&b, " WHEN employees.age < %d THEN 'under %d'", bounds[0], bounds[0])
+	for i := 1; i < len(bounds); i++ {
+		fmt.Fprintf(&b, " WHEN employees.age < %d THEN '%d-%d'", bounds[i], bounds[i-1], bounds[i]-1)
+	}
+	fmt.Fprintf(&b, " ELSE '%d+' END", bounds[len(bounds)-1])
+	return b.String()
+}
+
+// withComputedFields selects employees with the fields worked out in SQL:
+// the names of their department and company, their tenure and their age
+// band. The names are subqueries rather than joins, so the filters on
+// employees stay unambiguous; all of them can be sorted by.
+func withComputedFields(tx *gorm.DB) *gorm.DB {
+	return selectComputedFields(tx, nil)
+}
+
+// withComputedFieldsOn is withComputedFields with tenure counted up to day
+// rather than today, for records as they were then.
+func withComputedFieldsOn(day time.Time) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		return selectComputedFields(tx, &day)
+	}
+}
+
+func selectComputedFields(tx *gorm.DB, day *time.Time) *gorm.DB {
+	return tx.Select("employees.*, " +
+		"(SELECT name FROM departments WHERE departments.id = employees.department_id) AS department, " +
+		"(SELECT name FROM companies WHERE companies.id = employees.company_id) AS company, " +
+		tenureExpr(tx, day) + " AS tenure_years, " +
+		ageBandExpr() + " AS age_band")
+}
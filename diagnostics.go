@@ -0,0 +1,139 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/gin-gonic/gin"
+)
+
+// importProgress tracks the rows a running import holds in memory: parsed
+// but not yet inserted, whether in the batch being built or queued for a
+// worker.
+type importProgress struct {
+	jobID         string
+	tenantID      string
+	started       time.Time
+	rowsRead      atomic.Int64
+	rowsInserted  atomic.Int64
+	rowsUpdated   atomic.Int64
+	rowsSkipped   atomic.Int64
+	rowsFailed    atomic.Int64
+	bufferedRows  atomic.Int64
+	bufferedBytes atomic.Int64
+	firstError    atomic.Pointer[string]
+	stats         *jobStats
+}
+
+// activeImports maps job ID to *importProgress.
+var activeImports sync.Map
+
+func trackImport(job ImportJob) *importProgress {
+	p := &importProgress{jobID: job.ID, tenantID: job.TenantID, started: time.Now(), stats: newJobStats()}
+	p.rowsInserted.Store(job.RowsInserted)
+	p.rowsUpdated.Store(job.RowsUpdated)
+	p.rowsSkipped.Store(job.RowsSkipped)
+	p.rowsFailed.Store(job.RowsFailed)
+	activeImports.Store(job.ID, p)
+	return p
+}
+
+func untrackImport(jobID string) {
+	activeImports.Delete(jobID)
+}
+
+// employeeSize estimates the memory held by one parsed row. It ignores
+// allocator overhead, so it is a lower bound.
+func employeeSize(e *Employee) int64 {
+	return int64(unsafe.Sizeof(*e)) + int64(len(e.TenantID)+len(e.FirstName)+len(e.LastName)+
+		len(e.Email)+len(e.Gender)+len(e.Department)+len(e.Company)+len(e.Currency))
+}
+
+// fail counts rows that failed and remembers the first error for the job's
+// error summary.
+func (p *importProgress) fail(rows int, format string, args ...interface{}) {
+	p.rowsFailed.Add(int64(rows))
+	msg := fmt.Sprintf(format, args...)
+	p.firstError.CompareAndSwap(nil, &msg)
+}
+
+func (p *importProgress) buffer(e *Employee) {
+	p.bufferedRows.Add(1)
+	p.bufferedBytes.Add(employeeSize(e))
+}
+
+func (p *importProgress) release(batch []Employee) {
+	var size int64
+	for i := range batch {
+		size += employeeSize(&batch[i])
+	}
+	p.bufferedRows.Add(-int64(len(batch)))
+	p.bufferedBytes.Add(-size)
+}
+
+func importDiagnostics() interface{} {
+	var jobs []gin.H
+	activeImports.Range(func(_, v interface{}) bool {
+		p := v.(*importProgress)
+		jobs = append(jobs, gin.H{
+			"job_id":                 p.jobID,
+			"tenant_id":              p.tenantID,
+			"running_for":            time.Since(p.started).Round(time.Second).String(),
+			"rows_read":              p.rowsRead.Load(),
+			"buffered_rows":          p.bufferedRows.Load(),
+			"estimated_buffer_bytes": p.bufferedBytes.Load(),
+		})
+		return true
+	})
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i]["job_id"].(string) < jobs[j]["job_id"].(string) })
+	return jobs
+}
+
+func runtimeDiagnostics() interface{} {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return gin.H{
+		"goroutines":       runtime.NumGoroutine(),
+		"heap_alloc_bytes": m.HeapAlloc,
+		"heap_inuse_bytes": m.HeapInuse,
+		"heap_objects":     m.HeapObjects,
+		"sys_bytes":        m.Sys,
+		"num_gc":           m.NumGC,
+	}
+}
+
+func init() {
+	expvar.Publish("runtime", expvar.Func(runtimeDiagnostics))
+	expvar.Publish("imports", expvar.Func(importDiagnostics))
+}
+
+// debugVars serves the expvar variables (including memstats and cmdline)
+// alongside the runtime and per-import summaries published above.
+func debugVars(c *gin.Context) {
+	expvar.Handler().ServeHTTP(c.Writer, c.Request)
+}
+
+// debugPprof dispatches /debug/pprof/*name to net/http/pprof. Index serves
+// both the listing and the named runtime profiles (heap, goroutine, ...).
+func debugPprof(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("name"), "/") {
+	case "cmdline":
+		pprof.Cmdline(c.Writer, c.Request)
+	case "profile":
+		pprof.Profile(c.Writer, c.Request)
+	case "symbol":
+		pprof.Symbol(c.Writer, c.Request)
+	case "trace":
+		pprof.Trace(c.Writer, c.Request)
+	default:
+		pprof.Index(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// import.on_duplicate_email policies.
+const (
+	duplicateSkip   = "skip"
+	duplicateUpdate = "update"
+	duplicateError  = "error"
+)
+
+// employeeUpsertColumns are the columns an imported row overwrites when it
+// updates the record with its email.
+var employeeUpsertColumns = []string{
+	"first_name", "last_name", "age", "gender", "department_id", "company_id",
+	"salary", "currency", "date_joined", "is_active", "extra", "updated_at", "import_job_id",
+}
+
+// batchOutcome counts what became of the rows of one batch. Rows that were
+// neither inserted, updated nor skipped failed.
+type batchOutcome struct {
+	inserted, updated, skipped, failed int
+	// duplicate is an email that failed a row under the error policy, for
+	// the job's error summary.
+	duplicate string
+	// rolledBack is set when the batch's transaction failed, so none of
+	// its rows were written and a retry must send them again.
+	rolledBack bool
+}
+
+// insertEmployees inserts a batch of one tenant's rows, handling rows whose
+// email the tenant already has, or that repeat an earlier row of the
+// batch, by policy. A row whose email is taken by a concurrent batch
+// between the lookup and the insert is skipped, or failed under error;
+// under update it still updates but counts as inserted. When employees is
+// partitioned, conflicts are only caught within a partition, so this
+// lookup is all that keeps emails unique across partitions.
+func insertEmployees(tx *gorm.DB, tenantID string, batch []Employee, policy string) (batchOutcome, error) {
+	if err := resolveReferences(tx, tenantID, batch); err != nil {
+		return batchOutcome{}, err
+	}
+	var out batchOutcome
+	rows := make([]Employee, 0, len(batch))
+	index := make(map[string]int, len(batch))
+	for _, e := range batch {
+		i, ok := index[e.Email]
+		if !ok {
+			index[e.Email] = len(rows)
+			rows = append(rows, e)
+			continue
+		}
+		// The later row wins, as it would had it come in a later batch.
+		switch policy {
+		case duplicateUpdate:
+			rows[i] = e
+			out.updated++
+		case duplicateError:
+			out.failed++
+			out.duplicate = e.Email
+		default:
+			out.skipped++
+		}
+	}
+
+	emails := make([]string, len(rows))
+	for i, e := range rows {
+		emails[i] = e.Email
+	}
+	scheme, partitioned := partitionSchemes[employeePartitioning]
+	columns := []string{"email"}
+	conflict := clause.OnConflict{
+		Columns:   []clause.Column{{Name: "tenant_id"}, {Name: "email"}},
+		DoNothing: true,
+	}
+	if partitioned {
+		if err := ensureEmployeePartitions(tx.Statement.Context, rows); err != nil {
+			return batchOutcome{}, err
+		}
+		columns = append(columns, scheme.column)
+		conflict.Columns = append(conflict.Columns, clause.Column{Name: scheme.column})
+	}
+	var found []Employee
+	if err := tx.Model(&Employee{}).Select(columns).Where("tenant_id = ? AND email IN ?", tenantID, emails).Find(&found).Error; err != nil {
+		return batchOutcome{}, err
+	}
+	existing := make([]string, len(found))
+	for i, e := range found {
+		existing[i] = e.Email
+	}
+
+	if policy == duplicateUpdate {
+		if partitioned {
+			if err := movePartitionKeys(tx, scheme, tenantID, rows, found); err != nil {
+				return batchOutcome{}, err
+			}
+		}
+		conflict.DoNothing = false
+		conflict.DoUpdates = clause.AssignmentColumns(employeeUpsertColumns)
+		if _, err := bulkInsert(tx.Clauses(conflict), &rows); err != nil {
+			return batchOutcome{}, err
+		}
+		out.inserted = len(rows) - len(existing)
+		out.updated += len(existing)
+		return out, nil
+	}
+
+	taken := make(map[string]bool, len(existing))
+	for _, email := range existing {
+		taken[email] = true
+	}
+	fresh := rows[:0]
+	for _, e := range rows {
+		if !taken[e.Email] {
+			fresh = append(fresh, e)
+		} else if policy == duplicateError {
+			out.failed++
+			out.duplicate = e.Email
+		} else {
+			out.skipped++
+		}
+	}
+	if len(fresh) == 0 {
+		return out, nil
+	}
+	inserted, err := bulkInsert(tx.Clauses(conflict), &fresh)
+	if err != nil {
+		return batchOutcome{}, err
+	}
+	out.inserted = int(inserted)
+	if lost := len(fresh) - out.inserted; policy == duplicateError {
+		out.failed += lost
+	} else {
+		out.skipped += lost
+	}
+	return out, nil
+}
+
+// movePartitionKeys sets the partition key of each existing row that an
+// update changes first, which moves it to its new partition: conflicts are
+// only found within a partition, so the upsert would otherwise add a second
+// row with the email.
+func movePartitionKeys(tx *gorm.DB, scheme partitionScheme, tenantID string, rows, found []Employee) error {
+	current := make(map[string]*Employee, len(found))
+	for i := range found {
+		current[found[i].Email] = &found[i]
+	}
+	for i := range rows {
+		old, ok := current[rows[i].Email]
+		if !ok || scheme.same(old, &rows[i]) {
+			continue
+		}
+		err := tx.Model(&Employee{}).Where("tenant_id = ? AND email = ?", tenantID, rows[i].Email).
+			UpdateColumn(scheme.column, scheme.value(&rows[i])).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o batchOutcome) String() string {
+	return fmt.Sprintf("%d inserted, %d updated, %d skipped, %d failed", o.inserted, o.updated, o.skipped, o.failed)
+}
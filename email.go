@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	emailNotifyAll      = "all"
+	emailNotifyFailures = "failures"
+)
+
+func emailEnabled() bool {
+	return cfg.Email.SMTPHost != "" && len(cfg.Email.To) > 0
+}
+
+// sendJobEmail mails a job summary to email.to in the background. With
+// email.notify_on set to failures, jobs that completed cleanly are skipped.
+func sendJobEmail(ctx context.Context, event jobEvent) {
+	if !emailEnabled() {
+		return
+	}
+	if cfg.Email.NotifyOn == emailNotifyFailures && event.Status == jobCompleted && event.RowsFailed == 0 {
+		return
+	}
+	conf := cfg.Email
+	msg := jobEmail(conf, event)
+	policy := retryPolicy{attempts: 3, base: 5 * time.Second, max: time.Minute, exponential: true}
+	go func() {
+		addr := net.JoinHostPort(conf.SMTPHost, strconv.Itoa(conf.SMTPPort))
+		var auth smtp.Auth
+		if conf.Username != "" {
+			auth = smtp.PlainAuth("", conf.Username, conf.Password, conf.SMTPHost)
+		}
+		// SendMail upgrades to STARTTLS whenever the server offers it.
+		err := policy.do(ctx, "Sending email for job "+event.JobID, anyError, func() error {
+			return smtp.SendMail(addr, auth, conf.From, conf.To, msg)
+		})
+		if err != nil {
+			logCtx(ctx).Errorf("Giving up on email for job %s: %v", event.JobID, err)
+			return
+		}
+		logCtx(ctx).Infof("Emailed %s summary of job %s to %d recipient(s)", event.Status, event.JobID, len(conf.To))
+	}()
+}
+
+func jobEmail(conf EmailConfig, event jobEvent) []byte {
+	subject := fmt.Sprintf("Import %s %s: %d inserted, %d failed", event.FileName, event.Status, event.RowsInserted, event.RowsFailed)
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", conf.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(conf.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Job:           %s\r\n", event.JobID)
+	fmt.Fprintf(&b, "Tenant:        %s\r\n", event.TenantID)
+	fmt.Fprintf(&b, "File:          %s\r\n", event.FileName)
+	fmt.Fprintf(&b, "Status:        %s\r\n", event.Status)
+	fmt.Fprintf(&b, "Finished:      %s\r\n", event.FinishedAt.In(cfg.Location()).Format(time.RFC1123))
+	fmt.Fprintf(&b, "Rows read:     %d\r\n", event.RowsRead)
+	fmt.Fprintf(&b, "Rows inserted: %d\r\n", event.RowsInserted)
+	fmt.Fprintf(&b, "Rows updated:  %d\r\n", event.RowsUpdated)
+	fmt.Fprintf(&b, "Rows skipped:  %d\r\n", event.RowsSkipped)
+	fmt.Fprintf(&b, "Rows failed:   %d\r\n", event.RowsFailed)
+	if event.Error != "" {
+		fmt.Fprintf(&b, "\r\n%s\r\n", event.Error)
+	}
+	fmt.Fprintf(&b, "\r\nJob details and errors: %s\r\n", event.JobURL)
+	return []byte(b.String())
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	exportPending   = "pending"
+	exportRunning   = "running"
+	exportCompleted = "completed"
+	exportFailed    = "failed"
+)
+
+type ExportJob struct {
+	ID         string `gorm:"primaryKey;size:36" json:"id"`
+	TenantID   string `gorm:"size:64;not null;index" json:"tenant_id"`
+	CreatedBy  string `json:"created_by"`
+	Status     string `gorm:"size:16;index" json:"status"`
+	SortColumn string `json:"sort"`
+	SortDesc   bool   `json:"sort_desc"`
+	// AsOf exports records as they were at that time rather than now.
+	AsOf        *time.Time `json:"as_of,omitempty"`
+	Policy      string     `json:"-"`
+	FilePath    string     `json:"-"`
+	RowCount    int64      `json:"row_count"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
+// employeeExportColumns lists the JSON keys written to export files, in order.
+var employeeExportColumns = []string{
+	"ID", "FirstName", "LastName", "Email", "Age", "Gender",
+	"Department", "Company", "Salary", "Currency", "DateJoined", "IsActive",
+	"CreatedAt", "UpdatedAt", "TenureYears", "AgeBand",
+}
+
+var exportSigningKey []byte
+
+func initExports() {
+	if cfg.Exports.SigningKey != "" {
+		exportSigningKey = []byte(cfg.Exports.SigningKey)
+		return
+	}
+	exportSigningKey = make([]byte, 32)
+	if _, err := rand.Read(exportSigningKey); err != nil {
+		logr.Fatalf("Failed to generate export signing key: %v", err)
+	}
+	logr.Warn("EXPORT_SIGNING_KEY not set; download links will stop working after a restart")
+}
+
+func signDownload(path string, expires int64) string {
+	mac := hmac.New(sha256.New, exportSigningKey)
+	fmt.Fprintf(mac, "%s\n%d", path, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func signedDownloadURL(job ExportJob) (string, time.Time) {
+	expires := time.Now().Add(cfg.Exports.URLTTL).UTC()
+	path := "/exports/download/" + job.ID
+	return fmt.Sprintf("%s?expires=%d&sig=%s", path, expires.Unix(), signDownload(path, expires.Unix())), expires
+}
+
+func createExport(c *gin.Context) {
+	orderBy, err := parseSort(c, employeeSortColumns, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var asOf *time.Time
+	if v := c.Query("as_of"); v != "" {
+		t, err := parseAsOf(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid as_of, expected YYYY-MM-DD or an RFC 3339 timestamp"})
+			return
+		}
+		asOf = &t
+	}
+	policy, _ := json.Marshal(redactionPolicy(c))
+
+	job := ExportJob{
+		ID:         uuid.NewString(),
+		TenantID:   tenantID(c),
+		CreatedBy:  c.GetString(ctxActor),
+		Status:     exportPending,
+		SortColumn: orderBy.Column.Name,
+		SortDesc:   orderBy.Desc,
+		AsOf:       asOf,
+		Policy:     string(policy),
+	}
+	if err := db.Create(&job).Error; err != nil {
+		logCtx(c).Errorf("Error creating export job: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create export"})
+		return
+	}
+
+	setAuditEvent(c, "export.create", "export "+job.ID)
+	go runExport(withRequestID(context.Background(), c), job)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Export started", "export": job})
+}
+
+func runExport(ctx context.Context, job ExportJob) {
+	db.Model(&job).Update("status", exportRunning)
+
+	rows, err := writeExportFile(&job)
+	now := time.Now().UTC()
+	updates := map[string]interface{}{"completed_at": &now, "row_count": rows}
+	if err != nil {
+		logCtx(ctx).Errorf("Export %s failed: %v", job.ID, err)
+		updates["status"] = exportFailed
+		updates["error"] = err.Error()
+	} else {
+		logCtx(ctx).Infof("Export %s completed with %d rows", job.ID, rows)
+		updates["status"] = exportCompleted
+		updates["file_path"] = job.FilePath
+	}
+	if err := db.Model(&ExportJob{}).Where("id = ?", job.ID).Updates(updates).Error; err != nil {
+		logCtx(ctx).Errorf("Error updating export job %s: %v", job.ID, err)
+	}
+}
+
+func writeExportFile(job *ExportJob) (int64, error) {
+	var policy map[string]string
+	if err := json.Unmarshal([]byte(job.Policy), &policy); err != nil {
+		return 0, fmt.Errorf("decoding redaction policy: %w", err)
+	}
+
+	if err := os.MkdirAll(cfg.Exports.Dir, os.ModePerm); err != nil {
+		return 0, fmt.Errorf("creating export directory: %w", err)
+	}
+	job.FilePath = filepath.Join(cfg.Exports.Dir, job.ID+".csv")
+	file, err := os.Create(job.FilePath)
+	if err != nil {
+		return 0, fmt.Errorf("creating export file: %w", err)
+	}
+	defer file.Close()
+
+	var columns []string
+	for _, col := range employeeExportColumns {
+		if policy[normalizeFieldName(col)] != redactDrop {
+			columns = append(columns, col)
+		}
+	}
+	w := csv.NewWriter(file)
+	if err := w.Write(columns); err != nil {
+		return 0, err
+	}
+
+	var rows int64
+	var batch []Employee
+	orderBy := clause.OrderByColumn{Column: clause.Column{Name: job.SortColumn}, Desc: job.SortDesc}
+	source, computed := db, withComputedFields
+	if job.AsOf != nil {
+		source, computed = employeesAsOf(db, *job.AsOf), withComputedFieldsOn(asOfDay(*job.AsOf))
+	}
+	result := source.Where("tenant_id = ?", job.TenantID).Scopes(computed).Order(orderBy).FindInBatches(&batch, 1000, func(tx *gorm.DB, _ int) error {
+		for _, e := range batch {
+			raw, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			var obj map[string]interface{}
+			if err := json.Unmarshal(raw, &obj); err != nil {
+				return err
+			}
+			redactObject(obj, policy)
+
+			record := make([]string, len(columns))
+			for i, col := range columns {
+				if v := obj[col]; v != nil {
+					record[i] = fmt.Sprint(v)
+				}
+			}
+			if err := w.Write(record); err != nil {
+				return err
+			}
+			rows++
+		}
+		return nil
+	})
+	if result.Error != nil {
+		return rows, result.Error
+	}
+	w.Flush()
+	return rows, w.Error()
+}
+
+func getExport(c *gin.Context) {
+	var job ExportJob
+	if err := db.Scopes(tenantScope(c)).First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+
+	response := gin.H{"export": job}
+	if job.Status == exportCompleted {
+		url, expires := signedDownloadURL(job)
+		response["download_url"] = url
+		response["download_expires_at"] = expires
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// downloadExport is deliberately unauthenticated: possession of a valid,
+// unexpired signature is the authorization.
+func downloadExport(c *gin.Context) {
+	expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid download link"})
+		return
+	}
+	expected := signDownload(c.Request.URL.Path, expires)
+	if !hmac.Equal([]byte(expected), []byte(c.Query("sig"))) {
+		logCtx(c).Warnf("Rejected export download with bad signature from %s", c.ClientIP())
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid download link"})
+		return
+	}
+	if time.Now().Unix() > expires {
+		c.JSON(http.StatusGone, gin.H{"error": "Download link has expired"})
+		return
+	}
+
+	var job ExportJob
+	if err := db.First(&job, "id = ? AND status = ?", c.Param("id"), exportCompleted).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Export not found"})
+		return
+	}
+	setRowsAffected(c, job.RowCount)
+	setAuditEvent(c, "export.download", fmt.Sprintf("export %s of tenant %s, created by %s", job.ID, job.TenantID, job.CreatedBy))
+	c.FileAttachment(job.FilePath, "export-"+job.ID+".csv")
+}
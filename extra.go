@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+// employeeColumns is how many leading CSV columns map to Employee fields;
+// the rest are kept as extra attributes.
+const employeeColumns = 11
+
+// extraAttributes are the values of a row's unmapped CSV columns, by header.
+// They are stored as jsonb on Postgres, json on MySQL and JSON text on
+// SQLite.
+type extraAttributes map[string]string
+
+func (extraAttributes) GormDataType() string { return "json" }
+
+func (extraAttributes) GormDBDataType(db *gorm.DB, _ *schema.Field) string {
+	switch db.Dialector.Name() {
+	case driverPostgres:
+		return "jsonb"
+	case driverMySQL:
+		return "json"
+	}
+	return "text"
+}
+
+func (a extraAttributes) Value() (driver.Value, error) {
+	if len(a) == 0 {
+		return nil, nil
+	}
+	b, err := json.Marshal(a)
+	return string(b), err
+}
+
+func (a *extraAttributes) Scan(v interface{}) error {
+	var b []byte
+	switch v := v.(type) {
+	case nil:
+		*a = nil
+		return nil
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	default:
+		return fmt.Errorf("unsupported extra attributes type %T", v)
+	}
+	return json.Unmarshal(b, a)
+}
+
+// extraHeaders names the unmapped columns of a header. A blank or repeated
+// name is replaced by column_N, N counting from 1.
+func extraHeaders(header []string) []string {
+	if len(header) <= employeeColumns {
+		return nil
+	}
+	names := make([]string, 0, len(header)-employeeColumns)
+	seen := map[string]bool{}
+	for i, h := range header[employeeColumns:] {
+		name := strings.TrimSpace(h)
+		if name == "" || seen[name] {
+			name = "column_" + strconv.Itoa(employeeColumns+i+1)
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	return names
+}
+
+// extraValues picks a row's non-blank unmapped values.
+func extraValues(names, record []string) extraAttributes {
+	var extra extraAttributes
+	for i, name := range names {
+		if employeeColumns+i >= len(record) {
+			break
+		}
+		if v := strings.TrimSpace(record[employeeColumns+i]); v != "" {
+			if extra == nil {
+				extra = extraAttributes{}
+			}
+			extra[name] = v
+		}
+	}
+	return extra
+}
+
+// readHeader reads a stored upload's header, for resuming a job past it.
+func readHeader(ctx context.Context, job ImportJob) ([]string, error) {
+	file, err := uploads.OpenAt(ctx, job.StoredPath, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return csv.NewReader(file).Read()
+}
+
+// extraFilterScope reads the ?extra.<name>=<value> filters of /records,
+// each matching records whose extra attribute has exactly that value.
+func extraFilterScope(c *gin.Context) (func(*gorm.DB) *gorm.DB, error) {
+	type filter struct{ name, value string }
+	var filters []filter
+	for key, values := range c.Request.URL.Query() {
+		name, ok := strings.CutPrefix(key, "extra.")
+		if !ok {
+			continue
+		}
+		if name == "" || strings.ContainsAny(name, `"\`) {
+			return nil, fmt.Errorf("Invalid filter %q, expected extra.<column>", key)
+		}
+		filters = append(filters, filter{name, values[0]})
+	}
+	return func(tx *gorm.DB) *gorm.DB {
+		for _, f := range filters {
+			switch tx.Dialector.Name() {
+			case driverPostgres:
+				tx = tx.Where("extra ->> ? = ?", f.name, f.value)
+			case driverMySQL:
+				tx = tx.Where("JSON_UNQUOTE(JSON_EXTRACT(extra, ?)) = ?", `$."`+f.name+`"`, f.value)
+			default:
+				tx = tx.Where("json_extract(extra, ?) = ?", `$."`+f.name+`"`, f.value)
+			}
+		}
+		return tx
+	}, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+const featurePaginationEnvelope = "pagination_envelope"
+
+type featureFlag struct {
+	Default     bool
+	Description string
+}
+
+// featureFlags lists every flag the code checks. A flag resolves to its
+// database override, else the features config section, else its default.
+var featureFlags = map[string]featureFlag{
+	featurePaginationEnvelope: {false, "Wrap /records results in {data, page, limit, total}"},
+}
+
+// FeatureFlag is an override set through the admin API; it applies to every
+// instance sharing the database.
+type FeatureFlag struct {
+	Name      string    `gorm:"primaryKey;size:64" json:"name"`
+	Enabled   bool      `json:"enabled"`
+	UpdatedBy string    `json:"updated_by"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+var featureOverrides = struct {
+	mu    sync.RWMutex
+	flags map[string]bool
+}{flags: map[string]bool{}}
+
+func featureEnabled(name string) bool {
+	featureOverrides.mu.RLock()
+	enabled, ok := featureOverrides.flags[name]
+	featureOverrides.mu.RUnlock()
+	if ok {
+		return enabled
+	}
+	if enabled, ok := cfg.Features[name]; ok {
+		return enabled
+	}
+	return featureFlags[name].Default
+}
+
+func loadFeatureOverrides() error {
+	var rows []FeatureFlag
+	if err := db.Find(&rows).Error; err != nil {
+		return err
+	}
+	flags := make(map[string]bool, len(rows))
+	for _, row := range rows {
+		flags[row.Name] = row.Enabled
+	}
+	featureOverrides.mu.Lock()
+	featureOverrides.flags = flags
+	featureOverrides.mu.Unlock()
+	return nil
+}
+
+// startFeatureRefresher picks up overrides made through other instances.
+func startFeatureRefresher(interval time.Duration) {
+	if err := loadFeatureOverrides(); err != nil {
+		logr.Errorf("Error loading feature flags: %v", err)
+	}
+	go func() {
+		for range time.Tick(interval) {
+			if err := loadFeatureOverrides(); err != nil {
+				logr.Errorf("Error refreshing feature flags: %v", err)
+			}
+		}
+	}()
+}
+
+func listFeatures(c *gin.Context) {
+	featureOverrides.mu.RLock()
+	defer featureOverrides.mu.RUnlock()
+
+	features := make([]gin.H, 0, len(featureFlags))
+	for name, flag := range featureFlags {
+		entry := gin.H{"name": name, "description": flag.Description, "default": flag.Default}
+		enabled := flag.Default
+		if v, ok := cfg.Features[name]; ok {
+			entry["config"] = v
+			enabled = v
+		}
+		if v, ok := featureOverrides.flags[name]; ok {
+			entry["override"] = v
+			enabled = v
+		}
+		entry["enabled"] = enabled
+		features = append(features, entry)
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i]["name"].(string) < features[j]["name"].(string) })
+	c.JSON(http.StatusOK, gin.H{"features": features})
+}
+
+func setFeature(c *gin.Context) {
+	name := c.Param("name")
+	if _, ok := featureFlags[name]; !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown feature flag"})
+		return
+	}
+	var req struct {
+		Enabled *bool `json:"enabled" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	flag := FeatureFlag{Name: name, Enabled: *req.Enabled, UpdatedBy: c.GetString(ctxActor), UpdatedAt: time.Now().UTC()}
+	err := db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "name"}},
+		DoUpdates: clause.AssignmentColumns([]string{"enabled", "updated_by", "updated_at"}),
+	}).Create(&flag).Error
+	if err != nil {
+		logCtx(c).Errorf("Error saving feature flag %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save feature flag"})
+		return
+	}
+	featureOverrides.mu.Lock()
+	featureOverrides.flags[name] = flag.Enabled
+	featureOverrides.mu.Unlock()
+
+	logCtx(c).Warnf("Feature flag %s set to %t by %s", name, flag.Enabled, flag.UpdatedBy)
+	c.JSON(http.StatusOK, flag)
+}
+
+func clearFeature(c *gin.Context) {
+	name := c.Param("name")
+	if err := db.Delete(&FeatureFlag{}, "name = ?", name).Error; err != nil {
+		logCtx(c).Errorf("Error clearing feature flag %s: %v", name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear feature flag"})
+		return
+	}
+	featureOverrides.mu.Lock()
+	delete(featureOverrides.flags, name)
+	featureOverrides.mu.Unlock()
+
+	logCtx(c).Warnf("Feature flag %s override cleared by %s", name, c.GetString(ctxActor))
+	c.JSON(http.StatusOK, gin.H{"message": "Override cleared", "enabled": featureEnabled(name)})
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// forgottenMark replaces a forgotten email in text that is kept, such as
+// log messages.
+const forgottenMark = "[forgotten]"
+
+// deletionCertificate attests what POST /records/forget erased. It names
+// the person only by the SHA-256 of their email, lowercased, so it can be
+// kept and matched against a request without holding their data. Deleted
+// counts the rows removed and Redacted those the email was cut out of, by
+// store; Retained lists what may still hold it and couldn't be erased.
+type deletionCertificate struct {
+	ID          string           `json:"id"`
+	TenantID    string           `json:"tenant_id"`
+	SubjectHash string           `json:"subject_sha256"`
+	RecordIDs   []uint           `json:"record_ids"`
+	Deleted     map[string]int64 `json:"deleted"`
+	Redacted    map[string]int64 `json:"redacted"`
+	Retained    []string         `json:"retained,omitempty"`
+	IssuedBy    string           `json:"issued_by"`
+	IssuedAt    time.Time        `json:"issued_at"`
+	Algorithm   string           `json:"algorithm"`
+	Signature   string           `json:"signature,omitempty"`
+}
+
+// sign returns the HMAC-SHA256 under records.certificate_key of the
+// certificate's JSON without its signature.
+func (cert deletionCertificate) sign() (string, error) {
+	cert.Signature = ""
+	body, err := json.Marshal(cert)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, []byte(cfg.Records.CertificateKey))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// forgetRecords hard-deletes every trace of a person, by the body's
+// "email", from the tenant's data: the records that have or had it, with
+// their versions and outliers, the audit entries on them or mentioning it,
+// and rows of datasets and of kept import and export files holding it. Log
+// entries of the tenant's import jobs and import errors keep their other
+// text, with the email cut out; the logs table has no tenant, so entries
+// not tied to one of its jobs are left, and listed as retained.
+// Unlike anonymizing, nothing of the records is left to count. The response
+// is a deletion certificate signed with records.certificate_key.
+func forgetRecords(c *gin.Context) {
+	var req struct {
+		Email string `json:"email" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+	if !validEmail(email) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "email must be a valid email address"})
+		return
+	}
+	if cfg.Records.CertificateKey == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "records.certificate_key is not set, so no deletion certificate can be issued"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	tenant := tenantID(c)
+	subject := sha256.Sum256([]byte(email))
+	cert := deletionCertificate{
+		ID:          uuid.NewString(),
+		TenantID:    tenant,
+		SubjectHash: hex.EncodeToString(subject[:]),
+		RecordIDs:   []uint{},
+		Deleted:     map[string]int64{},
+		Redacted:    map[string]int64{},
+		IssuedBy:    c.GetString(ctxActor),
+		Algorithm:   "HMAC-SHA256",
+	}
+	emails := []string{email}
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var err error
+		cert.RecordIDs, emails, err = forgetFromDatabase(tx, tenant, email, cert.Deleted, cert.Redacted)
+		return err
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error forgetting records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to forget records; nothing was deleted"})
+		return
+	}
+
+	// Files can't take part in the transaction, so are rewritten once it
+	// has committed; those that fail are listed as retained.
+	cert.Retained = append(cert.Retained, forgetFromUploads(c, tenant, emails, cert.Deleted)...)
+	cert.Retained = append(cert.Retained, forgetFromExports(c, tenant, emails, cert.RecordIDs, cert.Deleted)...)
+	cert.Retained = append(cert.Retained, "log entries not tied to one of the tenant's import jobs are not rewritten; they age out under log.retention")
+	if cfg.Log.File != "" {
+		cert.Retained = append(cert.Retained, "log files are not rewritten; they age out under log.max_age_days")
+	}
+	if logShip != nil {
+		for _, sink := range logShip.sinks {
+			cert.Retained = append(cert.Retained, "log entries already shipped to "+sink.name)
+		}
+	}
+
+	cert.IssuedAt = time.Now().UTC()
+	if cert.Signature, err = cert.sign(); err != nil {
+		logCtx(c).Errorf("Error signing deletion certificate %s: %v", cert.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Records forgotten, but failed to sign the certificate"})
+		return
+	}
+	setRowsAffected(c, int64(len(cert.RecordIDs)))
+	setAuditEvent(c, "record.forget", fmt.Sprintf("certificate %s, %d records", cert.ID, len(cert.RecordIDs)))
+	logCtx(c).Infof("Forgot %d records of tenant %s (certificate %s)", len(cert.RecordIDs), tenant, cert.ID)
+	c.JSON(http.StatusOK, cert)
+}
+
+// forgetFromDatabase deletes the records of tenant that have or had email,
+// and what refers to them, counting the rows into deleted and redacted by
+// table. It returns the records' IDs, and every email they had.
+func forgetFromDatabase(tx *gorm.DB, tenant, email string, deleted, redacted map[string]int64) ([]uint, []string, error) {
+	var ids []uint
+	err := tx.Unscoped().Model(&Employee{}).
+		Where("tenant_id = ? AND (email = ? OR id IN (SELECT employee_id FROM employee_versions WHERE tenant_id = ? AND email = ?))",
+			tenant, email, tenant, email).
+		Pluck("id", &ids).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	emails := []string{email}
+	if len(ids) > 0 {
+		var past []string
+		err := tx.Model(&EmployeeVersion{}).Distinct("email").
+			Where("tenant_id = ? AND employee_id IN ? AND email IS NOT NULL AND email <> '' AND email <> ?", tenant, ids, email).
+			Pluck("email", &past).Error
+		if err != nil {
+			return nil, nil, err
+		}
+		emails = append(emails, past...)
+	} else {
+		ids = []uint{}
+	}
+
+	count := func(table string, res *gorm.DB) error {
+		deleted[table] += res.RowsAffected
+		return res.Error
+	}
+	if err := count("employees", tx.Unscoped().Where("tenant_id = ? AND id IN ?", tenant, ids).Delete(&Employee{})); err != nil {
+		return nil, nil, err
+	}
+	// After the records, as deleting them versions them once more.
+	err = count("employee_versions", tx.Where("tenant_id = ? AND (employee_id IN ? OR email IN ?)", tenant, ids, emails).
+		Delete(&EmployeeVersion{}))
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := count("outliers", tx.Where("tenant_id = ? AND employee_id IN ?", tenant, ids).Delete(&Outlier{})); err != nil {
+		return nil, nil, err
+	}
+	audit := tx.Where("tenant_id = ?", tenant)
+	mentions := tx.Where("record_id IN ?", ids)
+	for _, e := range emails {
+		like := "%" + likeEscaper.Replace(e) + "%"
+		mentions = mentions.Or("params LIKE ? ESCAPE '!' OR detail LIKE ? ESCAPE '!'", like, like)
+	}
+	if err := count("api_audit", audit.Where(mentions).Delete(&AuditEntry{})); err != nil {
+		return nil, nil, err
+	}
+
+	var datasets []Dataset
+	if err := tx.Where("tenant_id = ?", tenant).Find(&datasets).Error; err != nil {
+		return nil, nil, err
+	}
+	for _, d := range datasets {
+		for _, col := range d.Columns {
+			if col.Type != columnEmail {
+				continue
+			}
+			// Column names are checked against datasetNamePattern.
+			if err := count("datasets", tx.Table(d.DataTable).Where(col.Name+" IN ?", emails).Delete(d.model())); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	// Logs and import errors are kept for what else they say. Log entries
+	// carry no tenant, so only those of the tenant's import jobs are its own.
+	jobs := tx.Model(&ImportJob{}).Select("id").Where("tenant_id = ?", tenant)
+	for _, e := range emails {
+		like := "%" + likeEscaper.Replace(e) + "%"
+		res := tx.Model(&LogEntry{}).
+			Where("job_id IN (?) AND (message LIKE ? ESCAPE '!' OR fields LIKE ? ESCAPE '!')", jobs, like, like).
+			Updates(map[string]interface{}{
+				"message": gorm.Expr("REPLACE(message, ?, ?)", e, forgottenMark),
+				"fields":  gorm.Expr("REPLACE(fields, ?, ?)", e, forgottenMark),
+			})
+		if res.Error != nil {
+			return nil, nil, res.Error
+		}
+		redacted["logs"] += res.RowsAffected
+		res = tx.Model(&ImportJob{}).Where("tenant_id = ? AND error LIKE ? ESCAPE '!'", tenant, like).
+			Update("error", gorm.Expr("REPLACE(error, ?, ?)", e, forgottenMark))
+		if res.Error != nil {
+			return nil, nil, res.Error
+		}
+		redacted["import_jobs"] += res.RowsAffected
+	}
+	return ids, emails, nil
+}
+
+// forgetFromUploads drops the rows holding one of emails from the tenant's
+// kept upload files. Only the files of completed imports are rewritten: a
+// job that may still resume reads its file from a byte offset, which
+// removing rows would move. The others holding the email are returned as
+// retained.
+func forgetFromUploads(c *gin.Context, tenant string, emails []string, deleted map[string]int64) []string {
+	ctx := context.WithoutCancel(c.Request.Context())
+	var jobs []ImportJob
+	if err := db.WithContext(ctx).Where("tenant_id = ? AND stored_path <> ''", tenant).Find(&jobs).Error; err != nil {
+		logCtx(c).Errorf("Error listing uploads to forget from: %v", err)
+		return []string{"uploaded files: failed to list them"}
+	}
+	var retained []string
+	for _, job := range jobs {
+		// Files imported from elsewhere, such as by the import command,
+		// aren't the store's to rewrite.
+		if !strings.HasSuffix(job.StoredPath, job.ID+".csv") {
+			continue
+		}
+		src, err := uploads.Open(ctx, job.StoredPath)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logCtx(c).Errorf("Error opening upload of job %s: %v", job.ID, err)
+			retained = append(retained, "upload of import job "+job.ID+": failed to read it")
+			continue
+		}
+		// The store saves a file where it read it from, so the rewrite is
+		// held in memory until the original is closed.
+		var kept bytes.Buffer
+		removed, err := dropCSVRows(src, &kept, func(row []string) bool { return rowHasEmail(row, emails) })
+		src.Close()
+		if err != nil {
+			logCtx(c).Errorf("Error reading upload of job %s: %v", job.ID, err)
+			retained = append(retained, "upload of import job "+job.ID+": failed to read it")
+			continue
+		}
+		if removed == 0 {
+			continue
+		}
+		if job.Status != jobCompleted {
+			retained = append(retained, fmt.Sprintf("upload of import job %s: %d rows, kept while the job is %s", job.ID, removed, job.Status))
+			continue
+		}
+		if _, err := uploads.Save(ctx, job.ID+".csv", &kept); err != nil {
+			logCtx(c).Errorf("Error rewriting upload of job %s: %v", job.ID, err)
+			retained = append(retained, fmt.Sprintf("upload of import job %s: %d rows, failed to rewrite it", job.ID, removed))
+			continue
+		}
+		deleted["uploads"] += removed
+	}
+	return retained
+}
+
+// forgetFromExports drops the rows of the records of ids, or holding one
+// of emails, from the tenant's export files.
+func forgetFromExports(c *gin.Context, tenant string, emails []string, ids []uint, deleted map[string]int64) []string {
+	ctx := context.WithoutCancel(c.Request.Context())
+	var jobs []ExportJob
+	if err := db.WithContext(ctx).Where("tenant_id = ? AND status = ? AND file_path <> ''", tenant, jobCompleted).Find(&jobs).Error; err != nil {
+		logCtx(c).Errorf("Error listing exports to forget from: %v", err)
+		return []string{"export files: failed to list them"}
+	}
+	recordIDs := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		recordIDs[strconv.FormatUint(uint64(id), 10)] = true
+	}
+	var retained []string
+	for _, job := range jobs {
+		removed, err := rewriteExportFile(job.FilePath, func(header, row []string) bool {
+			for i, name := range header {
+				if name == "ID" && i < len(row) && recordIDs[row[i]] {
+					return true
+				}
+			}
+			return rowHasEmail(row, emails)
+		})
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			logCtx(c).Errorf("Error rewriting export %s: %v", job.ID, err)
+			retained = append(retained, "export "+job.ID+": failed to rewrite it")
+			continue
+		}
+		if removed == 0 {
+			continue
+		}
+		deleted["exports"] += removed
+		err = db.WithContext(ctx).Model(&job).UpdateColumn("row_count", gorm.Expr("row_count - ?", removed)).Error
+		if err != nil {
+			logCtx(c).Warnf("Error updating row count of export %s: %v", job.ID, err)
+		}
+	}
+	return retained
+}
+
+// rewriteExportFile drops the rows drop selects from an export file,
+// replacing it whole once the rest is written.
+func rewriteExportFile(path string, drop func(header, row []string) bool) (int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(cfg.Exports.Dir, ".forget-*.csv")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	var header []string
+	removed, err := dropCSVRows(src, tmp, func(row []string) bool {
+		if header == nil {
+			header = row
+			return false
+		}
+		return drop(header, row)
+	})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil || removed == 0 {
+		return 0, err
+	}
+	return removed, os.Rename(tmp.Name(), path)
+}
+
+// dropCSVRows copies the CSV rows of r that drop doesn't select to w, and
+// returns how many it dropped.
+func dropCSVRows(r io.Reader, w io.Writer, drop func(row []string) bool) (int64, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	writer := csv.NewWriter(w)
+	var removed int64
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if drop(row) {
+			removed++
+			continue
+		}
+		if err := writer.Write(row); err != nil {
+			return 0, err
+		}
+	}
+	writer.Flush()
+	return removed, writer.Error()
+}
+
+// rowHasEmail reports whether any field of row is one of emails.
+func rowHasEmail(row, emails []string) bool {
+	for _, field := range row {
+		field = strings.TrimSpace(field)
+		for _, e := range emails {
+			if strings.EqualFold(field, e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifyDeletionCertificate checks that the certificate in the body was
+// issued under records.certificate_key and hasn't been altered.
+func verifyDeletionCertificate(c *gin.Context) {
+	var cert deletionCertificate
+	if err := c.ShouldBindJSON(&cert); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if cfg.Records.CertificateKey == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "records.certificate_key is not set"})
+		return
+	}
+	want, err := cert.sign()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": cert.ID, "valid": hmac.Equal([]byte(want), []byte(cert.Signature))})
+}
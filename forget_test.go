@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func forgetTestCSV(emails ...string) string {
+	data := "id,first_name,last_name,email,age,gender,department,company,salary,date_joined,is_active\n"
+	for _, email := range emails {
+		data += ",Test,Person," + email + ",40,F,Engineering,Acme,5000,2019-01-01,true\n"
+	}
+	return data
+}
+
+func TestForgetStaysInTenant(t *testing.T) {
+	tenantA, keyA := newTestTenant(t)
+	tenantB, keyB := newTestTenant(t)
+	email := "shared@" + tenantA + ".example.com"
+	createTestRecord(t, keyA, email)
+	idB := createTestRecord(t, keyB, email)
+	jobA := uploadTestCSV(t, keyA, forgetTestCSV("a-only@"+tenantA+".example.com"))
+	jobB := uploadTestCSV(t, keyB, forgetTestCSV("b-only@"+tenantB+".example.com"))
+	logs := []LogEntry{
+		{Time: time.Now(), Level: "info", Message: "row of " + email, JobID: jobA.ID},
+		{Time: time.Now(), Level: "info", Message: "row of " + email, JobID: jobB.ID},
+		{Time: time.Now(), Level: "info", Message: "request for " + email},
+	}
+	if err := db.Create(&logs).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	var cert deletionCertificate
+	w := testCall(t, http.MethodPost, "/records/forget", bearer(keyA), gin.H{"email": email})
+	decodeResponse(t, w, http.StatusOK, &cert)
+	if cert.TenantID != tenantA || len(cert.RecordIDs) != 1 || cert.RecordIDs[0] == idB {
+		t.Errorf("certificate = %+v, want tenant A's one record", cert)
+	}
+
+	var count int64
+	db.Model(&Employee{}).Where("tenant_id = ? AND email = ?", tenantA, email).Count(&count)
+	if count != 0 {
+		t.Error("tenant A's record survived")
+	}
+	db.Model(&Employee{}).Where("id = ? AND email = ?", idB, email).Count(&count)
+	if count != 1 {
+		t.Error("tenant B's record with the same email was erased")
+	}
+	for i, want := range []string{"row of " + forgottenMark, "row of " + email, "request for " + email} {
+		var entry LogEntry
+		if err := db.First(&entry, logs[i].ID).Error; err != nil {
+			t.Fatal(err)
+		}
+		if entry.Message != want {
+			t.Errorf("log entry %d = %q, want %q", i, entry.Message, want)
+		}
+	}
+}
+
+func TestForgetCertificateAndFiles(t *testing.T) {
+	tenant, key := newTestTenant(t)
+	email, keep := "forget@"+tenant+".example.com", "keep@"+tenant+".example.com"
+	job := uploadTestCSV(t, key, forgetTestCSV(email, keep))
+	if job.Status != jobCompleted || job.RowsInserted != 2 {
+		t.Fatalf("import = %+v, want 2 rows inserted", job)
+	}
+	var created struct {
+		Export ExportJob `json:"export"`
+	}
+	decodeResponse(t, testCall(t, http.MethodPost, "/exports", bearer(key), nil), http.StatusAccepted, &created)
+	if export, _ := waitForExport(t, key, created.Export.ID); export.RowCount != 2 {
+		t.Fatalf("export = %+v, want 2 rows", export)
+	}
+
+	var cert deletionCertificate
+	w := testCall(t, http.MethodPost, "/records/forget", bearer(key), gin.H{"email": strings.ToUpper(email)})
+	decodeResponse(t, w, http.StatusOK, &cert)
+	subject := sha256.Sum256([]byte(email))
+	switch {
+	case cert.TenantID != tenant, cert.SubjectHash != hex.EncodeToString(subject[:]):
+		t.Errorf("certificate names tenant %s and subject %s", cert.TenantID, cert.SubjectHash)
+	case len(cert.RecordIDs) != 1, cert.Deleted["employees"] != 1, cert.Deleted["employee_versions"] < 1:
+		t.Errorf("certificate = %+v, want 1 record with its versions", cert)
+	case cert.Deleted["uploads"] != 1, cert.Deleted["exports"] != 1:
+		t.Errorf("certificate = %+v, want 1 upload and 1 export row", cert)
+	case cert.IssuedBy != "apikey:test", cert.Algorithm != "HMAC-SHA256", cert.Signature == "":
+		t.Errorf("certificate = %+v, want signed by HMAC-SHA256 and issued by the key", cert)
+	}
+
+	var verified struct {
+		Valid bool `json:"valid"`
+	}
+	decodeResponse(t, testCall(t, http.MethodPost, "/records/forget/verify", bearer(key), cert), http.StatusOK, &verified)
+	if !verified.Valid {
+		t.Error("certificate as issued failed verification")
+	}
+	cert.Deleted["employees"] = 0
+	decodeResponse(t, testCall(t, http.MethodPost, "/records/forget/verify", bearer(key), cert), http.StatusOK, &verified)
+	if verified.Valid {
+		t.Error("altered certificate passed verification")
+	}
+
+	if err := db.First(&job, "id = ?", job.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	src, err := uploads.Open(context.Background(), job.StoredPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload, err := io.ReadAll(src)
+	src.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(upload), email) || !strings.Contains(string(upload), keep) {
+		t.Errorf("upload after forgetting:\n%s", upload)
+	}
+
+	var export ExportJob
+	if err := db.First(&export, "id = ?", created.Export.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(export.FilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); export.RowCount != 1 || lines != 2 {
+		t.Errorf("export has %d lines and row_count %d after forgetting, want a header and 1 row:\n%s", lines, export.RowCount, data)
+	}
+}
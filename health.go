@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	migrationsApplied atomic.Bool
+	shuttingDown      atomic.Bool
+)
+
+// unauditedPaths are polled by infrastructure and would flood the audit table.
+var unauditedPaths = map[string]bool{
+	"/healthz": true,
+	"/livez":   true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// livez only proves the HTTP stack is serving; it must not depend on the
+// database, or a DB outage would make Kubernetes restart healthy pods.
+func livez(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "alive"})
+}
+
+func readyz(c *gin.Context) {
+	checks := gin.H{}
+	ready := true
+
+	if shuttingDown.Load() {
+		checks["shutdown"] = "in progress"
+		ready = false
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), 2*time.Second)
+	defer cancel()
+	if db == nil {
+		checks["database"] = "not connected"
+		ready = false
+	} else if sqlDB, err := db.DB(); err != nil {
+		checks["database"] = err.Error()
+		ready = false
+	} else if err := sqlDB.PingContext(ctx); err != nil {
+		checks["database"] = "unreachable: " + err.Error()
+		ready = false
+	} else {
+		checks["database"] = "ok"
+	}
+
+	// A lost replica breaks reads but not writes; it is reported without
+	// failing readiness so every pod isn't pulled out at once.
+	for i, replica := range replicaDBs {
+		key := fmt.Sprintf("replica_%d", i)
+		if err := replica.PingContext(ctx); err != nil {
+			checks[key] = "unreachable: " + err.Error()
+		} else {
+			checks[key] = "ok"
+		}
+	}
+
+	if migrationsApplied.Load() {
+		checks["migrations"] = "ok"
+	} else {
+		checks["migrations"] = "pending"
+		ready = false
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+}
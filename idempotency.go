@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	maxIdempotencyKeyLen = 255
+)
+
+// uploadIdempotencyHash returns the hash an upload's Idempotency-Key is
+// stored under, or nil when the request has none. Keys are scoped to the
+// tenant, so two tenants may use the same one.
+func uploadIdempotencyHash(c *gin.Context) (*string, error) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if key == "" {
+		return nil, nil
+	}
+	if len(key) > maxIdempotencyKeyLen {
+		return nil, fmt.Errorf("%s must be at most %d characters", idempotencyKeyHeader, maxIdempotencyKeyLen)
+	}
+	sum := sha256.Sum256([]byte(tenantID(c) + "\x00" + key))
+	hash := hex.EncodeToString(sum[:])
+	return &hash, nil
+}
+
+// replayUpload answers a retried upload with the job its Idempotency-Key
+// already created and reports whether it did. A key reused for a different
+// file is rejected rather than silently returning the wrong job.
+func replayUpload(c *gin.Context, hash, fileName string, size int64) bool {
+	var job ImportJob
+	if err := db.WithContext(c.Request.Context()).First(&job, "idempotency_hash = ?", hash).Error; err != nil {
+		return false
+	}
+	if job.OriginalName != fileName || job.Size != size {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{
+			"error":  fmt.Sprintf("%s was already used for %s (%d bytes)", idempotencyKeyHeader, job.OriginalName, job.Size),
+			"job_id": job.ID,
+		})
+		return true
+	}
+	c.Header("Idempotent-Replayed", "true")
+	logCtx(c).Infof("Upload of %s repeats %s of job %s, not starting another import", fileName, idempotencyKeyHeader, job.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "File already uploaded with this " + idempotencyKeyHeader, "job_id": job.ID, "status": job.Status})
+	return true
+}
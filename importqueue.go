@@ -0,0 +1,133 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+)
+
+// errImportsDraining stops queued jobs when the server shuts down; they are
+// left interrupted so they can be retried.
+var errImportsDraining = errors.New("server is shutting down")
+
+type importWaiter struct {
+	priority  int
+	seq       uint64
+	ready     chan struct{}
+	cancelled bool
+}
+
+// waitQueue orders waiting jobs by priority, then arrival.
+type waitQueue []*importWaiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *waitQueue) Push(x interface{}) { *q = append(*q, x.(*importWaiter)) }
+func (q *waitQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
+
+// importLimiter caps how many imports run at once (import.max_concurrent_jobs,
+// 0 for no limit); the rest wait their turn.
+type importLimiter struct {
+	mu       sync.Mutex
+	running  int
+	waiting  waitQueue
+	seq      uint64
+	draining chan struct{}
+	drained  bool
+}
+
+var importSlots = &importLimiter{draining: make(chan struct{})}
+
+func (l *importLimiter) available() bool {
+	limit := cfg.Import.MaxConcurrentJobs
+	return limit == 0 || l.running < limit
+}
+
+// acquire blocks until the job may run. onQueued is called first if it has
+// to wait. The error is ctx's cause or errImportsDraining.
+func (l *importLimiter) acquire(ctx context.Context, priority int, onQueued func()) error {
+	l.mu.Lock()
+	if l.drained {
+		l.mu.Unlock()
+		return errImportsDraining
+	}
+	if l.waiting.Len() == 0 && l.available() {
+		l.running++
+		l.mu.Unlock()
+		return nil
+	}
+	l.seq++
+	w := &importWaiter{priority: priority, seq: l.seq, ready: make(chan struct{})}
+	heap.Push(&l.waiting, w)
+	l.mu.Unlock()
+	onQueued()
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		err = context.Cause(ctx)
+	case <-l.draining:
+		err = errImportsDraining
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	select {
+	case <-w.ready:
+		// Granted while giving up; hand the slot on.
+		l.running--
+		l.grant()
+	default:
+		w.cancelled = true
+	}
+	return err
+}
+
+func (l *importLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running--
+	l.grant()
+}
+
+// wake starts waiting jobs after import.max_concurrent_jobs is raised.
+func (l *importLimiter) wake() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.grant()
+}
+
+func (l *importLimiter) grant() {
+	for l.waiting.Len() > 0 && l.available() {
+		w := heap.Pop(&l.waiting).(*importWaiter)
+		if w.cancelled {
+			continue
+		}
+		l.running++
+		close(w.ready)
+	}
+}
+
+// drain releases every waiting job with errImportsDraining and refuses new
+// ones, so shutdown only waits for imports that are already running.
+func (l *importLimiter) drain() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.drained {
+		l.drained = true
+		close(l.draining)
+	}
+}
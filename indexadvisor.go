@@ -0,0 +1,233 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// minAdvisedTableRows is how many rows a table needs before its sequential
+// scans are reported; scanning smaller ones is cheaper than an index.
+const minAdvisedTableRows = 10000
+
+type slowStatement struct {
+	Query   string  `json:"query"`
+	Calls   int64   `json:"calls"`
+	TotalMs float64 `json:"total_ms"`
+	MeanMs  float64 `json:"mean_ms"`
+	Rows    int64   `json:"rows"`
+}
+
+type indexSuggestion struct {
+	Table  string `json:"table"`
+	Column string `json:"column"`
+	// Statements is how many of the slow statements filter or sort on the
+	// column, taking TotalMs between them.
+	Statements int     `json:"statements"`
+	TotalMs    float64 `json:"total_ms"`
+	SQL        string  `json:"sql"`
+}
+
+type sequentialScans struct {
+	Table      string `json:"table"`
+	SeqScan    int64  `json:"seq_scan"`
+	SeqTupRead int64  `json:"seq_tup_read"`
+	IdxScan    int64  `json:"idx_scan"`
+	LiveRows   int64  `json:"live_rows"`
+}
+
+var (
+	statementTables = regexp.MustCompile(`\b(?:from|join|update|into)\s+"?(\w+)"?`)
+	// statementPredicates finds where a statement's WHERE or ORDER BY
+	// starts; the columns after it are the ones an index could serve.
+	statementPredicates = regexp.MustCompile(`\b(?:where|order by)\b`)
+)
+
+// indexAdvisor reports the statements that take the most database time,
+// from pg_stat_statements, and suggests indexes for the columns they filter
+// or sort on that no index starts with. Suggestions are found by matching
+// column names in the statement text, so are a starting point to check
+// with EXPLAIN rather than a prescription. Takes ?top= (default 20, up to
+// 100) and ?min_mean_ms= (default db.slow_query_threshold).
+func indexAdvisor(c *gin.Context) {
+	if cfg.DB.Driver != driverPostgres {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "The index advisor needs Postgres"})
+		return
+	}
+	top, _ := strconv.Atoi(c.DefaultQuery("top", "20"))
+	if top < 1 || top > 100 {
+		top = 20
+	}
+	minMean := float64(cfg.DB.SlowQueryThreshold.Milliseconds())
+	if v := c.Query("min_mean_ms"); v != "" {
+		var err error
+		if minMean, err = strconv.ParseFloat(v, 64); err != nil || minMean < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid min_mean_ms"})
+			return
+		}
+	}
+	tx := db.WithContext(c.Request.Context())
+
+	var installed int64
+	if err := tx.Raw("SELECT COUNT(*) FROM pg_extension WHERE extname = 'pg_stat_statements'").Scan(&installed).Error; err != nil {
+		logCtx(c).Errorf("Error checking for pg_stat_statements: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read query statistics"})
+		return
+	}
+	if installed == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "pg_stat_statements is not installed; add it to shared_preload_libraries and run CREATE EXTENSION pg_stat_statements"})
+		return
+	}
+
+	statements, err := slowStatements(tx, top, minMean)
+	if err != nil {
+		logCtx(c).Errorf("Error reading pg_stat_statements: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read query statistics"})
+		return
+	}
+	suggestions, err := suggestIndexes(tx, statements)
+	if err != nil {
+		logCtx(c).Errorf("Error reading indexes: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read query statistics"})
+		return
+	}
+	scans := []sequentialScans{}
+	err = tx.Raw(`SELECT relname AS "table", seq_scan, seq_tup_read, COALESCE(idx_scan, 0) AS idx_scan, n_live_tup AS live_rows
+		FROM pg_stat_user_tables WHERE schemaname = current_schema() AND seq_scan > COALESCE(idx_scan, 0) AND n_live_tup >= ?
+		ORDER BY seq_tup_read DESC`, minAdvisedTableRows).Scan(&scans).Error
+	if err != nil {
+		logCtx(c).Errorf("Error reading table statistics: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read query statistics"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"statements":       statements,
+		"suggestions":      suggestions,
+		"sequential_scans": scans,
+	})
+}
+
+// slowStatements reads the top statements of this database by total time,
+// of those taking at least minMean on average. pg_stat_statements names
+// its timings *_exec_time from PostgreSQL 13.
+func slowStatements(tx *gorm.DB, top int, minMean float64) ([]slowStatement, error) {
+	var version int
+	if err := tx.Raw("SELECT current_setting('server_version_num')::int").Scan(&version).Error; err != nil {
+		return nil, err
+	}
+	total, mean := "total_exec_time", "mean_exec_time"
+	if version < 130000 {
+		total, mean = "total_time", "mean_time"
+	}
+	statements := []slowStatement{}
+	err := tx.Raw(`SELECT query, calls, `+total+` AS total_ms, `+mean+` AS mean_ms, rows FROM pg_stat_statements
+		WHERE dbid = (SELECT oid FROM pg_database WHERE datname = current_database()) AND `+mean+` >= ?
+		ORDER BY `+total+` DESC LIMIT ?`, minMean, top).Scan(&statements).Error
+	for i := range statements {
+		statements[i].Query = truncate(statements[i].Query, maxSlowQuerySQL)
+	}
+	return statements, err
+}
+
+// suggestIndexes finds the columns of the tables each statement reads that
+// appear after its WHERE or ORDER BY, and suggests an index on those no
+// index of the table starts with, most costly first.
+func suggestIndexes(tx *gorm.DB, statements []slowStatement) ([]indexSuggestion, error) {
+	var columns []struct{ TableName, ColumnName string }
+	err := tx.Raw("SELECT table_name, column_name FROM information_schema.columns WHERE table_schema = current_schema()").
+		Scan(&columns).Error
+	if err != nil {
+		return nil, err
+	}
+	tableColumns := map[string][]string{}
+	for _, col := range columns {
+		tableColumns[col.TableName] = append(tableColumns[col.TableName], col.ColumnName)
+	}
+	var leading []struct{ TableName, ColumnName string }
+	err = tx.Raw(`SELECT c.relname AS table_name, a.attname AS column_name FROM pg_index i
+		JOIN pg_class c ON c.oid = i.indrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = i.indkey[0]
+		WHERE n.nspname = current_schema()`).Scan(&leading).Error
+	if err != nil {
+		return nil, err
+	}
+	indexed := map[string]bool{}
+	for _, l := range leading {
+		indexed[l.TableName+"."+l.ColumnName] = true
+	}
+
+	found := map[string]*indexSuggestion{}
+	for _, s := range statements {
+		query := strings.ToLower(s.Query)
+		loc := statementPredicates.FindStringIndex(query)
+		if loc == nil {
+			continue
+		}
+		predicates := query[loc[0]:]
+		seen := map[string]bool{}
+		for _, m := range statementTables.FindAllStringSubmatch(query, -1) {
+			table := m[1]
+			for _, column := range tableColumns[table] {
+				key := table + "." + column
+				if indexed[key] || seen[key] || !mentionsColumn(predicates, column) {
+					continue
+				}
+				seen[key] = true
+				sug := found[key]
+				if sug == nil {
+					// Postgres can't build an index on a partitioned table
+					// concurrently.
+					create := "CREATE INDEX CONCURRENTLY "
+					if table == "employees" && employeePartitioning != "" {
+						create = "CREATE INDEX "
+					}
+					sug = &indexSuggestion{
+						Table:  table,
+						Column: column,
+						SQL:    create + "idx_" + table + "_" + column + " ON " + table + " (" + column + ")",
+					}
+					found[key] = sug
+				}
+				sug.Statements++
+				sug.TotalMs += s.TotalMs
+			}
+		}
+	}
+	suggestions := make([]indexSuggestion, 0, len(found))
+	for _, sug := range found {
+		suggestions = append(suggestions, *sug)
+	}
+	sort.Slice(suggestions, func(i, j int) bool {
+		if suggestions[i].TotalMs != suggestions[j].TotalMs {
+			return suggestions[i].TotalMs > suggestions[j].TotalMs
+		}
+		return suggestions[i].Table+"."+suggestions[i].Column < suggestions[j].Table+"."+suggestions[j].Column
+	})
+	return suggestions, nil
+}
+
+// mentionsColumn reports whether column appears in text as a whole word,
+// quoted or not.
+func mentionsColumn(text, column string) bool {
+	for i := 0; ; {
+		j := strings.Index(text[i:], column)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(column)
+		if (start == 0 || !isWordByte(text[start-1])) && (end == len(text) || !isWordByte(text[end])) {
+			return true
+		}
+		i = end
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9'
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	minImportPriority     = 0
+	maxImportPriority     = 9
+	defaultImportPriority = 5
+)
+
+// importBatches tracks the batches one import has handed to the insert pool.
+// slots bounds how many the job may have queued or in flight, so a fast
+// reader can't buffer a whole file in memory.
+type importBatches struct {
+	ctx      context.Context
+	jobID    string
+	tenantID string
+	priority int
+	progress *importProgress
+	slots    chan struct{}
+	wg       sync.WaitGroup
+
+	// Batches commit out of order across workers. pending holds the marks
+	// of unfinished batches in submission order, and checkpoint the totals
+	// up to the last batch that finished with every earlier one.
+	// insertSkipped is the checkpointed rows skipped by workers as
+	// duplicates, on top of those the reader skipped. held is set once a
+	// batch rolls back: the checkpoint stays before it for the rest of the
+	// run, so resuming sends its rows again.
+	mu            sync.Mutex
+	pending       []*batchMark
+	checkpoint    importCounts
+	insertSkipped int64
+	held          bool
+	savedAt       time.Time
+}
+
+// batchMark is where the reader was in the file when a batch was submitted,
+// with the rows it had skipped and the quality it had counted by then, and
+// once done what became of the batch.
+type batchMark struct {
+	row, offset, skipped int64
+	quality              importQuality
+	outcome              batchOutcome
+	done                 bool
+}
+
+func newImportBatches(ctx context.Context, job ImportJob, progress *importProgress) *importBatches {
+	b := &importBatches{
+		ctx:        context.WithoutCancel(ctx),
+		jobID:      job.ID,
+		tenantID:   job.TenantID,
+		priority:   job.Priority,
+		progress:   progress,
+		slots:      make(chan struct{}, cfg.Import.Workers+cfg.Import.QueueSize),
+		checkpoint: checkpointCounts(job),
+		savedAt:    time.Now(),
+	}
+	return b
+}
+
+// submit queues a batch, blocking while the job is at its limit. row and
+// offset are the rows read and the byte offset just past the batch's last
+// row, skipped the rows skipped and quality the rows counted up to there.
+func (b *importBatches) submit(batch []Employee, row, offset, skipped int64, quality importQuality) {
+	b.slots <- struct{}{}
+	b.wg.Add(1)
+	mark := &batchMark{row: row, offset: offset, skipped: skipped, quality: quality}
+	b.mu.Lock()
+	b.pending = append(b.pending, mark)
+	b.mu.Unlock()
+	insertPool.push(&insertTask{batches: b, rows: batch, mark: mark, queued: time.Now()})
+}
+
+// finished records what became of a batch and advances the checkpoint,
+// saving it at most every import.checkpoint_interval.
+func (b *importBatches) finished(mark *batchMark, out batchOutcome) {
+	b.mu.Lock()
+	mark.done, mark.outcome = true, out
+	advanced := false
+	for !b.held && len(b.pending) > 0 && b.pending[0].done {
+		m := b.pending[0]
+		if m.outcome.rolledBack {
+			b.held = true
+			break
+		}
+		b.pending = b.pending[1:]
+		b.insertSkipped += int64(m.outcome.skipped)
+		b.checkpoint.read, b.checkpoint.offset = m.row, m.offset
+		b.checkpoint.skipped = m.skipped + b.insertSkipped
+		b.checkpoint.quality = m.quality
+		b.checkpoint.inserted += int64(m.outcome.inserted)
+		b.checkpoint.updated += int64(m.outcome.updated)
+		advanced = true
+	}
+	if !advanced || time.Since(b.savedAt) < cfg.Import.CheckpointInterval {
+		b.mu.Unlock()
+		return
+	}
+	b.savedAt = time.Now()
+	counts := b.checkpoint.withFailed()
+	b.mu.Unlock()
+	b.saveCheckpoint(counts)
+}
+
+// saveCheckpointNow saves the checkpoint regardless of the interval.
+func (b *importBatches) saveCheckpointNow() {
+	b.mu.Lock()
+	b.savedAt = time.Now()
+	counts := b.checkpoint.withFailed()
+	b.mu.Unlock()
+	b.saveCheckpoint(counts)
+}
+
+// heldCounts returns the checkpoint totals when a batch rolled back. A run
+// that stops early records them in place of the reader's position, which
+// is past the rows the batch failed to write.
+func (b *importBatches) heldCounts() (importCounts, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.checkpoint.withFailed(), b.held
+}
+
+// saveCheckpoint records progress on the running job. Workers save
+// concurrently, so an older checkpoint never replaces a newer one.
+func (b *importBatches) saveCheckpoint(counts importCounts) {
+	err := db.WithContext(b.ctx).Model(&ImportJob{}).
+		Where("id = ? AND status IN ? AND checkpoint_row < ?", b.jobID, []string{jobRunning, jobPaused}, counts.read).
+		Updates(map[string]interface{}{
+			"checkpoint_row":    counts.read,
+			"checkpoint_offset": counts.offset,
+			"rows_inserted":     counts.inserted,
+			"rows_updated":      counts.updated,
+			"rows_skipped":      counts.skipped,
+			"rows_failed":       counts.failed,
+			"quality":           counts.quality,
+			"quality_score":     counts.quality.score(),
+		}).Error
+	if err != nil {
+		logCtx(b.ctx).Warnf("Error saving checkpoint of import job %s at row %d: %v", b.jobID, counts.read, err)
+	}
+}
+
+// wait returns once every submitted batch has been inserted or has failed.
+func (b *importBatches) wait() {
+	b.wg.Wait()
+}
+
+type insertTask struct {
+	batches *importBatches
+	rows    []Employee
+	mark    *batchMark
+	seq     uint64
+	queued  time.Time
+}
+
+// taskQueue orders tasks by job priority, then submission order.
+type taskQueue []*insertTask
+
+func (q taskQueue) Len() int { return len(q) }
+func (q taskQueue) Less(i, j int) bool {
+	if q[i].batches.priority != q[j].batches.priority {
+		return q[i].batches.priority > q[j].batches.priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q taskQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *taskQueue) Push(x interface{}) { *q = append(*q, x.(*insertTask)) }
+func (q *taskQueue) Pop() interface{} {
+	old := *q
+	t := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return t
+}
+
+// batchPool is the set of insert workers shared by all imports. Workers take
+// batches of higher-priority jobs first, so a small urgent file doesn't wait
+// behind a long backfill.
+type batchPool struct {
+	once  sync.Once
+	mu    sync.Mutex
+	ready *sync.Cond
+	queue taskQueue
+	seq   uint64
+	// workers is how many are running and target how many there should be;
+	// surplus workers stop after their current batch.
+	workers, target int
+}
+
+var insertPool = &batchPool{}
+
+func (p *batchPool) start() {
+	p.ready = sync.NewCond(&p.mu)
+	p.mu.Lock()
+	p.scale(cfg.Import.Workers)
+	p.mu.Unlock()
+}
+
+// resize changes the number of insert workers, for running imports too.
+func (p *batchPool) resize(n int) {
+	p.once.Do(p.start)
+	p.mu.Lock()
+	p.scale(n)
+	p.mu.Unlock()
+	p.ready.Broadcast()
+}
+
+// scale starts workers up to n, or lets the surplus stop. p.mu must be held.
+func (p *batchPool) scale(n int) {
+	p.target = n
+	for p.workers < n {
+		p.workers++
+		go p.work()
+	}
+}
+
+// size returns the running and target number of workers.
+func (p *batchPool) size() (running, target int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.workers, p.target
+}
+
+func (p *batchPool) push(t *insertTask) {
+	p.once.Do(p.start)
+	p.mu.Lock()
+	p.seq++
+	t.seq = p.seq
+	heap.Push(&p.queue, t)
+	p.mu.Unlock()
+	importQueueDepth.Inc()
+	p.ready.Signal()
+}
+
+func (p *batchPool) work() {
+	for {
+		p.mu.Lock()
+		for p.queue.Len() == 0 && p.workers <= p.target {
+			p.ready.Wait()
+		}
+		if p.workers > p.target {
+			p.workers--
+			p.mu.Unlock()
+			return
+		}
+		t := heap.Pop(&p.queue).(*insertTask)
+		p.mu.Unlock()
+		importQueueDepth.Dec()
+
+		start := time.Now()
+		out := insertBatch(t.batches, t.rows)
+		t.batches.progress.stats.addBatch(start.Sub(t.queued), time.Since(start), out.inserted+out.updated)
+		t.batches.finished(t.mark, out)
+		<-t.batches.slots
+		t.batches.wg.Done()
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckpointHeldAtRolledBackBatch(t *testing.T) {
+	b := newImportBatches(context.Background(), ImportJob{ID: "checkpoint-test"}, nil)
+	marks := []*batchMark{{row: 10, offset: 100}, {row: 20, offset: 200}, {row: 30, offset: 300}}
+	b.pending = append(b.pending, marks...)
+
+	// Out of order, as workers finish them: the middle batch rolls back.
+	b.finished(marks[1], batchOutcome{failed: 10, rolledBack: true})
+	b.finished(marks[2], batchOutcome{inserted: 10})
+	b.finished(marks[0], batchOutcome{inserted: 10})
+
+	counts, held := b.heldCounts()
+	if !held {
+		t.Fatal("checkpoint not held after a batch rolled back")
+	}
+	if counts.read != 10 || counts.offset != 100 || counts.inserted != 10 || counts.failed != 0 {
+		t.Errorf("held counts = %+v, want 10 rows read to byte 100, all inserted", counts)
+	}
+}
+
+func TestCheckpointAdvancesPastFailedRows(t *testing.T) {
+	b := newImportBatches(context.Background(), ImportJob{ID: "checkpoint-test"}, nil)
+	marks := []*batchMark{{row: 10, offset: 100}, {row: 20, offset: 200}}
+	b.pending = append(b.pending, marks...)
+
+	// Rows failed by the duplicate policy were written as intended.
+	b.finished(marks[0], batchOutcome{inserted: 5, failed: 5})
+	b.finished(marks[1], batchOutcome{inserted: 10})
+
+	counts, held := b.heldCounts()
+	if held {
+		t.Fatal("checkpoint held without a rolled back batch")
+	}
+	if counts.read != 20 || counts.inserted != 15 || counts.failed != 5 {
+		t.Errorf("counts = %+v, want 20 rows read, 15 inserted, 5 failed", counts)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ipFilter rejects callers matched by the deny list, or not matched by the
+// allow list when one is configured. The client address comes from
+// c.ClientIP(), which only honours X-Forwarded-For from trusted proxies.
+func ipFilter(conf IPFilterConfig) gin.HandlerFunc {
+	allow, err := parseCIDRs(conf.Allow)
+	if err != nil {
+		logr.Fatalf("Invalid IP allowlist: %v", err)
+	}
+	deny, err := parseCIDRs(conf.Deny)
+	if err != nil {
+		logr.Fatalf("Invalid IP denylist: %v", err)
+	}
+
+	return func(c *gin.Context) {
+		clientIP := c.ClientIP()
+		ip := net.ParseIP(clientIP)
+		if ip == nil {
+			logCtx(c).Warnf("Rejected request to %s from unparseable client address %q", c.Request.URL.Path, clientIP)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+		if containsIP(deny, ip) || (len(allow) > 0 && !containsIP(allow, ip)) {
+			logCtx(c).Warnf("Rejected request to %s from %s by IP filter", c.Request.URL.Path, clientIP)
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	jobEventBuffer   = 64
+	jobEventKeepOpen = 15 * time.Second
+	// progressStep is how far, in percent of the file, a running import
+	// gets between progress events.
+	progressStep = 10
+)
+
+// jobStreamEvent is one entry of the GET /jobs/events stream: import.created,
+// import.queued, import.started, import.progress, import.paused,
+// import.resumed, or import.<final status>.
+type jobStreamEvent struct {
+	Event        string    `json:"event"`
+	JobID        string    `json:"job_id"`
+	TenantID     string    `json:"tenant_id"`
+	FileName     string    `json:"file_name"`
+	Status       string    `json:"status"`
+	Percent      int       `json:"percent,omitempty"`
+	RowsRead     int64     `json:"rows_read"`
+	RowsInserted int64     `json:"rows_inserted"`
+	RowsFailed   int64     `json:"rows_failed"`
+	Error        string    `json:"error,omitempty"`
+	Time         time.Time `json:"time"`
+}
+
+func newJobStreamEvent(job ImportJob, event, status string) jobStreamEvent {
+	return jobStreamEvent{
+		Event:        event,
+		JobID:        job.ID,
+		TenantID:     job.TenantID,
+		FileName:     job.OriginalName,
+		Status:       status,
+		RowsRead:     job.CheckpointRow,
+		RowsInserted: job.RowsInserted,
+		RowsFailed:   job.RowsFailed,
+	}
+}
+
+// jobEventHub fans job events out to the streams open on this instance.
+type jobEventHub struct {
+	mu     sync.Mutex
+	subs   map[chan jobStreamEvent]string // stream → tenant ID
+	closed bool
+}
+
+var jobEvents = &jobEventHub{subs: make(map[chan jobStreamEvent]string)}
+
+// subscribe returns a stream of the tenant's job events, closed on shutdown,
+// and the function that ends it.
+func (h *jobEventHub) subscribe(tenant string) (<-chan jobStreamEvent, func()) {
+	ch := make(chan jobStreamEvent, jobEventBuffer)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	h.subs[ch] = tenant
+	return ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// deliver passes the event to the tenant's streams. A stream that has
+// fallen a full buffer behind misses it rather than holding up imports.
+func (h *jobEventHub) deliver(e jobStreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch, tenant := range h.subs {
+		if tenant != e.TenantID {
+			continue
+		}
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// close ends every stream so server shutdown isn't held up by them.
+func (h *jobEventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publishJobEvent sends the event to the streams on every instance, through
+// Redis when imports are shared there.
+func publishJobEvent(ctx context.Context, e jobStreamEvent) {
+	e.Time = time.Now().UTC()
+	if jobQueue != nil {
+		err := jobQueue.publishEvent(ctx, e)
+		if err == nil {
+			return
+		}
+		logCtx(ctx).Warnf("Error publishing %s of job %s to Redis: %v", e.Event, e.JobID, err)
+	}
+	jobEvents.deliver(e)
+}
+
+// streamJobEvents sends the lifecycle events of the tenant's jobs as
+// server-sent events until the client goes away.
+func streamJobEvents(c *gin.Context) {
+	events, unsubscribe := jobEvents.subscribe(tenantID(c))
+	defer unsubscribe()
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	keepOpen := time.NewTicker(jobEventKeepOpen)
+	defer keepOpen.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return false
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logCtx(c).Errorf("Error encoding job event: %v", err)
+				return true
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Event, data)
+			return err == nil
+		case <-keepOpen.C:
+			// A comment line keeps proxies from closing an idle stream.
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// progressEvents publishes import.progress each time a running import gets
+// another progressStep percent through its file.
+type progressEvents struct {
+	job  ImportJob
+	next int64
+}
+
+func newProgressEvents(job ImportJob) *progressEvents {
+	p := &progressEvents{job: job, next: progressStep}
+	if job.Size > 0 {
+		p.next = (job.CheckpointOffset*100/job.Size/progressStep + 1) * progressStep
+	}
+	return p
+}
+
+func (p *progressEvents) update(ctx context.Context, offset int64, progress *importProgress) {
+	if p.job.Size == 0 {
+		return
+	}
+	percent := offset * 100 / p.job.Size
+	if percent < p.next || percent >= 100 {
+		return
+	}
+	p.next = (percent/progressStep + 1) * progressStep
+	event := newJobStreamEvent(p.job, "import.progress", jobRunning)
+	event.Percent = int(percent)
+	event.RowsRead, event.RowsInserted, event.RowsFailed = progress.rowsRead.Load(), progress.rowsInserted.Load(), progress.rowsFailed.Load()
+	publishJobEvent(ctx, event)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+type jobIDKey struct{}
+
+// ctxJobID holds the job a request acts on, for middleware running after
+// the handler, which may no longer see the handler's request context.
+const ctxJobID = "job_id"
+
+// withJobID tags ctx so every entry logged through logCtx while processing
+// the job carries its job_id.
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey{}, id)
+}
+
+func jobIDFrom(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok {
+		if id := c.GetString(ctxJobID); id != "" {
+			return id
+		}
+		ctx = c.Request.Context()
+	}
+	id, _ := ctx.Value(jobIDKey{}).(string)
+	return id
+}
+
+// tagRequestWithJob tags the rest of a request acting on a job, down to its
+// access log entry, with the job's ID.
+func tagRequestWithJob(c *gin.Context, id string) {
+	c.Set(ctxJobID, id)
+	c.Request = c.Request.WithContext(withJobID(c.Request.Context(), id))
+}
+
+// logJob is logCtx for code handling a job outside its import context, such
+// as the Redis queue.
+func logJob(id string) *logrus.Entry {
+	return logCtx(withJobID(context.Background(), id))
+}
+
+// getJobLogs returns the log entries tagged with the job's ID, oldest first,
+// optionally filtered by level. Only log segments written since the job was
+// created are read.
+func getJobLogs(c *gin.Context) {
+	var job ImportJob
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	level := c.Query("level")
+
+	segments, err := logSegmentsBetween(job.CreatedAt, time.Time{})
+	if err != nil {
+		logCtx(c).Errorf("Error listing log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+
+	logs := []map[string]interface{}{}
+	for _, segment := range segments {
+		f, err := openLogSegment(segment)
+		if err != nil {
+			logCtx(c).Errorf("Error opening log segment %s: %v", segment, err)
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var logEntry map[string]interface{}
+			if json.Unmarshal(scanner.Bytes(), &logEntry) != nil || logEntry["job_id"] != job.ID {
+				continue
+			}
+			if level != "" && logEntry["level"] != level {
+				continue
+			}
+			logs = append(logs, logEntry)
+		}
+		if err := scanner.Err(); err != nil {
+			logCtx(c).Errorf("Error reading log segment %s: %v", segment, err)
+		}
+		f.Close()
+	}
+
+	c.JSON(http.StatusOK, gin.H{"job_id": job.ID, "status": job.Status, "logs": logs})
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	jobPending     = "pending"
+	jobQueued      = "queued"
+	jobRunning     = "running"
+	jobCompleted   = "completed"
+	jobFailed      = "failed"
+	jobInterrupted = "interrupted"
+	jobCancelled   = "cancelled"
+	jobPaused      = "paused"
+)
+
+type ImportJob struct {
+	ID           string `gorm:"primaryKey;size:36" json:"id"`
+	TenantID     string `gorm:"size:64;not null;index" json:"tenant_id"`
+	CreatedBy    string `json:"created_by,omitempty"`
+	OriginalName string `json:"file_name"`
+	StoredPath   string `json:"-"`
+	Size         int64  `json:"size"`
+	// Checksum is the hex SHA-256 of the file as received.
+	Checksum string `gorm:"size:64;index" json:"checksum,omitempty"`
+	Status   string `gorm:"size:16;index;default:'pending'" json:"status"`
+	// IdempotencyHash identifies the upload's Idempotency-Key within its
+	// tenant; it is nil for uploads sent without one.
+	IdempotencyHash *string `gorm:"size:64;uniqueIndex" json:"-"`
+	// CallbackURL receives a signed POST when the job finishes or fails.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Priority orders the job's batches in the shared insert pool, 0 to 9,
+	// higher first.
+	Priority int `gorm:"not null;default:5" json:"priority"`
+	// DateFormat is the upload's date_format hint for reading DateJoined;
+	// empty to guess it per row.
+	DateFormat string `gorm:"size:16" json:"date_format,omitempty"`
+	// CheckpointRow is the number of data rows consumed from the file. Every
+	// row before it has been committed, skipped or failed validation, so
+	// processing can resume from there; a batch whose insert rolled back
+	// holds it before its rows. While a job runs it is saved as batches
+	// commit, so a job orphaned by a crash resumes close to where it stopped.
+	CheckpointRow int64 `json:"rows_read"`
+	// CheckpointOffset is the byte offset in the file just past
+	// CheckpointRow, letting a resumed job seek instead of re-reading the
+	// rows before it. It is 0 for jobs checkpointed before it was recorded.
+	CheckpointOffset int64 `gorm:"not null;default:0" json:"-"`
+	// Every row read ends up inserted, updated, skipped or failed, so the
+	// four add up to rows_read. Updated rows changed the existing record
+	// with their email, under import.on_duplicate_email update. Skipped rows
+	// were left out on purpose, such as rows with every field blank or, by
+	// default, an email already imported.
+	RowsInserted int64      `json:"rows_inserted"`
+	RowsUpdated  int64      `gorm:"not null;default:0" json:"rows_updated"`
+	RowsSkipped  int64      `gorm:"not null;default:0" json:"rows_skipped"`
+	RowsFailed   int64      `json:"rows_failed"`
+	Error        string     `json:"error,omitempty"`
+	CreatedAt    time.Time  `gorm:"index" json:"created_at"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	FinishedAt   *time.Time `json:"finished_at,omitempty"`
+	// QualityScore is the percentage of the rows read, blank ones aside,
+	// without quality warnings; Quality counts the rows with each warning.
+	// Both cover every run of the job, and are updated with its checkpoint.
+	QualityScore *float64      `gorm:"index" json:"quality_score,omitempty"`
+	Quality      importQuality `gorm:"type:text" json:"quality"`
+	// Performance is the throughput and timing breakdown of the latest run,
+	// stored when it finishes. Job lists leave it out.
+	Performance *jobPerformance `gorm:"type:text;serializer:json" json:"performance,omitempty"`
+}
+
+// importCounts are the row totals of a finished or stopped import. offset
+// is the byte offset in the file just past the last row read.
+type importCounts struct {
+	read, inserted, updated, skipped, failed, offset int64
+	quality                                          importQuality
+}
+
+// withFailed sets failed to the rows read that had no other outcome.
+func (c importCounts) withFailed() importCounts {
+	c.failed = c.read - c.inserted - c.updated - c.skipped
+	return c
+}
+
+// checkpointCounts are the totals recorded for the job so far, for a run that
+// stops before reading anything.
+func checkpointCounts(job ImportJob) importCounts {
+	return importCounts{
+		read:     job.CheckpointRow,
+		inserted: job.RowsInserted,
+		updated:  job.RowsUpdated,
+		skipped:  job.RowsSkipped,
+		offset:   job.CheckpointOffset,
+		quality:  job.Quality.clone(),
+	}.withFailed()
+}
+
+var (
+	importsWG sync.WaitGroup
+	// importCtx is cancelled on shutdown to stop import readers.
+	importCtx, stopImports = context.WithCancel(context.Background())
+)
+
+// errImportCancelled is the cancellation cause of a job stopped through the
+// API, as opposed to by shutdown.
+var errImportCancelled = errors.New("cancelled")
+
+type runningImport struct {
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+	gate   pauseGate
+}
+
+// runningImports maps job ID to the *runningImport processing it on this
+// instance.
+var runningImports sync.Map
+
+// registerImport prepares the context a job runs under and registers it as
+// running here until finish is called. The trace of the request that queued
+// it is carried over, as is its request ID for log correlation, but not its
+// cancellation. Its log entries are also tagged with the job ID.
+func registerImport(parent context.Context, job ImportJob) (context.Context, *runningImport) {
+	ctx := trace.ContextWithSpanContext(importCtx, trace.SpanContextFromContext(parent))
+	ctx = withRequestID(ctx, parent)
+	ctx = withJobID(ctx, job.ID)
+	ctx, cancel := context.WithCancelCause(ctx)
+	run := &runningImport{cancel: cancel, done: make(chan struct{})}
+	runningImports.Store(job.ID, run)
+	importsWG.Add(1)
+	return ctx, run
+}
+
+func (run *runningImport) finish(jobID string) {
+	run.cancel(nil)
+	runningImports.Delete(jobID)
+	close(run.done)
+	importsWG.Done()
+}
+
+// startImport runs the job in the background on this instance once an
+// import slot is free.
+func startImport(parent context.Context, job ImportJob) {
+	ctx, run := registerImport(parent, job)
+	go func() {
+		defer run.finish(job.ID)
+		if err := importSlots.acquire(ctx, job.Priority, func() { markJobQueued(ctx, job) }); err != nil {
+			stopQueuedJob(ctx, job, err)
+			return
+		}
+		defer importSlots.release()
+		processCSV(ctx, job)
+	}()
+}
+
+// runImportNow processes a small job in the calling goroutine without
+// waiting for an import slot, so it is never stuck behind large imports.
+func runImportNow(parent context.Context, job ImportJob) {
+	ctx, run := registerImport(parent, job)
+	defer run.finish(job.ID)
+	processCSV(ctx, job)
+}
+
+// smallUpload reports whether an upload of size bytes and lines lines is
+// imported within the request (import.small_file_max_bytes and _rows).
+func smallUpload(size, lines int64) bool {
+	maxBytes, maxRows := cfg.Import.SmallFileMaxBytes, cfg.Import.SmallFileMaxRows
+	return maxBytes > 0 && size <= maxBytes && (maxRows == 0 || lines-1 <= maxRows)
+}
+
+// lineCounter counts the newlines written to it, to size up an upload as it
+// is saved. Quoted fields spanning lines make it an overestimate of rows.
+type lineCounter int64
+
+func (n *lineCounter) Write(p []byte) (int, error) {
+	*n += lineCounter(bytes.Count(p, []byte{'\n'}))
+	return len(p), nil
+}
+
+func markJobQueued(ctx context.Context, job ImportJob) {
+	logCtx(ctx).Infof("Import job %s queued, %d imports already running", job.ID, cfg.Import.MaxConcurrentJobs)
+	err := db.WithContext(ctx).Model(&ImportJob{}).Where("id = ?", job.ID).Update("status", jobQueued).Error
+	if err != nil {
+		logCtx(ctx).Errorf("Error marking import job %s as queued: %v", job.ID, err)
+		return
+	}
+	publishJobEvent(ctx, newJobStreamEvent(job, "import.queued", jobQueued))
+}
+
+// stopQueuedJob records a job that was cancelled or shut down before it got
+// to run, keeping the progress of any earlier attempt.
+func stopQueuedJob(ctx context.Context, job ImportJob, cause error) {
+	counts := checkpointCounts(job)
+	if errors.Is(cause, errImportCancelled) {
+		logCtx(ctx).Warnf("Queued import job %s %v", job.ID, cause)
+		finishImportJob(ctx, job, jobCancelled, counts, cause.Error())
+		return
+	}
+	finishImportJob(ctx, job, jobInterrupted, counts, "interrupted by shutdown before it started")
+}
+
+// drainImports gives running imports up to timeout to finish. After that the
+// readers are stopped; workers still finish the batches they already hold so
+// the recorded checkpoint stays accurate.
+func drainImports(timeout time.Duration) {
+	importSlots.drain()
+	done := make(chan struct{})
+	go func() {
+		importsWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+		logr.Warnf("Imports still running after %s, checkpointing and stopping them", timeout)
+	}
+	stopImports()
+	<-done
+}
+
+func finishImportJob(ctx context.Context, job ImportJob, status string, counts importCounts, errMsg string) {
+	importJobsFinished.WithLabelValues(status).Inc()
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(
+		attribute.String("import.status", status),
+		attribute.Int64("import.rows_read", counts.read),
+		attribute.Int64("import.rows_inserted", counts.inserted),
+		attribute.Int64("import.rows_updated", counts.updated),
+		attribute.Int64("import.rows_skipped", counts.skipped),
+		attribute.Int64("import.rows_failed", counts.failed),
+	)
+	if status == jobFailed {
+		span.SetStatus(codes.Error, errMsg)
+	}
+
+	now := time.Now().UTC()
+	updates := map[string]interface{}{
+		"status":            status,
+		"checkpoint_row":    counts.read,
+		"checkpoint_offset": counts.offset,
+		"rows_inserted":     counts.inserted,
+		"rows_updated":      counts.updated,
+		"rows_skipped":      counts.skipped,
+		"rows_failed":       counts.failed,
+		"quality":           counts.quality,
+		"quality_score":     counts.quality.score(),
+		"error":             errMsg,
+		"finished_at":       &now,
+	}
+	if v, ok := activeImports.Load(job.ID); ok {
+		if perf, err := json.Marshal(v.(*importProgress).stats.summary()); err == nil {
+			updates["performance"] = string(perf)
+		}
+	}
+	ctx = context.WithoutCancel(ctx)
+	err := dbRetryPolicy().do(ctx, "Recording import job result", isConnectionError, func() error {
+		return db.WithContext(ctx).Model(&ImportJob{}).Where("id = ?", job.ID).Updates(updates).Error
+	})
+	if err != nil {
+		logCtx(ctx).Errorf("Error updating import job %s: %v", job.ID, err)
+	}
+	event := newJobStreamEvent(job, "import."+status, status)
+	event.RowsRead, event.RowsInserted, event.RowsFailed, event.Error = counts.read, counts.inserted, counts.failed, errMsg
+	publishJobEvent(ctx, event)
+	notifyJobFinished(ctx, job, status, counts, errMsg, now)
+}
+
+// uploadFileName returns the client-supplied file name after rejecting
+// anything that could be interpreted as a path. The raw Content-Disposition
+// value is checked because multipart already strips directories from Filename.
+func uploadFileName(fh *multipart.FileHeader) (string, error) {
+	name := fh.Filename
+	if _, params, err := mime.ParseMediaType(fh.Header.Get("Content-Disposition")); err == nil {
+		if raw, ok := params["filename"]; ok {
+			name = raw
+		}
+	}
+	name = strings.TrimSpace(name)
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "", fmt.Errorf("invalid file name %q", name)
+	case strings.ContainsAny(name, `/\`):
+		return "", fmt.Errorf("file name %q must not contain path separators", name)
+	case strings.ContainsRune(name, 0):
+		return "", fmt.Errorf("file name must not contain NUL bytes")
+	}
+	return name, nil
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func listJobs(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 50
+	}
+
+	query := db.WithContext(c.Request.Context()).Model(&ImportJob{}).Scopes(tenantScope(c))
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if name := c.Query("file_name"); name != "" {
+		query = query.Where("original_name = ?", name)
+	}
+	if checksum := c.Query("checksum"); checksum != "" {
+		query = query.Where("checksum = ?", strings.ToLower(checksum))
+	}
+	if createdBy := c.Query("created_by"); createdBy != "" {
+		query = query.Where("created_by = ?", createdBy)
+	}
+	if startDate := c.Query("start_date"); startDate != "" {
+		start, err := parseDay(startDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid start_date, expected YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at >= ?", start)
+	}
+	if endDate := c.Query("end_date"); endDate != "" {
+		end, err := parseDay(endDate)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid end_date, expected YYYY-MM-DD"})
+			return
+		}
+		query = query.Where("created_at < ?", end.AddDate(0, 0, 1))
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logCtx(c).Errorf("Error counting import jobs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list jobs"})
+		return
+	}
+
+	var jobs []ImportJob
+	if err := query.Omit("performance").Order("created_at desc").Limit(limit).Offset((page - 1) * limit).Find(&jobs).Error; err != nil {
+		logCtx(c).Errorf("Error listing import jobs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list jobs"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "page": page, "limit": limit, "jobs": jobs})
+}
+
+// getJob returns the job record and, while it runs on this instance, its live
+// progress.
+func getJob(c *gin.Context) {
+	var job ImportJob
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	response := gin.H{"job": job}
+	if v, ok := activeImports.Load(job.ID); ok {
+		p := v.(*importProgress)
+		response["progress"] = gin.H{
+			"rows_read":     p.rowsRead.Load(),
+			"rows_inserted": p.rowsInserted.Load(),
+			"rows_updated":  p.rowsUpdated.Load(),
+			"rows_skipped":  p.rowsSkipped.Load(),
+			"rows_failed":   p.rowsFailed.Load(),
+			"running_for":   time.Since(p.started).Round(time.Second).String(),
+			"performance":   p.stats.summary(),
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// retryJob re-runs a failed, interrupted or cancelled job from its stored file. By
+// default it resumes after the checkpoint; from=start reprocesses the whole
+// file, which is only allowed while nothing has been inserted.
+func retryJob(c *gin.Context) {
+	var job ImportJob
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	tagRequestWithJob(c, job.ID)
+	if job.Status != jobFailed && job.Status != jobInterrupted && job.Status != jobCancelled {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Job is %s, only failed, interrupted or cancelled jobs can be retried", job.Status)})
+		return
+	}
+	switch c.DefaultQuery("from", "checkpoint") {
+	case "checkpoint":
+	case "start":
+		if job.RowsInserted > 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Job already inserted %d rows, retrying from the start would duplicate them", job.RowsInserted)})
+			return
+		}
+		job.CheckpointRow, job.CheckpointOffset = 0, 0
+		job.RowsSkipped, job.RowsFailed = 0, 0
+		job.Quality = importQuality{}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from, must be checkpoint or start"})
+		return
+	}
+
+	// Claiming the job by its status keeps concurrent retries from both
+	// starting it.
+	result := db.WithContext(c.Request.Context()).Model(&ImportJob{}).
+		Where("id = ? AND status = ?", job.ID, job.Status).
+		Updates(map[string]interface{}{
+			"status":            jobPending,
+			"checkpoint_row":    job.CheckpointRow,
+			"checkpoint_offset": job.CheckpointOffset,
+			"rows_skipped":      job.RowsSkipped,
+			"rows_failed":       job.RowsFailed,
+			"quality":           job.Quality,
+			"quality_score":     job.Quality.score(),
+			"error":             "",
+			"finished_at":       nil,
+		})
+	if result.Error != nil {
+		logCtx(c).Errorf("Error requeueing import job %s: %v", job.ID, result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retry job"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is already being retried"})
+		return
+	}
+
+	logCtx(c).Infof("Retrying import job %s from row %d, requested by %s", job.ID, job.CheckpointRow, c.GetString(ctxActor))
+	dispatchImport(c.Request.Context(), job)
+	c.JSON(http.StatusAccepted, gin.H{"message": "Retry started", "job_id": job.ID, "resume_from_row": job.CheckpointRow})
+}
+
+// cancelJob stops a job running on this instance and waits for its workers to
+// drain, so the response carries the rows inserted before cancellation. With
+// the Redis queue, a job still waiting is taken out of the queue and one
+// running elsewhere is cancelled by the instance running it.
+func cancelJob(c *gin.Context) {
+	var job ImportJob
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&job, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	tagRequestWithJob(c, job.ID)
+	actor := c.GetString(ctxActor)
+
+	v, ok := runningImports.Load(job.ID)
+	dequeued := false
+	if !ok && jobQueue != nil && (job.Status == jobRunning || job.Status == jobQueued || job.Status == jobPaused) {
+		if job.Status == jobQueued {
+			removed, err := jobQueue.removeQueued(c.Request.Context(), job.ID)
+			if err != nil {
+				logCtx(c).Errorf("Error removing import job %s from the Redis queue: %v", job.ID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+				return
+			}
+			if !removed {
+				c.JSON(http.StatusConflict, gin.H{"error": "Job was just picked up by an instance, try again"})
+				return
+			}
+			// Out of the queue, it is cancelled below like a job no
+			// instance holds.
+			dequeued = true
+		} else {
+			if err := jobQueue.control(c.Request.Context(), "cancel", job.ID, actor); err != nil {
+				logCtx(c).Errorf("Error requesting cancellation of import job %s: %v", job.ID, err)
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+				return
+			}
+			logCtx(c).Warnf("Cancelling import job %s on another instance, requested by %s", job.ID, actor)
+			c.JSON(http.StatusAccepted, gin.H{"message": "Cancellation requested from the instance running the job", "job_id": job.ID})
+			return
+		}
+	}
+	if !ok {
+		if (job.Status == jobRunning || job.Status == jobQueued || job.Status == jobPaused) && !dequeued {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Job is %s on another instance", job.Status)})
+			return
+		}
+		if job.Status != jobPending && job.Status != jobInterrupted && job.Status != jobFailed && !dequeued {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Job is already %s", job.Status)})
+			return
+		}
+		// Not being processed anywhere; just record the cancellation.
+		now := time.Now().UTC()
+		result := db.WithContext(c.Request.Context()).Model(&ImportJob{}).
+			Where("id = ? AND status = ?", job.ID, job.Status).
+			Updates(map[string]interface{}{"status": jobCancelled, "error": "cancelled by " + actor, "finished_at": &now})
+		if result.Error != nil {
+			logCtx(c).Errorf("Error cancelling import job %s: %v", job.ID, result.Error)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+			return
+		}
+		if result.RowsAffected == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "Job changed state, try again"})
+			return
+		}
+		logCtx(c).Warnf("Import job %s cancelled by %s", job.ID, actor)
+		job.Status, job.Error, job.FinishedAt = jobCancelled, "cancelled by "+actor, &now
+		c.JSON(http.StatusOK, gin.H{"message": "Job cancelled", "job": job})
+		return
+	}
+
+	run := v.(*runningImport)
+	run.cancel(fmt.Errorf("%w by %s", errImportCancelled, actor))
+	logCtx(c).Warnf("Cancelling import job %s, requested by %s", job.ID, actor)
+	select {
+	case <-run.done:
+	case <-c.Request.Context().Done():
+		return
+	case <-time.After(30 * time.Second):
+		c.JSON(http.StatusAccepted, gin.H{"message": "Cancellation requested, workers are still draining", "job_id": job.ID})
+		return
+	}
+
+	if err := db.WithContext(c.Request.Context()).First(&job, "id = ?", job.ID).Error; err != nil {
+		logCtx(c).Errorf("Error reloading import job %s: %v", job.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Job cancelled, but failed to load its final state"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Job cancelled", "job": job})
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	throughputInterval   = 5 * time.Second
+	maxThroughputSamples = 120
+)
+
+// batchLatencyBuckets are the upper bounds, in milliseconds, of the batch
+// insert latency histogram. Slower batches land in a final overflow bucket.
+var batchLatencyBuckets = []int64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// jobStats measures where a running import spends its time. The reader's
+// time is split between reading the file (including CSV decoding), parsing
+// rows and waiting for insert workers to take batches; workers record how
+// long batches queued and took to insert.
+type jobStats struct {
+	mu        sync.Mutex
+	started   time.Time
+	read      time.Duration
+	parse     time.Duration
+	blocked   time.Duration
+	paused    time.Duration
+	queueWait time.Duration
+	insert    time.Duration
+	batches   int64
+	rows      int64
+	maxBatch  time.Duration
+	latency   []int64
+	samples   []throughputSample
+	interval  time.Duration
+}
+
+type throughputSample struct {
+	At             float64 `json:"at_seconds"`
+	ReadPerSec     float64 `json:"read_per_sec"`
+	InsertedPerSec float64 `json:"inserted_per_sec"`
+}
+
+type latencyBucket struct {
+	LE    string `json:"le_ms"`
+	Count int64  `json:"count"`
+}
+
+// jobPerformance is the summary of jobStats shown by the jobs API and stored
+// on the job when it finishes. A retried job reports its latest run.
+type jobPerformance struct {
+	ElapsedSeconds float64 `json:"elapsed_seconds"`
+	RowsPerSec     float64 `json:"rows_per_sec"`
+	// Bottleneck is file, parser or database, whichever the reader spent most
+	// of its time on.
+	Bottleneck     string  `json:"bottleneck"`
+	ReadSeconds    float64 `json:"read_seconds"`
+	ParseSeconds   float64 `json:"parse_seconds"`
+	BlockedSeconds float64 `json:"blocked_on_inserts_seconds"`
+	// PausedSeconds is time spent paused, left out of the rates.
+	PausedSeconds     float64 `json:"paused_seconds"`
+	QueueWaitSeconds  float64 `json:"batch_queue_wait_seconds"`
+	InsertSeconds     float64 `json:"insert_seconds"`
+	WorkerUtilization float64 `json:"worker_utilization"`
+	Batches           int64   `json:"batches"`
+	// BatchLatency counts batches by insert time.
+	BatchLatency       []latencyBucket    `json:"batch_latency"`
+	MeanBatchLatencyMS float64            `json:"mean_batch_latency_ms"`
+	MaxBatchLatencyMS  float64            `json:"max_batch_latency_ms"`
+	Throughput         []throughputSample `json:"throughput"`
+}
+
+func newJobStats() *jobStats {
+	return &jobStats{
+		started:  time.Now(),
+		latency:  make([]int64, len(batchLatencyBuckets)+1),
+		interval: throughputInterval,
+	}
+}
+
+func (s *jobStats) addRead(d time.Duration) {
+	s.mu.Lock()
+	s.read += d
+	s.mu.Unlock()
+}
+
+func (s *jobStats) addParse(d time.Duration) {
+	s.mu.Lock()
+	s.parse += d
+	s.mu.Unlock()
+}
+
+func (s *jobStats) addBlocked(d time.Duration) {
+	s.mu.Lock()
+	s.blocked += d
+	s.mu.Unlock()
+}
+
+func (s *jobStats) addPaused(d time.Duration) {
+	if d == 0 {
+		return
+	}
+	s.mu.Lock()
+	s.paused += d
+	s.mu.Unlock()
+}
+
+// addBatch records one batch handed to a worker; inserted is 0 if it failed.
+func (s *jobStats) addBatch(queued, took time.Duration, inserted int) {
+	ms := took.Milliseconds()
+	i := 0
+	for i < len(batchLatencyBuckets) && ms > batchLatencyBuckets[i] {
+		i++
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queueWait += queued
+	s.insert += took
+	s.batches++
+	s.rows += int64(inserted)
+	s.latency[i]++
+	if took > s.maxBatch {
+		s.maxBatch = took
+	}
+}
+
+// sample records read and insert rates every interval until stop is called.
+// Once maxThroughputSamples are held, neighbouring samples are merged and
+// the interval doubled, so long imports keep a bounded history.
+func (s *jobStats) sample(read, inserted func() int64) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		lastRead, lastInserted, last := read(), inserted(), time.Now()
+		timer := time.NewTimer(throughputInterval)
+		defer timer.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-timer.C:
+				r, n := read(), inserted()
+				secs := now.Sub(last).Seconds()
+				s.mu.Lock()
+				s.samples = append(s.samples, throughputSample{
+					At:             now.Sub(s.started).Seconds(),
+					ReadPerSec:     float64(r-lastRead) / secs,
+					InsertedPerSec: float64(n-lastInserted) / secs,
+				})
+				if len(s.samples) >= maxThroughputSamples {
+					s.downsample()
+				}
+				timer.Reset(s.interval)
+				s.mu.Unlock()
+				lastRead, lastInserted, last = r, n, now
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *jobStats) downsample() {
+	merged := s.samples[:0]
+	for i := 0; i+1 < len(s.samples); i += 2 {
+		a, b := s.samples[i], s.samples[i+1]
+		merged = append(merged, throughputSample{
+			At:             b.At,
+			ReadPerSec:     (a.ReadPerSec + b.ReadPerSec) / 2,
+			InsertedPerSec: (a.InsertedPerSec + b.InsertedPerSec) / 2,
+		})
+	}
+	if len(s.samples)%2 == 1 {
+		merged = append(merged, s.samples[len(s.samples)-1])
+	}
+	s.samples = merged
+	s.interval *= 2
+}
+
+// summary reports the stats so far.
+func (s *jobStats) summary() *jobPerformance {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	elapsed := time.Since(s.started)
+	p := &jobPerformance{
+		ElapsedSeconds:    elapsed.Seconds(),
+		ReadSeconds:       s.read.Seconds(),
+		ParseSeconds:      s.parse.Seconds(),
+		BlockedSeconds:    s.blocked.Seconds(),
+		PausedSeconds:     s.paused.Seconds(),
+		QueueWaitSeconds:  s.queueWait.Seconds(),
+		InsertSeconds:     s.insert.Seconds(),
+		Batches:           s.batches,
+		MaxBatchLatencyMS: float64(s.maxBatch.Microseconds()) / 1000,
+		Throughput:        append([]throughputSample(nil), s.samples...),
+	}
+	if active := elapsed - s.paused; active > 0 {
+		p.RowsPerSec = float64(s.rows) / active.Seconds()
+		// The share of the shared insert pool's capacity this job used.
+		p.WorkerUtilization = s.insert.Seconds() / (active.Seconds() * float64(cfg.Import.Workers))
+	}
+	if s.batches > 0 {
+		p.MeanBatchLatencyMS = float64(s.insert.Microseconds()) / 1000 / float64(s.batches)
+	}
+	switch {
+	case s.blocked >= s.read && s.blocked >= s.parse:
+		p.Bottleneck = "database"
+	case s.parse > s.read:
+		p.Bottleneck = "parser"
+	default:
+		p.Bottleneck = "file"
+	}
+	for i, count := range s.latency {
+		le := "+Inf"
+		if i < len(batchLatencyBuckets) {
+			le = strconv.FormatInt(batchLatencyBuckets[i], 10)
+		}
+		p.BatchLatency = append(p.BatchLatency, latencyBucket{LE: le, Count: count})
+	}
+	return p
+}
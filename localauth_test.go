@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+func testLogin(t *testing.T, username, password string) testTokens {
+	t.Helper()
+	var tokens testTokens
+	w := testCall(t, http.MethodPost, "/auth/login", nil, gin.H{"username": username, "password": password})
+	decodeResponse(t, w, http.StatusOK, &tokens)
+	return tokens
+}
+
+func TestUpdateUserEndsSessions(t *testing.T) {
+	tenant, _ := newTestTenant(t)
+
+	for _, tc := range []struct {
+		name   string
+		update gin.H
+	}{
+		{"password", gin.H{"password": "another-long-password"}},
+		{"disabled", gin.H{"disabled": true}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			username := tenant + "-" + tc.name
+			var user User
+			w := testCall(t, http.MethodPost, "/admin/tenants/"+tenant+"/users", adminHeader(),
+				gin.H{"username": username, "password": "a-long-password"})
+			decodeResponse(t, w, http.StatusCreated, &user)
+
+			tokens := testLogin(t, username, "a-long-password")
+			decodeResponse(t, testCall(t, http.MethodGet, "/records", bearer(tokens.AccessToken), nil), http.StatusOK, nil)
+
+			w = testCall(t, http.MethodPut, fmt.Sprintf("/admin/users/%d", user.ID), adminHeader(), tc.update)
+			decodeResponse(t, w, http.StatusOK, nil)
+
+			decodeResponse(t, testCall(t, http.MethodGet, "/records", bearer(tokens.AccessToken), nil), http.StatusUnauthorized, nil)
+			w = testCall(t, http.MethodPost, "/auth/refresh", nil, gin.H{"refresh_token": tokens.RefreshToken})
+			decodeResponse(t, w, http.StatusUnauthorized, nil)
+		})
+	}
+}
+
+func TestTokenStillValid(t *testing.T) {
+	tenant, _ := newTestTenant(t)
+	user := User{Username: tenant + "-user", TenantID: tenant, Role: roleViewer}
+	_, claims, err := issueAccessToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tokenStillValid(user, claims) {
+		t.Error("token of an active user without tokens_valid_after refused")
+	}
+
+	after := claims.IssuedAt.Time.Add(-2 * time.Second)
+	user.TokensValidAfter = &after
+	if !tokenStillValid(user, claims) {
+		t.Error("token issued after tokens_valid_after refused")
+	}
+	after = claims.IssuedAt.Time
+	if tokenStillValid(user, claims) {
+		t.Error("token issued in the second of tokens_valid_after accepted")
+	}
+	user.TokensValidAfter = nil
+	user.DisabledAt = &after
+	if tokenStillValid(user, claims) {
+		t.Error("token of a disabled user accepted")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// logAlerter is a logrus hook checking every entry against chat.rules.
+// Hooks run on the goroutine that logs, so Fire only counts matches; alerts
+// are logged and posted from a goroutine of their own.
+type logAlerter struct {
+	mu    sync.Mutex
+	rules []*logAlertState
+	fired chan firedLogAlert
+}
+
+type logAlertState struct {
+	rule    LogAlertRule
+	level   logrus.Level
+	message string
+	// hits are the times of the latest matches within the window, oldest
+	// first; no more than Threshold+1 are needed to tell if it is exceeded.
+	hits       []time.Time
+	quietUntil time.Time
+}
+
+type firedLogAlert struct {
+	rule   LogAlertRule
+	latest string
+}
+
+var logAlerts = &logAlerter{fired: make(chan firedLogAlert, 16)}
+
+// startLogAlerts begins evaluating chat.rules against the log.
+func startLogAlerts() {
+	logAlerts.setRules(cfg.Chat.Rules)
+	logr.AddHook(logAlerts)
+	go logAlerts.run()
+}
+
+// setRules replaces the rules, keeping the counts of rules that didn't
+// change.
+func (a *logAlerter) setRules(rules []LogAlertRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	old := map[string]*logAlertState{}
+	for _, s := range a.rules {
+		old[s.rule.Name] = s
+	}
+	a.rules = a.rules[:0:0]
+	for _, r := range rules {
+		if s, ok := old[r.Name]; ok && reflect.DeepEqual(s.rule, r) {
+			a.rules = append(a.rules, s)
+			continue
+		}
+		level, _ := logrus.ParseLevel(r.Level)
+		a.rules = append(a.rules, &logAlertState{rule: r, level: level, message: strings.ToLower(r.Message)})
+	}
+}
+
+func (a *logAlerter) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (a *logAlerter) Fire(e *logrus.Entry) error {
+	// The alerter's own entries never count, so a rule can't feed itself.
+	if _, ok := e.Data["alert_rule"]; ok {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, s := range a.rules {
+		if !s.matches(e) {
+			continue
+		}
+		r := s.rule
+		cutoff := e.Time.Add(-r.Window)
+		kept := s.hits[:0]
+		for _, t := range s.hits {
+			if t.After(cutoff) {
+				kept = append(kept, t)
+			}
+		}
+		s.hits = append(kept, e.Time)
+		if len(s.hits) > r.Threshold+1 {
+			s.hits = s.hits[len(s.hits)-r.Threshold-1:]
+		}
+		if len(s.hits) <= r.Threshold || e.Time.Before(s.quietUntil) {
+			continue
+		}
+		s.quietUntil = e.Time.Add(r.Cooldown)
+		select {
+		case a.fired <- firedLogAlert{rule: r, latest: truncate(e.Message, 500)}:
+		default:
+		}
+	}
+	return nil
+}
+
+func (s *logAlertState) matches(e *logrus.Entry) bool {
+	if e.Level > s.level {
+		return false
+	}
+	if s.rule.WebhookURL == "" && cfg.Chat.WebhookURL == "" {
+		return false
+	}
+	if s.rule.Source != "" && fmt.Sprint(e.Data["source"]) != s.rule.Source {
+		return false
+	}
+	return s.message == "" || strings.Contains(strings.ToLower(e.Message), s.message)
+}
+
+func (a *logAlerter) run() {
+	for f := range a.fired {
+		r := f.rule
+		alert := chatAlert{Event: "log_alert." + r.Name, Title: "Log alert " + r.Name}
+		if r.Threshold == 0 {
+			alert.Text = fmt.Sprintf("A %s entry matched: %s", r.Level, f.latest)
+		} else {
+			alert.Text = fmt.Sprintf("More than %d matching entries within %s. Latest: %s", r.Threshold, r.Window, f.latest)
+		}
+		logr.WithField("alert_rule", r.Name).Warnf("Log alert rule %s fired", r.Name)
+
+		webhookURL, format := r.WebhookURL, r.Format
+		if webhookURL == "" {
+			webhookURL, format = cfg.Chat.WebhookURL, cfg.Chat.Format
+		} else if format == "" {
+			format = chatGeneric
+		}
+		postChatAlert(context.Background(), webhookURL, format, alert)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// downloadLogs sends the log lines matching the /logs filters, as they
+// appear in the log files, as a gzipped attachment. It always reads the
+// files, even when entries are also stored in the database.
+func downloadLogs(c *gin.Context) {
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	segments, err := logSegmentsBetween(filter.start, filter.end)
+	if err != nil {
+		logCtx(c).Errorf("Error listing log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+
+	name := "logs"
+	for _, param := range []string{"start_date", "end_date"} {
+		if v := c.Query(param); v != "" {
+			name += "-" + v
+		}
+	}
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".log.gz"))
+	c.Status(http.StatusOK)
+
+	// Once the body has started there is no way to report an error but to
+	// cut the download short, which leaves the gzip stream truncated.
+	gz := gzip.NewWriter(c.Writer)
+	var lines, size int64
+	defer func() {
+		setRowsAffected(c, lines)
+		setAuditEvent(c, "logs.download", fmt.Sprintf("%d lines, %d bytes uncompressed", lines, size))
+	}()
+	skipped, err := scanLogSegments(c.Request.Context(), segments, func(line []byte) bool {
+		if len(line) == 0 {
+			return true
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil || !filter.match(c, entry) {
+			return true
+		}
+		lines++
+		size += int64(len(line)) + 1
+		if _, err := gz.Write(line); err != nil {
+			return false
+		}
+		_, err := gz.Write([]byte{'\n'})
+		return err == nil
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error reading log files: %v", err)
+		return
+	}
+	if err := gz.Close(); err != nil {
+		logCtx(c).Warnf("Error writing log download: %v", err)
+		return
+	}
+	if skipped > 0 {
+		logCtx(c).Warnf("Skipped %d log lines longer than %d bytes", skipped, maxLogLineBytes)
+	}
+	logCtx(c).Infof("Downloaded %d log lines", lines)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const maxLogQueryLen = 1024
+
+// logCondition is one comparison of a log query, such as level=error.
+type logCondition struct {
+	field, op, value string
+	// regex marks a /.../ value.
+	regex bool
+}
+
+// applyQuery narrows the filter by a query: conditions joined by AND, each
+// a field, an operator and a value, e.g.
+//
+//	level=error AND msg~"batch" AND time>2024-06-01
+//
+// time takes >, >=, < and <= with a date or timestamp, read in the filter's
+// time zone. msg takes ~ for a case-insensitive substring, or ~/regex/.
+// Other fields take =. Values with spaces are quoted; \" and \\ escape in
+// quotes.
+func (f *logFilter) applyQuery(query string) error {
+	if len(query) > maxLogQueryLen {
+		return fmt.Errorf("must be at most %d characters", maxLogQueryLen)
+	}
+	conds, err := parseLogQuery(query)
+	if err != nil {
+		return err
+	}
+	for _, cond := range conds {
+		if err := f.applyCondition(cond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *logFilter) applyCondition(cond logCondition) error {
+	if cond.field == "time" {
+		t, day, err := parseDayOrTime(cond.value, f.loc)
+		if err != nil {
+			return fmt.Errorf("time %s %q is not a date or RFC3339 timestamp", cond.op, cond.value)
+		}
+		var start, end time.Time
+		switch cond.op {
+		case ">":
+			start = logTimeAfter(t, day)
+		case ">=":
+			start = t
+		case "<":
+			end = t
+		case "<=":
+			end = logTimeAfter(t, day)
+		default:
+			return fmt.Errorf("time takes >, >=, < or <=, not %s", cond.op)
+		}
+		// Bounds given more than once all apply, so the tightest wins.
+		if start.After(f.start) {
+			f.start = start
+		}
+		if !end.IsZero() && (f.end.IsZero() || end.Before(f.end)) {
+			f.end = end
+		}
+		return nil
+	}
+
+	if cond.field == "msg" {
+		if cond.op != "~" {
+			return fmt.Errorf("msg takes ~, not %s", cond.op)
+		}
+		if !cond.regex {
+			return setOnce(&f.msg, strings.ToLower(cond.value), "msg")
+		}
+		if f.regex != nil {
+			return errors.New("only one regex may be given")
+		}
+		if len(cond.value) > maxLogRegexLen {
+			return fmt.Errorf("regex must be at most %d characters", maxLogRegexLen)
+		}
+		re, err := regexp.Compile(cond.value)
+		if err != nil {
+			return fmt.Errorf("regex: %v", err)
+		}
+		f.regex = re
+		return nil
+	}
+
+	if cond.op != "=" || cond.regex {
+		return fmt.Errorf("%s takes =", cond.field)
+	}
+	switch cond.field {
+	case "level":
+		return setOnce(&f.level, cond.value, "level")
+	case "source":
+		return setOnce(&f.source, cond.value, "source")
+	case "request_id":
+		return setOnce(&f.requestID, cond.value, "request_id")
+	case "job_id":
+		return setOnce(&f.jobID, cond.value, "job_id")
+	}
+	if f.fields == nil {
+		f.fields = map[string]string{}
+	}
+	value, ok := f.fields[cond.field]
+	if !ok && len(f.fields) == maxLogFields {
+		return fmt.Errorf("at most %d field filters are allowed", maxLogFields)
+	}
+	if err := setOnce(&value, cond.value, cond.field); err != nil {
+		return err
+	}
+	f.fields[cond.field] = value
+	return nil
+}
+
+// setOnce sets a filter that may already be set by a parameter or an
+// earlier condition, as long as it isn't set to something else.
+func setOnce(dst *string, value, name string) error {
+	if *dst != "" && *dst != value {
+		return fmt.Errorf("%s is given twice with different values", name)
+	}
+	*dst = value
+	return nil
+}
+
+// parseLogQuery splits a query into its conditions.
+func parseLogQuery(query string) ([]logCondition, error) {
+	var conds []logCondition
+	s := strings.TrimSpace(query)
+	for {
+		var cond logCondition
+		i := strings.IndexFunc(s, func(r rune) bool {
+			return !(r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r))
+		})
+		if i <= 0 {
+			return nil, fmt.Errorf("expected a field name at %q", s)
+		}
+		cond.field, s = s[:i], strings.TrimLeft(s[i:], " ")
+		for _, op := range []string{">=", "<=", "=", "~", ">", "<"} {
+			if strings.HasPrefix(s, op) {
+				cond.op, s = op, strings.TrimLeft(s[len(op):], " ")
+				break
+			}
+		}
+		if cond.op == "" {
+			return nil, fmt.Errorf("expected =, ~, >, >=, < or <= after %s", cond.field)
+		}
+
+		var err error
+		switch {
+		case strings.HasPrefix(s, `"`):
+			cond.value, s, err = cutQuoted(s[1:], '"', true)
+		case strings.HasPrefix(s, "/"):
+			cond.regex = true
+			cond.value, s, err = cutQuoted(s[1:], '/', false)
+		default:
+			end := strings.IndexByte(s, ' ')
+			if end < 0 {
+				end = len(s)
+			}
+			cond.value, s = s[:end], s[end:]
+			if cond.value == "" {
+				err = fmt.Errorf("expected a value after %s%s", cond.field, cond.op)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		conds = append(conds, cond)
+
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return conds, nil
+		}
+		word, rest, _ := strings.Cut(s, " ")
+		if !strings.EqualFold(word, "AND") {
+			return nil, fmt.Errorf("expected AND at %q", s)
+		}
+		s = strings.TrimSpace(rest)
+	}
+}
+
+// cutQuoted returns the text up to the closing quote and what follows it.
+// Inside double quotes, a backslash escapes the next character; in a
+// /regex/, only \/ is unescaped, leaving the regex's own escapes alone.
+func cutQuoted(s string, quote byte, unescape bool) (string, string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (unescape || s[i+1] == quote):
+			i++
+			b.WriteByte(s[i])
+		case s[i] == quote:
+			return b.String(), s[i+1:], nil
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", "", fmt.Errorf("missing closing %c", quote)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+func newLogWriter(conf LogConfig) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   conf.File,
+		MaxSize:    conf.MaxSizeMB,
+		MaxAge:     conf.MaxAgeDays,
+		MaxBackups: conf.MaxBackups,
+		Compress:   conf.Compress,
+	}
+}
+
+// logSegments returns the rotated backups of the log file, oldest first,
+// followed by the active file. lumberjack names backups
+// <name>-<timestamp><ext>[.gz], so a lexical sort is chronological.
+func logSegments() ([]string, error) {
+	dir := filepath.Dir(cfg.Log.File)
+	ext := filepath.Ext(cfg.Log.File)
+	prefix := strings.TrimSuffix(filepath.Base(cfg.Log.File), ext) + "-"
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if strings.HasSuffix(name, ext) || strings.HasSuffix(name, ext+".gz") {
+			segments = append(segments, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(segments)
+	if _, err := os.Stat(cfg.Log.File); err == nil {
+		segments = append(segments, cfg.Log.File)
+	}
+	return segments, nil
+}
+
+// logSegmentsBetween is logSegments without the segments that can only hold
+// entries outside start to end; a zero time leaves that side open. A backup
+// holds the entries written after the previous one was rotated out, up to
+// its own rotation; lumberjack stamps backups with that time in UTC.
+func logSegmentsBetween(start, end time.Time) ([]string, error) {
+	segments, err := logSegments()
+	if err != nil {
+		return nil, err
+	}
+	var inRange []string
+	for _, segment := range segments {
+		rotated, ok := logSegmentRotatedAt(segment)
+		if ok && !start.IsZero() && rotated.Before(start) {
+			continue
+		}
+		inRange = append(inRange, segment)
+		if ok && !end.IsZero() && rotated.After(end) {
+			break
+		}
+	}
+	return inRange, nil
+}
+
+type gzipSegment struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipSegment) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// openLogSegment opens a log segment, transparently decompressing .gz backups.
+func openLogSegment(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return gzipSegment{Reader: zr, file: f}, nil
+}
+
+// logSegmentRotatedAt parses the timestamp lumberjack puts in a backup's
+// name. It reports false for the active log file.
+func logSegmentRotatedAt(path string) (time.Time, bool) {
+	ext := filepath.Ext(cfg.Log.File)
+	prefix := strings.TrimSuffix(filepath.Base(cfg.Log.File), ext) + "-"
+	name := strings.TrimSuffix(filepath.Base(path), ".gz")
+	if !strings.HasPrefix(name, prefix) {
+		return time.Time{}, false
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)
+	t, err := time.Parse("2006-01-02T15-04-05.000", stamp)
+	return t, err == nil
+}
+
+// maxLogLineBytes bounds the memory a single log line may take while
+// scanning; longer lines are skipped.
+const maxLogLineBytes = 1 << 20
+
+// scanLogSegments calls fn with every line of the segments in order until fn
+// returns false or ctx is done. It returns how many lines were skipped for
+// being longer than maxLogLineBytes. Segments that can't be opened are
+// logged and skipped.
+func scanLogSegments(ctx context.Context, segments []string, fn func(line []byte) bool) (int, error) {
+	var skipped int
+	for _, segment := range segments {
+		f, err := openLogSegment(segment)
+		if err != nil {
+			logCtx(ctx).Errorf("Error opening log segment %s: %v", segment, err)
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 0, 64<<10), maxLogLineBytes)
+		scanner.Split(skipLongLines(&skipped))
+		more := true
+		for more && scanner.Scan() {
+			more = fn(scanner.Bytes()) && ctx.Err() == nil
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return skipped, fmt.Errorf("reading %s: %w", segment, err)
+		}
+		if !more {
+			break
+		}
+	}
+	return skipped, ctx.Err()
+}
+
+// skipLongLines is bufio.ScanLines, except that a line filling the whole
+// scanner buffer is dropped, up to its newline, instead of failing the scan
+// with bufio.ErrTooLong.
+func skipLongLines(skipped *int) bufio.SplitFunc {
+	dropping := false
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			if dropping {
+				dropping = false
+				return i + 1, nil, nil
+			}
+			return i + 1, bytes.TrimSuffix(data[:i], []byte{'\r'}), nil
+		}
+		switch {
+		case atEOF && len(data) > 0 && !dropping:
+			return len(data), data, nil
+		case atEOF && len(data) > 0:
+			return len(data), nil, nil
+		case len(data) >= maxLogLineBytes:
+			if !dropping {
+				*skipped++
+			}
+			dropping = true
+			return len(data), nil, nil
+		}
+		return 0, nil, nil
+	}
+}
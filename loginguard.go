@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type attemptRecord struct {
+	failures     int
+	firstFailure time.Time
+	lastFailure  time.Time
+	lockouts     int
+	lockedUntil  time.Time
+}
+
+// loginGuard tracks failed logins per account and per client IP. Reaching the
+// attempt limit locks the key out; each consecutive lockout doubles in length
+// up to the configured maximum. The records live in this process only, so
+// the limits hold per instance, and restart with it.
+type loginGuard struct {
+	mu       sync.Mutex
+	accounts map[string]*attemptRecord
+	ips      map[string]*attemptRecord
+}
+
+var logins = &loginGuard{
+	accounts: make(map[string]*attemptRecord),
+	ips:      make(map[string]*attemptRecord),
+}
+
+// lockedFor returns how much longer the account or IP is locked out.
+func (g *loginGuard) lockedFor(account, ip string) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	var remaining time.Duration
+	for _, rec := range []*attemptRecord{g.accounts[account], g.ips[ip]} {
+		if rec != nil && rec.lockedUntil.After(now) {
+			if d := rec.lockedUntil.Sub(now); d > remaining {
+				remaining = d
+			}
+		}
+	}
+	return remaining
+}
+
+func (g *loginGuard) record(m map[string]*attemptRecord, key string, limit int, now time.Time) time.Duration {
+	rec := m[key]
+	if rec == nil {
+		rec = &attemptRecord{}
+		m[key] = rec
+	}
+	// A quiet period forgets earlier failures and, after long enough, earlier lockouts.
+	if now.Sub(rec.lastFailure) > cfg.LoginGuard.ResetAfter {
+		rec.lockouts = 0
+	}
+	if now.Sub(rec.firstFailure) > cfg.LoginGuard.Window {
+		rec.failures = 0
+		rec.firstFailure = now
+	}
+	rec.failures++
+	rec.lastFailure = now
+	if rec.failures < limit {
+		return 0
+	}
+
+	lockout := cfg.LoginGuard.LockoutBase << rec.lockouts
+	if lockout <= 0 || lockout > cfg.LoginGuard.LockoutMax {
+		lockout = cfg.LoginGuard.LockoutMax
+	}
+	rec.lockouts++
+	rec.failures = 0
+	rec.lockedUntil = now.Add(lockout)
+	return lockout
+}
+
+// fail records a failed attempt and returns the lockout durations it
+// triggered for the account and the IP, if any.
+func (g *loginGuard) fail(account, ip string) (accountLock, ipLock time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	g.prune(now)
+	accountLock = g.record(g.accounts, account, cfg.LoginGuard.MaxAttempts, now)
+	ipLock = g.record(g.ips, ip, cfg.LoginGuard.MaxAttemptsPerIP, now)
+	return accountLock, ipLock
+}
+
+func (g *loginGuard) succeed(account string) {
+	g.mu.Lock()
+	delete(g.accounts, account)
+	g.mu.Unlock()
+}
+
+func (g *loginGuard) prune(now time.Time) {
+	for _, m := range []map[string]*attemptRecord{g.accounts, g.ips} {
+		for key, rec := range m {
+			if now.Sub(rec.lastFailure) > cfg.LoginGuard.ResetAfter && now.After(rec.lockedUntil) {
+				delete(m, key)
+			}
+		}
+	}
+}
+
+func auditLockout(c *gin.Context, subject string, d time.Duration) {
+	logCtx(c).Warnf("Locked out %s for %s after repeated failed logins", subject, d)
+	recordAuditEvent(c, "login_lockout", subject+" locked for "+d.String())
+}
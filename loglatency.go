@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxLatencyGroups caps the groups /logs/latency keeps, as maxDistinctErrors
+// does for /logs/stats.
+const maxLatencyGroups = 10000
+
+var latencyGroupings = map[string]bool{"route": true, "method": true, "status": true}
+
+type latencyGroup struct {
+	Key       string  `json:"key"`
+	Count     int     `json:"count"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	AvgMs     float64 `json:"avg_ms"`
+	P50Ms     int64   `json:"p50_ms"`
+	P95Ms     int64   `json:"p95_ms"`
+	P99Ms     int64   `json:"p99_ms"`
+	MaxMs     int64   `json:"max_ms"`
+
+	// Latencies are whole milliseconds, so counting each distinct value
+	// gives exact percentiles without keeping every request.
+	latencies map[int64]int
+	sumMs     int64
+}
+
+// percentiles fills in the latency percentiles from the counted latencies.
+func (g *latencyGroup) percentiles() {
+	values := make([]int64, 0, len(g.latencies))
+	for v := range g.latencies {
+		values = append(values, v)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+	targets := []struct {
+		p   float64
+		dst *int64
+	}{{0.50, &g.P50Ms}, {0.95, &g.P95Ms}, {0.99, &g.P99Ms}, {1, &g.MaxMs}}
+	seen := 0
+	for _, v := range values {
+		seen += g.latencies[v]
+		for len(targets) > 0 && float64(seen) >= targets[0].p*float64(g.Count) {
+			*targets[0].dst = v
+			targets = targets[1:]
+		}
+	}
+	g.AvgMs = float64(g.sumMs) / float64(g.Count)
+	g.ErrorRate = float64(g.Errors) / float64(g.Count)
+}
+
+// logLatency reports request counts, 5xx error rates and latency
+// percentiles from the access log entries matching the /logs filters,
+// grouped by route (with method), method or status.
+func logLatency(c *gin.Context) {
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	groupBy := c.DefaultQuery("group_by", "route")
+	if !latencyGroupings[groupBy] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group_by, must be route, method or status"})
+		return
+	}
+	filter.source = "access"
+
+	segments, err := logSegmentsBetween(filter.start, filter.end)
+	if err != nil {
+		logCtx(c).Errorf("Error listing log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+
+	groups := map[string]*latencyGroup{}
+	var total int
+	skipped, err := scanLogSegments(c.Request.Context(), segments, func(line []byte) bool {
+		if len(line) == 0 {
+			return true
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil || !filter.match(c, entry) {
+			return true
+		}
+		latency, ok := entry["latency_ms"].(float64)
+		if !ok {
+			return true
+		}
+		status, _ := entry["status"].(float64)
+		method, _ := entry["method"].(string)
+		var key string
+		switch groupBy {
+		case "route":
+			route, _ := entry["route"].(string)
+			if route == "" {
+				route = "(unmatched)"
+			}
+			key = method + " " + route
+		case "method":
+			key = method
+		case "status":
+			key = strconv.Itoa(int(status))
+		}
+
+		g, ok := groups[key]
+		if !ok {
+			if len(groups) >= maxLatencyGroups {
+				return true
+			}
+			g = &latencyGroup{Key: key, latencies: map[int64]int{}}
+			groups[key] = g
+		}
+		total++
+		g.Count++
+		if status >= http.StatusInternalServerError {
+			g.Errors++
+		}
+		g.latencies[int64(latency)]++
+		g.sumMs += int64(latency)
+		return true
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error reading log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+	if skipped > 0 {
+		logCtx(c).Warnf("Skipped %d log lines longer than %d bytes", skipped, maxLogLineBytes)
+	}
+
+	result := make([]*latencyGroup, 0, len(groups))
+	for _, g := range groups {
+		g.percentiles()
+		result = append(result, g)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Key < result[j].Key
+	})
+	c.JSON(http.StatusOK, gin.H{"group_by": groupBy, "total": total, "groups": result})
+}
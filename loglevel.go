@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var runtimeLogLevels = map[string]logrus.Level{
+	"debug": logrus.DebugLevel,
+	"info":  logrus.InfoLevel,
+	"warn":  logrus.WarnLevel,
+	"error": logrus.ErrorLevel,
+}
+
+func getLogLevel(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"level": logr.GetLevel().String(), "default": cfg.Log.Level})
+}
+
+func setLogLevel(c *gin.Context) {
+	var req struct {
+		Level string `json:"level" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	level, ok := runtimeLogLevels[req.Level]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid level, must be debug, info, warn or error"})
+		return
+	}
+
+	previous := logr.GetLevel()
+	logr.SetLevel(level)
+	// Logged at warn so the change is recorded even when switching to warn.
+	logCtx(c).Warnf("Log level changed from %s to %s by %s", previous, level, c.GetString(ctxActor))
+	c.JSON(http.StatusOK, gin.H{"level": level.String(), "previous": previous.String()})
+}
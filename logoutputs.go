@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// gelfChunkSize keeps GELF UDP datagrams within what Graylog accepts.
+	gelfChunkSize = 8192
+	gelfMaxChunks = 128
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogSeverity maps a logrus level to a syslog severity, as logrus's own
+// syslog hook does.
+func syslogSeverity(level string) int {
+	l, _ := logrus.ParseLevel(level)
+	switch l {
+	case logrus.PanicLevel, logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7
+}
+
+// parseLogAddress splits udp://host:port or tcp://host:port.
+func parseLogAddress(raw string) (network, addr string, err error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return "", "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if _, _, err := net.SplitHostPort(u.Host); err != nil {
+		return "", "", err
+	}
+	return u.Scheme, u.Host, nil
+}
+
+// logConn is a connection to a log collector, dialled when first needed and
+// again after a write fails.
+type logConn struct {
+	network, addr string
+	conn          net.Conn
+}
+
+func (c *logConn) write(ctx context.Context, p []byte) error {
+	if c.conn == nil {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, c.network, c.addr)
+		if err != nil {
+			return err
+		}
+		c.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := c.conn.Write(p); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "-"
+	}
+	return name
+}
+
+// newSyslogSender returns the send function of the syslog sink. Each entry
+// becomes an RFC 5424 message carrying the JSON entry; over TCP, messages
+// are framed by octet counting (RFC 6587).
+func newSyslogSender(conf SyslogConfig) func(context.Context, []shippedEntry) error {
+	network, addr, _ := parseLogAddress(conf.Address)
+	conn := &logConn{network: network, addr: addr}
+	facility := syslogFacilities[conf.Facility]
+	host, procID := hostname(), strconv.Itoa(os.Getpid())
+	return func(ctx context.Context, batch []shippedEntry) error {
+		var buf bytes.Buffer
+		for _, e := range batch {
+			msg := fmt.Sprintf("<%d>1 %s %s %s %s - - %s", facility*8+syslogSeverity(e.level),
+				e.time.UTC().Format(time.RFC3339Nano), host, conf.AppName, procID, e.line)
+			if network == "udp" {
+				if err := conn.write(ctx, []byte(msg)); err != nil {
+					return err
+				}
+				continue
+			}
+			fmt.Fprintf(&buf, "%d %s", len(msg), msg)
+		}
+		if buf.Len() == 0 {
+			return nil
+		}
+		return conn.write(ctx, buf.Bytes())
+	}
+}
+
+// gelfMessage converts an entry to GELF 1.1: msg becomes short_message,
+// the level a syslog severity, and the other fields additional fields.
+func gelfMessage(e shippedEntry, host string) ([]byte, error) {
+	var entry map[string]interface{}
+	if err := json.Unmarshal(e.line, &entry); err != nil {
+		return nil, err
+	}
+	msg := map[string]interface{}{
+		"version":   "1.1",
+		"host":      host,
+		"timestamp": float64(e.time.UnixNano()) / 1e9,
+		"level":     syslogSeverity(e.level),
+	}
+	for k, v := range entry {
+		switch k {
+		case "msg":
+			msg["short_message"] = v
+		case "level", "time":
+		case "id":
+			// _id is reserved by GELF.
+			msg["_log_id"] = v
+		default:
+			msg["_"+k] = v
+		}
+	}
+	if s, _ := msg["short_message"].(string); s == "" {
+		msg["short_message"] = "-"
+	}
+	return json.Marshal(msg)
+}
+
+// newGELFSender returns the send function of the GELF sink. Over TCP,
+// messages end with a null byte; over UDP, a message larger than a datagram
+// is compressed and, if still too large, chunked.
+func newGELFSender(conf GELFConfig) func(context.Context, []shippedEntry) error {
+	network, addr, _ := parseLogAddress(conf.Address)
+	conn := &logConn{network: network, addr: addr}
+	host := conf.Host
+	if host == "" {
+		host = hostname()
+	}
+	return func(ctx context.Context, batch []shippedEntry) error {
+		var buf bytes.Buffer
+		for _, e := range batch {
+			msg, err := gelfMessage(e, host)
+			if err != nil {
+				continue
+			}
+			if network == "tcp" {
+				buf.Write(msg)
+				buf.WriteByte(0)
+				continue
+			}
+			if err := writeGELFDatagram(ctx, conn, msg); err != nil {
+				return err
+			}
+		}
+		if buf.Len() == 0 {
+			return nil
+		}
+		return conn.write(ctx, buf.Bytes())
+	}
+}
+
+func writeGELFDatagram(ctx context.Context, conn *logConn, msg []byte) error {
+	if len(msg) <= gelfChunkSize {
+		return conn.write(ctx, msg)
+	}
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	zw.Write(msg)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	msg = zipped.Bytes()
+	if len(msg) <= gelfChunkSize {
+		return conn.write(ctx, msg)
+	}
+
+	// Chunks carry a 12-byte header: magic bytes, message ID, sequence
+	// number and count.
+	const payload = gelfChunkSize - 12
+	count := (len(msg) + payload - 1) / payload
+	if count > gelfMaxChunks {
+		return errors.New("GELF message too large to send over UDP")
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	for i := 0; i < count; i++ {
+		end := min((i+1)*payload, len(msg))
+		chunk := append([]byte{0x1e, 0x0f}, id...)
+		chunk = append(chunk, byte(i), byte(count))
+		chunk = append(chunk, msg[i*payload:end]...)
+		if err := conn.write(ctx, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
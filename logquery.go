@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxLogRegexLen bounds the regex parameter. Go regexps run in linear
+	// time, so only their size needs limiting.
+	maxLogRegexLen = 256
+	maxLogFields   = 20
+	logFieldPrefix = "field."
+)
+
+// logFilter selects log entries by the query parameters shared by the /logs
+// endpoints: start_date, end_date, level, source, request_id, job_id, msg (a
+// case-insensitive substring) or regex matched against the message, and
+// field.<name>=<value> for any other field of the entries.
+// The query parameter combines the same filters in one expression; see
+// applyQuery.
+//
+// Dates are days, or timestamps, in tz (the service time zone by default),
+// and the end is inclusive: end_date=2026-10-15 takes in the whole day.
+type logFilter struct {
+	// end is exclusive; parseLogFilter moves it past the requested end.
+	start, end time.Time
+	loc        *time.Location
+	level      string
+	source     string
+	requestID  string
+	jobID      string
+	msg        string
+	regex      *regexp.Regexp
+	fields     map[string]string
+}
+
+func parseLogFilter(c *gin.Context) (logFilter, error) {
+	f := logFilter{
+		level:     c.Query("level"),
+		source:    c.Query("source"),
+		requestID: c.Query("request_id"),
+		jobID:     c.Query("job_id"),
+		msg:       strings.ToLower(c.Query("msg")),
+	}
+	if v := c.Query("regex"); v != "" {
+		if len(v) > maxLogRegexLen {
+			return f, fmt.Errorf("Invalid regex, must be at most %d characters", maxLogRegexLen)
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return f, fmt.Errorf("Invalid regex: %v", err)
+		}
+		f.regex = re
+	}
+	for param, values := range c.Request.URL.Query() {
+		name, ok := strings.CutPrefix(param, logFieldPrefix)
+		if !ok {
+			continue
+		}
+		if name == "" {
+			return f, errors.New("Invalid field filter, expected field.<name>=<value>")
+		}
+		if f.fields == nil {
+			f.fields = map[string]string{}
+		}
+		if len(f.fields) == maxLogFields {
+			return f, fmt.Errorf("Too many field filters, at most %d are allowed", maxLogFields)
+		}
+		f.fields[name] = values[0]
+	}
+	f.loc = cfg.Location()
+	if v := c.Query("tz"); v != "" {
+		loc, err := time.LoadLocation(v)
+		if err != nil {
+			return f, errors.New("Invalid tz, expected an IANA time zone such as Europe/Berlin")
+		}
+		f.loc = loc
+	}
+	// Log times carry their offset, so they compare correctly in any zone.
+	if v := c.Query("start_date"); v != "" {
+		start, _, err := parseDayOrTime(v, f.loc)
+		if err != nil {
+			return f, errors.New("Invalid start_date, expected YYYY-MM-DD or an RFC3339 timestamp")
+		}
+		f.start = start
+	}
+	if v := c.Query("end_date"); v != "" {
+		end, day, err := parseDayOrTime(v, f.loc)
+		if err != nil {
+			return f, errors.New("Invalid end_date, expected YYYY-MM-DD or an RFC3339 timestamp")
+		}
+		f.end = logTimeAfter(end, day)
+	}
+	if v := c.Query("query"); v != "" {
+		if err := f.applyQuery(v); err != nil {
+			return f, fmt.Errorf("Invalid query: %v", err)
+		}
+	}
+	if !f.start.IsZero() && !f.end.IsZero() && !f.start.Before(f.end) {
+		return f, errors.New("start_date must not be after end_date")
+	}
+	return f, nil
+}
+
+// logTimeAfter returns the first log time after t, or after the whole day
+// when t is a day. Log times are whole seconds, so an entry logged within
+// the second of t is written with that second.
+func logTimeAfter(t time.Time, day bool) time.Time {
+	if day {
+		return t.AddDate(0, 0, 1)
+	}
+	return t.Truncate(time.Second).Add(time.Second)
+}
+
+// match reports whether a decoded log entry passes the filter.
+func (f logFilter) match(ctx context.Context, entry map[string]interface{}) bool {
+	if f.level != "" && entry["level"] != f.level {
+		return false
+	}
+	if !f.start.IsZero() || !f.end.IsZero() {
+		logTime, err := logEntryTime(entry)
+		if err != nil {
+			logCtx(ctx).Errorf("Error parsing log time: %v", err)
+			return false
+		}
+		if !f.start.IsZero() && logTime.Before(f.start) {
+			return false
+		}
+		if !f.end.IsZero() && !logTime.Before(f.end) {
+			return false
+		}
+	}
+	if f.source != "" && entry["source"] != f.source {
+		return false
+	}
+	if f.requestID != "" && entry["request_id"] != f.requestID {
+		return false
+	}
+	if f.jobID != "" && entry["job_id"] != f.jobID {
+		return false
+	}
+	for name, want := range f.fields {
+		v, ok := logEntryField(entry, name)
+		if !ok || v != want {
+			return false
+		}
+	}
+	if f.msg != "" || f.regex != nil {
+		msg, _ := entry["msg"].(string)
+		if f.msg != "" && !strings.Contains(strings.ToLower(msg), f.msg) {
+			return false
+		}
+		if f.regex != nil && !f.regex.MatchString(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// logEntryField returns a field of a decoded log entry as it would be written
+// in a query string. A name with dots that isn't itself a key is looked up
+// as a path into nested objects.
+func logEntryField(entry map[string]interface{}, name string) (string, bool) {
+	v, ok := entry[name]
+	if !ok {
+		var obj interface{} = entry
+		for _, key := range strings.Split(name, ".") {
+			m, isObj := obj.(map[string]interface{})
+			if !isObj {
+				return "", false
+			}
+			if obj, ok = m[key]; !ok {
+				return "", false
+			}
+		}
+		v = obj
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case nil:
+		return "null", true
+	case map[string]interface{}, []interface{}:
+		data, _ := json.Marshal(v)
+		return string(data), true
+	}
+	return fmt.Sprint(v), true
+}
+
+// logOrder is the order /logs returns entries in: by time, or by level and
+// then time, ascending or descending. Ascending levels go from trace to
+// panic, so sort=level&order=desc puts the most severe first.
+type logOrder struct {
+	byLevel bool
+	desc    bool
+}
+
+func parseLogOrder(c *gin.Context) (logOrder, error) {
+	var o logOrder
+	switch c.DefaultQuery("sort", "time") {
+	case "time":
+	case "level":
+		o.byLevel = true
+	default:
+		return o, errors.New("Invalid sort, must be time or level")
+	}
+	switch c.DefaultQuery("order", "desc") {
+	case "asc":
+	case "desc":
+		o.desc = true
+	default:
+		return o, errors.New("Invalid order, must be asc or desc")
+	}
+	return o, nil
+}
+
+// groups is how many groups group can return.
+func (o logOrder) groups() int {
+	if o.byLevel {
+		return len(logrus.AllLevels)
+	}
+	return 1
+}
+
+// group returns the severity of the entry's level when sorting by level,
+// from 0 for trace up; entries without a known level count as trace.
+func (o logOrder) group(entry map[string]interface{}) int {
+	if !o.byLevel {
+		return 0
+	}
+	s, _ := entry["level"].(string)
+	level, err := logrus.ParseLevel(s)
+	if err != nil {
+		return 0
+	}
+	return int(logrus.TraceLevel - level)
+}
+
+// sql is the ORDER BY clause for the logs table.
+func (o logOrder) sql() string {
+	dir := " ASC"
+	if o.desc {
+		dir = " DESC"
+	}
+	by := "time" + dir + ", id" + dir
+	if !o.byLevel {
+		return by
+	}
+	rank := "CASE level"
+	for _, level := range logrus.AllLevels {
+		rank += fmt.Sprintf(" WHEN '%s' THEN %d", level, logrus.TraceLevel-level)
+	}
+	return rank + " ELSE 0 END" + dir + ", " + by
+}
+
+func logEntryTime(entry map[string]interface{}) (time.Time, error) {
+	s, _ := entry["time"].(string)
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// emailPattern is the default log.redact pattern.
+const emailPattern = `[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`
+
+// logRedactor is a logrus hook scrubbing entries as log.redact says. It is
+// added before every other hook, and logrus formats entries only after the
+// hooks have run, so nothing downstream sees the original values.
+type logRedactor struct {
+	fields   map[string]string
+	patterns []*regexp.Regexp
+	action   string
+}
+
+func newLogRedactor(conf LogRedactConfig) *logRedactor {
+	r := &logRedactor{fields: make(map[string]string), action: conf.PatternAction}
+	for field, action := range conf.Fields {
+		r.fields[normalizeFieldName(field)] = action
+	}
+	for _, pattern := range conf.Patterns {
+		r.patterns = append(r.patterns, regexp.MustCompile(pattern))
+	}
+	return r
+}
+
+func (r *logRedactor) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (r *logRedactor) Fire(e *logrus.Entry) error {
+	e.Message = r.scrub(e.Message)
+	for key, v := range e.Data {
+		switch r.fields[normalizeFieldName(key)] {
+		case redactMask:
+			e.Data[key] = maskValue(v)
+			continue
+		case redactHash:
+			e.Data[key] = hashValue(v)
+			continue
+		case redactNull:
+			e.Data[key] = nil
+			continue
+		case redactDrop:
+			delete(e.Data, key)
+			continue
+		}
+		// Errors are written as their message, which can quote the data
+		// that caused them.
+		var s string
+		switch v := v.(type) {
+		case string:
+			s = v
+		case error:
+			s = v.Error()
+		default:
+			continue
+		}
+		if scrubbed := r.scrub(s); scrubbed != s {
+			e.Data[key] = scrubbed
+		}
+	}
+	return nil
+}
+
+// scrub replaces the pattern matches in s.
+func (r *logRedactor) scrub(s string) string {
+	for _, re := range r.patterns {
+		s = re.ReplaceAllStringFunc(s, func(match string) string {
+			if r.action == redactHash {
+				return hashValue(match)
+			}
+			return maskValue(match).(string)
+		})
+	}
+	return s
+}
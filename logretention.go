@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// logCleanup reports what a cleanup removed.
+type logCleanup struct {
+	FilesRemoved   int   `json:"files_removed"`
+	BytesFreed     int64 `json:"bytes_freed"`
+	EntriesDeleted int64 `json:"entries_deleted"`
+}
+
+// logCleanupMu keeps the pruner and the admin endpoint from cleaning up at
+// the same time.
+var logCleanupMu sync.Mutex
+
+// cleanupLogs applies log.retention and log.max_age_days to the rotated log
+// files and the logs table. The active log file is never removed.
+func cleanupLogs(ctx context.Context) (logCleanup, error) {
+	logCleanupMu.Lock()
+	defer logCleanupMu.Unlock()
+
+	var result logCleanup
+	conf := cfg.Log
+	segments, err := logSegments()
+	if err != nil {
+		return result, err
+	}
+	sizes := make([]int64, len(segments))
+	var total int64
+	for i, segment := range segments {
+		if info, err := os.Stat(segment); err == nil {
+			sizes[i] = info.Size()
+			total += sizes[i]
+		}
+	}
+	maxAge := time.Duration(conf.MaxAgeDays) * 24 * time.Hour
+	maxTotal := int64(conf.Retention.MaxTotalMB) << 20
+	for i, segment := range segments {
+		rotated, backup := logSegmentRotatedAt(segment)
+		if !backup {
+			continue
+		}
+		expired := conf.MaxAgeDays > 0 && time.Since(rotated) > maxAge
+		if !expired && (maxTotal == 0 || total <= maxTotal) {
+			continue
+		}
+		if err := os.Remove(segment); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logCtx(ctx).Errorf("Error removing log file %s: %v", segment, err)
+			continue
+		}
+		result.FilesRemoved++
+		result.BytesFreed += sizes[i]
+		total -= sizes[i]
+	}
+
+	q := db.WithContext(ctx)
+	if conf.Retention.DatabaseMaxAge > 0 {
+		res := q.Where("time < ?", time.Now().Add(-conf.Retention.DatabaseMaxAge).UTC()).Delete(&LogEntry{})
+		if res.Error != nil {
+			return result, res.Error
+		}
+		result.EntriesDeleted += res.RowsAffected
+	}
+	if conf.Retention.DatabaseMaxRows > 0 {
+		// IDs grow with time, so everything up to the first ID past the
+		// newest DatabaseMaxRows goes.
+		var cutoff LogEntry
+		err := q.Select("id").Order("id DESC").Offset(int(conf.Retention.DatabaseMaxRows)).Take(&cutoff).Error
+		switch {
+		case errors.Is(err, gorm.ErrRecordNotFound):
+		case err != nil:
+			return result, err
+		default:
+			res := q.Where("id <= ?", cutoff.ID).Delete(&LogEntry{})
+			if res.Error != nil {
+				return result, res.Error
+			}
+			result.EntriesDeleted += res.RowsAffected
+		}
+	}
+	return result, nil
+}
+
+// startLogPruner runs cleanupLogs every log.retention.interval.
+func startLogPruner() {
+	interval := cfg.Log.Retention.Interval
+	if interval == 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			result, err := cleanupLogs(context.Background())
+			if err != nil {
+				logr.Errorf("Error cleaning up logs: %v", err)
+			}
+			if result.FilesRemoved > 0 || result.EntriesDeleted > 0 {
+				logr.Infof("Log cleanup removed %d files (%d bytes) and %d stored entries",
+					result.FilesRemoved, result.BytesFreed, result.EntriesDeleted)
+			}
+		}
+	}()
+}
+
+// cleanupLogsHandler applies the retention settings now.
+func cleanupLogsHandler(c *gin.Context) {
+	result, err := cleanupLogs(c.Request.Context())
+	if err != nil {
+		logCtx(c).Errorf("Error cleaning up logs: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clean up logs", "result": result})
+		return
+	}
+	logCtx(c).Warnf("Log cleanup by %s removed %d files (%d bytes) and %d stored entries",
+		c.GetString(ctxActor), result.FilesRemoved, result.BytesFreed, result.EntriesDeleted)
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const logShipBatchSize = 1000
+
+// shippedEntry is a log entry as written to the file, ready to send.
+type shippedEntry struct {
+	time  time.Time
+	level string
+	line  []byte
+}
+
+// logSink sends batches of entries to one backend from its own goroutine,
+// so a slow or unreachable backend holds up neither logging nor the others.
+type logSink struct {
+	name    string
+	send    func(ctx context.Context, batch []shippedEntry) error
+	entries chan shippedEntry
+	done    chan struct{}
+	failing bool
+}
+
+// logShipper is a logrus hook passing every entry to the configured sinks.
+type logShipper struct {
+	sinks []*logSink
+	stop  chan struct{}
+}
+
+var (
+	logShip       *logShipper
+	logShipClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// initLogShipping starts shipping log entries to the backends with a URL or
+// address in log.ship.
+func initLogShipping() {
+	ship := cfg.Log.Ship
+	s := &logShipper{stop: make(chan struct{})}
+	if ship.Loki.URL != "" {
+		s.add("loki", pushToLoki)
+	}
+	if ship.Elasticsearch.URL != "" {
+		s.add("elasticsearch", indexInElasticsearch)
+	}
+	if ship.Syslog.Address != "" {
+		s.add("syslog", newSyslogSender(ship.Syslog))
+	}
+	if ship.GELF.Address != "" {
+		s.add("gelf", newGELFSender(ship.GELF))
+	}
+	if len(s.sinks) == 0 {
+		return
+	}
+	logShip = s
+	logr.AddHook(s)
+	for _, sink := range s.sinks {
+		logr.Infof("Shipping log entries to %s", sink.name)
+	}
+}
+
+func (s *logShipper) add(name string, send func(context.Context, []shippedEntry) error) {
+	sink := &logSink{
+		name:    name,
+		send:    send,
+		entries: make(chan shippedEntry, cfg.Log.Ship.BufferSize),
+		done:    make(chan struct{}),
+	}
+	s.sinks = append(s.sinks, sink)
+	go sink.run(s.stop)
+}
+
+func (s *logShipper) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (s *logShipper) Fire(e *logrus.Entry) error {
+	line, err := e.Logger.Formatter.Format(e)
+	if err != nil {
+		return err
+	}
+	entry := shippedEntry{time: e.Time, level: e.Level.String(), line: bytes.TrimRight(line, "\n")}
+	for _, sink := range s.sinks {
+		select {
+		case sink.entries <- entry:
+		default:
+			logEntriesNotShipped.WithLabelValues(sink.name).Inc()
+		}
+	}
+	return nil
+}
+
+func (k *logSink) run(stop <-chan struct{}) {
+	defer close(k.done)
+	ticker := time.NewTicker(cfg.Log.Ship.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]shippedEntry, 0, logShipBatchSize)
+	for {
+		select {
+		case e := <-k.entries:
+			batch = append(batch, e)
+			if len(batch) < logShipBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-stop:
+			for {
+				select {
+				case e := <-k.entries:
+					batch = append(batch, e)
+					if len(batch) == logShipBatchSize {
+						k.flush(batch)
+						batch = batch[:0]
+					}
+				default:
+					k.flush(batch)
+					return
+				}
+			}
+		}
+		k.flush(batch)
+		batch = batch[:0]
+	}
+}
+
+// flush sends a batch. As with the database store, a failed batch is
+// dropped and only the first of a run of failures is logged.
+func (k *logSink) flush(batch []shippedEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), logShipClient.Timeout)
+	defer cancel()
+	if err := k.send(ctx, batch); err != nil {
+		logEntriesNotShipped.WithLabelValues(k.name).Add(float64(len(batch)))
+		if !k.failing {
+			logr.Errorf("Error shipping log entries to %s, dropping them until it recovers: %v", k.name, err)
+		}
+		k.failing = true
+		return
+	}
+	if k.failing {
+		logr.Infof("Shipping log entries to %s again", k.name)
+		k.failing = false
+	}
+}
+
+// flushLogShipping sends the entries still buffered at shutdown.
+func flushLogShipping() {
+	if logShip == nil {
+		return
+	}
+	close(logShip.stop)
+	var wg sync.WaitGroup
+	for _, sink := range logShip.sinks {
+		wg.Add(1)
+		go func(sink *logSink) {
+			defer wg.Done()
+			select {
+			case <-sink.done:
+			case <-time.After(5 * time.Second):
+				logr.Warnf("Timed out shipping buffered log entries to %s", sink.name)
+			}
+		}(sink)
+	}
+	wg.Wait()
+}
+
+// postLogs sends body to a backend and returns the response body of a
+// successful request.
+func postLogs(ctx context.Context, url, contentType string, body []byte, auth func(*http.Request)) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	auth(req)
+	resp, err := logShipClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, truncate(strings.TrimSpace(string(data)), 200))
+	}
+	return data, nil
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// pushToLoki sends a batch through the Loki push API, one stream per level.
+func pushToLoki(ctx context.Context, batch []shippedEntry) error {
+	loki := cfg.Log.Ship.Loki
+	streams := map[string]*lokiStream{}
+	var order []string
+	for _, e := range batch {
+		s, ok := streams[e.level]
+		if !ok {
+			labels := make(map[string]string, len(loki.Labels)+1)
+			for k, v := range loki.Labels {
+				labels[k] = v
+			}
+			labels["level"] = e.level
+			s = &lokiStream{Stream: labels}
+			streams[e.level] = s
+			order = append(order, e.level)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), string(e.line)})
+	}
+	push := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, level := range order {
+		push.Streams = append(push.Streams, streams[level])
+	}
+	body, err := json.Marshal(push)
+	if err != nil {
+		return err
+	}
+	_, err = postLogs(ctx, strings.TrimRight(loki.URL, "/")+"/loki/api/v1/push", "application/json", body, func(req *http.Request) {
+		if loki.TenantID != "" {
+			req.Header.Set("X-Scope-OrgID", loki.TenantID)
+		}
+		if loki.Username != "" {
+			req.SetBasicAuth(loki.Username, loki.Password)
+		}
+	})
+	return err
+}
+
+// indexInElasticsearch sends a batch through the bulk API. Each document is
+// the entry as logged plus @timestamp.
+func indexInElasticsearch(ctx context.Context, batch []shippedEntry) error {
+	es := cfg.Log.Ship.Elasticsearch
+	action, err := json.Marshal(map[string]interface{}{"create": map[string]string{"_index": es.Index}})
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	for _, e := range batch {
+		if len(e.line) < 2 || e.line[0] != '{' {
+			continue
+		}
+		body.Write(action)
+		body.WriteString("\n{\"@timestamp\":\"")
+		body.WriteString(e.time.UTC().Format(time.RFC3339Nano))
+		body.WriteString("\",")
+		body.Write(e.line[1:])
+		body.WriteByte('\n')
+	}
+	data, err := postLogs(ctx, strings.TrimRight(es.URL, "/")+"/_bulk", "application/x-ndjson", body.Bytes(), func(req *http.Request) {
+		if es.APIKey != "" {
+			req.Header.Set("Authorization", "ApiKey "+es.APIKey)
+		} else if es.Username != "" {
+			req.SetBasicAuth(es.Username, es.Password)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// The bulk API answers 200 even when documents are rejected.
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Error json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("decoding bulk response: %w", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	failed := 0
+	var first json.RawMessage
+	for _, item := range result.Items {
+		for _, op := range item {
+			if len(op.Error) > 0 {
+				failed++
+				if first == nil {
+					first = op.Error
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%d of %d entries rejected: %s", failed, len(batch), truncate(string(first), 200))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxDistinctErrors caps the error messages /logs/stats keeps counts for, so
+// a flood of unique messages can't grow the response without bound.
+const maxDistinctErrors = 10000
+
+var (
+	logStatsIntervals = map[string]bool{"minute": true, "hour": true, "day": true}
+	// Request IDs, job IDs and counts vary between otherwise identical
+	// messages; they are masked so recurring errors group together.
+	uuidPattern   = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	numberPattern = regexp.MustCompile(`\d+(\.\d+)?`)
+)
+
+type logBucket struct {
+	Start  time.Time      `json:"start"`
+	Total  int            `json:"total"`
+	Counts map[string]int `json:"counts"`
+}
+
+type recurringError struct {
+	Message  string    `json:"message"`
+	Count    int       `json:"count"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// logErrorPattern masks the variable parts of an error message.
+func logErrorPattern(msg string) string {
+	return numberPattern.ReplaceAllString(uuidPattern.ReplaceAllString(msg, "<id>"), "<n>")
+}
+
+// bucketStart truncates t to the start of its interval in loc, so day
+// buckets begin at local midnight.
+func bucketStart(t time.Time, interval string, loc *time.Location) time.Time {
+	t = t.In(loc)
+	switch interval {
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	case "hour":
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+	}
+	return t.Truncate(time.Minute)
+}
+
+// logStats counts the entries matching the /logs filters per level and time
+// bucket, and lists the most frequent error messages.
+func logStats(c *gin.Context) {
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	interval := c.DefaultQuery("interval", "hour")
+	if !logStatsIntervals[interval] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid interval, must be minute, hour or day"})
+		return
+	}
+	top, _ := strconv.Atoi(c.DefaultQuery("top", "10"))
+	if top < 1 || top > 100 {
+		top = 10
+	}
+
+	segments, err := logSegmentsBetween(filter.start, filter.end)
+	if err != nil {
+		logCtx(c).Errorf("Error listing log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+
+	buckets := map[int64]*logBucket{}
+	totals := map[string]int{}
+	errorsByPattern := map[string]*recurringError{}
+	var total int
+	skipped, err := scanLogSegments(c.Request.Context(), segments, func(line []byte) bool {
+		if len(line) == 0 {
+			return true
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return true
+		}
+		if !filter.match(c, entry) {
+			return true
+		}
+		logTime, err := logEntryTime(entry)
+		if err != nil {
+			return true
+		}
+		level, _ := entry["level"].(string)
+
+		total++
+		totals[level]++
+		start := bucketStart(logTime, interval, filter.loc)
+		b, ok := buckets[start.Unix()]
+		if !ok {
+			b = &logBucket{Start: start, Counts: map[string]int{}}
+			buckets[start.Unix()] = b
+		}
+		b.Total++
+		b.Counts[level]++
+
+		if level != "error" && level != "fatal" && level != "panic" {
+			return true
+		}
+		msg, _ := entry["msg"].(string)
+		pattern := logErrorPattern(msg)
+		e, ok := errorsByPattern[pattern]
+		if !ok {
+			if len(errorsByPattern) >= maxDistinctErrors {
+				return true
+			}
+			e = &recurringError{Message: pattern}
+			errorsByPattern[pattern] = e
+		}
+		e.Count++
+		if logTime.After(e.LastSeen) {
+			e.LastSeen = logTime
+		}
+		return true
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error reading log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+	if skipped > 0 {
+		logCtx(c).Warnf("Skipped %d log lines longer than %d bytes", skipped, maxLogLineBytes)
+	}
+
+	series := make([]*logBucket, 0, len(buckets))
+	for _, b := range buckets {
+		series = append(series, b)
+	}
+	sort.Slice(series, func(i, j int) bool { return series[i].Start.Before(series[j].Start) })
+
+	recurring := make([]*recurringError, 0, len(errorsByPattern))
+	for _, e := range errorsByPattern {
+		recurring = append(recurring, e)
+	}
+	sort.Slice(recurring, func(i, j int) bool {
+		if recurring[i].Count != recurring[j].Count {
+			return recurring[i].Count > recurring[j].Count
+		}
+		return recurring[i].Message < recurring[j].Message
+	})
+	if len(recurring) > top {
+		recurring = recurring[:top]
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"interval":   interval,
+		"total":      total,
+		"by_level":   totals,
+		"buckets":    series,
+		"top_errors": recurring,
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+const logStoreBatchSize = 500
+
+// LogEntry is a log entry stored in the database (log.database.enabled).
+// The fields /logs filters on have their own columns; the rest are kept as
+// a JSON object in Fields.
+type LogEntry struct {
+	ID        uint64    `gorm:"primaryKey"`
+	Time      time.Time `gorm:"not null;index"`
+	Level     string    `gorm:"size:16;not null;index"`
+	Message   string    `gorm:"type:text"`
+	Source    string    `gorm:"size:32;index"`
+	RequestID string    `gorm:"size:128;index"`
+	JobID     string    `gorm:"size:36;index"`
+	Fields    string    `gorm:"type:text"`
+}
+
+func (LogEntry) TableName() string { return "logs" }
+
+func newLogEntry(e *logrus.Entry) LogEntry {
+	entry := LogEntry{Time: e.Time.UTC(), Level: e.Level.String(), Message: e.Message}
+	fields := make(map[string]interface{}, len(e.Data))
+	for k, v := range e.Data {
+		switch k {
+		case "source":
+			entry.Source = truncate(fmt.Sprint(v), 32)
+		case "request_id":
+			entry.RequestID = truncate(fmt.Sprint(v), 128)
+		case "job_id":
+			entry.JobID = truncate(fmt.Sprint(v), 36)
+		default:
+			// As logrus.JSONFormatter does, so errors aren't stored as {}.
+			if err, ok := v.(error); ok {
+				v = err.Error()
+			}
+			fields[k] = v
+		}
+	}
+	if len(fields) > 0 {
+		if data, err := json.Marshal(fields); err == nil {
+			entry.Fields = string(data)
+		}
+	}
+	return entry
+}
+
+// asMap returns the entry as it appears in the log file.
+func (e LogEntry) asMap() map[string]interface{} {
+	m := map[string]interface{}{}
+	if e.Fields != "" {
+		json.Unmarshal([]byte(e.Fields), &m)
+	}
+	m["time"] = e.Time.In(cfg.Location()).Format(time.RFC3339)
+	m["level"] = e.Level
+	m["msg"] = e.Message
+	for k, v := range map[string]string{"source": e.Source, "request_id": e.RequestID, "job_id": e.JobID} {
+		if v != "" {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func truncate(s string, n int) string {
+	if len(s) > n {
+		return s[:n]
+	}
+	return s
+}
+
+// logStore is a logrus hook that writes entries to the database in batches
+// from a background goroutine, so logging never waits on the database.
+type logStore struct {
+	entries chan LogEntry
+	stop    chan struct{}
+	done    chan struct{}
+	failing bool
+}
+
+var logDB *logStore
+
+// initLogStore starts storing log entries in the database when
+// log.database.enabled is set. It needs the logs table, so it runs after
+// the schema is prepared.
+func initLogStore() {
+	if !cfg.Log.Database.Enabled {
+		return
+	}
+	logDB = &logStore{
+		entries: make(chan LogEntry, cfg.Log.Database.BufferSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go logDB.run()
+	logr.AddHook(logDB)
+	logr.Info("Storing log entries in the database")
+}
+
+func (s *logStore) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (s *logStore) Fire(e *logrus.Entry) error {
+	select {
+	case s.entries <- newLogEntry(e):
+	default:
+		logEntriesDropped.Inc()
+	}
+	return nil
+}
+
+func (s *logStore) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(cfg.Log.Database.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]LogEntry, 0, logStoreBatchSize)
+	for {
+		select {
+		case e := <-s.entries:
+			batch = append(batch, e)
+			if len(batch) < logStoreBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-s.stop:
+			for {
+				select {
+				case e := <-s.entries:
+					batch = append(batch, e)
+				default:
+					s.write(batch)
+					return
+				}
+			}
+		}
+		s.write(batch)
+		batch = batch[:0]
+	}
+}
+
+// write inserts a batch. While the database is failing, entries are dropped
+// and only the first error is logged, so the failure doesn't feed itself.
+func (s *logStore) write(batch []LogEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := db.CreateInBatches(&batch, logStoreBatchSize).Error; err != nil {
+		logEntriesDropped.Add(float64(len(batch)))
+		if !s.failing {
+			logr.Errorf("Error storing log entries in the database, dropping them until it recovers: %v", err)
+		}
+		s.failing = true
+		return
+	}
+	if s.failing {
+		logr.Info("Storing log entries in the database again")
+		s.failing = false
+	}
+}
+
+// flushLogStore writes the entries still buffered at shutdown.
+func flushLogStore() {
+	if logDB == nil {
+		return
+	}
+	close(logDB.stop)
+	select {
+	case <-logDB.done:
+	case <-time.After(5 * time.Second):
+		logr.Warn("Timed out writing buffered log entries to the database")
+	}
+}
+
+// logColumns are the fields stored in columns of their own.
+var logColumns = map[string]string{"level": "level", "msg": "message", "source": "source", "request_id": "request_id", "job_id": "job_id"}
+
+// query narrows q to the entries the filter matches, except for regex,
+// which SQL databases don't support alike, and field filters on fields
+// without a column.
+func (f logFilter) query(q *gorm.DB) *gorm.DB {
+	if !f.start.IsZero() {
+		q = q.Where("time >= ?", f.start.UTC())
+	}
+	if !f.end.IsZero() {
+		q = q.Where("time < ?", f.end.UTC())
+	}
+	if f.level != "" {
+		q = q.Where("level = ?", f.level)
+	}
+	if f.source != "" {
+		q = q.Where("source = ?", f.source)
+	}
+	if f.requestID != "" {
+		q = q.Where("request_id = ?", f.requestID)
+	}
+	if f.jobID != "" {
+		q = q.Where("job_id = ?", f.jobID)
+	}
+	if f.msg != "" {
+		q = q.Where("LOWER(message) LIKE ? ESCAPE '!'", "%"+likeEscaper.Replace(f.msg)+"%")
+	}
+	for name, want := range f.fields {
+		if column, ok := logColumns[name]; ok {
+			q = q.Where(column+" = ?", want)
+		}
+	}
+	return q
+}
+
+// filtersInSQL reports whether query applies the whole filter.
+func (f logFilter) filtersInSQL() bool {
+	if f.regex != nil {
+		return false
+	}
+	for name := range f.fields {
+		if _, ok := logColumns[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+// searchLogStore answers /logs from the logs table. A regex and filters on
+// fields without a column are applied to the rows the rest selects.
+func searchLogStore(c *gin.Context, f logFilter, order logOrder, page, limit int) {
+	q := f.query(db.WithContext(c.Request.Context()).Model(&LogEntry{}))
+	var entries []LogEntry
+	var total int64
+	if f.filtersInSQL() {
+		err := q.Count(&total).Error
+		if err == nil {
+			err = q.Order(order.sql()).Offset((page - 1) * limit).Limit(limit).Find(&entries).Error
+		}
+		if err != nil {
+			logCtx(c).Errorf("Error querying stored logs: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query logs"})
+			return
+		}
+	} else {
+		rows, err := q.Order(order.sql()).Rows()
+		if err != nil {
+			logCtx(c).Errorf("Error querying stored logs: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query logs"})
+			return
+		}
+		defer rows.Close()
+		skip := int64((page - 1) * limit)
+		for rows.Next() {
+			var e LogEntry
+			if err := db.ScanRows(rows, &e); err != nil {
+				logCtx(c).Errorf("Error reading stored log entry: %v", err)
+				continue
+			}
+			if !f.match(c, e.asMap()) {
+				continue
+			}
+			total++
+			if total > skip && len(entries) < limit {
+				entries = append(entries, e)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			logCtx(c).Errorf("Error querying stored logs: %v", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to query logs"})
+			return
+		}
+	}
+
+	logs := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		logs = append(logs, e.asMap())
+	}
+	setRowsAffected(c, int64(len(logs)))
+	setAuditEvent(c, "logs.search", fmt.Sprintf("%d of %d matching entries", len(logs), total))
+	c.JSON(http.StatusOK, gin.H{"logs": logs, "total": total, "page": page, "limit": limit})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const logTailBuffer = 256
+
+// logTailer receives every entry written to the log file and passes it to
+// the open GET /logs/tail streams. logrus calls Write with its lock held, so
+// Write must never log or block; filtering happens in each stream.
+type logTailer struct {
+	mu     sync.Mutex
+	subs   map[*logTailSub]struct{}
+	closed bool
+}
+
+type logTailSub struct {
+	lines   chan []byte
+	dropped atomic.Int64
+}
+
+var logTail = &logTailer{subs: make(map[*logTailSub]struct{})}
+
+func (t *logTailer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.subs) == 0 {
+		return len(p), nil
+	}
+	line := append([]byte(nil), p...)
+	for sub := range t.subs {
+		select {
+		case sub.lines <- line:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+	return len(p), nil
+}
+
+func (t *logTailer) subscribe() (*logTailSub, func()) {
+	sub := &logTailSub{lines: make(chan []byte, logTailBuffer)}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		close(sub.lines)
+		return sub, func() {}
+	}
+	t.subs[sub] = struct{}{}
+	return sub, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if _, ok := t.subs[sub]; ok {
+			delete(t.subs, sub)
+			close(sub.lines)
+		}
+	}
+}
+
+// close ends every stream so server shutdown isn't held up by them.
+func (t *logTailer) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for sub := range t.subs {
+		delete(t.subs, sub)
+		close(sub.lines)
+	}
+}
+
+// tailLogs streams new log entries matching the /logs filters as
+// server-sent "log" events. If the client falls behind, entries are dropped
+// and a "dropped" event says how many.
+func tailLogs(c *gin.Context) {
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sub, unsubscribe := logTail.subscribe()
+	defer unsubscribe()
+	logCtx(c).Infof("Log tail opened")
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	var sent int64
+	defer func() {
+		setRowsAffected(c, sent)
+		setAuditEvent(c, "logs.tail", fmt.Sprintf("%d entries streamed", sent))
+	}()
+	keepOpen := time.NewTicker(jobEventKeepOpen)
+	defer keepOpen.Stop()
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case line, ok := <-sub.lines:
+			if !ok {
+				return false
+			}
+			if n := sub.dropped.Swap(0); n > 0 {
+				if _, err := fmt.Fprintf(w, "event: dropped\ndata: {\"dropped\":%d}\n\n", n); err != nil {
+					return false
+				}
+			}
+			var entry map[string]interface{}
+			if err := json.Unmarshal(line, &entry); err != nil || !filter.match(c, entry) {
+				return true
+			}
+			_, err := fmt.Fprintf(w, "event: log\ndata: %s\n\n", bytes.TrimRight(line, "\r\n"))
+			sent++
+			return err == nil
+		case <-keepOpen.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
@@ -1,35 +1,74 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/http/pprof"
 	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
-	"gorm.io/driver/postgres"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/gorm"
 )
 
 type Employee struct {
-	ID         uint   `gorm:"primaryKey"`
-	FirstName  string `gorm:"index"`
-	LastName   string
-	Email      string
-	Age        int
-	Gender     string
-	Department string
-	Company    string
-	Salary     float64
-	DateJoined string
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"size:64;not null;default:'default';index;uniqueIndex:idx_employees_tenant_email"`
+	FirstName string `gorm:"index"`
+	LastName  string
+	// Email is unique within the tenant, stored lowercase.
+	Email  string `gorm:"size:254;uniqueIndex:idx_employees_tenant_email"`
+	Age    int
+	Gender string
+	// Department and Company are the names of the rows DepartmentID and
+	// CompanyID point to. They are only read back when selected with
+	// withComputedFields, and written by resolving them to IDs.
+	Department   string  `gorm:"->;-:migration"`
+	Company      string  `gorm:"->;-:migration"`
+	DepartmentID *uint   `gorm:"index"`
+	CompanyID    *uint   `gorm:"index"`
+	Salary       float64 `gorm:"index"`
+	// Currency is the ISO 4217 code of Salary.
+	Currency string `gorm:"size:3"`
+	// Extra holds the values of CSV columns past the fixed schema.
+	Extra extraAttributes
+	// DateJoined is a day, stored as midnight UTC; nil when the file left
+	// it blank.
+	DateJoined *time.Time `gorm:"index"`
 	IsActive   bool
+	// CreatedAt and UpdatedAt are kept by GORM. Rows created before they
+	// were recorded carry the time of that migration.
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
+	// TenureYears (full years since DateJoined) and AgeBand are worked out
+	// in SQL by withComputedFields, and never stored.
+	TenureYears *int   `gorm:"->;-:migration"`
+	AgeBand     string `gorm:"->;-:migration"`
+	// DeletedAt is set on records merged into another, which GORM then
+	// leaves out of queries.
+	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	// AnonymizedAt is when the record's personal data was scrubbed.
+	AnonymizedAt *time.Time `gorm:"index"`
+	// ImportJobID is the import that last wrote the record, empty for
+	// records created through the API or before it was recorded.
+	ImportJobID string `gorm:"size:36;index"`
 }
 
 var (
@@ -38,281 +77,876 @@ var (
 )
 
 func main() {
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+func serve(args []string) int {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var err error
+	cfg, err = loadConfig(fs, args)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	serveArgs = args
 	initLogger()
-	initDB()
+	initTracing()
+
+	var handler http.Handler
+	if cfg.Server.StartupProbe {
+		startup := newStartupHandler()
+		go startup.install(setupApp)
+		handler = startup
+	} else {
+		handler = setupApp()
+	}
+	if err := runServer(handler, cfg.Server.Addr); err != nil {
+		log.Fatalf("Failed to start server: %v", err)
+	}
+	return 0
+}
 
-	r := gin.Default()
+// setupApp connects to the database and builds the router.
+func setupApp() http.Handler {
+	connectDB()
+	instrumentDB()
+	connectReplicas()
+	prepareSchema()
+	initLogStore()
+	initLogShipping()
+	registerDBMetrics()
+	initOIDC()
+	initExports()
+	initUploads()
+	initJobQueue()
+	startTokenPruner()
+	startFeatureRefresher(30 * time.Second)
+	startErrorRateMonitor()
+	startLogAlerts()
+	startLogPruner()
+	startScheduler()
+	startRetention()
+
+	r := gin.New()
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		logr.Fatalf("Invalid trusted proxies: %v", err)
+	}
+	r.Use(requestIDMiddleware())
+	r.Use(accessLogMiddleware())
+	r.Use(gin.RecoveryWithWriter(logr.WriterLevel(logrus.ErrorLevel)))
+	r.Use(tracingMiddleware())
+	r.Use(metricsMiddleware())
+	r.Use(corsMiddleware(cfg.CORS))
 	r.Use(func(c *gin.Context) {
-		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, 50<<30) // 50GB limit
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, cfg.Server.MaxBodyBytes)
 		c.Next()
 	})
-
-	r.GET("/", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Welcome to the API",
-			"routes": gin.H{
-				"/upload":  "POST - Upload a CSV file",
-				"/records": "GET - Get paginated records",
-				"/count":   "GET - Get total record count",
-				"/logs":    "GET - Analyze application logs",
-			},
-		})
-	})
-
-	r.POST("/upload", handleFileUpload)
-	r.GET("/records", getPaginatedRecords)
-	r.GET("/count", getRowCount)
-	r.GET("/logs", analyzeLogs)
-
-	logr.Info("Starting server on port 8080")
-	if err := r.Run(":8080"); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	r.Use(auditMiddleware())
+
+	r.GET("/", routeIndex(r))
+	r.GET("/healthz", healthz)
+	r.GET("/livez", livez)
+	r.GET("/readyz", readyz)
+	r.GET("/metrics", ipFilter(cfg.AdminIPFilter), metricsHandler())
+	r.GET("/version", ipFilter(cfg.AdminIPFilter), getVersion)
+
+	r.GET("/auth/oidc/login", oidcLogin)
+	r.GET("/auth/oidc/callback", oidcCallback)
+	r.GET("/exports/download/:id", downloadExport)
+	r.POST("/auth/login", login)
+	r.POST("/auth/refresh", refreshTokens)
+
+	api := r.Group("/", requireAuth(), csrfProtect(), maintenanceGuard())
+	adminIPs := ipFilter(cfg.AdminIPFilter)
+
+	api.POST("/auth/logout", logout)
+	api.GET("/auth/csrf", getCSRFToken)
+	api.POST("/upload", adminIPs, requireRole(roleEditor), handleFileUpload)
+	api.GET("/records", requireRole(roleViewer), getPaginatedRecords)
+	api.POST("/records", requireRole(roleEditor), createRecord)
+	api.PUT("/records/:id", requireRole(roleEditor), updateRecord)
+	api.POST("/records/merge", requireRole(roleEditor), mergeRecords)
+	api.GET("/records/:id/as-of", requireRole(roleViewer), getRecordAsOf)
+	api.POST("/records/anonymize", requireRole(roleAdmin), anonymizeRecords)
+	api.POST("/records/forget", requireRole(roleAdmin), forgetRecords)
+	api.POST("/records/forget/verify", requireRole(roleAdmin), verifyDeletionCertificate)
+	api.GET("/retention/policies", requireRole(roleViewer), listRetentionPolicies)
+	api.POST("/retention/policies", requireRole(roleAdmin), createRetentionPolicy)
+	api.GET("/retention/policies/:id", requireRole(roleViewer), getRetentionPolicy)
+	api.PUT("/retention/policies/:id", requireRole(roleAdmin), updateRetentionPolicy)
+	api.DELETE("/retention/policies/:id", requireRole(roleAdmin), deleteRetentionPolicy)
+	api.POST("/retention/policies/:id/run", requireRole(roleAdmin), runRetentionPolicyNow)
+	api.GET("/retention/preview", requireRole(roleViewer), previewRetention)
+	api.GET("/validation-rules", requireRole(roleAdmin), listValidationRules)
+	api.POST("/validation-rules", requireRole(roleAdmin), createValidationRule)
+	api.PUT("/validation-rules/:id", requireRole(roleAdmin), updateValidationRule)
+	api.DELETE("/validation-rules/:id", requireRole(roleAdmin), deleteValidationRule)
+	for _, kind := range referenceKinds {
+		api.GET("/"+kind.table, requireRole(roleViewer), kind.list)
+		api.GET("/"+kind.table+"/:id", requireRole(roleViewer), kind.get)
+		api.POST("/"+kind.table, requireRole(roleEditor), kind.create)
+		api.PUT("/"+kind.table+"/:id", requireRole(roleEditor), kind.rename)
+		api.DELETE("/"+kind.table+"/:id", requireRole(roleEditor), kind.delete)
 	}
+	api.GET("/datasets", requireRole(roleViewer), listDatasets)
+	api.POST("/datasets", requireRole(roleAdmin), createDataset)
+	api.GET("/datasets/:name", requireRole(roleViewer), getDataset)
+	api.DELETE("/datasets/:name", requireRole(roleAdmin), deleteDataset)
+	api.POST("/datasets/:name/upload", requireRole(roleEditor), uploadDatasetRows)
+	api.GET("/datasets/:name/records", requireRole(roleViewer), getDatasetRows)
+	api.GET("/analytics/salary", requireRole(roleViewer), salaryAnalytics)
+	api.POST("/outliers/scan", requireRole(roleEditor), scanOutliers)
+	api.GET("/outliers", requireRole(roleViewer), listOutliers)
+	api.POST("/outliers/:id/accept", requireRole(roleEditor), acceptOutlier)
+	api.POST("/outliers/:id/fix", requireRole(roleEditor), fixOutlier)
+	api.GET("/allowed-values", requireRole(roleViewer), listAllowedValues)
+	api.GET("/allowed-values/unknown", requireRole(roleViewer), listUnknownValues)
+	api.POST("/allowed-values", requireRole(roleAdmin), createAllowedValue)
+	api.PUT("/allowed-values/:id", requireRole(roleAdmin), updateAllowedValue)
+	api.DELETE("/allowed-values/:id", requireRole(roleAdmin), deleteAllowedValue)
+	api.GET("/count", requireRole(roleViewer), getRowCount)
+	api.GET("/audit", requireRole(roleAdmin), getAuditEntries)
+	api.POST("/exports", requireRole(roleViewer), createExport)
+	api.GET("/exports/:id", requireRole(roleViewer), getExport)
+	api.GET("/jobs", requireRole(roleViewer), listJobs)
+	api.GET("/jobs/events", requireRole(roleViewer), streamJobEvents)
+	api.GET("/jobs/:id", requireRole(roleViewer), getJob)
+	api.GET("/jobs/:id/logs", requireRole(roleViewer), getJobLogs)
+	api.POST("/jobs/:id/retry", requireRole(roleEditor), retryJob)
+	api.POST("/jobs/:id/cancel", requireRole(roleEditor), cancelJob)
+	api.POST("/jobs/:id/pause", requireRole(roleEditor), pauseJob)
+	api.POST("/jobs/:id/resume", requireRole(roleEditor), resumeJob)
+	api.GET("/schedules", requireRole(roleViewer), listSchedules)
+	api.POST("/schedules", requireRole(roleAdmin), createSchedule)
+	api.GET("/schedules/:id", requireRole(roleViewer), getSchedule)
+	api.PUT("/schedules/:id", requireRole(roleAdmin), updateSchedule)
+	api.DELETE("/schedules/:id", requireRole(roleAdmin), deleteSchedule)
+	api.POST("/schedules/:id/run", requireRole(roleEditor), runScheduleNow)
+
+	admin := r.Group("/", adminIPs, requireAdminToken())
+	admin.GET("/logs", analyzeLogs)
+	admin.GET("/logs/stats", logStats)
+	admin.GET("/logs/tail", tailLogs)
+	admin.GET("/logs/download", downloadLogs)
+	admin.GET("/logs/latency", logLatency)
+	admin.GET("/logs/slow-queries", logSlowQueries)
+	admin.GET("/admin/tenants", listTenants)
+	admin.POST("/admin/tenants", createTenant)
+	admin.GET("/admin/tenants/:id/api-keys", listAPIKeys)
+	admin.POST("/admin/tenants/:id/api-keys", createAPIKey)
+	admin.DELETE("/admin/api-keys/:id", revokeAPIKey)
+	admin.PUT("/admin/api-keys/:id/callback", setAPIKeyCallback)
+	admin.POST("/admin/tenants/:id/users", createUser)
+	admin.PUT("/admin/users/:id", updateUser)
+	admin.POST("/admin/db/rotate-credentials", rotateDBCredentials)
+	admin.GET("/admin/db/stats", getDBStats)
+	admin.GET("/admin/db/index-advisor", indexAdvisor)
+	admin.GET("/admin/log-level", getLogLevel)
+	admin.PUT("/admin/log-level", setLogLevel)
+	admin.POST("/admin/config/reload", reloadConfigHandler)
+	admin.POST("/admin/logs/cleanup", cleanupLogsHandler)
+	admin.GET("/admin/workers", getWorkers)
+	admin.PUT("/admin/workers", setWorkers)
+	admin.GET("/admin/maintenance", getMaintenance)
+	admin.PUT("/admin/maintenance", setMaintenance)
+	admin.GET("/admin/features", listFeatures)
+	admin.PUT("/admin/features/:name", setFeature)
+	admin.DELETE("/admin/features/:name", clearFeature)
+	admin.GET("/debug/vars", debugVars)
+	admin.GET("/debug/pprof/*name", debugPprof)
+	admin.POST("/debug/pprof/symbol", gin.WrapF(pprof.Symbol))
+	return r
 }
 
 func initLogger() {
-	logFile, err := os.OpenFile("logs/app.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
+	if err := os.MkdirAll(filepath.Dir(cfg.Log.File), os.ModePerm); err != nil {
+		log.Fatalf("Failed to create log directory: %v", err)
+	}
+	logFile := newLogWriter(cfg.Log)
+	if _, err := logFile.Write(nil); err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
-	logr.Out = logFile
+	level, _ := logrus.ParseLevel(cfg.Log.Level)
+	logr.Out = io.MultiWriter(logFile, logTail)
 	logr.SetFormatter(&logrus.JSONFormatter{})
-	logr.SetLevel(logrus.InfoLevel)
+	logr.SetLevel(level)
+	if conf := cfg.Log.Redact; len(conf.Fields) > 0 || len(conf.Patterns) > 0 {
+		logr.AddHook(newLogRedactor(conf))
+	}
 }
 
-func initDB() {
-	var err error
-	dbcon := "host=postgres user=ArnavJain password=admin dbname=CSV_db port=5432 sslmode=disable TimeZone=UTC"
-
-	for i := 0; i < 10; i++ {
-		db, err = gorm.Open(postgres.Open(dbcon), &gorm.Config{})
-		if err == nil {
-			break
-		}
-		logr.Warnf("Database not ready, retrying in 5 seconds... (%d/10)", i+1)
-		time.Sleep(5 * time.Second)
+func connectDB() {
+	source, err := newCredentialSource(cfg.DB)
+	if err != nil {
+		logr.Fatalf("Invalid database secrets configuration: %v", err)
 	}
+	dbCredentials = newCredentialCache(source, cfg.DB.SecretsRefresh)
 
+	sqlDB, dialector, err := openDatabase(cfg.DB)
+	if err != nil {
+		logr.Fatalf("Invalid database configuration: %v", err)
+	}
+	configurePool(sqlDB, cfg.DB)
+	err = dbRetryPolicy().do(context.Background(), "Connecting to database", anyError, func() error {
+		db, err = gorm.Open(dialector, &gorm.Config{Logger: slowQueryLogger{}})
+		return err
+	})
 	if err != nil {
-		logr.Fatalf("Failed to connect to database after 10 attempts: %v", err)
+		logr.Fatalf("Failed to connect to database: %v", err)
+	}
+	if err := registerVersioning(db); err != nil {
+		logr.Fatalf("Failed to register record versioning: %v", err)
+	}
+	if cfg.DB.MaxOpenConns > 0 && cfg.DB.MaxOpenConns <= cfg.Import.Workers {
+		logr.Warnf("db.max_open_conns (%d) does not leave room for API traffic alongside %d import workers", cfg.DB.MaxOpenConns, cfg.Import.Workers)
 	}
+}
 
-	if err := db.AutoMigrate(&Employee{}); err != nil {
+func migrateDB() {
+	if err := newMigrator().Migrate(); err != nil {
 		logr.Fatalf("Migration failed: %v", err)
 	}
+	logr.Info("Database migrations applied")
+}
+
+// prepareSchema migrates on startup when db.auto_migrate is set and otherwise
+// refuses to serve until "main migrate" has brought the schema up to date.
+func prepareSchema() {
+	if cfg.DB.AutoMigrate {
+		migrateDB()
+	} else if err := requireCurrentSchema(); err != nil {
+		logr.Fatalf("Refusing to start: %v", err)
+	}
+	if err := ensureDefaultTenant(); err != nil {
+		logr.Fatalf("Failed to create default tenant: %v", err)
+	}
+	if err := loadEmployeePartitioning(); err != nil {
+		logr.Fatalf("Failed to read employee partitioning: %v", err)
+	}
+	migrationsApplied.Store(true)
 	logr.Info("Database initialized successfully")
 }
 
 func handleFileUpload(c *gin.Context) {
 	file, err := c.FormFile("file")
 	if err != nil {
-		logr.Errorf("Error receiving file: %v", err)
+		logCtx(c).Errorf("Error receiving file: %v", err)
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to upload file"})
 		return
 	}
 
-	logr.Infof("Received file: %s", file.Filename)
+	originalName, err := uploadFileName(file)
+	if err != nil {
+		logCtx(c).Warnf("Rejected upload: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	uploadDir := "./uploads"
-	if err := os.MkdirAll(uploadDir, os.ModePerm); err != nil {
-		logr.Errorf("Error creating upload directory: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create upload directory"})
+	logCtx(c).Infof("Received file: %s", originalName)
+
+	idempotencyHash, err := uploadIdempotencyHash(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if idempotencyHash != nil && replayUpload(c, *idempotencyHash, originalName, file.Size) {
 		return
 	}
 
-	filepath := uploadDir + "/" + file.Filename
-	err = c.SaveUploadedFile(file, filepath)
+	priority := defaultImportPriority
+	if v := c.Query("priority"); v != "" {
+		priority, err = strconv.Atoi(v)
+		if err != nil || priority < minImportPriority || priority > maxImportPriority {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid priority, must be %d to %d", minImportPriority, maxImportPriority)})
+			return
+		}
+	}
+
+	dateFormat := c.Query("date_format")
+	if dateFormat == dateFormatAuto {
+		dateFormat = ""
+	}
+	if dateFormat != "" && !validDateFormat(dateFormat) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date_format, must be auto, iso, mdy, dmy or excel"})
+		return
+	}
+
+	callbackURL := c.Query("callback_url")
+	if callbackURL != "" {
+		if err := validCallbackURL(callbackURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	} else {
+		callbackURL = c.GetString(ctxCallbackURL)
+	}
+
+	job := ImportJob{
+		ID:           uuid.NewString(),
+		TenantID:     tenantID(c),
+		CreatedBy:    c.GetString(ctxActor),
+		OriginalName: originalName,
+		Size:         file.Size,
+		Priority:     priority,
+		CallbackURL:  callbackURL,
+		DateFormat:   dateFormat,
+
+		IdempotencyHash: idempotencyHash,
+	}
+	src, err := file.Open()
+	if err != nil {
+		logCtx(c).Errorf("Error opening uploaded file: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+	hash := sha256.New()
+	var lines lineCounter
+	job.StoredPath, err = uploads.Save(c.Request.Context(), job.ID+".csv", io.TeeReader(src, io.MultiWriter(hash, &lines)))
+	src.Close()
+	job.Checksum = hex.EncodeToString(hash.Sum(nil))
 	if err != nil {
-		logr.Errorf("Error saving file to %s: %v", filepath, err)
+		logCtx(c).Errorf("Error saving file %s: %v", originalName, err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
 	}
 
-	logr.Infof("File uploaded successfully to %s", filepath)
+	if err := db.WithContext(c.Request.Context()).Create(&job).Error; err != nil {
+		if err := uploads.Remove(context.WithoutCancel(c.Request.Context()), job.StoredPath); err != nil {
+			logCtx(c).Warnf("Error removing %s: %v", job.StoredPath, err)
+		}
+		// A concurrent request with the same key got there first.
+		if idempotencyHash != nil && replayUpload(c, *idempotencyHash, originalName, file.Size) {
+			return
+		}
+		logCtx(c).Errorf("Error recording import job for %s: %v", originalName, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record import job"})
+		return
+	}
 
-	go processCSV(filepath)
-	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully, processing started"})
+	tagRequestWithJob(c, job.ID)
+	logCtx(c).Infof("File %s uploaded successfully to %s (job %s)", originalName, job.StoredPath, job.ID)
+	publishJobEvent(c.Request.Context(), newJobStreamEvent(job, "import.created", jobPending))
+
+	if smallUpload(job.Size, int64(lines)) {
+		logCtx(c).Infof("Importing small file %s within the request (job %s)", originalName, job.ID)
+		runImportNow(c.Request.Context(), job)
+		if err := db.WithContext(c.Request.Context()).First(&job, "id = ?", job.ID).Error; err != nil {
+			logCtx(c).Errorf("Error loading import job %s: %v", job.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load import job"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "File imported", "job_id": job.ID, "job": job})
+		return
+	}
+	dispatchImport(c.Request.Context(), job)
+	c.JSON(http.StatusOK, gin.H{"message": "File uploaded successfully, processing started", "job_id": job.ID})
 }
 
-func processCSV(filepath string) {
-	file, err := os.Open(filepath)
+func processCSV(ctx context.Context, job ImportJob) {
+	ctx, span := tracer().Start(ctx, "import.processCSV", trace.WithAttributes(
+		attribute.String("import.job_id", job.ID),
+		attribute.String("import.tenant_id", job.TenantID),
+		attribute.Int64("import.file_size", job.Size),
+	))
+	defer span.End()
+
+	importJobsRunning.Inc()
+	defer importJobsRunning.Dec()
+	progress := trackImport(job)
+	defer untrackImport(job.ID)
+	var gate *pauseGate
+	if v, ok := runningImports.Load(job.ID); ok {
+		gate = &v.(*runningImport).gate
+	}
+
+	err := dbRetryPolicy().do(ctx, "Marking import job running", isConnectionError, func() error {
+		return db.WithContext(ctx).Model(&ImportJob{}).Where("id = ?", job.ID).Updates(map[string]interface{}{
+			"status":     jobRunning,
+			"started_at": time.Now().UTC(),
+		}).Error
+	})
 	if err != nil {
-		logr.Errorf("Error opening file: %v", err)
+		logCtx(ctx).Errorf("Error marking import job %s as running: %v", job.ID, err)
+	} else {
+		publishJobEvent(ctx, newJobStreamEvent(job, "import.started", jobRunning))
+	}
+
+	// Rules and allowed values are read once, so edits apply from the
+	// tenant's next import.
+	rules, err := loadRuleSet(ctx, job.TenantID)
+	if err != nil {
+		logCtx(ctx).Errorf("Error loading validation rules for tenant %s: %v", job.TenantID, err)
+		finishImportJob(ctx, job, jobFailed, checkpointCounts(job), "failed to load validation rules")
+		return
+	}
+	allowed, err := loadValueLists(ctx, job.TenantID)
+	if err != nil {
+		logCtx(ctx).Errorf("Error loading allowed values for tenant %s: %v", job.TenantID, err)
+		finishImportJob(ctx, job, jobFailed, checkpointCounts(job), "failed to load allowed values")
+		return
+	}
+
+	// A resumed job continues after its checkpoint; every row before it was
+	// inserted or failed on an earlier run. With a byte offset the file is
+	// opened just past the checkpoint row, so there is no header to skip.
+	file, err := uploads.OpenAt(ctx, job.StoredPath, job.CheckpointOffset)
+	if err != nil {
+		logCtx(ctx).Errorf("Error opening file: %v", err)
+		finishImportJob(ctx, job, jobFailed, checkpointCounts(job), "failed to open file")
 		return
 	}
 	defer file.Close()
 
 	reader := csv.NewReader(file)
-	_, err = reader.Read()
+	offset := func() int64 { return job.CheckpointOffset + reader.InputOffset() }
+	var rowsRead int64
+	rowsSkipped := job.RowsSkipped
+	quality := checkpointCounts(job).quality
+	var header []string
+	if job.CheckpointOffset > 0 {
+		rowsRead = job.CheckpointRow
+		header, err = readHeader(ctx, job)
+	} else {
+		header, err = reader.Read()
+	}
 	if err != nil {
-		logr.Errorf("Error reading header: %v", err)
+		logCtx(ctx).Errorf("Error reading header: %v", err)
+		finishImportJob(ctx, job, jobFailed, checkpointCounts(job), "failed to read header")
 		return
 	}
-
-	var wg sync.WaitGroup
-	ch := make(chan []Employee, 10)
-
-	for i := 0; i < 10; i++ {
-		wg.Add(1)
-		go batchInsert(ch, &wg)
+	// Columns past the fixed schema are kept on each record by header name.
+	extras := extraHeaders(header)
+	if job.CheckpointOffset == 0 {
+		for rowsRead < job.CheckpointRow {
+			if _, err := reader.Read(); err == io.EOF {
+				break
+			}
+			rowsRead++
+		}
+	}
+	progress.rowsRead.Store(rowsRead)
+	if rowsRead > 0 {
+		logCtx(ctx).Infof("Resuming import job %s after row %d (byte %d)", job.ID, rowsRead, offset())
 	}
 
-	batch := make([]Employee, 0, 100)
+	batches := newImportBatches(ctx, job, progress)
+	milestones := newProgressEvents(job)
+	stats := progress.stats
+	stopSampling := stats.sample(progress.rowsRead.Load, progress.rowsInserted.Load)
+	// import.batch_size is read for every batch, so changes made through
+	// PUT /admin/workers or a reload apply to running imports.
+	batch := make([]Employee, 0, cfg.Import.BatchSize)
+	interrupted := false
 	for {
+		if gate != nil && gate.isPaused() {
+			// Commit and checkpoint what was read, so the job's recorded
+			// progress is current for as long as it stays paused.
+			if len(batch) > 0 {
+				batches.submit(batch, rowsRead, offset(), rowsSkipped, quality.clone())
+				batch = make([]Employee, 0, cfg.Import.BatchSize)
+			}
+			batches.wait()
+			batches.saveCheckpointNow()
+			logCtx(ctx).Infof("Import job %s paused after row %d", job.ID, rowsRead)
+			stats.addPaused(gate.wait(ctx))
+		}
+		if ctx.Err() != nil {
+			interrupted = true
+			break
+		}
+		readStart := time.Now()
 		record, err := reader.Read()
+		stats.addRead(time.Since(readStart))
 		if err == io.EOF {
 			break
 		}
+		rowsRead++
+		progress.rowsRead.Store(rowsRead)
 		if err != nil {
-			logr.Errorf("Error reading record: %v", err)
+			logCtx(ctx).Errorf("Error reading record: %v", err)
+			importParseErrors.Inc()
+			quality.add(qualityUnreadable)
+			progress.fail(1, "row %d: %v", rowsRead, err)
+			continue
+		}
+		if blankRecord(record) {
+			rowsSkipped++
+			progress.rowsSkipped.Add(1)
 			continue
 		}
 
-		employee, parseErr := parseRecord(record)
+		parseStart := time.Now()
+		employee, parseErr := parseRecord(record, job.DateFormat)
+		stats.addParse(time.Since(parseStart))
 		if parseErr != nil {
-			logr.Errorf("Error parsing record: %v", parseErr)
+			logCtx(ctx).Errorf("Error parsing record: %v", parseErr)
+			importParseErrors.Inc()
+			quality.add(qualityUnreadable)
+			progress.fail(1, "row %d: %v", rowsRead, parseErr)
 			continue
 		}
+		employee.Extra = extraValues(extras, record)
+		errs := append(validateEmployee(&employee), allowed.normalize(&employee)...)
+		rejects, warnings := rules.check(&employee)
+		if len(warnings) > 0 {
+			logCtx(ctx).Warnf("Record at row %d breaks warn rules: %v", rowsRead, warnings)
+			importRuleViolations.WithLabelValues(severityWarn).Add(float64(len(warnings)))
+		}
+		if errs != nil || rejects != nil {
+			logCtx(ctx).Errorf("Invalid record at row %d: %v", rowsRead, append(errs, rejects...))
+			for _, e := range errs {
+				importRowsInvalid.WithLabelValues(e.Code).Inc()
+			}
+			importRuleViolations.WithLabelValues(severityReject).Add(float64(len(rejects)))
+			quality.add(validationCodes(append(errs, rejects...))...)
+			progress.fail(1, "row %d: %v", rowsRead, append(errs, rejects...))
+			continue
+		}
+		quality.add(append(validationCodes(warnings), qualityWarnings(record, &employee)...)...)
+		importRowsParsed.Inc()
+		employee.TenantID = job.TenantID
+		employee.ImportJobID = job.ID
+		progress.buffer(&employee)
 		batch = append(batch, employee)
-		if len(batch) >= 100 {
-			ch <- batch
-			batch = make([]Employee, 0, 100)
+		if len(batch) >= cfg.Import.BatchSize {
+			submitStart := time.Now()
+			batches.submit(batch, rowsRead, offset(), rowsSkipped, quality.clone())
+			stats.addBlocked(time.Since(submitStart))
+			milestones.update(ctx, offset(), progress)
+			batch = make([]Employee, 0, cfg.Import.BatchSize)
 		}
 	}
 
 	if len(batch) > 0 {
-		ch <- batch
+		batches.submit(batch, rowsRead, offset(), rowsSkipped, quality.clone())
+	}
+	waitStart := time.Now()
+	batches.wait()
+	stats.addBlocked(time.Since(waitStart))
+	stopSampling()
+
+	// Workers have drained, so every row read has an outcome.
+	counts := importCounts{
+		read:     rowsRead,
+		inserted: progress.rowsInserted.Load(),
+		updated:  progress.rowsUpdated.Load(),
+		skipped:  progress.rowsSkipped.Load(),
+		offset:   offset(),
+		quality:  quality,
+	}.withFailed()
+	// A stopped job resumes from its checkpoint, which must not pass rows of
+	// a batch that rolled back; a completed one reports them as failed.
+	if held, ok := batches.heldCounts(); ok && interrupted {
+		counts = held
+	}
+	if cause := context.Cause(ctx); interrupted && errors.Is(cause, errLeaseLost) {
+		logCtx(ctx).Warnf("CSV processing of job %s stopped at row %d, %v", job.ID, rowsRead, cause)
+		return
+	}
+	if cause := context.Cause(ctx); interrupted && errors.Is(cause, errImportCancelled) {
+		logCtx(ctx).Warnf("CSV processing of job %s %v at row %d", job.ID, cause, rowsRead)
+		finishImportJob(ctx, job, jobCancelled, counts, cause.Error())
+		return
+	}
+	if interrupted && gate != nil && gate.isPaused() {
+		logCtx(ctx).Warnf("Paused import job %s interrupted at row %d", job.ID, rowsRead)
+		finishImportJob(ctx, job, jobInterrupted, counts, "interrupted by shutdown while paused; retry to resume")
+		return
+	}
+	if interrupted {
+		logCtx(ctx).Warnf("CSV processing of job %s interrupted at row %d", job.ID, rowsRead)
+		finishImportJob(ctx, job, jobInterrupted, counts, "interrupted by shutdown")
+		return
+	}
+	status, summary := jobCompleted, ""
+	if first := progress.firstError.Load(); first != nil {
+		summary = fmt.Sprintf("%d of %d rows failed, first error: %s", counts.failed, counts.read, *first)
 	}
+	if counts.inserted == 0 && counts.failed > 0 {
+		status = jobFailed
+	}
+	finishImportJob(ctx, job, status, counts, summary)
+	logCtx(ctx).Infof("CSV processing completed: %d rows read, %d inserted, %d updated, %d skipped, %d failed",
+		counts.read, counts.inserted, counts.updated, counts.skipped, counts.failed)
+}
 
-	close(ch)
-	wg.Wait()
-	logr.Info("CSV processing completed")
+// blankRecord reports whether every field is empty or whitespace, as in the
+// trailing rows spreadsheets often export.
+func blankRecord(record []string) bool {
+	for _, field := range record {
+		if strings.TrimSpace(field) != "" {
+			return false
+		}
+	}
+	return true
 }
 
-func parseRecord(record []string) (Employee, error) {
+// parseRecord converts a data row. dateFormat is the job's date_format.
+func parseRecord(record []string, dateFormat string) (Employee, error) {
 	age, err := strconv.Atoi(record[4])
 	if err != nil {
 		return Employee{}, err
 	}
-	salary, err := strconv.ParseFloat(record[8], 64)
+	salary, currency, err := parseSalary(record[8], cfg.Currency.Default)
 	if err != nil {
 		return Employee{}, err
 	}
+	var dateJoined *time.Time
+	if strings.TrimSpace(record[9]) != "" {
+		t, err := parseDate(record[9], dateFormat)
+		if err != nil {
+			return Employee{}, err
+		}
+		dateJoined = &t
+	}
 	isActive := strings.ToLower(record[10]) == "true"
+	// Emails identify employees within a tenant, so they are compared
+	// without case.
+	email := strings.ToLower(strings.TrimSpace(record[3]))
 
 	return Employee{
 		FirstName:  record[1],
 		LastName:   record[2],
-		Email:      record[3],
+		Email:      email,
 		Age:        age,
 		Gender:     record[5],
 		Department: record[6],
 		Company:    record[7],
 		Salary:     salary,
-		DateJoined: record[9],
+		Currency:   currency,
+		DateJoined: dateJoined,
 		IsActive:   isActive,
 	}, nil
 }
 
-func batchInsert(ch chan []Employee, wg *sync.WaitGroup) {
-	defer wg.Done()
-
-	for batch := range ch {
-		if err := db.Create(&batch).Error; err != nil {
-			logr.Errorf("Error inserting batch: %v", err)
+// insertBatch commits one batch of an import, handling duplicate emails by
+// import.on_duplicate_email, and returns what became of its rows. Batches
+// are inserted even after the import is cancelled: the reader stops handing
+// out work, but rows already read are committed so the job checkpoint stays
+// consistent.
+func insertBatch(b *importBatches, batch []Employee) batchOutcome {
+	ctx := b.ctx
+	policy := cfg.Import.OnDuplicateEmail
+	// A batch is one transaction, so a dropped connection rolls it back and
+	// it can be sent again.
+	var out batchOutcome
+	err := dbRetryPolicy().do(ctx, "Inserting batch", isConnectionError, func() error {
+		return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			var err error
+			out, err = insertEmployees(tx, b.tenantID, batch, policy)
+			return err
+		})
+	})
+	defer b.progress.release(batch)
+	if err != nil {
+		logCtx(ctx).Errorf("Error inserting batch: %v", err)
+		importBatchFailures.Inc()
+		b.progress.fail(len(batch), "inserting batch of %d rows: %v", len(batch), err)
+		return batchOutcome{failed: len(batch), rolledBack: true}
+	}
+	b.progress.rowsInserted.Add(int64(out.inserted))
+	b.progress.rowsUpdated.Add(int64(out.updated))
+	b.progress.rowsSkipped.Add(int64(out.skipped))
+	if out.failed > 0 {
+		if out.duplicate != "" {
+			b.progress.fail(out.failed, "email %s is already imported", out.duplicate)
 		} else {
-			logr.Infof("Successfully inserted batch of %d records", len(batch))
+			b.progress.fail(out.failed, "%d rows had emails imported concurrently", out.failed)
 		}
 	}
+	importRowsInserted.Add(float64(out.inserted))
+	logCtx(ctx).Infof("Inserted batch of %d records: %v", len(batch), out)
+	return out
 }
 
 func getRowCount(c *gin.Context) {
 	var count int64
-	result := db.Model(&Employee{}).Count(&count)
+	result := db.WithContext(c.Request.Context()).Model(&Employee{}).Scopes(tenantScope(c)).Count(&count)
 	if result.Error != nil {
-		logr.Errorf("Error counting rows: %v", result.Error)
+		logCtx(c).Errorf("Error counting rows: %v", result.Error)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count rows"})
 		return
 	}
 	c.JSON(http.StatusOK, gin.H{"total_rows": count})
 }
 
+// updatedSinceScope limits records to those changed at or after
+// updated_since, a date or timestamp, so a consumer can sync only what
+// changed since its last pull.
+func updatedSinceScope(c *gin.Context) (func(*gorm.DB) *gorm.DB, error) {
+	v := c.Query("updated_since")
+	if v == "" {
+		return func(tx *gorm.DB) *gorm.DB { return tx }, nil
+	}
+	since, _, err := parseDayOrTime(v, cfg.Location())
+	if err != nil {
+		return nil, errors.New("Invalid updated_since, expected YYYY-MM-DD or an RFC3339 timestamp")
+	}
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("updated_at >= ?", since.UTC())
+	}, nil
+}
+
 func getPaginatedRecords(c *gin.Context) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
 	offset := (page - 1) * limit
 
-	sort := c.DefaultQuery("sort", "id")
-	order := c.DefaultQuery("order", "asc")
+	orderBy, err := parseSort(c, employeeSortColumns, "id")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	since, err := updatedSinceScope(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	refs, err := referenceFilterScope(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	extra, err := extraFilterScope(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
 	var employees []Employee
-	result := db.Order(sort + " " + order).Limit(limit).Offset(offset).Find(&employees)
+	result := db.WithContext(c.Request.Context()).Scopes(tenantScope(c), since, refs, extra, withComputedFields).Order(orderBy).Limit(limit).Offset(offset).Find(&employees)
 	if result.Error != nil {
-		logr.Errorf("Error retrieving paginated records: %v", result.Error)
+		logCtx(c).Errorf("Error retrieving paginated records: %v", result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve records"})
+		return
+	}
+
+	response, err := presentRecords(c, employees)
+	if err != nil {
+		logCtx(c).Errorf("Error serializing records: %v", err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve records"})
 		return
 	}
 
-	c.JSON(http.StatusOK, employees)
+	setRowsAffected(c, result.RowsAffected)
+	if !featureEnabled(featurePaginationEnvelope) {
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	var total int64
+	if err := db.WithContext(c.Request.Context()).Model(&Employee{}).Scopes(tenantScope(c), since, refs, extra).Count(&total).Error; err != nil {
+		logCtx(c).Errorf("Error counting records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve records"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": response, "page": page, "limit": limit, "total": total})
 }
 
 func analyzeLogs(c *gin.Context) {
-	startDate := c.Query("start_date")
-	endDate := c.Query("end_date")
-	level := c.Query("level")
-	source := c.Query("source")
-
-	logFile := "logs/app.log"
-	content, err := os.ReadFile(logFile)
+	filter, err := parseLogFilter(c)
 	if err != nil {
-		logr.Errorf("Error reading log file: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	order, err := parseLogOrder(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "100"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 100
+	}
 
-	var filteredLogs []map[string]interface{}
-	logs := strings.Split(string(content), "\n")
-	for _, logLine := range logs {
-		if logLine == "" {
-			continue
-		}
-
-		var logEntry map[string]interface{}
-		if err := json.Unmarshal([]byte(logLine), &logEntry); err != nil {
-			logr.Errorf("Error parsing log entry: %v", err)
-			continue
-		}
+	if logDB != nil {
+		searchLogStore(c, filter, order, page, limit)
+		return
+	}
 
-		if level != "" && logEntry["level"] != level {
-			continue
-		}
+	segments, err := logSegmentsBetween(filter.start, filter.end)
+	if err != nil {
+		logCtx(c).Errorf("Error listing log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
 
-		if startDate != "" || endDate != "" {
-			logTime, err := time.Parse(time.RFC3339, logEntry["time"].(string))
-			if err != nil {
-				logr.Errorf("Error parsing log time: %v", err)
-				continue
+	// The files are read twice so memory use doesn't grow with them: first
+	// to count the matches in each group (level, when sorting by level),
+	// then to keep the ones whose place in the requested order is on the
+	// page. The files are in time order, so a match's place follows from its
+	// group and how many of that group came before it.
+	scan := func(fn func(group int, line []byte)) error {
+		skipped, err := scanLogSegments(c.Request.Context(), segments, func(line []byte) bool {
+			if len(line) == 0 {
+				return true
 			}
-			if startDate != "" {
-				start, _ := time.Parse("2006-01-02", startDate)
-				if logTime.Before(start) {
-					continue
-				}
+			var logEntry map[string]interface{}
+			if err := json.Unmarshal(line, &logEntry); err != nil {
+				return true
 			}
-			if endDate != "" {
-				end, _ := time.Parse("2006-01-02", endDate)
-				if logTime.After(end) {
-					continue
-				}
+			if filter.match(c, logEntry) {
+				fn(order.group(logEntry), line)
 			}
+			return true
+		})
+		if skipped > 0 {
+			logCtx(c).Warnf("Skipped %d log lines longer than %d bytes", skipped, maxLogLineBytes)
 		}
+		return err
+	}
 
-		if source != "" && logEntry["source"] != source {
-			continue
+	counts := make([]int, order.groups())
+	err = scan(func(group int, _ []byte) { counts[group]++ })
+	offsets := make([]int, len(counts))
+	var total int
+	for i := range counts {
+		group := i
+		if order.desc {
+			group = len(counts) - 1 - i
 		}
-
-		filteredLogs = append(filteredLogs, logEntry)
+		offsets[group] = total
+		total += counts[group]
 	}
 
-	c.JSON(http.StatusOK, gin.H{"logs": filteredLogs})
+	type match struct {
+		place int
+		line  json.RawMessage
+	}
+	var matches []match
+	skip := (page - 1) * limit
+	if err == nil && skip < total {
+		seen := make([]int, len(counts))
+		err = scan(func(group int, line []byte) {
+			i := seen[group]
+			seen[group]++
+			// Entries logged since the first pass have no place.
+			if i >= counts[group] {
+				return
+			}
+			if order.desc {
+				i = counts[group] - 1 - i
+			}
+			if place := offsets[group] + i; place >= skip && place < skip+limit {
+				matches = append(matches, match{place, append(json.RawMessage(nil), line...)})
+			}
+		})
+	}
+	if err != nil {
+		logCtx(c).Errorf("Error reading log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].place < matches[j].place })
+	logs := make([]json.RawMessage, len(matches))
+	for i, m := range matches {
+		logs[i] = m.line
+	}
+	setRowsAffected(c, int64(len(logs)))
+	setAuditEvent(c, "logs.search", fmt.Sprintf("%d of %d matching entries", len(logs), total))
+	c.JSON(http.StatusOK, gin.H{"logs": logs, "total": total, "page": page, "limit": limit})
 }
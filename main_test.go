@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const testAdminToken = "test-admin-token"
+
+var testRouter http.Handler
+
+// TestMain builds the app once, on a SQLite database in a temporary
+// directory. Tests share it, and keep apart by each creating tenants of
+// their own with newTestTenant.
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	dir, err := os.MkdirTemp("", "mini-project-test-")
+	if err != nil {
+		log.Fatalf("Creating test directory: %v", err)
+	}
+
+	cfg = defaultConfig()
+	cfg.DB.Driver = "sqlite"
+	cfg.DB.SQLitePath = filepath.Join(dir, "app.db")
+	cfg.DB.TimeZone = cfg.TimeZone
+	cfg.DB.AutoMigrate = true
+	cfg.Log.File = filepath.Join(dir, "app.log")
+	cfg.Upload.Dir = filepath.Join(dir, "uploads")
+	cfg.Exports.Dir = filepath.Join(dir, "exports")
+	cfg.Auth.AdminToken = testAdminToken
+	cfg.JWT.Secret = strings.Repeat("j", 32)
+	cfg.Records.CertificateKey = strings.Repeat("c", 32)
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid test configuration:\n%v", err)
+	}
+	cfg.location, _ = time.LoadLocation(cfg.TimeZone)
+	logr.SetLevel(logrus.ErrorLevel)
+
+	testRouter = setupApp()
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// testCall sends a request to the app, with body encoded as JSON unless
+// it is already a string, and the given headers.
+func testCall(t *testing.T, method, path string, header map[string]string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatalf("encoding request body: %v", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if _, ok := body.(string); !ok && body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	testRouter.ServeHTTP(w, req)
+	return w
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func adminHeader() map[string]string {
+	return map[string]string{"X-Admin-Token": testAdminToken}
+}
+
+// decodeResponse fails the test unless w has status, and decodes its body
+// into v when v isn't nil.
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, status int, v interface{}) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body.String())
+	}
+	if v != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("decoding response %s: %v", w.Body.String(), err)
+		}
+	}
+}
+
+// newTestTenant creates a tenant and returns its ID with an admin API key.
+func newTestTenant(t *testing.T) (string, string) {
+	t.Helper()
+	id := "t-" + uuid.NewString()[:8]
+	decodeResponse(t, testCall(t, http.MethodPost, "/admin/tenants", adminHeader(), gin.H{"id": id}), http.StatusCreated, nil)
+	var created struct {
+		Key string `json:"key"`
+	}
+	w := testCall(t, http.MethodPost, "/admin/tenants/"+id+"/api-keys", adminHeader(), gin.H{"name": "test", "role": roleAdmin})
+	decodeResponse(t, w, http.StatusCreated, &created)
+	return id, created.Key
+}
+
+// createTestRecord creates a record through the API as the holder of key,
+// and returns its ID.
+func createTestRecord(t *testing.T, key, email string) uint {
+	t.Helper()
+	var record struct {
+		ID uint
+	}
+	w := testCall(t, http.MethodPost, "/records", bearer(key), testRecordBody(email))
+	decodeResponse(t, w, http.StatusCreated, &record)
+	return record.ID
+}
+
+// testRecordBody is a valid body for POST /records and PUT /records/:id.
+func testRecordBody(email string) gin.H {
+	return gin.H{
+		"FirstName": "Test", "LastName": "Person", "Email": email, "Age": 30, "Gender": "Female",
+		"Department": "Engineering", "Company": "Acme", "Salary": 50000, "DateJoined": "2020-01-02", "IsActive": true,
+	}
+}
+
+// waitForExport polls an export of the key's tenant until it has finished.
+func waitForExport(t *testing.T, key, id string) (ExportJob, string) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		var resp struct {
+			Export      ExportJob `json:"export"`
+			DownloadURL string    `json:"download_url"`
+		}
+		decodeResponse(t, testCall(t, http.MethodGet, "/exports/"+id, bearer(key), nil), http.StatusOK, &resp)
+		if resp.Export.Status != exportPending && resp.Export.Status != exportRunning {
+			return resp.Export, resp.DownloadURL
+		}
+	}
+	t.Fatalf("export %s did not finish", id)
+	return ExportJob{}, ""
+}
+
+// uploadTestCSV imports data as the holder of key, and returns the job
+// once it has finished.
+func uploadTestCSV(t *testing.T, key, data string) ImportJob {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "test.csv")
+	if err == nil {
+		_, err = io.WriteString(part, data)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := bearer(key)
+	header["Content-Type"] = form.FormDataContentType()
+	var uploaded struct {
+		JobID string `json:"job_id"`
+	}
+	decodeResponse(t, testCall(t, http.MethodPost, "/upload", header, body.String()), http.StatusOK, &uploaded)
+
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		var resp struct {
+			Job ImportJob `json:"job"`
+		}
+		decodeResponse(t, testCall(t, http.MethodGet, "/jobs/"+uploaded.JobID, bearer(key), nil), http.StatusOK, &resp)
+		switch resp.Job.Status {
+		case jobCompleted, jobFailed:
+			return resp.Job
+		}
+	}
+	t.Fatalf("import job %s did not finish", uploaded.JobID)
+	return ImportJob{}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMaintenanceRetryAfter = 5 * time.Minute
+
+// maintenance is this instance's maintenance state. It is deliberately kept
+// in memory: the database may be unavailable while it is on.
+var maintenance struct {
+	sync.RWMutex
+	enabled    bool
+	reason     string
+	since      time.Time
+	retryAfter time.Duration
+	by         string
+}
+
+func maintenanceStatus() gin.H {
+	maintenance.RLock()
+	defer maintenance.RUnlock()
+	status := gin.H{"enabled": maintenance.enabled}
+	if maintenance.enabled {
+		status["reason"] = maintenance.reason
+		status["since"] = maintenance.since
+		status["retry_after_seconds"] = int(maintenance.retryAfter.Seconds())
+		status["enabled_by"] = maintenance.by
+	}
+	return status
+}
+
+// maintenanceGuard rejects uploads and other mutations with 503 while
+// maintenance mode is on. Reads, sign-in and running jobs carry on.
+func maintenanceGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+		if strings.HasPrefix(c.Request.URL.Path, "/auth/") {
+			c.Next()
+			return
+		}
+		maintenance.RLock()
+		enabled, reason, retryAfter := maintenance.enabled, maintenance.reason, maintenance.retryAfter
+		maintenance.RUnlock()
+		if !enabled {
+			c.Next()
+			return
+		}
+		c.Header("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Service is in maintenance mode, writes are disabled", "reason": reason})
+	}
+}
+
+func getMaintenance(c *gin.Context) {
+	c.JSON(http.StatusOK, maintenanceStatus())
+}
+
+func setMaintenance(c *gin.Context) {
+	var req struct {
+		Enabled    *bool  `json:"enabled" binding:"required"`
+		Reason     string `json:"reason"`
+		RetryAfter string `json:"retry_after"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	retryAfter := defaultMaintenanceRetryAfter
+	if req.RetryAfter != "" {
+		d, err := time.ParseDuration(req.RetryAfter)
+		if err != nil || d < time.Second {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid retry_after, must be a duration of at least 1s"})
+			return
+		}
+		retryAfter = d
+	}
+
+	actor := c.GetString(ctxActor)
+	maintenance.Lock()
+	if *req.Enabled {
+		if !maintenance.enabled {
+			maintenance.since = time.Now().UTC()
+		}
+		maintenance.reason, maintenance.retryAfter, maintenance.by = req.Reason, retryAfter, actor
+	}
+	maintenance.enabled = *req.Enabled
+	maintenance.Unlock()
+
+	if *req.Enabled {
+		logCtx(c).Warnf("Maintenance mode enabled by %s: %s", actor, req.Reason)
+	} else {
+		logCtx(c).Warnf("Maintenance mode disabled by %s", actor)
+	}
+	c.JSON(http.StatusOK, maintenanceStatus())
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// records.merge_precedence values.
+const (
+	mergeSurvivor = "survivor"
+	mergeNewest   = "newest"
+)
+
+func validMergePrecedence(p string) bool {
+	return p == mergeSurvivor || p == mergeNewest
+}
+
+// mergeFields are the fields a merge takes from one of the records merged:
+// the first, in order of precedence, that isn't blank. IsActive is never
+// blank, so comes from the first record.
+var mergeFields = []struct {
+	name  string
+	blank func(e *Employee) bool
+	copy  func(dst, src *Employee)
+}{
+	{"FirstName", func(e *Employee) bool { return strings.TrimSpace(e.FirstName) == "" }, func(dst, src *Employee) { dst.FirstName = src.FirstName }},
+	{"LastName", func(e *Employee) bool { return strings.TrimSpace(e.LastName) == "" }, func(dst, src *Employee) { dst.LastName = src.LastName }},
+	{"Email", func(e *Employee) bool { return e.Email == "" }, func(dst, src *Employee) { dst.Email = src.Email }},
+	{"Age", func(e *Employee) bool { return e.Age == 0 }, func(dst, src *Employee) { dst.Age = src.Age }},
+	{"Gender", func(e *Employee) bool { return strings.TrimSpace(e.Gender) == "" }, func(dst, src *Employee) { dst.Gender = src.Gender }},
+	{"Department", func(e *Employee) bool { return e.DepartmentID == nil }, func(dst, src *Employee) {
+		dst.DepartmentID, dst.Department = src.DepartmentID, src.Department
+	}},
+	{"Company", func(e *Employee) bool { return e.CompanyID == nil }, func(dst, src *Employee) {
+		dst.CompanyID, dst.Company = src.CompanyID, src.Company
+	}},
+	// A salary only means anything in its currency.
+	{"Salary", func(e *Employee) bool { return e.Salary == 0 }, func(dst, src *Employee) {
+		dst.Salary, dst.Currency = src.Salary, src.Currency
+	}},
+	{"DateJoined", func(e *Employee) bool { return e.DateJoined == nil }, func(dst, src *Employee) { dst.DateJoined = src.DateJoined }},
+	{"IsActive", func(e *Employee) bool { return false }, func(dst, src *Employee) { dst.IsActive = src.IsActive }},
+}
+
+// mergedColumns are the columns of the surviving record a merge writes.
+var mergedColumns = []string{
+	"first_name", "last_name", "email", "age", "gender", "department_id", "company_id",
+	"salary", "currency", "extra", "date_joined", "is_active", "updated_at",
+}
+
+// consolidateRecords merges records, in order of precedence, into the first
+// of them, and returns the ID of the record each field was taken from.
+// Extra attributes are merged key by key.
+func consolidateRecords(records []*Employee) (Employee, map[string]uint) {
+	merged := *records[0]
+	sources := map[string]uint{}
+	for _, f := range mergeFields {
+		for _, r := range records {
+			if !f.blank(r) {
+				f.copy(&merged, r)
+				sources[f.name] = r.ID
+				break
+			}
+		}
+	}
+	merged.Extra = nil
+	for i := len(records) - 1; i >= 0; i-- {
+		for k, v := range records[i].Extra {
+			if merged.Extra == nil {
+				merged.Extra = extraAttributes{}
+			}
+			merged.Extra[k] = v
+		}
+	}
+	return merged, sources
+}
+
+// mergeRecords merges duplicate records into a surviving one, in one
+// transaction: each field of the survivor is taken from the records by
+// the body's "precedence" (default records.merge_precedence), the audit
+// entries of the duplicates are moved to the survivor, and the duplicates
+// are deleted. Deleted records are kept, without their email so it can be
+// used again, but no longer listed, exported or counted; the outliers
+// flagged on them are dropped, and a rescan reviews the merged values.
+func mergeRecords(c *gin.Context) {
+	var req struct {
+		SurvivorID   uint   `json:"survivor_id" binding:"required"`
+		DuplicateIDs []uint `json:"duplicate_ids" binding:"required,min=1"`
+		Precedence   string `json:"precedence"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Precedence == "" {
+		req.Precedence = cfg.Records.MergePrecedence
+	}
+	if !validMergePrecedence(req.Precedence) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("precedence must be %s or %s", mergeSurvivor, mergeNewest)})
+		return
+	}
+	ids := append([]uint{req.SurvivorID}, req.DuplicateIDs...)
+	seen := make(map[uint]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Record %d is listed more than once", id)})
+			return
+		}
+		seen[id] = true
+	}
+
+	ctx := c.Request.Context()
+	var found []Employee
+	if err := withComputedFields(db.WithContext(ctx)).Scopes(tenantScope(c)).Where("id IN ?", ids).Find(&found).Error; err != nil {
+		logCtx(c).Errorf("Error loading records to merge: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge records"})
+		return
+	}
+	byID := make(map[uint]*Employee, len(found))
+	for i := range found {
+		byID[found[i].ID] = &found[i]
+	}
+	records := make([]*Employee, 0, len(ids))
+	for _, id := range ids {
+		r, ok := byID[id]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Record %d not found", id)})
+			return
+		}
+		if r.AnonymizedAt != nil {
+			c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Record %d is anonymized", id)})
+			return
+		}
+		records = append(records, r)
+	}
+	if req.Precedence == mergeNewest {
+		sort.SliceStable(records, func(i, j int) bool { return records[i].UpdatedAt.After(records[j].UpdatedAt) })
+	}
+	merged, sources := consolidateRecords(records)
+	merged.ID, merged.CreatedAt = req.SurvivorID, byID[req.SurvivorID].CreatedAt
+	if err := ensureEmployeePartitions(ctx, []Employee{merged}); err != nil {
+		logCtx(c).Errorf("Error merging records: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge records"})
+		return
+	}
+
+	var moved int64
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// The duplicates give up their emails first, as the survivor may
+		// take one.
+		err := tx.Model(&Employee{}).Scopes(tenantScope(c)).Where("id IN ?", req.DuplicateIDs).
+			Updates(map[string]interface{}{"email": nil, "deleted_at": time.Now().UTC()}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Model(&merged).Select(mergedColumns).Updates(&merged).Error; err != nil {
+			return err
+		}
+		if err := tx.Scopes(tenantScope(c)).Where("employee_id IN ?", req.DuplicateIDs).Delete(&Outlier{}).Error; err != nil {
+			return err
+		}
+		res := tx.Model(&AuditEntry{}).Scopes(tenantScope(c)).Where("record_id IN ?", req.DuplicateIDs).
+			Update("record_id", req.SurvivorID)
+		moved = res.RowsAffected
+		return res.Error
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error merging records into %d: %v", req.SurvivorID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge records"})
+		return
+	}
+
+	duplicates := make([]string, len(req.DuplicateIDs))
+	for i, id := range req.DuplicateIDs {
+		duplicates[i] = fmt.Sprint(id)
+	}
+	setRowsAffected(c, int64(len(ids)))
+	setAuditEvent(c, "record.merge", fmt.Sprintf("record %d merged %s by %s", req.SurvivorID, strings.Join(duplicates, ", "), req.Precedence))
+	setAuditRecord(c, req.SurvivorID)
+	// Read back for the fields worked out in SQL, such as tenure.
+	err = withComputedFields(db.WithContext(ctx)).First(&merged, req.SurvivorID).Error
+	var record interface{}
+	if err == nil {
+		record, err = presentRecords(c, merged)
+	}
+	if err != nil {
+		logCtx(c).Errorf("Error serializing record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Records merged, but failed to serialize the result"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"record":        record,
+		"merged":        req.DuplicateIDs,
+		"sources":       sources,
+		"audit_entries": moved,
+	})
+}
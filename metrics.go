@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	importRowsParsed = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "import_rows_parsed_total",
+		Help: "CSV rows successfully parsed into employees.",
+	})
+
+	importParseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "import_parse_errors_total",
+		Help: "CSV rows that could not be read or parsed.",
+	})
+
+	importRowsInvalid = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "import_rows_invalid_total",
+		Help: "Parsed CSV rows failing validation, by rule broken.",
+	}, []string{"code"})
+
+	importRuleViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "import_rule_violations_total",
+		Help: "Breaches of tenant validation rules by imported rows, by rule severity.",
+	}, []string{"severity"})
+
+	importRowsInserted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "import_rows_inserted_total",
+		Help: "Rows inserted into the database by imports.",
+	})
+
+	importBatchFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "import_batch_failures_total",
+		Help: "Insert batches that failed.",
+	})
+
+	importQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "import_batch_queue_depth",
+		Help: "Batches waiting in import channels for an insert worker.",
+	})
+
+	importJobsRunning = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "import_jobs_running",
+		Help: "Import jobs currently being processed.",
+	})
+
+	importJobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "import_jobs_finished_total",
+		Help: "Finished import jobs by final status.",
+	}, []string{"status"})
+
+	logEntriesDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "log_entries_dropped_total",
+		Help: "Log entries not stored in the database because its buffer was full or the write failed.",
+	})
+
+	logEntriesNotShipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "log_entries_not_shipped_total",
+		Help: "Log entries not shipped because the backend's buffer was full or the request failed, by backend.",
+	}, []string{"backend"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		httpRequests, httpDuration,
+		importRowsParsed, importParseErrors, importRowsInvalid, importRuleViolations, importRowsInserted, importBatchFailures,
+		importQueueDepth, importJobsRunning, importJobsFinished,
+		logEntriesDropped, logEntriesNotShipped,
+	)
+}
+
+func registerDBMetrics() {
+	sqlDB, err := db.DB()
+	if err != nil {
+		logr.Errorf("Error registering database metrics: %v", err)
+		return
+	}
+	prometheus.MustRegister(collectors.NewDBStatsCollector(sqlDB, cfg.DB.Name))
+}
+
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Use the route template, not the raw path, to keep label cardinality bounded.
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+func metricsHandler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
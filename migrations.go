@@ -0,0 +1,1196 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-gormigrate/gormigrate/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const migrationsTable = "schema_migrations"
+
+// migrations is the ordered schema history. Each migration works on its own
+// snapshot of the models it touches so replaying history on an empty database
+// always produces the same schema; never change a migration once released,
+// add a new one instead.
+var migrations = []*gormigrate.Migration{
+	{
+		// Matches the schema the server used to create with AutoMigrate, so
+		// existing databases adopt it without changes.
+		ID: "202610150001_baseline",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(baselineModels...)
+		},
+		Rollback: func(tx *gorm.DB) error {
+			for i := len(baselineModels) - 1; i >= 0; i-- {
+				if err := tx.Migrator().DropTable(baselineModels[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID: "202610150002_feature_flags",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&featureFlagV1{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&featureFlagV1{})
+		},
+	},
+	{
+		ID: "202610150003_import_job_details",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&importJobV2{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&importJobV2{}, "CreatedAt"); err != nil {
+				return err
+			}
+			for _, column := range []string{"CreatedBy", "Checksum", "RowsFailed", "StartedAt"} {
+				if err := tx.Migrator().DropColumn(&importJobV2{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID: "202610150004_import_job_priority",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&importJobV3{}, "Priority")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&importJobV3{}, "Priority")
+		},
+	},
+	{
+		ID: "202610150005_job_callbacks",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&importJobV4{}, "CallbackURL"); err != nil {
+				return err
+			}
+			return tx.Migrator().AddColumn(&apiKeyV2{}, "CallbackURL")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&apiKeyV2{}, "CallbackURL"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&importJobV4{}, "CallbackURL")
+		},
+	},
+	{
+		ID: "202610150006_import_job_performance",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&importJobV5{}, "Performance")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&importJobV5{}, "Performance")
+		},
+	},
+	{
+		ID: "202610150007_schedules",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&scheduleV1{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&scheduleV1{})
+		},
+	},
+	{
+		ID: "202610150008_import_job_checkpoint_offset",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&importJobV6{}, "CheckpointOffset")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&importJobV6{}, "CheckpointOffset")
+		},
+	},
+	{
+		ID: "202610150009_import_job_outcomes",
+		Migrate: func(tx *gorm.DB) error {
+			for _, field := range []string{"RowsUpdated", "RowsSkipped"} {
+				if err := tx.Migrator().AddColumn(&importJobV7{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			for _, field := range []string{"RowsUpdated", "RowsSkipped"} {
+				if err := tx.Migrator().DropColumn(&importJobV7{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID: "202610150010_import_job_idempotency",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&importJobV8{}, "IdempotencyHash"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&importJobV8{}, "IdempotencyHash")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&importJobV8{}, "IdempotencyHash"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&importJobV8{}, "IdempotencyHash")
+		},
+	},
+	{
+		ID: "202610150011_logs",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&logEntryV1{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&logEntryV1{})
+		},
+	},
+	{
+		// Dates that can't be read are cleared, and counted in the log.
+		ID: "202610150012_employee_date_joined_time",
+		Migrate: func(tx *gorm.DB) error {
+			return convertDateJoined(tx, "date_joined_text", "date_joined_time", func(e *employeeDateJoined) bool {
+				if e.Text == "" {
+					return true
+				}
+				t, err := parseDate(e.Text, dateFormatAuto)
+				if err != nil {
+					return false
+				}
+				e.Time = &t
+				return true
+			})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return convertDateJoined(tx, "date_joined_time", "date_joined_text", func(e *employeeDateJoined) bool {
+				if e.Time != nil {
+					e.Text = e.Time.Format(dayLayout)
+				}
+				return true
+			})
+		},
+	},
+	{
+		ID: "202610150013_import_job_date_format",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&importJobV9{}, "DateFormat")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&importJobV9{}, "DateFormat")
+		},
+	},
+	{
+		ID: "202610150014_employee_timestamps",
+		Migrate: func(tx *gorm.DB) error {
+			for _, field := range []string{"CreatedAt", "UpdatedAt"} {
+				if err := tx.Migrator().AddColumn(&employeeTimestamps{}, field); err != nil {
+					return err
+				}
+			}
+			now := time.Now().UTC()
+			if err := tx.Model(&employeeTimestamps{}).Where("1 = 1").
+				UpdateColumns(map[string]interface{}{"created_at": now, "updated_at": now}).Error; err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&employeeTimestamps{}, "UpdatedAt")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&employeeTimestamps{}, "UpdatedAt"); err != nil {
+				return err
+			}
+			for _, column := range []string{"updated_at", "created_at"} {
+				if err := dropEmployeeColumn(tx, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		// Emails are lowercased, blank ones cleared so they don't collide,
+		// and of each set of duplicates only the latest row is kept.
+		ID: "202610150015_employee_unique_email",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Exec("UPDATE employees SET email = LOWER(TRIM(email))").Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("UPDATE employees SET email = NULL WHERE email = ''").Error; err != nil {
+				return err
+			}
+			// MySQL can't select from the table it deletes from, except
+			// through a derived table.
+			res := tx.Exec(`DELETE FROM employees WHERE email IS NOT NULL AND id NOT IN (
+				SELECT id FROM (SELECT MAX(id) AS id FROM employees WHERE email IS NOT NULL GROUP BY tenant_id, email) AS latest)`)
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected > 0 {
+				logr.Warnf("Removed %d employees with the email of a later row", res.RowsAffected)
+			}
+			// MySQL can only index text of bounded length. SQLite ignores
+			// the size, and its migrator would rebuild the table to change it.
+			if tx.Dialector.Name() != driverSQLite {
+				if err := tx.Migrator().AlterColumn(&employeeUniqueEmail{}, "Email"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&employeeUniqueEmail{}, "idx_employees_tenant_email")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropIndex(&employeeUniqueEmail{}, "idx_employees_tenant_email")
+		},
+	},
+	{
+		ID: "202610150016_validation_rules",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&validationRuleV1{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&validationRuleV1{})
+		},
+	},
+	{
+		ID: "202610150017_allowed_values",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&allowedValueV1{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&allowedValueV1{})
+		},
+	},
+	{
+		// Each tenant's distinct department and company names become rows
+		// of their own tables, which employees point to by ID.
+		ID: "202610150018_department_company_tables",
+		Migrate: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.CreateTable(&departmentV1{}, &companyV1{}); err != nil {
+				return err
+			}
+			now := time.Now().UTC()
+			for _, ref := range employeeReferenceColumns {
+				if err := m.AddColumn(&employeeReferences{}, ref.idField); err != nil {
+					return err
+				}
+				if err := m.CreateIndex(&employeeReferences{}, ref.idField); err != nil {
+					return err
+				}
+				err := tx.Exec("INSERT INTO ? (tenant_id, name, created_at, updated_at) SELECT DISTINCT tenant_id, TRIM(?), ?, ? FROM employees WHERE TRIM(?) <> ''",
+					clause.Table{Name: ref.table}, clause.Column{Name: ref.name}, now, now, clause.Column{Name: ref.name}).Error
+				if err != nil {
+					return err
+				}
+				err = tx.Exec("UPDATE employees SET ? = (SELECT id FROM ? WHERE ?.tenant_id = employees.tenant_id AND ?.name = TRIM(employees.?))",
+					clause.Column{Name: ref.id}, clause.Table{Name: ref.table}, clause.Table{Name: ref.table}, clause.Table{Name: ref.table}, clause.Column{Name: ref.name}).Error
+				if err != nil {
+					return err
+				}
+				// SQLite can't add a foreign key to an existing table, short
+				// of rebuilding it.
+				if tx.Dialector.Name() != driverSQLite {
+					if err := m.CreateConstraint(&employeeReferences{}, ref.refField); err != nil {
+						return err
+					}
+				}
+				if err := dropEmployeeColumn(tx, ref.name); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			for _, ref := range employeeReferenceColumns {
+				if err := m.AddColumn(&employeeReferences{}, ref.nameField); err != nil {
+					return err
+				}
+				err := tx.Exec("UPDATE employees SET ? = COALESCE((SELECT name FROM ? WHERE ?.id = employees.?), '')",
+					clause.Column{Name: ref.name}, clause.Table{Name: ref.table}, clause.Table{Name: ref.table}, clause.Column{Name: ref.id}).Error
+				if err != nil {
+					return err
+				}
+				if tx.Dialector.Name() != driverSQLite {
+					if err := m.DropConstraint(&employeeReferences{}, ref.refField); err != nil {
+						return err
+					}
+				}
+				if err := m.DropIndex(&employeeReferences{}, ref.idField); err != nil {
+					return err
+				}
+				if err := dropEmployeeColumn(tx, ref.id); err != nil {
+					return err
+				}
+			}
+			return m.DropTable(&companyV1{}, &departmentV1{})
+		},
+	},
+	{
+		// Salaries imported so far were read as plain numbers, so they are
+		// taken to be in currency.default.
+		ID: "202610150019_employee_currency",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&employeeCurrency{}, "Currency"); err != nil {
+				return err
+			}
+			return tx.Model(&employeeCurrency{}).Where("1 = 1").UpdateColumn("currency", cfg.Currency.Default).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropEmployeeColumn(tx, "currency")
+		},
+	},
+	{
+		ID: "202610150020_employee_extra",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&employeeExtra{}, "Extra")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return dropEmployeeColumn(tx, "extra")
+		},
+	},
+	{
+		// Each registered dataset's own table is created by the API, and
+		// is not rolled back with this.
+		ID: "202610150021_datasets",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&datasetV1{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&datasetV1{})
+		},
+	},
+	{
+		// Partitions employees by db.partition_by as set when this runs;
+		// "main migrate partitions" applies a later change. A no-op
+		// unless it is set.
+		ID: "202610150022_employee_partitions",
+		Migrate: func(tx *gorm.DB) error {
+			return repartitionEmployees(tx, cfg.DB.PartitionBy)
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return repartitionEmployees(tx, "")
+		},
+	},
+	{
+		// Email, department and company are indexed already; these serve
+		// the salary and join date filters, sorts and analytics.
+		ID: "202610150023_employee_salary_date_indexes",
+		Migrate: func(tx *gorm.DB) error {
+			for _, field := range []string{"Salary", "DateJoined"} {
+				if err := tx.Migrator().CreateIndex(&employeeIndexes{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Rollback: func(tx *gorm.DB) error {
+			for _, field := range []string{"DateJoined", "Salary"} {
+				if err := tx.Migrator().DropIndex(&employeeIndexes{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, {
+		// Jobs imported before this have no score.
+		ID: "202610150024_import_job_quality",
+		Migrate: func(tx *gorm.DB) error {
+			for _, field := range []string{"Quality", "QualityScore"} {
+				if err := tx.Migrator().AddColumn(&importJobV10{}, field); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&importJobV10{}, "QualityScore")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&importJobV10{}, "QualityScore"); err != nil {
+				return err
+			}
+			for _, field := range []string{"QualityScore", "Quality"} {
+				if err := tx.Migrator().DropColumn(&importJobV10{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}, {
+		ID: "202610150025_outliers",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&outlierV1{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&outlierV1{})
+		},
+	}, {
+		// Audit entries of record writes recorded before this name the
+		// record only in their detail, which is read back for their ID.
+		ID: "202610150026_record_merge",
+		Migrate: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.AddColumn(&employeeSoftDelete{}, "DeletedAt"); err != nil {
+				return err
+			}
+			if err := m.CreateIndex(&employeeSoftDelete{}, "DeletedAt"); err != nil {
+				return err
+			}
+			if err := m.AddColumn(&auditRecordV1{}, "RecordID"); err != nil {
+				return err
+			}
+			if err := m.CreateIndex(&auditRecordV1{}, "RecordID"); err != nil {
+				return err
+			}
+			var batch []auditRecordV1
+			return tx.Where("event IN ?", []string{"record.create", "record.update", "outlier.accept", "outlier.fix"}).
+				FindInBatches(&batch, 1000, func(_ *gorm.DB, _ int) error {
+					for _, entry := range batch {
+						var id uint
+						if _, err := fmt.Sscanf(entry.Detail, "record %d", &id); err != nil {
+							continue
+						}
+						if err := tx.Model(&auditRecordV1{ID: entry.ID}).Update("record_id", id).Error; err != nil {
+							return err
+						}
+					}
+					return nil
+				}).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			m := tx.Migrator()
+			if err := m.DropIndex(&auditRecordV1{}, "RecordID"); err != nil {
+				return err
+			}
+			if err := m.DropIndex(&employeeSoftDelete{}, "DeletedAt"); err != nil {
+				return err
+			}
+			// The SQLite migrator drops a column by rebuilding the table,
+			// which loses its other indexes; every dialect can drop an
+			// unindexed one in place.
+			if err := tx.Exec("ALTER TABLE api_audit DROP COLUMN record_id").Error; err != nil {
+				return err
+			}
+			return tx.Exec("ALTER TABLE employees DROP COLUMN deleted_at").Error
+		},
+	}, {
+		// Each existing record gets a baseline version as of its last
+		// update, so as-of reads see it from then on; earlier states were
+		// never kept.
+		ID: "202610150027_employee_versions",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Migrator().CreateTable(&employeeVersionV1{}); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&exportJobAsOf{}, "AsOf"); err != nil {
+				return err
+			}
+			const columns = "tenant_id, first_name, last_name, email, age, gender, department_id, company_id, " +
+				"salary, currency, extra, date_joined, is_active, created_at, updated_at, deleted_at"
+			return tx.Exec("INSERT INTO employee_versions (employee_id, operation, recorded_at, "+columns+") "+
+				"SELECT id, ?, updated_at, "+columns+" FROM employees WHERE deleted_at IS NULL", versionBaseline).Error
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&exportJobAsOf{}, "AsOf"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropTable(&employeeVersionV1{})
+		},
+	}, {
+		ID: "202610150028_employee_anonymized_at",
+		Migrate: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&employeeAnonymized{}, &employeeVersionAnonymized{}} {
+				if err := tx.Migrator().AddColumn(model, "AnonymizedAt"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&employeeAnonymized{}, "AnonymizedAt")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropIndex(&employeeAnonymized{}, "AnonymizedAt"); err != nil {
+				return err
+			}
+			// Dropped in place, as in 202610150026_record_merge.
+			for _, table := range []string{"employees", "employee_versions"} {
+				if err := tx.Exec("ALTER TABLE " + table + " DROP COLUMN anonymized_at").Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID: "202610150029_retention_policies",
+		Migrate: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&employeeImportJob{}, "ImportJobID"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().CreateIndex(&employeeImportJob{}, "ImportJobID"); err != nil {
+				return err
+			}
+			return tx.AutoMigrate(&retentionPolicyV1{})
+		},
+		Rollback: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&retentionPolicyV1{}); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropIndex(&employeeImportJob{}, "ImportJobID"); err != nil {
+				return err
+			}
+			// Dropped in place, as in 202610150026_record_merge.
+			return tx.Exec("ALTER TABLE employees DROP COLUMN import_job_id").Error
+		},
+	},
+	{
+		ID: "202610150030_user_tokens_valid_after",
+		Migrate: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&userTokensValidAfter{}, "TokensValidAfter")
+		},
+		Rollback: func(tx *gorm.DB) error {
+			// Dropped in place, as in 202610150026_record_merge.
+			return tx.Exec("ALTER TABLE users DROP COLUMN tokens_valid_after").Error
+		},
+	},
+}
+
+// employeeReferenceColumns are the employees columns moved into tables of
+// their own by 202610150018_department_company_tables.
+var employeeReferenceColumns = []struct {
+	table, name, id              string
+	nameField, idField, refField string
+}{
+	{"departments", "department", "department_id", "Department", "DepartmentID", "DepartmentRef"},
+	{"companies", "company", "company_id", "Company", "CompanyID", "CompanyRef"},
+}
+
+// convertDateJoined changes the type of employees.date_joined: the column is
+// renamed to from, a column to is added, convert fills in each row, and to
+// replaces from.
+func convertDateJoined(tx *gorm.DB, from, to string, convert func(*employeeDateJoined) bool) error {
+	m := tx.Migrator()
+	if err := m.RenameColumn(&employeeDateJoined{}, "date_joined", from); err != nil {
+		return err
+	}
+	if err := m.AddColumn(&employeeDateJoined{}, to); err != nil {
+		return err
+	}
+	var batch []employeeDateJoined
+	unreadable := 0
+	err := tx.FindInBatches(&batch, 1000, func(_ *gorm.DB, _ int) error {
+		for _, e := range batch {
+			if !convert(&e) {
+				unreadable++
+				continue
+			}
+			if err := tx.Model(&employeeDateJoined{ID: e.ID}).Select(to).Updates(&e).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	}).Error
+	if err != nil {
+		return err
+	}
+	if unreadable > 0 {
+		logr.Warnf("Cleared %d employee join dates that could not be read as dates", unreadable)
+	}
+	if err := dropEmployeeColumn(tx, from); err != nil {
+		return err
+	}
+	return m.RenameColumn(&employeeDateJoined{}, to, "date_joined")
+}
+
+// dropEmployeeColumn drops a column of employees. SQLite's migrator drops a
+// column by rebuilding the table, which loses its indexes; every supported
+// database can drop it in place.
+func dropEmployeeColumn(tx *gorm.DB, column string) error {
+	return tx.Exec("ALTER TABLE ? DROP COLUMN ?", clause.Table{Name: "employees"}, clause.Column{Name: column}).Error
+}
+
+func newMigrator() *gormigrate.Gormigrate {
+	return gormigrate.New(db, &gormigrate.Options{
+		TableName:    migrationsTable,
+		IDColumnName: "id",
+		IDColumnSize: 255,
+		// Postgres and SQLite run DDL transactionally, so a failed migration
+		// leaves nothing half-applied. MySQL commits DDL implicitly.
+		UseTransaction:            cfg.DB.Driver != driverMySQL,
+		ValidateUnknownMigrations: true,
+	}, migrations)
+}
+
+// schemaStatus reports which known migrations have not been applied and which
+// applied IDs are unknown to this binary (the database is ahead of it).
+func schemaStatus() (pending, unknown []string, err error) {
+	applied := make(map[string]bool)
+	if db.Migrator().HasTable(migrationsTable) {
+		var ids []string
+		if err := db.Table(migrationsTable).Pluck("id", &ids).Error; err != nil {
+			return nil, nil, err
+		}
+		for _, id := range ids {
+			applied[id] = true
+		}
+	}
+	for _, m := range migrations {
+		if !applied[m.ID] {
+			pending = append(pending, m.ID)
+		}
+		delete(applied, m.ID)
+	}
+	for id := range applied {
+		unknown = append(unknown, id)
+	}
+	return pending, unknown, nil
+}
+
+// requireCurrentSchema refuses to serve against a database whose schema is
+// behind or ahead of this binary.
+func requireCurrentSchema() error {
+	pending, unknown, err := schemaStatus()
+	if err != nil {
+		return fmt.Errorf("reading migration status: %w", err)
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("database schema is behind, %d pending migration(s) starting at %s; run \"main migrate\" or set db.auto_migrate", len(pending), pending[0])
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("database has migrations unknown to this build (%v); deploy a newer version", unknown)
+	}
+	return nil
+}
+
+// Snapshots of the models as of 202610150001_baseline.
+
+var baselineModels = []interface{}{
+	&baselineEmployee{}, &baselineImportJob{}, &baselineAuditEntry{}, &baselineTenant{}, &baselineAPIKey{},
+	&baselineExportJob{}, &baselineUser{}, &baselineRefreshToken{}, &baselineRevokedToken{},
+}
+
+type baselineEmployee struct {
+	ID         uint   `gorm:"primaryKey"`
+	TenantID   string `gorm:"size:64;not null;default:'default';index"`
+	FirstName  string `gorm:"index"`
+	LastName   string
+	Email      string
+	Age        int
+	Gender     string
+	Department string
+	Company    string
+	Salary     float64
+	DateJoined string
+	IsActive   bool
+}
+
+func (baselineEmployee) TableName() string { return "employees" }
+
+type baselineImportJob struct {
+	ID            string `gorm:"primaryKey;size:36"`
+	TenantID      string `gorm:"size:64;not null;index"`
+	OriginalName  string
+	StoredPath    string
+	Size          int64
+	Status        string `gorm:"size:16;index;default:'pending'"`
+	CheckpointRow int64
+	RowsInserted  int64
+	Error         string
+	CreatedAt     time.Time
+	FinishedAt    *time.Time
+}
+
+func (baselineImportJob) TableName() string { return "import_jobs" }
+
+type baselineAuditEntry struct {
+	ID           uint      `gorm:"primaryKey"`
+	Time         time.Time `gorm:"index"`
+	TenantID     string    `gorm:"size:64;index"`
+	Actor        string    `gorm:"index"`
+	Event        string    `gorm:"size:64;index"`
+	Detail       string
+	ClientIP     string
+	Method       string
+	Route        string `gorm:"index"`
+	Path         string
+	Params       string
+	Status       int
+	RowsAffected int64
+	DurationMs   int64
+}
+
+func (baselineAuditEntry) TableName() string { return "api_audit" }
+
+type baselineTenant struct {
+	ID        string `gorm:"primaryKey;size:64"`
+	Name      string
+	CreatedAt time.Time
+}
+
+func (baselineTenant) TableName() string { return "tenants" }
+
+type baselineAPIKey struct {
+	ID        uint `gorm:"primaryKey"`
+	Name      string
+	TenantID  string `gorm:"size:64;not null;index"`
+	Prefix    string `gorm:"size:12"`
+	KeyHash   string `gorm:"size:64;uniqueIndex"`
+	Role      string `gorm:"size:16;not null;default:'editor'"`
+	Scopes    string
+	CreatedAt time.Time
+	RevokedAt *time.Time
+}
+
+func (baselineAPIKey) TableName() string { return "api_keys" }
+
+type baselineExportJob struct {
+	ID          string `gorm:"primaryKey;size:36"`
+	TenantID    string `gorm:"size:64;not null;index"`
+	CreatedBy   string
+	Status      string `gorm:"size:16;index"`
+	SortColumn  string
+	SortDesc    bool
+	Policy      string
+	FilePath    string
+	RowCount    int64
+	Error       string
+	CreatedAt   time.Time
+	CompletedAt *time.Time
+}
+
+func (baselineExportJob) TableName() string { return "export_jobs" }
+
+type baselineUser struct {
+	ID           uint   `gorm:"primaryKey"`
+	Username     string `gorm:"size:128;uniqueIndex"`
+	PasswordHash string
+	TenantID     string `gorm:"size:64;not null;index"`
+	Role         string `gorm:"size:16;not null"`
+	Scopes       string
+	CreatedAt    time.Time
+	DisabledAt   *time.Time
+}
+
+func (baselineUser) TableName() string { return "users" }
+
+type baselineRefreshToken struct {
+	ID         uint      `gorm:"primaryKey"`
+	UserID     uint      `gorm:"index"`
+	FamilyID   string    `gorm:"size:36;index"`
+	TokenHash  string    `gorm:"size:64;uniqueIndex"`
+	ExpiresAt  time.Time `gorm:"index"`
+	CreatedAt  time.Time
+	RevokedAt  *time.Time
+	ReplacedBy *uint
+}
+
+func (baselineRefreshToken) TableName() string { return "refresh_tokens" }
+
+type baselineRevokedToken struct {
+	JTI       string    `gorm:"primaryKey;size:36"`
+	ExpiresAt time.Time `gorm:"index"`
+	CreatedAt time.Time
+}
+
+func (baselineRevokedToken) TableName() string { return "revoked_tokens" }
+
+// Snapshots as of 202610150002_feature_flags.
+
+type featureFlagV1 struct {
+	Name      string `gorm:"primaryKey;size:64"`
+	Enabled   bool
+	UpdatedBy string
+	UpdatedAt time.Time
+}
+
+func (featureFlagV1) TableName() string { return "feature_flags" }
+
+// Snapshots as of 202610150003_import_job_details.
+
+type importJobV2 struct {
+	ID            string `gorm:"primaryKey;size:36"`
+	TenantID      string `gorm:"size:64;not null;index"`
+	CreatedBy     string
+	OriginalName  string
+	StoredPath    string
+	Size          int64
+	Checksum      string `gorm:"size:64;index"`
+	Status        string `gorm:"size:16;index;default:'pending'"`
+	CheckpointRow int64
+	RowsInserted  int64
+	RowsFailed    int64
+	Error         string
+	CreatedAt     time.Time `gorm:"index"`
+	StartedAt     *time.Time
+	FinishedAt    *time.Time
+}
+
+func (importJobV2) TableName() string { return "import_jobs" }
+
+// Snapshots as of 202610150004_import_job_priority.
+
+type importJobV3 struct {
+	importJobV2
+	Priority int `gorm:"not null;default:5"`
+}
+
+// Snapshots as of 202610150005_job_callbacks.
+
+type importJobV4 struct {
+	importJobV3
+	CallbackURL string
+}
+
+type apiKeyV2 struct {
+	baselineAPIKey
+	CallbackURL string
+}
+
+// Snapshots as of 202610150006_import_job_performance.
+
+type importJobV5 struct {
+	importJobV4
+	Performance string `gorm:"type:text"`
+}
+
+// Snapshots as of 202610150007_schedules.
+
+type scheduleV1 struct {
+	ID          string `gorm:"primaryKey;size:36"`
+	TenantID    string `gorm:"size:64;not null;index"`
+	Name        string `gorm:"size:128;not null"`
+	Cron        string `gorm:"size:128;not null"`
+	Source      string `gorm:"not null"`
+	Priority    int    `gorm:"not null;default:5"`
+	CallbackURL string
+	Misfire     string     `gorm:"size:16;not null;default:'run_once'"`
+	Enabled     bool       `gorm:"not null;default:true"`
+	NextRunAt   *time.Time `gorm:"index"`
+	LastRunAt   *time.Time
+	LastJobID   string `gorm:"size:36"`
+	LastError   string
+	CreatedBy   string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (scheduleV1) TableName() string { return "schedules" }
+
+// Snapshots as of 202610150008_import_job_checkpoint_offset.
+
+type importJobV6 struct {
+	importJobV5
+	CheckpointOffset int64 `gorm:"not null;default:0"`
+}
+
+// Snapshots as of 202610150009_import_job_outcomes.
+
+type importJobV7 struct {
+	importJobV6
+	RowsUpdated int64 `gorm:"not null;default:0"`
+	RowsSkipped int64 `gorm:"not null;default:0"`
+}
+
+// Snapshots as of 202610150010_import_job_idempotency.
+
+type importJobV8 struct {
+	importJobV7
+	IdempotencyHash *string `gorm:"size:64;uniqueIndex"`
+}
+
+// Snapshots as of 202610150011_logs.
+
+type logEntryV1 struct {
+	ID        uint64    `gorm:"primaryKey"`
+	Time      time.Time `gorm:"not null;index"`
+	Level     string    `gorm:"size:16;not null;index"`
+	Message   string    `gorm:"type:text"`
+	Source    string    `gorm:"size:32;index"`
+	RequestID string    `gorm:"size:128;index"`
+	JobID     string    `gorm:"size:36;index"`
+	Fields    string    `gorm:"type:text"`
+}
+
+func (logEntryV1) TableName() string { return "logs" }
+
+// Snapshots as of 202610150012_employee_date_joined_time.
+
+// employeeDateJoined holds both forms of employees.date_joined while it is
+// converted.
+type employeeDateJoined struct {
+	ID   uint       `gorm:"primaryKey"`
+	Text string     `gorm:"column:date_joined_text"`
+	Time *time.Time `gorm:"column:date_joined_time"`
+}
+
+func (employeeDateJoined) TableName() string { return "employees" }
+
+// Snapshots as of 202610150013_import_job_date_format.
+
+type importJobV9 struct {
+	importJobV8
+	DateFormat string `gorm:"size:16"`
+}
+
+// Snapshots as of 202610150014_employee_timestamps.
+
+type employeeTimestamps struct {
+	ID        uint `gorm:"primaryKey"`
+	CreatedAt time.Time
+	UpdatedAt time.Time `gorm:"index"`
+}
+
+func (employeeTimestamps) TableName() string { return "employees" }
+
+// Snapshots as of 202610150015_employee_unique_email.
+
+type employeeUniqueEmail struct {
+	ID       uint   `gorm:"primaryKey"`
+	TenantID string `gorm:"size:64;not null;default:'default';index;uniqueIndex:idx_employees_tenant_email"`
+	Email    string `gorm:"size:254;uniqueIndex:idx_employees_tenant_email"`
+}
+
+func (employeeUniqueEmail) TableName() string { return "employees" }
+
+// Snapshots as of 202610150016_validation_rules.
+
+type validationRuleV1 struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"size:64;not null;uniqueIndex:idx_validation_rules_tenant_name"`
+	Name      string `gorm:"size:64;not null;uniqueIndex:idx_validation_rules_tenant_name"`
+	Field     string `gorm:"size:32;not null"`
+	Type      string `gorm:"size:16;not null"`
+	Params    string `gorm:"type:text"`
+	Severity  string `gorm:"size:8;not null"`
+	Enabled   bool   `gorm:"not null;default:true"`
+	CreatedBy string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (validationRuleV1) TableName() string { return "validation_rules" }
+
+// Snapshots as of 202610150017_allowed_values.
+
+type allowedValueV1 struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"size:64;not null;uniqueIndex:idx_allowed_values_tenant_field_value"`
+	Field     string `gorm:"size:32;not null;uniqueIndex:idx_allowed_values_tenant_field_value"`
+	Value     string `gorm:"size:128;not null;uniqueIndex:idx_allowed_values_tenant_field_value"`
+	Aliases   string `gorm:"type:text"`
+	CreatedBy string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (allowedValueV1) TableName() string { return "allowed_values" }
+
+// Snapshots as of 202610150018_department_company_tables.
+
+type departmentV1 struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"size:64;not null;uniqueIndex:idx_departments_tenant_name"`
+	Name      string `gorm:"size:128;not null;uniqueIndex:idx_departments_tenant_name"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (departmentV1) TableName() string { return "departments" }
+
+type companyV1 struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"size:64;not null;uniqueIndex:idx_companies_tenant_name"`
+	Name      string `gorm:"size:128;not null;uniqueIndex:idx_companies_tenant_name"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+func (companyV1) TableName() string { return "companies" }
+
+type employeeReferences struct {
+	ID            uint `gorm:"primaryKey"`
+	Department    string
+	Company       string
+	DepartmentID  *uint         `gorm:"index"`
+	CompanyID     *uint         `gorm:"index"`
+	DepartmentRef *departmentV1 `gorm:"foreignKey:DepartmentID"`
+	CompanyRef    *companyV1    `gorm:"foreignKey:CompanyID"`
+}
+
+func (employeeReferences) TableName() string { return "employees" }
+
+// Snapshots as of 202610150019_employee_currency.
+
+type employeeCurrency struct {
+	ID       uint   `gorm:"primaryKey"`
+	Currency string `gorm:"size:3"`
+}
+
+func (employeeCurrency) TableName() string { return "employees" }
+
+// Snapshots as of 202610150020_employee_extra.
+
+type employeeExtra struct {
+	ID    uint `gorm:"primaryKey"`
+	Extra extraAttributes
+}
+
+func (employeeExtra) TableName() string { return "employees" }
+
+// Snapshots as of 202610150021_datasets.
+
+type datasetV1 struct {
+	ID        uint   `gorm:"primaryKey"`
+	TenantID  string `gorm:"size:64;not null;uniqueIndex:idx_datasets_tenant_name"`
+	Name      string `gorm:"size:63;not null;uniqueIndex:idx_datasets_tenant_name"`
+	Columns   string `gorm:"type:text"`
+	DataTable string `gorm:"size:64;not null"`
+	CreatedBy string
+	CreatedAt time.Time
+}
+
+func (datasetV1) TableName() string { return "datasets" }
+
+// Snapshots as of 202610150023_employee_salary_date_indexes.
+
+type employeeIndexes struct {
+	ID         uint       `gorm:"primaryKey"`
+	Salary     float64    `gorm:"index"`
+	DateJoined *time.Time `gorm:"index"`
+}
+
+func (employeeIndexes) TableName() string { return "employees" }
+
+// Snapshots as of 202610150024_import_job_quality.
+
+type importJobV10 struct {
+	importJobV9
+	Quality      string   `gorm:"type:text"`
+	QualityScore *float64 `gorm:"index"`
+}
+
+// Snapshots as of 202610150025_outliers.
+
+type outlierV1 struct {
+	ID         uint   `gorm:"primaryKey"`
+	TenantID   string `gorm:"size:64;not null;uniqueIndex:idx_outliers_tenant_employee_field"`
+	EmployeeID uint   `gorm:"not null;uniqueIndex:idx_outliers_tenant_employee_field"`
+	Field      string `gorm:"size:16;not null;uniqueIndex:idx_outliers_tenant_employee_field"`
+	Value      float64
+	FixedValue *float64
+	Sigma      *float64
+	Reason     string
+	Status     string `gorm:"size:16;not null;index"`
+	ReviewedBy string
+	ReviewedAt *time.Time
+	DetectedAt time.Time
+}
+
+func (outlierV1) TableName() string { return "outliers" }
+
+// Snapshots as of 202610150026_record_merge.
+
+type employeeSoftDelete struct {
+	ID        uint           `gorm:"primaryKey"`
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+func (employeeSoftDelete) TableName() string { return "employees" }
+
+type auditRecordV1 struct {
+	ID       uint `gorm:"primaryKey"`
+	Event    string
+	Detail   string
+	RecordID *uint `gorm:"index"`
+}
+
+func (auditRecordV1) TableName() string { return "api_audit" }
+
+// Snapshots as of 202610150027_employee_versions.
+
+type employeeVersionV1 struct {
+	ID           uint      `gorm:"primaryKey"`
+	EmployeeID   uint      `gorm:"not null;index"`
+	Operation    string    `gorm:"size:16;not null"`
+	RecordedAt   time.Time `gorm:"not null;index"`
+	TenantID     string    `gorm:"size:64;not null;index"`
+	FirstName    string
+	LastName     string
+	Email        string `gorm:"size:254"`
+	Age          int
+	Gender       string
+	DepartmentID *uint
+	CompanyID    *uint
+	Salary       float64
+	Currency     string `gorm:"size:3"`
+	Extra        extraAttributes
+	DateJoined   *time.Time
+	IsActive     bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	DeletedAt    *time.Time
+}
+
+func (employeeVersionV1) TableName() string { return "employee_versions" }
+
+type exportJobAsOf struct {
+	ID   string `gorm:"primaryKey;size:36"`
+	AsOf *time.Time
+}
+
+func (exportJobAsOf) TableName() string { return "export_jobs" }
+
+// Snapshots as of 202610150028_employee_anonymized_at.
+
+type employeeAnonymized struct {
+	ID           uint       `gorm:"primaryKey"`
+	AnonymizedAt *time.Time `gorm:"index"`
+}
+
+func (employeeAnonymized) TableName() string { return "employees" }
+
+type employeeVersionAnonymized struct {
+	ID           uint `gorm:"primaryKey"`
+	AnonymizedAt *time.Time
+}
+
+func (employeeVersionAnonymized) TableName() string { return "employee_versions" }
+
+// Snapshots as of 202610150029_retention_policies.
+
+type employeeImportJob struct {
+	ID          uint   `gorm:"primaryKey"`
+	ImportJobID string `gorm:"size:36;index"`
+}
+
+func (employeeImportJob) TableName() string { return "employees" }
+
+type retentionPolicyV1 struct {
+	ID           string `gorm:"primaryKey;size:36"`
+	TenantID     string `gorm:"size:64;not null;index"`
+	Name         string `gorm:"size:128;not null"`
+	CompanyID    *uint
+	ImportJobID  string `gorm:"size:36"`
+	InactiveOnly bool   `gorm:"not null"`
+	MaxAgeDays   int    `gorm:"not null"`
+	Action       string `gorm:"size:16;not null"`
+	Enabled      bool   `gorm:"not null"`
+	LastRunAt    *time.Time
+	LastPurged   int64 `gorm:"not null;default:0"`
+	LastError    string
+	CreatedBy    string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+func (retentionPolicyV1) TableName() string { return "retention_policies" }
+
+// Snapshots as of 202610150030_user_tokens_valid_after.
+
+type userTokensValidAfter struct {
+	ID               uint `gorm:"primaryKey"`
+	TokensValidAfter *time.Time
+}
+
+func (userTokensValidAfter) TableName() string { return "users" }
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// jobURL links to the job in notifications sent outside a request.
+func jobURL(id string) string {
+	return strings.TrimRight(cfg.PublicURL, "/") + "/jobs/" + id
+}
+
+// notifyJobFinished tells whoever asked about a job that reached a final state.
+// Interrupted jobs are not final; they are retried.
+func notifyJobFinished(ctx context.Context, job ImportJob, status string, counts importCounts, errMsg string, finishedAt time.Time) {
+	if status == jobInterrupted {
+		return
+	}
+	event := jobEvent{
+		Event:        "import." + status,
+		JobID:        job.ID,
+		TenantID:     job.TenantID,
+		FileName:     job.OriginalName,
+		Status:       status,
+		RowsRead:     counts.read,
+		RowsInserted: counts.inserted,
+		RowsUpdated:  counts.updated,
+		RowsSkipped:  counts.skipped,
+		RowsFailed:   counts.failed,
+		Error:        errMsg,
+		JobURL:       jobURL(job.ID),
+		FinishedAt:   finishedAt,
+	}
+	if job.CallbackURL != "" {
+		sendWebhook(ctx, job.CallbackURL, event)
+	}
+	sendJobEmail(ctx, event)
+	chatJobAlert(ctx, event)
+}
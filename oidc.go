@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const oidcStateCookie = "oidc_state"
+
+type oidcAuthenticator struct {
+	conf     OIDCConfig
+	provider *oidc.Provider
+	verifier *oidc.IDTokenVerifier
+	oauth    oauth2.Config
+}
+
+var oidcAuth *oidcAuthenticator
+
+func initOIDC() {
+	if cfg.OIDC.IssuerURL == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, cfg.OIDC.IssuerURL)
+	if err != nil {
+		logr.Fatalf("OIDC discovery failed for %s: %v", cfg.OIDC.IssuerURL, err)
+	}
+
+	oidcAuth = &oidcAuthenticator{
+		conf:     cfg.OIDC,
+		provider: provider,
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.OIDC.ClientID}),
+		oauth: oauth2.Config{
+			ClientID:     cfg.OIDC.ClientID,
+			ClientSecret: cfg.OIDC.ClientSecret,
+			RedirectURL:  cfg.OIDC.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       append([]string{oidc.ScopeOpenID, "email", "profile"}, cfg.OIDC.ExtraScopes...),
+		},
+	}
+	logr.Infof("OIDC authentication enabled (issuer: %s)", cfg.OIDC.IssuerURL)
+}
+
+// roleForGroups maps the token's groups onto the highest configured role.
+func (o *oidcAuthenticator) roleForGroups(groups []string) string {
+	role := ""
+	for _, g := range groups {
+		if r, ok := o.conf.GroupRoles[g]; ok && roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+	if role == "" {
+		role = o.conf.DefaultRole
+	}
+	return role
+}
+
+func (o *oidcAuthenticator) scopesForGroups(groups []string) []string {
+	var scopes []string
+	for _, g := range groups {
+		scopes = append(scopes, parseScopes(o.conf.GroupScopes[g])...)
+	}
+	return scopes
+}
+
+func (o *oidcAuthenticator) authenticate(c *gin.Context, rawToken string) {
+	token, err := o.verifier.Verify(c.Request.Context(), rawToken)
+	if err != nil {
+		logCtx(c).Warnf("Rejected OIDC token from %s: %v", c.ClientIP(), err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	var claims map[string]interface{}
+	if err := token.Claims(&claims); err != nil {
+		logCtx(c).Errorf("Error decoding OIDC claims: %v", err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		return
+	}
+
+	var groups []string
+	if raw, ok := claims[o.conf.GroupsClaim].([]interface{}); ok {
+		for _, g := range raw {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	role := o.roleForGroups(groups)
+	if role == "" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "No role mapped for this account"})
+		return
+	}
+
+	tenant := o.conf.DefaultTenant
+	if o.conf.TenantClaim != "" {
+		if t, ok := claims[o.conf.TenantClaim].(string); ok && t != "" {
+			tenant = t
+		}
+	}
+
+	subject := token.Subject
+	if email, ok := claims["email"].(string); ok && email != "" {
+		subject = email
+	}
+
+	c.Set(ctxTenant, tenant)
+	c.Set(ctxRole, role)
+	c.Set(ctxScopes, o.scopesForGroups(groups))
+	c.Set(ctxActor, "oidc:"+subject)
+	c.Next()
+}
+
+func oidcLogin(c *gin.Context) {
+	if oidcAuth == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+		return
+	}
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		logCtx(c).Errorf("Error generating OIDC state: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+	state := hex.EncodeToString(buf)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, state, 600, "/auth/oidc", "", c.Request.TLS != nil, true)
+	c.Redirect(http.StatusFound, oidcAuth.oauth.AuthCodeURL(state))
+}
+
+func oidcCallback(c *gin.Context) {
+	if oidcAuth == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "OIDC login is not configured"})
+		return
+	}
+	state, err := c.Cookie(oidcStateCookie)
+	if err != nil || state == "" || state != c.Query("state") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid login state"})
+		return
+	}
+	c.SetCookie(oidcStateCookie, "", -1, "/auth/oidc", "", c.Request.TLS != nil, true)
+
+	token, err := oidcAuth.oauth.Exchange(c.Request.Context(), c.Query("code"))
+	if err != nil {
+		logCtx(c).Warnf("OIDC code exchange failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed"})
+		return
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Provider did not return an ID token"})
+		return
+	}
+	idToken, err := oidcAuth.verifier.Verify(c.Request.Context(), rawIDToken)
+	if err != nil {
+		logCtx(c).Warnf("OIDC ID token verification failed: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Login failed"})
+		return
+	}
+
+	logCtx(c).Infof("OIDC login for subject %s", idToken.Subject)
+	c.JSON(http.StatusOK, gin.H{
+		"id_token":   rawIDToken,
+		"token_type": "Bearer",
+		"expires_at": idToken.Expiry,
+	})
+}
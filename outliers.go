@@ -0,0 +1,367 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Outlier statuses.
+const (
+	outlierOpen     = "open"
+	outlierAccepted = "accepted"
+	outlierFixed    = "fixed"
+)
+
+// Fields the outlier scan checks.
+const (
+	outlierSalary = "salary"
+	outlierAge    = "age"
+)
+
+// Outlier is a value of a record the outlier scan flagged for review. A
+// record has at most one per field: accepting it keeps later scans from
+// flagging the same value, and fixing it corrects the record.
+type Outlier struct {
+	ID         uint   `gorm:"primaryKey" json:"id"`
+	TenantID   string `gorm:"size:64;not null;uniqueIndex:idx_outliers_tenant_employee_field" json:"tenant_id"`
+	EmployeeID uint   `gorm:"not null;uniqueIndex:idx_outliers_tenant_employee_field" json:"employee_id"`
+	Field      string `gorm:"size:16;not null;uniqueIndex:idx_outliers_tenant_employee_field" json:"field"`
+	// Value is the value flagged, and FixedValue what it was corrected to.
+	Value      float64  `json:"value"`
+	FixedValue *float64 `json:"fixed_value,omitempty"`
+	// Sigma is how many standard deviations a salary is from the mean of
+	// the rest of its group; nil for ages, and for a salary whose group is
+	// otherwise all one value.
+	Sigma      *float64   `json:"sigma,omitempty"`
+	Reason     string     `json:"reason"`
+	Status     string     `gorm:"size:16;not null;index" json:"status"`
+	ReviewedBy string     `json:"reviewed_by,omitempty"`
+	ReviewedAt *time.Time `json:"reviewed_at,omitempty"`
+	DetectedAt time.Time  `json:"detected_at"`
+}
+
+// findOutliers finds the tenant's ages outside what validation allows,
+// which records stored before it was enforced can have, and salaries more
+// than analytics.outlier_sigma standard deviations from the mean of the
+// rest of their department and currency. Leaving the salary itself out of
+// its group's mean and deviation keeps one large mistake from hiding
+// itself in a small group.
+func findOutliers(tx *gorm.DB, tenantID string) ([]Outlier, error) {
+	var found []Outlier
+	var ages []struct {
+		ID  uint
+		Age int
+	}
+	err := tx.Model(&Employee{}).Select("id, age").
+		Where("tenant_id = ? AND (age < ? OR age > ?)", tenantID, minEmployeeAge, maxEmployeeAge).Scan(&ages).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range ages {
+		found = append(found, Outlier{
+			EmployeeID: a.ID,
+			Field:      outlierAge,
+			Value:      float64(a.Age),
+			Reason:     fmt.Sprintf("age %d is not within %d-%d", a.Age, minEmployeeAge, maxEmployeeAge),
+		})
+	}
+
+	var departments []Reference
+	if err := tx.Table("departments").Where("tenant_id = ?", tenantID).Find(&departments).Error; err != nil {
+		return nil, err
+	}
+	names := make(map[uint]string, len(departments))
+	for _, d := range departments {
+		names[d.ID] = d.Name
+	}
+	var groups []struct {
+		DepartmentID *uint
+		Currency     string
+		N            int64
+		Mean, MeanSq float64
+	}
+	err = tx.Model(&Employee{}).Select("department_id, currency, COUNT(*) AS n, AVG(salary) AS mean, AVG(salary * salary) AS mean_sq").
+		Where("tenant_id = ?", tenantID).Group("department_id, currency").
+		Having("COUNT(*) >= ?", cfg.Analytics.OutlierMinGroup).Scan(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+	k := cfg.Analytics.OutlierSigma
+	for _, g := range groups {
+		sd := math.Sqrt(math.Max(g.MeanSq-g.Mean*g.Mean, 0))
+		if sd == 0 {
+			continue
+		}
+		// A value z deviations from the whole group's mean is
+		// sqrt(n z² / (n-1-z²)) from the rest's, so is an outlier from
+		// z = k sqrt((n-1) / (n+k²)) on.
+		n := float64(g.N)
+		bound := k * math.Sqrt((n-1)/(n+k*k)) * sd
+		query := tx.Model(&Employee{}).Select("id, salary").
+			Where("tenant_id = ? AND currency = ? AND (salary > ? OR salary < ?)", tenantID, g.Currency, g.Mean+bound, g.Mean-bound)
+		group := "without a department"
+		if g.DepartmentID != nil {
+			query = query.Where("department_id = ?", *g.DepartmentID)
+			group = "in " + names[*g.DepartmentID]
+		} else {
+			query = query.Where("department_id IS NULL")
+		}
+		var rows []struct {
+			ID     uint
+			Salary float64
+		}
+		if err := query.Scan(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			z := math.Abs(r.Salary-g.Mean) / sd
+			restMean := (n*g.Mean - r.Salary) / (n - 1)
+			o := Outlier{EmployeeID: r.ID, Field: outlierSalary, Value: r.Salary}
+			if rest := n - 1 - z*z; rest > 1e-9 {
+				sigma := math.Round(math.Sqrt(n*z*z/rest)*10) / 10
+				o.Sigma = &sigma
+				o.Reason = fmt.Sprintf("salary %v %s is %.1fσ from the mean %.2f of the other %d %s",
+					r.Salary, g.Currency, sigma, restMean, g.N-1, group)
+			} else {
+				o.Reason = fmt.Sprintf("salary %v %s differs from the other %d %s, which are all %.2f",
+					r.Salary, g.Currency, g.N-1, group, restMean)
+			}
+			found = append(found, o)
+		}
+	}
+	return found, nil
+}
+
+// scanOutliers flags the tenant's outliers into the review queue. Values
+// flagged before are refreshed, and reopened if they were fixed, or
+// accepted at a different value; open ones no longer found are cleared.
+func scanOutliers(c *gin.Context) {
+	tenant := tenantID(c)
+	now := time.Now().UTC()
+	var flagged, reopened, cleared, open int64
+	err := db.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+		found, err := findOutliers(tx, tenant)
+		if err != nil {
+			return err
+		}
+		var existing []Outlier
+		if err := tx.Where("tenant_id = ?", tenant).Find(&existing).Error; err != nil {
+			return err
+		}
+		type key struct {
+			employee uint
+			field    string
+		}
+		known := make(map[key]Outlier, len(existing))
+		for _, o := range existing {
+			known[key{o.EmployeeID, o.Field}] = o
+		}
+		for _, f := range found {
+			k := key{f.EmployeeID, f.Field}
+			o, ok := known[k]
+			delete(known, k)
+			switch {
+			case !ok:
+				f.TenantID, f.Status, f.DetectedAt = tenant, outlierOpen, now
+				if err := tx.Create(&f).Error; err != nil {
+					return err
+				}
+				flagged++
+				continue
+			case o.Status == outlierAccepted && o.Value == f.Value:
+				continue
+			case o.Status != outlierOpen:
+				reopened++
+			}
+			open++
+			err := tx.Model(&o).Updates(map[string]interface{}{
+				"value": f.Value, "fixed_value": nil, "sigma": f.Sigma, "reason": f.Reason,
+				"status": outlierOpen, "reviewed_by": "", "reviewed_at": nil, "detected_at": now,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+		for _, o := range known {
+			if o.Status != outlierOpen {
+				continue
+			}
+			if err := tx.Delete(&o).Error; err != nil {
+				return err
+			}
+			cleared++
+		}
+		return nil
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error scanning for outliers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan for outliers"})
+		return
+	}
+	setRowsAffected(c, flagged+reopened+cleared)
+	logCtx(c).Infof("Outlier scan of tenant %s: %d flagged, %d reopened, %d cleared", tenant, flagged, reopened, cleared)
+	c.JSON(http.StatusOK, gin.H{
+		"flagged":  flagged,
+		"reopened": reopened,
+		"open":     flagged + open,
+		"cleared":  cleared,
+	})
+}
+
+// listOutliers pages through the review queue, open outliers by default
+// (?status=), optionally of one ?field=. Salary outliers are left out for
+// roles salaries are redacted for.
+func listOutliers(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 50
+	}
+	query := db.WithContext(c.Request.Context()).Model(&Outlier{}).Scopes(tenantScope(c))
+	switch status := c.DefaultQuery("status", outlierOpen); status {
+	case outlierOpen, outlierAccepted, outlierFixed:
+		query = query.Where("status = ?", status)
+	case "all":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid status, expected open, accepted, fixed or all"})
+		return
+	}
+	switch field := c.Query("field"); field {
+	case "":
+	case outlierSalary, outlierAge:
+		query = query.Where("field = ?", field)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid field, expected salary or age"})
+		return
+	}
+	if _, redacted := redactionPolicy(c)["salary"]; redacted {
+		query = query.Where("field <> ?", outlierSalary)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logCtx(c).Errorf("Error counting outliers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list outliers"})
+		return
+	}
+	outliers := []Outlier{}
+	if err := query.Order("detected_at DESC").Order("id").Limit(limit).Offset((page - 1) * limit).Find(&outliers).Error; err != nil {
+		logCtx(c).Errorf("Error listing outliers: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list outliers"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "page": page, "limit": limit, "outliers": outliers})
+}
+
+// findOutlier loads the outlier of the path's ID, answering the request
+// and returning false if there is none or the caller may not see it.
+func findOutlier(c *gin.Context, o *Outlier) bool {
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(o, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Outlier not found"})
+		return false
+	}
+	if _, redacted := redactionPolicy(c)["salary"]; redacted && o.Field == outlierSalary {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Salaries are redacted for your role"})
+		return false
+	}
+	return true
+}
+
+// acceptOutlier marks an open outlier as a correct value.
+func acceptOutlier(c *gin.Context) {
+	var o Outlier
+	if !findOutlier(c, &o) {
+		return
+	}
+	if o.Status != outlierOpen {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Outlier is %s, only open outliers can be accepted", o.Status)})
+		return
+	}
+	now := time.Now().UTC()
+	o.Status, o.ReviewedBy, o.ReviewedAt = outlierAccepted, c.GetString(ctxActor), &now
+	if err := db.WithContext(c.Request.Context()).Select("status", "reviewed_by", "reviewed_at").Save(&o).Error; err != nil {
+		logCtx(c).Errorf("Error accepting outlier %d: %v", o.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to accept outlier"})
+		return
+	}
+	setRowsAffected(c, 1)
+	setAuditEvent(c, "outlier.accept", fmt.Sprintf("record %d %s", o.EmployeeID, o.Field))
+	setAuditRecord(c, o.EmployeeID)
+	c.JSON(http.StatusOK, o)
+}
+
+// fixOutlier corrects the flagged field of the record to the body's
+// "value", validated as record updates are, and marks the outlier fixed.
+func fixOutlier(c *gin.Context) {
+	var req struct {
+		Value *float64 `json:"value" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var o Outlier
+	if !findOutlier(c, &o) {
+		return
+	}
+	if o.Status == outlierFixed {
+		c.JSON(http.StatusConflict, gin.H{"error": "Outlier is already fixed"})
+		return
+	}
+	ctx := c.Request.Context()
+	var e Employee
+	if err := db.WithContext(ctx).Scopes(tenantScope(c)).First(&e, "id = ?", o.EmployeeID).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+		return
+	}
+	value := *req.Value
+	switch o.Field {
+	case outlierAge:
+		if value != math.Trunc(value) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Age must be a whole number"})
+			return
+		}
+		e.Age = int(value)
+	case outlierSalary:
+		value = roundAmount(value, e.Currency)
+		e.Salary = value
+	}
+	rules, err := loadRuleSet(ctx, tenantID(c))
+	if err != nil {
+		logCtx(c).Errorf("Error loading validation rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fix outlier"})
+		return
+	}
+	rejects, _ := rules.check(&e)
+	if errs := append(validateEmployee(&e), rejects...); errs != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Record is invalid", "errors": errs})
+		return
+	}
+
+	now := time.Now().UTC()
+	o.Status, o.FixedValue, o.ReviewedBy, o.ReviewedAt = outlierFixed, &value, c.GetString(ctxActor), &now
+	err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&e).Update(o.Field, value).Error; err != nil {
+			return err
+		}
+		return tx.Select("status", "fixed_value", "reviewed_by", "reviewed_at").Save(&o).Error
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error fixing outlier %d: %v", o.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fix outlier"})
+		return
+	}
+	setRowsAffected(c, 1)
+	setAuditEvent(c, "outlier.fix", fmt.Sprintf("record %d %s", o.EmployeeID, o.Field))
+	setAuditRecord(c, o.EmployeeID)
+	c.JSON(http.StatusOK, o)
+}
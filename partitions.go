@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// db.partition_by values.
+const (
+	partitionByCompany  = "company"
+	partitionByJoinYear = "join_year"
+)
+
+// partitionScheme is a way of partitioning employees on Postgres: a
+// partition per key, created as rows with that key arrive, and a default
+// partition for rows without one.
+type partitionScheme struct {
+	// column is the partition key. Unique indexes of a partitioned table
+	// must include it, so the one on tenant and email does.
+	column   string
+	strategy string
+	// keyExpr is the SQL of a row's key.
+	keyExpr string
+	// key is the key of e, false when it has none.
+	key func(e *Employee) (int, bool)
+	// bounds are the values of the partition of key k; match selects its
+	// rows.
+	bounds func(k int) string
+	match  func(k int) string
+	// value is e's value of column, and same reports whether two versions
+	// of an employee have the same one.
+	value func(e *Employee) interface{}
+	same  func(a, b *Employee) bool
+}
+
+var partitionSchemes = map[string]partitionScheme{
+	partitionByCompany: {
+		column:   "company_id",
+		strategy: "LIST",
+		keyExpr:  "company_id",
+		key: func(e *Employee) (int, bool) {
+			if e.CompanyID == nil {
+				return 0, false
+			}
+			return int(*e.CompanyID), true
+		},
+		bounds: func(k int) string { return fmt.Sprintf("FOR VALUES IN (%d)", k) },
+		match:  func(k int) string { return fmt.Sprintf("company_id = %d", k) },
+		value:  func(e *Employee) interface{} { return e.CompanyID },
+		same: func(a, b *Employee) bool {
+			return (a.CompanyID == nil) == (b.CompanyID == nil) && (a.CompanyID == nil || *a.CompanyID == *b.CompanyID)
+		},
+	},
+	// Join dates are stored as midnight UTC, so years are taken in UTC
+	// whatever the session time zone.
+	partitionByJoinYear: {
+		column:   "date_joined",
+		strategy: "RANGE",
+		keyExpr:  "CAST(EXTRACT(YEAR FROM date_joined AT TIME ZONE 'UTC') AS INTEGER)",
+		key: func(e *Employee) (int, bool) {
+			if e.DateJoined == nil {
+				return 0, false
+			}
+			return e.DateJoined.UTC().Year(), true
+		},
+		bounds: func(y int) string {
+			return fmt.Sprintf("FOR VALUES FROM ('%04d-01-01 00:00:00+00') TO ('%04d-01-01 00:00:00+00')", y, y+1)
+		},
+		match: func(y int) string {
+			return fmt.Sprintf("date_joined >= '%04d-01-01 00:00:00+00' AND date_joined < '%04d-01-01 00:00:00+00'", y, y+1)
+		},
+		value: func(e *Employee) interface{} { return e.DateJoined },
+		same: func(a, b *Employee) bool {
+			return (a.DateJoined == nil) == (b.DateJoined == nil) && (a.DateJoined == nil || a.DateJoined.Equal(*b.DateJoined))
+		},
+	},
+}
+
+// employeePartitioning is how employees is partitioned, as found at
+// startup: a key of partitionSchemes, or empty for one table.
+var employeePartitioning string
+
+// knownPartitions are the names of the employee partitions seen to exist.
+var knownPartitions sync.Map
+
+func partitionName(by string, k int) string {
+	return fmt.Sprintf("employees_%s_%d", by, k)
+}
+
+// currentPartitioning reads how employees is partitioned.
+func currentPartitioning(tx *gorm.DB) (string, error) {
+	if tx.Dialector.Name() != driverPostgres {
+		return "", nil
+	}
+	var column string
+	err := tx.Raw(`SELECT a.attname FROM pg_partitioned_table p
+		JOIN pg_attribute a ON a.attrelid = p.partrelid AND a.attnum = p.partattrs[0]
+		WHERE p.partrelid = to_regclass('employees')`).Scan(&column).Error
+	if err != nil || column == "" {
+		return "", err
+	}
+	for by, scheme := range partitionSchemes {
+		if scheme.column == column {
+			return by, nil
+		}
+	}
+	return "", fmt.Errorf("employees is partitioned by %s, which is not a known scheme", column)
+}
+
+// loadEmployeePartitioning records how employees is partitioned, warning
+// when that is not what db.partition_by asks for.
+func loadEmployeePartitioning() error {
+	by, err := currentPartitioning(db)
+	if err != nil {
+		return err
+	}
+	employeePartitioning = by
+	if by != cfg.DB.PartitionBy {
+		logr.Warnf(`employees is partitioned by %q but db.partition_by is %q; run "main migrate partitions" to change it`, by, cfg.DB.PartitionBy)
+	}
+	return nil
+}
+
+// ensureEmployeePartitions creates the partitions the rows of batch belong
+// in that don't exist yet, so they aren't routed to the default partition.
+// It commits on its own, ahead of the batch, so the lock it takes on the
+// default partition is held only briefly.
+func ensureEmployeePartitions(ctx context.Context, batch []Employee) error {
+	scheme, ok := partitionSchemes[employeePartitioning]
+	if !ok {
+		return nil
+	}
+	var missing []int
+	seen := map[int]bool{}
+	for i := range batch {
+		k, ok := scheme.key(&batch[i])
+		if !ok || seen[k] {
+			continue
+		}
+		seen[k] = true
+		if _, known := knownPartitions.Load(partitionName(employeePartitioning, k)); !known {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, k := range missing {
+			if err := createEmployeePartition(tx, employeePartitioning, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range missing {
+		knownPartitions.Store(partitionName(employeePartitioning, k), true)
+	}
+	return nil
+}
+
+// createEmployeePartition creates the partition of key k unless it exists.
+// Rows of it already in the default partition are moved in first, as
+// Postgres won't attach a partition whose rows the default holds.
+func createEmployeePartition(tx *gorm.DB, by string, k int) error {
+	scheme := partitionSchemes[by]
+	name := partitionName(by, k)
+	// Import workers may need the same partition at once.
+	if err := tx.Exec("SELECT pg_advisory_xact_lock(hashtext('employees_partitions'))").Error; err != nil {
+		return err
+	}
+	var exists bool
+	if err := tx.Raw("SELECT to_regclass(?) IS NOT NULL", name).Scan(&exists).Error; err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	for _, stmt := range []string{
+		fmt.Sprintf("CREATE TABLE %s (LIKE employees INCLUDING DEFAULTS)", name),
+		fmt.Sprintf("WITH moved AS (DELETE FROM employees_default WHERE %s RETURNING *) INSERT INTO %s SELECT * FROM moved", scheme.match(k), name),
+		fmt.Sprintf("ALTER TABLE employees ATTACH PARTITION %s %s", name, scheme.bounds(k)),
+	} {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	logr.Infof("Created employee partition %s", name)
+	return nil
+}
+
+// repartitionEmployees rebuilds employees partitioned by by, or as one
+// table when by is empty. Every row is copied, so it takes as long as a
+// rewrite of the table, twice when switching between two schemes.
+func repartitionEmployees(tx *gorm.DB, by string) error {
+	current, err := currentPartitioning(tx)
+	if err != nil || current == by {
+		return err
+	}
+	if current != "" && by != "" {
+		if err := rebuildEmployees(tx, ""); err != nil {
+			return err
+		}
+	}
+	return rebuildEmployees(tx, by)
+}
+
+// rebuildEmployees copies employees into a new table, partitioned by by or
+// not at all, with the same sequence, indexes and foreign keys. A
+// partitioned table has no primary key, as it would have to include the
+// partition key, which may be null; id is indexed instead.
+func rebuildEmployees(tx *gorm.DB, by string) error {
+	var indexes []struct{ Indexname, Indexdef string }
+	err := tx.Raw("SELECT indexname, indexdef FROM pg_indexes WHERE schemaname = current_schema() AND tablename = 'employees'").
+		Scan(&indexes).Error
+	if err != nil {
+		return err
+	}
+	var foreignKeys []struct{ Conname, Def string }
+	err = tx.Raw("SELECT conname, pg_get_constraintdef(oid) AS def FROM pg_constraint WHERE conrelid = 'employees'::regclass AND contype = 'f'").
+		Scan(&foreignKeys).Error
+	if err != nil {
+		return err
+	}
+	var sequence string
+	if err := tx.Raw("SELECT COALESCE(pg_get_serial_sequence('employees', 'id'), '')").Scan(&sequence).Error; err != nil {
+		return err
+	}
+
+	scheme, partitioned := partitionSchemes[by]
+	if partitioned {
+		logr.Infof("Rebuilding employees partitioned by %s", by)
+	} else {
+		logr.Info("Rebuilding employees as one table")
+	}
+	var stmts []string
+	if sequence != "" {
+		// Dropping the old table would drop the sequence it owns.
+		stmts = append(stmts, "ALTER SEQUENCE "+sequence+" OWNED BY NONE")
+	}
+	create := "CREATE TABLE employees (LIKE employees_rebuilt INCLUDING DEFAULTS)"
+	if partitioned {
+		create += fmt.Sprintf(" PARTITION BY %s (%s)", scheme.strategy, scheme.column)
+	}
+	stmts = append(stmts, "ALTER TABLE employees RENAME TO employees_rebuilt", create)
+	if partitioned {
+		stmts = append(stmts, "CREATE TABLE employees_default PARTITION OF employees DEFAULT")
+	}
+	for _, stmt := range stmts {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	if partitioned {
+		var keys []int
+		err := tx.Raw(fmt.Sprintf("SELECT DISTINCT %s FROM employees_rebuilt WHERE %s IS NOT NULL", scheme.keyExpr, scheme.column)).
+			Scan(&keys).Error
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := createEmployeePartition(tx, by, k); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The old indexes go with the old table, and are created again after
+	// the copy, which is faster than maintaining them through it.
+	stmts = []string{"INSERT INTO employees SELECT * FROM employees_rebuilt", "DROP TABLE employees_rebuilt"}
+	if sequence != "" {
+		stmts = append(stmts, "ALTER SEQUENCE "+sequence+" OWNED BY employees.id")
+	}
+	emailKey := ""
+	if partitioned {
+		emailKey = ", " + scheme.column
+		stmts = append(stmts, "CREATE INDEX idx_employees_id ON employees (id)")
+	} else {
+		stmts = append(stmts, "ALTER TABLE employees ADD PRIMARY KEY (id)")
+	}
+	for _, idx := range indexes {
+		switch idx.Indexname {
+		case "employees_pkey", "idx_employees_id":
+		case "idx_employees_tenant_email":
+			stmts = append(stmts, "CREATE UNIQUE INDEX idx_employees_tenant_email ON employees (tenant_id, email"+emailKey+")")
+		default:
+			// Indexes of a partitioned table are defined on it ONLY.
+			stmts = append(stmts, strings.Replace(idx.Indexdef, " ON ONLY ", " ON ", 1))
+		}
+	}
+	for _, stmt := range stmts {
+		if err := tx.Exec(stmt).Error; err != nil {
+			return err
+		}
+	}
+	for _, fk := range foreignKeys {
+		if err := tx.Exec("ALTER TABLE employees ADD CONSTRAINT ? "+fk.Def, clause.Column{Name: fk.Conname}).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Exec("ANALYZE employees").Error
+}
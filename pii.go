@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ctxScopes = "scopes"
+
+	scopePIIRead = "pii:read"
+)
+
+const (
+	redactMask = "mask"
+	redactHash = "hash"
+	redactNull = "null"
+	redactDrop = "drop"
+)
+
+func callerScopes(c *gin.Context) []string {
+	scopes, _ := c.Get(ctxScopes)
+	list, _ := scopes.([]string)
+	return list
+}
+
+func hasScope(c *gin.Context, scope string) bool {
+	for _, s := range callerScopes(c) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func parseScopes(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' })
+}
+
+func maskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return "***"
+	}
+	return local[:1] + "***@" + domain
+}
+
+func maskValue(v interface{}) interface{} {
+	s, ok := v.(string)
+	if !ok {
+		return "***"
+	}
+	if strings.Contains(s, "@") {
+		return maskEmail(s)
+	}
+	if s == "" {
+		return s
+	}
+	return s[:1] + "***"
+}
+
+func hashValue(v interface{}) string {
+	mac := hmac.New(sha256.New, []byte(cfg.Redaction.HashSalt))
+	fmt.Fprint(mac, v)
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// normalizeFieldName lets policies name fields either by column ("date_joined")
+// or by their JSON key ("DateJoined").
+func normalizeFieldName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", ""))
+}
+
+func validRedactionAction(action string) bool {
+	switch action {
+	case redactMask, redactHash, redactNull, redactDrop:
+		return true
+	}
+	return false
+}
+
+// redactionPolicy returns the field actions to apply for the caller. Callers
+// holding pii:read see raw values.
+func redactionPolicy(c *gin.Context) map[string]string {
+	if hasScope(c, scopePIIRead) {
+		return nil
+	}
+	policy := make(map[string]string)
+	for field, action := range cfg.Redaction.Roles[c.GetString(ctxRole)] {
+		policy[normalizeFieldName(field)] = action
+	}
+	return policy
+}
+
+func redactObject(obj map[string]interface{}, policy map[string]string) {
+	for key, v := range obj {
+		switch policy[normalizeFieldName(key)] {
+		case redactMask:
+			obj[key] = maskValue(v)
+		case redactHash:
+			obj[key] = hashValue(v)
+		case redactNull:
+			obj[key] = nil
+		case redactDrop:
+			delete(obj, key)
+		}
+	}
+}
+
+// presentRecords is the single serialization path for record data leaving the
+// API. It applies the caller's redaction policy to a struct or slice of structs.
+func presentRecords(c *gin.Context, records interface{}) (interface{}, error) {
+	policy := redactionPolicy(c)
+	if len(policy) == 0 {
+		return records, nil
+	}
+
+	raw, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > 0 && raw[0] == '[' {
+		var list []map[string]interface{}
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		for _, obj := range list {
+			redactObject(obj, policy)
+		}
+		return list, nil
+	}
+	var obj map[string]interface{}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	redactObject(obj, policy)
+	return obj, nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Quality warnings, counted alongside the validation error codes of rows
+// that failed and the names of the warn rules rows broke.
+const (
+	qualityUnreadable        = "unreadable"
+	qualitySuspiciousAge     = "suspicious_age"
+	qualityDefaultCurrency   = "default_currency"
+	qualityMissingDateJoined = "missing_date_joined"
+	qualityMissingDepartment = "missing_department"
+	qualityMissingCompany    = "missing_company"
+	qualityMissingGender     = "missing_gender"
+)
+
+// Ages outside this range pass validation but are likely typos.
+const (
+	minPlausibleAge = 18
+	maxPlausibleAge = 70
+)
+
+// importQuality counts the rows of an import with quality warnings. Rows
+// is every row checked, that is every row read but blank ones; Flagged
+// those with at least one warning; Warnings the rows with each warning.
+type importQuality struct {
+	Rows     int64            `json:"rows"`
+	Flagged  int64            `json:"flagged"`
+	Warnings map[string]int64 `json:"warnings,omitempty"`
+}
+
+// Value stores q as JSON text. It is a Valuer rather than serialized by
+// GORM, so checkpoints can save it through a map of updates.
+func (q importQuality) Value() (driver.Value, error) {
+	b, err := json.Marshal(q)
+	return string(b), err
+}
+
+func (q *importQuality) Scan(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		*q = importQuality{}
+		return nil
+	case []byte:
+		return json.Unmarshal(v, q)
+	case string:
+		return json.Unmarshal([]byte(v), q)
+	}
+	return fmt.Errorf("unsupported import quality type %T", v)
+}
+
+// add counts a row with the given warnings, if any.
+func (q *importQuality) add(warnings ...string) {
+	q.Rows++
+	if len(warnings) == 0 {
+		return
+	}
+	q.Flagged++
+	if q.Warnings == nil {
+		q.Warnings = map[string]int64{}
+	}
+	seen := make(map[string]bool, len(warnings))
+	for _, w := range warnings {
+		if !seen[w] {
+			seen[w] = true
+			q.Warnings[w]++
+		}
+	}
+}
+
+// clone copies q, for a checkpoint taken while the reader goes on counting.
+func (q importQuality) clone() importQuality {
+	if q.Warnings != nil {
+		warnings := make(map[string]int64, len(q.Warnings))
+		for w, n := range q.Warnings {
+			warnings[w] = n
+		}
+		q.Warnings = warnings
+	}
+	return q
+}
+
+// score is the percentage of rows checked without warnings, to one
+// decimal, and nil before any row is.
+func (q importQuality) score() *float64 {
+	if q.Rows == 0 {
+		return nil
+	}
+	s := math.Round(float64(q.Rows-q.Flagged)/float64(q.Rows)*1000) / 10
+	return &s
+}
+
+// qualityWarnings lists what is doubtful about a row that passed
+// validation: implausible values, and fields left blank or filled in with
+// a default.
+func qualityWarnings(record []string, e *Employee) []string {
+	var warnings []string
+	if e.Age < minPlausibleAge || e.Age > maxPlausibleAge {
+		warnings = append(warnings, qualitySuspiciousAge)
+	}
+	if m := salaryPattern.FindStringSubmatch(strings.TrimSpace(record[8])); m != nil && m[1] == "" && m[3] == "" {
+		warnings = append(warnings, qualityDefaultCurrency)
+	}
+	if e.DateJoined == nil {
+		warnings = append(warnings, qualityMissingDateJoined)
+	}
+	if strings.TrimSpace(e.Department) == "" {
+		warnings = append(warnings, qualityMissingDepartment)
+	}
+	if strings.TrimSpace(e.Company) == "" {
+		warnings = append(warnings, qualityMissingCompany)
+	}
+	if strings.TrimSpace(e.Gender) == "" {
+		warnings = append(warnings, qualityMissingGender)
+	}
+	return warnings
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// employeeInput is the body of record writes, with the keys records are
+// returned with. DateJoined takes any format an import reads.
+type employeeInput struct {
+	FirstName  string
+	LastName   string
+	Email      string
+	Age        int
+	Gender     string
+	Department string
+	Company    string
+	Salary     float64
+	// Currency defaults to currency.default.
+	Currency   string
+	DateJoined string
+	IsActive   bool
+	Extra      map[string]string
+}
+
+// apply sets e's fields from the input, normalized as an import would, and
+// returns the validation errors of the result.
+func (in employeeInput) apply(e *Employee) validationErrors {
+	e.FirstName, e.LastName = in.FirstName, in.LastName
+	e.Email = strings.ToLower(strings.TrimSpace(in.Email))
+	e.Age, e.Gender, e.Department, e.Company = in.Age, in.Gender, in.Department, in.Company
+	e.Salary, e.IsActive = in.Salary, in.IsActive
+	e.Currency = strings.ToUpper(strings.TrimSpace(in.Currency))
+	if e.Currency == "" {
+		e.Currency = cfg.Currency.Default
+	}
+	e.Salary = roundAmount(e.Salary, e.Currency)
+	e.Extra = nil
+	if len(in.Extra) > 0 {
+		e.Extra = extraAttributes(in.Extra)
+	}
+	e.DateJoined = nil
+	errs := validateEmployee(e)
+	if strings.TrimSpace(in.DateJoined) != "" {
+		t, err := parseDate(in.DateJoined, dateFormatAuto)
+		if err != nil {
+			errs = append(errs, validationError{Field: "DateJoined", Code: codeInvalidDate, Message: err.Error()})
+		} else {
+			e.DateJoined = &t
+		}
+	}
+	return errs
+}
+
+// bindEmployee reads the request body into e, answering the request and
+// returning false if it is malformed, invalid, breaks one of the tenant's
+// reject rules or allowed values, or takes another record's email. Gender
+// and department are rewritten to their canonical values, and department
+// and company linked to by ID, added if the tenant has no such name yet.
+func bindEmployee(c *gin.Context, e *Employee) bool {
+	var in employeeInput
+	if err := c.ShouldBindJSON(&in); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid JSON body: " + err.Error()})
+		return false
+	}
+	rules, err := loadRuleSet(c.Request.Context(), tenantID(c))
+	if err != nil {
+		logCtx(c).Errorf("Error loading validation rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save record"})
+		return false
+	}
+	allowed, err := loadValueLists(c.Request.Context(), tenantID(c))
+	if err != nil {
+		logCtx(c).Errorf("Error loading allowed values: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save record"})
+		return false
+	}
+	errs := append(in.apply(e), allowed.normalize(e)...)
+	rejects, warnings := rules.check(e)
+	if len(warnings) > 0 {
+		logCtx(c).Warnf("Record breaks warn rules: %v", warnings)
+	}
+	if errs = append(errs, rejects...); errs != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Record is invalid", "errors": errs})
+		return false
+	}
+	var other Employee
+	err = db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Select("id").
+		Where("email = ? AND id <> ?", e.Email, e.ID).Take(&other).Error
+	switch {
+	case err == nil:
+		c.JSON(http.StatusConflict, gin.H{"error": "Another record has this email", "id": other.ID})
+		return false
+	case !errors.Is(err, gorm.ErrRecordNotFound):
+		logCtx(c).Errorf("Error checking for duplicate email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save record"})
+		return false
+	}
+	batch := []Employee{*e}
+	err = resolveReferences(db.WithContext(c.Request.Context()), tenantID(c), batch)
+	if err == nil {
+		err = ensureEmployeePartitions(c.Request.Context(), batch)
+	}
+	if err != nil {
+		logCtx(c).Errorf("Error saving record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save record"})
+		return false
+	}
+	*e = batch[0]
+	return true
+}
+
+// createRecord adds one employee record, validated as imported rows are.
+func createRecord(c *gin.Context) {
+	e := Employee{TenantID: tenantID(c)}
+	if !bindEmployee(c, &e) {
+		return
+	}
+	if err := db.WithContext(c.Request.Context()).Create(&e).Error; err != nil {
+		logCtx(c).Errorf("Error creating record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save record"})
+		return
+	}
+	setRowsAffected(c, 1)
+	setAuditEvent(c, "record.create", fmt.Sprintf("record %d", e.ID))
+	setAuditRecord(c, e.ID)
+	respondRecord(c, http.StatusCreated, e)
+}
+
+// updateRecord replaces the fields of an employee record.
+func updateRecord(c *gin.Context) {
+	var e Employee
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&e, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found"})
+		return
+	}
+	if e.AnonymizedAt != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Record is anonymized"})
+		return
+	}
+	if !bindEmployee(c, &e) {
+		return
+	}
+	if err := db.WithContext(c.Request.Context()).Save(&e).Error; err != nil {
+		logCtx(c).Errorf("Error updating record %d: %v", e.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save record"})
+		return
+	}
+	setRowsAffected(c, 1)
+	setAuditEvent(c, "record.update", fmt.Sprintf("record %d", e.ID))
+	setAuditRecord(c, e.ID)
+	respondRecord(c, http.StatusOK, e)
+}
+
+func respondRecord(c *gin.Context, status int, e Employee) {
+	response, err := presentRecords(c, e)
+	if err != nil {
+		logCtx(c).Errorf("Error serializing record: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Record saved, but failed to serialize it"})
+		return
+	}
+	c.JSON(status, response)
+}
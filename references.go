@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Reference is a department or company employees belong to. Records refer
+// to one by ID, so renaming it renames it on every record.
+type Reference struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TenantID  string    `json:"tenant_id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// EmployeeCount is filled in by lists and lookups.
+	EmployeeCount int64 `gorm:"->;-:migration" json:"employee_count"`
+}
+
+// referenceKind is a table of references, and the employees column and
+// record key pointing into it.
+type referenceKind struct {
+	table  string
+	column string
+	noun   string
+	title  string
+	// field returns an employee's name and ID of the reference.
+	field func(*Employee) (*string, **uint)
+}
+
+var (
+	departments = referenceKind{table: "departments", column: "department_id", noun: "department", title: "Department",
+		field: func(e *Employee) (*string, **uint) { return &e.Department, &e.DepartmentID }}
+	companies = referenceKind{table: "companies", column: "company_id", noun: "company", title: "Company",
+		field: func(e *Employee) (*string, **uint) { return &e.Company, &e.CompanyID }}
+
+	referenceKinds = []referenceKind{departments, companies}
+)
+
+const maxReferenceNameLen = 128
+
+// referenceFilterScope reads the ?department= and ?company= filters of
+// /records, each a name or, as department_id= and company_id=, an ID.
+func referenceFilterScope(c *gin.Context) (func(*gorm.DB) *gorm.DB, error) {
+	var conds []func(*gorm.DB) *gorm.DB
+	for _, kind := range referenceKinds {
+		kind := kind
+		if name := c.Query(kind.noun); name != "" {
+			conds = append(conds, func(tx *gorm.DB) *gorm.DB {
+				return tx.Where(kind.column+" IN (SELECT id FROM "+kind.table+" WHERE tenant_id = ? AND name = ?)",
+					tenantID(c), strings.TrimSpace(name))
+			})
+		}
+		if v := c.Query(kind.column); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s, expected an ID", kind.column)
+			}
+			conds = append(conds, func(tx *gorm.DB) *gorm.DB { return tx.Where(kind.column+" = ?", id) })
+		}
+	}
+	return func(tx *gorm.DB) *gorm.DB {
+		for _, cond := range conds {
+			tx = cond(tx)
+		}
+		return tx
+	}, nil
+}
+
+// resolveReferences sets the department and company IDs of a batch of one
+// tenant's employees from their names, adding the names the tenant does
+// not have yet. A blank name leaves the employee without one.
+func resolveReferences(tx *gorm.DB, tenantID string, batch []Employee) error {
+	for _, kind := range referenceKinds {
+		var names []string
+		seen := map[string]bool{}
+		for i := range batch {
+			name, _ := kind.field(&batch[i])
+			*name = strings.TrimSpace(*name)
+			if *name != "" && !seen[*name] {
+				seen[*name] = true
+				names = append(names, *name)
+			}
+		}
+		ids := map[string]uint{}
+		if len(names) > 0 {
+			var missing []Reference
+			err := lookupReferences(tx, kind, tenantID, names, ids)
+			if err == nil {
+				for _, name := range names {
+					if _, ok := ids[name]; !ok {
+						missing = append(missing, Reference{TenantID: tenantID, Name: name})
+					}
+				}
+			}
+			// A concurrent batch may add the same name; whichever loses
+			// reads the winner's ID.
+			if err == nil && len(missing) > 0 {
+				err = tx.Table(kind.table).Clauses(clause.OnConflict{DoNothing: true}).Create(&missing).Error
+				if err == nil {
+					err = lookupReferences(tx, kind, tenantID, names, ids)
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("resolving %s names: %w", kind.noun, err)
+			}
+		}
+		for i := range batch {
+			name, id := kind.field(&batch[i])
+			*id = nil
+			if v, ok := ids[*name]; ok {
+				*id = &v
+			}
+		}
+	}
+	return nil
+}
+
+func lookupReferences(tx *gorm.DB, kind referenceKind, tenantID string, names []string, ids map[string]uint) error {
+	var found []Reference
+	if err := tx.Table(kind.table).Select("id", "name").Where("tenant_id = ? AND name IN ?", tenantID, names).Find(&found).Error; err != nil {
+		return err
+	}
+	for _, r := range found {
+		ids[r.Name] = r.ID
+	}
+	return nil
+}
+
+// withEmployeeCount selects references with how many employees have each.
+func (kind referenceKind) withEmployeeCount(tx *gorm.DB) *gorm.DB {
+	return tx.Table(kind.table).Select(kind.table + ".*, " +
+		"(SELECT COUNT(*) FROM employees WHERE employees." + kind.column + " = " + kind.table + ".id AND employees.deleted_at IS NULL) AS employee_count")
+}
+
+func (kind referenceKind) list(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 50
+	}
+	query := db.WithContext(c.Request.Context()).Table(kind.table).Scopes(tenantScope(c))
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		query = query.Where("LOWER(name) LIKE ?", "%"+strings.ToLower(q)+"%")
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logCtx(c).Errorf("Error counting %s: %v", kind.table, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list " + kind.table})
+		return
+	}
+	refs := []Reference{}
+	if err := query.Scopes(kind.withEmployeeCount).Order("name").Limit(limit).Offset((page - 1) * limit).Find(&refs).Error; err != nil {
+		logCtx(c).Errorf("Error listing %s: %v", kind.table, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list " + kind.table})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{kind.table: refs, "page": page, "limit": limit, "total": total})
+}
+
+func (kind referenceKind) find(c *gin.Context) (Reference, bool) {
+	var ref Reference
+	err := db.WithContext(c.Request.Context()).Scopes(kind.withEmployeeCount, tenantScope(c)).
+		Where(kind.table+".id = ?", c.Param("id")).Take(&ref).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": kind.title + " not found"})
+		} else {
+			logCtx(c).Errorf("Error reading %s %s: %v", kind.noun, c.Param("id"), err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read " + kind.noun})
+		}
+		return ref, false
+	}
+	return ref, true
+}
+
+func (kind referenceKind) get(c *gin.Context) {
+	if ref, ok := kind.find(c); ok {
+		c.JSON(http.StatusOK, ref)
+	}
+}
+
+type referenceRequest struct {
+	Name string `json:"name" binding:"required"`
+}
+
+// save creates or renames a reference, answering 409 if the tenant has
+// another of the same name.
+func (kind referenceKind) save(c *gin.Context, ref *Reference, status int) {
+	var req referenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ref.Name = strings.TrimSpace(req.Name)
+	if ref.Name == "" || len(ref.Name) > maxReferenceNameLen {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("name must be 1-%d characters", maxReferenceNameLen)})
+		return
+	}
+	var other Reference
+	err := db.WithContext(c.Request.Context()).Table(kind.table).Scopes(tenantScope(c)).Select("id").
+		Where("name = ? AND id <> ?", ref.Name, ref.ID).Take(&other).Error
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Another %s has this name", kind.noun), "id": other.ID})
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = db.WithContext(c.Request.Context()).Table(kind.table).Save(ref).Error
+	}
+	if err != nil {
+		logCtx(c).Errorf("Error saving %s %q: %v", kind.noun, ref.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save " + kind.noun})
+		return
+	}
+	setRowsAffected(c, 1)
+	logCtx(c).Infof("Saved %s %d %q for tenant %s", kind.noun, ref.ID, ref.Name, ref.TenantID)
+	c.JSON(status, ref)
+}
+
+func (kind referenceKind) create(c *gin.Context) {
+	kind.save(c, &Reference{TenantID: tenantID(c)}, http.StatusCreated)
+}
+
+// rename changes a reference's name, on every record that has it.
+func (kind referenceKind) rename(c *gin.Context) {
+	if ref, ok := kind.find(c); ok {
+		kind.save(c, &ref, http.StatusOK)
+	}
+}
+
+// delete removes a reference no employee has; one still in use is a 409.
+// Merged records that had it are left without one.
+func (kind referenceKind) delete(c *gin.Context) {
+	ref, ok := kind.find(c)
+	if !ok {
+		return
+	}
+	if ref.EmployeeCount > 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("%d records have this %s", ref.EmployeeCount, kind.noun)})
+		return
+	}
+	// Records merged into others don't count, but still refer to it.
+	err := db.WithContext(c.Request.Context()).Transaction(func(tx *gorm.DB) error {
+		err := tx.Unscoped().Model(&Employee{}).Where(kind.column+" = ? AND deleted_at IS NOT NULL", ref.ID).
+			Update(kind.column, nil).Error
+		if err != nil {
+			return err
+		}
+		return tx.Table(kind.table).Delete(&Reference{}, ref.ID).Error
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error deleting %s %d: %v", kind.noun, ref.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete " + kind.noun})
+		return
+	}
+	setRowsAffected(c, 1)
+	logCtx(c).Infof("Deleted %s %d %q", kind.noun, ref.ID, ref.Name)
+	c.JSON(http.StatusOK, gin.H{"message": kind.title + " deleted"})
+}
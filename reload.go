@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// serveArgs are the flags serve was started with, re-applied on reload so
+	// command-line overrides keep their precedence.
+	serveArgs []string
+	reloadMu  sync.Mutex
+)
+
+// reloadConfig re-reads the config file, environment and flags and applies the
+// settings that are safe to change while running: log level, import tuning,
+// login rate limits, feature flags, currency, analytics, records, email and chat
+// notifications, including log alert rules. Running imports pick up new insert workers and batch
+// size; other import settings apply to the next job. Other changes are
+// reported but need a restart.
+func reloadConfig() ([]string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fresh, err := loadConfig(fs, serveArgs)
+	if err != nil {
+		return nil, err
+	}
+
+	next := *cfg
+	var changed []string
+	if fresh.Log.Level != cfg.Log.Level {
+		level, _ := logrus.ParseLevel(fresh.Log.Level)
+		logr.SetLevel(level)
+		next.Log.Level = fresh.Log.Level
+		changed = append(changed, "log.level")
+	}
+	if fresh.Import != cfg.Import {
+		next.Import = fresh.Import
+		changed = append(changed, "import")
+		if fresh.Import.Workers != cfg.Import.Workers {
+			insertPool.resize(fresh.Import.Workers)
+		}
+	}
+	if fresh.LoginGuard != cfg.LoginGuard {
+		next.LoginGuard = fresh.LoginGuard
+		changed = append(changed, "login_guard")
+	}
+	if !reflect.DeepEqual(fresh.Features, cfg.Features) {
+		next.Features = fresh.Features
+		changed = append(changed, "features")
+	}
+	if !reflect.DeepEqual(fresh.Email, cfg.Email) {
+		next.Email = fresh.Email
+		changed = append(changed, "email")
+	}
+	if !reflect.DeepEqual(fresh.Currency, cfg.Currency) {
+		next.Currency = fresh.Currency
+		changed = append(changed, "currency")
+	}
+	if !reflect.DeepEqual(fresh.Analytics, cfg.Analytics) {
+		next.Analytics = fresh.Analytics
+		changed = append(changed, "analytics")
+	}
+	if !reflect.DeepEqual(fresh.Records, cfg.Records) {
+		next.Records = fresh.Records
+		changed = append(changed, "records")
+	}
+	if !reflect.DeepEqual(fresh.Chat, cfg.Chat) {
+		next.Chat = fresh.Chat
+		changed = append(changed, "chat")
+		logAlerts.setRules(fresh.Chat.Rules)
+	}
+	cfg = &next
+	importSlots.wake()
+
+	if !reflect.DeepEqual(*fresh, next) {
+		logr.Warn("Configuration reloaded, but some changed settings only take effect after a restart")
+	}
+	return changed, nil
+}
+
+// watchReloadSignal reloads the configuration on every SIGHUP until ctx is done.
+func watchReloadSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				changed, err := reloadConfig()
+				if err != nil {
+					logr.Errorf("Configuration reload on SIGHUP failed, keeping current settings: %v", err)
+					continue
+				}
+				logr.Infof("Configuration reloaded on SIGHUP (changed: %s)", strings.Join(changed, ", "))
+			}
+		}
+	}()
+}
+
+func reloadConfigHandler(c *gin.Context) {
+	changed, err := reloadConfig()
+	if err != nil {
+		logCtx(c).Errorf("Configuration reload failed: %v", err)
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	logCtx(c).Infof("Configuration reloaded on request (changed: %s)", strings.Join(changed, ", "))
+	c.JSON(http.StatusOK, gin.H{"message": "Configuration reloaded", "changed": changed})
+}
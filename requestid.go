@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	ctxRequestID    = "request_id"
+	requestIDHeader = "X-Request-ID"
+)
+
+type requestIDKey struct{}
+
+// validRequestID accepts caller-supplied IDs that are safe to echo back and
+// write to logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-' || r == '_' || r == '.' || r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware reuses a well-formed X-Request-ID from the caller or
+// generates one. It is stored on the request context so work spawned by the
+// request, such as imports, logs under the same ID.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID(id) {
+			id = uuid.NewString()
+		}
+		c.Set(ctxRequestID, id)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+		c.Header(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+func requestIDFrom(ctx context.Context) string {
+	if c, ok := ctx.(*gin.Context); ok {
+		ctx = c.Request.Context()
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID copies the request ID of parent onto ctx.
+func withRequestID(ctx, parent context.Context) context.Context {
+	if id := requestIDFrom(parent); id != "" {
+		return context.WithValue(ctx, requestIDKey{}, id)
+	}
+	return ctx
+}
+
+// logCtx returns a log entry tagged with the request ID and import job ID
+// carried by ctx, which may be a *gin.Context.
+func logCtx(ctx context.Context) *logrus.Entry {
+	entry := logrus.NewEntry(logr)
+	if id := requestIDFrom(ctx); id != "" {
+		entry = entry.WithField("request_id", id)
+	}
+	if id := jobIDFrom(ctx); id != "" {
+		entry = entry.WithField("job_id", id)
+	}
+	return entry
+}
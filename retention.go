@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// What a retention policy does with the records it selects.
+const (
+	retentionDelete    = "delete"
+	retentionAnonymize = "anonymize"
+)
+
+// retentionPreviewSample caps the record IDs a preview lists per policy.
+const retentionPreviewSample = 20
+
+// RetentionPolicy purges a tenant's employee records that have gone
+// unchanged for MaxAgeDays, such as inactive employees after seven years.
+// CompanyID limits it to one company's records, ImportJobID to those last
+// written by one import, and InactiveOnly to records that aren't active.
+// Records are deleted with their versions and outliers, or, with action
+// anonymize, scrubbed as by POST /records/anonymize.
+type RetentionPolicy struct {
+	ID           string     `gorm:"primaryKey;size:36" json:"id"`
+	TenantID     string     `gorm:"size:64;not null;index" json:"tenant_id"`
+	Name         string     `gorm:"size:128;not null" json:"name"`
+	CompanyID    *uint      `json:"company_id,omitempty"`
+	ImportJobID  string     `gorm:"size:36" json:"import_job_id,omitempty"`
+	InactiveOnly bool       `gorm:"not null" json:"inactive_only"`
+	MaxAgeDays   int        `gorm:"not null" json:"max_age_days"`
+	Action       string     `gorm:"size:16;not null" json:"action"`
+	Enabled      bool       `gorm:"not null" json:"enabled"`
+	LastRunAt    *time.Time `json:"last_run_at,omitempty"`
+	LastPurged   int64      `gorm:"not null;default:0" json:"last_purged"`
+	LastError    string     `json:"last_error,omitempty"`
+	CreatedBy    string     `json:"created_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// cutoff is the time records selected at now were last updated before.
+func (p RetentionPolicy) cutoff(now time.Time) time.Time {
+	return now.AddDate(0, 0, -p.MaxAgeDays).UTC()
+}
+
+// scope selects the records the policy purges at now, merged ones
+// included, so it is used on an unscoped query.
+func (p RetentionPolicy) scope(now time.Time) func(*gorm.DB) *gorm.DB {
+	return func(tx *gorm.DB) *gorm.DB {
+		tx = tx.Where("tenant_id = ? AND updated_at < ?", p.TenantID, p.cutoff(now))
+		if p.CompanyID != nil {
+			tx = tx.Where("company_id = ?", *p.CompanyID)
+		}
+		if p.ImportJobID != "" {
+			tx = tx.Where("import_job_id = ?", p.ImportJobID)
+		}
+		if p.InactiveOnly {
+			tx = tx.Where("is_active = ?", false)
+		}
+		if p.Action == retentionAnonymize {
+			tx = tx.Where("anonymized_at IS NULL")
+		}
+		return tx
+	}
+}
+
+// applyRetentionPolicy purges the records p selects, a chunk per
+// transaction, and returns how many it purged. A failure leaves the chunks
+// before it purged.
+func applyRetentionPolicy(ctx context.Context, p RetentionPolicy) (int64, error) {
+	now := time.Now()
+	var purged int64
+	for {
+		var ids []uint
+		err := db.WithContext(ctx).Unscoped().Model(&Employee{}).Scopes(p.scope(now)).
+			Order("id").Limit(anonymizeChunk).Pluck("id", &ids).Error
+		if err != nil || len(ids) == 0 {
+			return purged, err
+		}
+		err = db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+			if p.Action == retentionAnonymize {
+				_, _, err := scrubRecords(tx, p.TenantID, ids)
+				return err
+			}
+			return purgeRecords(tx, p.TenantID, ids)
+		})
+		if err != nil {
+			return purged, err
+		}
+		purged += int64(len(ids))
+	}
+}
+
+// purgeRecords hard-deletes the tenant's records of ids with their
+// versions and outliers. Audit entries on them are kept.
+func purgeRecords(tx *gorm.DB, tenantID string, ids []uint) error {
+	if err := tx.Unscoped().Where("tenant_id = ? AND id IN ?", tenantID, ids).Delete(&Employee{}).Error; err != nil {
+		return err
+	}
+	// After the records, as deleting them versions them once more.
+	if err := tx.Where("tenant_id = ? AND employee_id IN ?", tenantID, ids).Delete(&EmployeeVersion{}).Error; err != nil {
+		return err
+	}
+	return tx.Where("tenant_id = ? AND employee_id IN ?", tenantID, ids).Delete(&Outlier{}).Error
+}
+
+// recordRetentionRun notes the outcome of a run on the policy, alerting
+// the chat webhook when it failed.
+func recordRetentionRun(ctx context.Context, p RetentionPolicy, purged int64, runErr error) {
+	updates := map[string]interface{}{"last_purged": purged, "last_error": ""}
+	if runErr != nil {
+		logCtx(ctx).Errorf("Retention policy %s (%s) failed after purging %d records: %v", p.ID, p.Name, purged, runErr)
+		updates["last_error"] = runErr.Error()
+		sendChatAlert(ctx, chatAlert{
+			Event: "retention.failed",
+			Title: fmt.Sprintf("Retention policy %s failed", p.Name),
+			Text:  fmt.Sprintf("Retention policy %s (tenant %s) failed after purging %d records: %v", p.ID, p.TenantID, purged, runErr),
+		})
+	} else if purged > 0 {
+		logCtx(ctx).Infof("Retention policy %s (%s) of tenant %s purged %d records by %s", p.ID, p.Name, p.TenantID, purged, p.Action)
+	}
+	if err := db.WithContext(ctx).Model(&RetentionPolicy{}).Where("id = ?", p.ID).Updates(updates).Error; err != nil {
+		logCtx(ctx).Errorf("Error recording run of retention policy %s: %v", p.ID, err)
+	}
+}
+
+// startRetention applies the enabled retention policies every
+// records.retention_interval. Each instance runs it; a policy's run is
+// claimed by advancing last_run_at with a conditional update, so only one
+// instance applies it per interval.
+func startRetention() {
+	interval := cfg.Records.RetentionInterval
+	if interval == 0 {
+		logr.Info("Retention policies disabled on this instance")
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			runRetentionPolicies(interval)
+		}
+	}()
+}
+
+func runRetentionPolicies(interval time.Duration) {
+	maintenance.RLock()
+	paused := maintenance.enabled
+	maintenance.RUnlock()
+	if paused {
+		return
+	}
+
+	var policies []RetentionPolicy
+	if err := db.Where("enabled = ?", true).Order("id").Find(&policies).Error; err != nil {
+		logr.Errorf("Error loading retention policies: %v", err)
+		return
+	}
+	for _, p := range policies {
+		claimed, err := claimRetentionPolicy(p.ID, time.Now().UTC(), interval)
+		if err != nil {
+			logr.Errorf("Error claiming retention policy %s: %v", p.ID, err)
+			continue
+		}
+		if !claimed {
+			continue // another instance took it, or it ran this interval
+		}
+		ctx := context.WithValue(importCtx, requestIDKey{}, "retention-"+uuid.NewString())
+		purged, err := applyRetentionPolicy(ctx, p)
+		recordRetentionRun(ctx, p, purged, err)
+	}
+}
+
+// claimRetentionPolicy sets the policy's last_run_at to now unless it ran
+// this interval, and reports whether it did. Half an interval back counts
+// as this interval, so a run a little early on another instance's clock
+// isn't repeated.
+func claimRetentionPolicy(id string, now time.Time, interval time.Duration) (bool, error) {
+	res := db.Model(&RetentionPolicy{}).
+		Where("id = ? AND (last_run_at IS NULL OR last_run_at < ?)", id, now.Add(-interval/2)).
+		Update("last_run_at", now)
+	return res.RowsAffected > 0, res.Error
+}
+
+type retentionRequest struct {
+	Name         string `json:"name" binding:"required"`
+	CompanyID    *uint  `json:"company_id"`
+	ImportJobID  string `json:"import_job_id"`
+	InactiveOnly bool   `json:"inactive_only"`
+	MaxAgeDays   int    `json:"max_age_days" binding:"required,min=1"`
+	Action       string `json:"action"`
+	Enabled      *bool  `json:"enabled"`
+}
+
+// apply validates req and copies it onto p, checking that the company and
+// import it names are the tenant's.
+func (req retentionRequest) apply(ctx context.Context, p *RetentionPolicy) error {
+	switch req.Action {
+	case "":
+		req.Action = retentionDelete
+	case retentionDelete, retentionAnonymize:
+	default:
+		return fmt.Errorf("action must be %s or %s", retentionDelete, retentionAnonymize)
+	}
+	if req.CompanyID != nil {
+		var n int64
+		if err := db.WithContext(ctx).Table(companies.table).Where("tenant_id = ? AND id = ?", p.TenantID, *req.CompanyID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("company %d not found", *req.CompanyID)
+		}
+	}
+	if req.ImportJobID != "" {
+		var n int64
+		if err := db.WithContext(ctx).Model(&ImportJob{}).Where("tenant_id = ? AND id = ?", p.TenantID, req.ImportJobID).Count(&n).Error; err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("import job %s not found", req.ImportJobID)
+		}
+	}
+
+	p.Name = req.Name
+	p.CompanyID = req.CompanyID
+	p.ImportJobID = req.ImportJobID
+	p.InactiveOnly = req.InactiveOnly
+	p.MaxAgeDays = req.MaxAgeDays
+	p.Action = req.Action
+	p.Enabled = req.Enabled == nil || *req.Enabled
+	return nil
+}
+
+func createRetentionPolicy(c *gin.Context) {
+	var req retentionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p := RetentionPolicy{ID: uuid.NewString(), TenantID: tenantID(c), CreatedBy: c.GetString(ctxActor)}
+	if err := req.apply(c.Request.Context(), &p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.WithContext(c.Request.Context()).Create(&p).Error; err != nil {
+		logCtx(c).Errorf("Error creating retention policy %s: %v", p.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create retention policy"})
+		return
+	}
+	setAuditEvent(c, "retention.create", fmt.Sprintf("policy %s: %s after %d days", p.ID, p.Action, p.MaxAgeDays))
+	logCtx(c).Infof("Created retention policy %s (%s): %s after %d days", p.ID, p.Name, p.Action, p.MaxAgeDays)
+	c.JSON(http.StatusCreated, p)
+}
+
+func listRetentionPolicies(c *gin.Context) {
+	var policies []RetentionPolicy
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Order("name").Find(&policies).Error; err != nil {
+		logCtx(c).Errorf("Error listing retention policies: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list retention policies"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policies": policies})
+}
+
+func findRetentionPolicy(c *gin.Context) (RetentionPolicy, bool) {
+	var p RetentionPolicy
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&p, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return p, false
+	}
+	return p, true
+}
+
+func getRetentionPolicy(c *gin.Context) {
+	if p, ok := findRetentionPolicy(c); ok {
+		c.JSON(http.StatusOK, p)
+	}
+}
+
+// updateRetentionPolicy replaces a retention policy's settings.
+func updateRetentionPolicy(c *gin.Context) {
+	var req retentionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, ok := findRetentionPolicy(c)
+	if !ok {
+		return
+	}
+	if err := req.apply(c.Request.Context(), &p); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.WithContext(c.Request.Context()).Save(&p).Error; err != nil {
+		logCtx(c).Errorf("Error updating retention policy %s: %v", p.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update retention policy"})
+		return
+	}
+	setAuditEvent(c, "retention.update", fmt.Sprintf("policy %s: %s after %d days", p.ID, p.Action, p.MaxAgeDays))
+	logCtx(c).Infof("Updated retention policy %s (%s): %s after %d days", p.ID, p.Name, p.Action, p.MaxAgeDays)
+	c.JSON(http.StatusOK, p)
+}
+
+func deleteRetentionPolicy(c *gin.Context) {
+	result := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Delete(&RetentionPolicy{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		logCtx(c).Errorf("Error deleting retention policy %s: %v", c.Param("id"), result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete retention policy"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+	setRowsAffected(c, result.RowsAffected)
+	setAuditEvent(c, "retention.delete", "policy "+c.Param("id"))
+	logCtx(c).Infof("Deleted retention policy %s", c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "Retention policy deleted"})
+}
+
+// runRetentionPolicyNow applies a policy immediately, enabled or not,
+// leaving its next scheduled run unchanged.
+func runRetentionPolicyNow(c *gin.Context) {
+	p, ok := findRetentionPolicy(c)
+	if !ok {
+		return
+	}
+	purged, err := applyRetentionPolicy(c.Request.Context(), p)
+	recordRetentionRun(c.Request.Context(), p, purged, err)
+	setRowsAffected(c, purged)
+	setAuditEvent(c, "retention.run", fmt.Sprintf("policy %s: %d records by %s", p.ID, purged, p.Action))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to apply retention policy", "purged": purged})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"policy_id": p.ID, "action": p.Action, "purged": purged})
+}
+
+// previewRetention is a dry run of the tenant's enabled retention
+// policies, or of ?policy_id= whether enabled or not: how many records
+// each would purge if it ran now, and the first of them, oldest first.
+func previewRetention(c *gin.Context) {
+	query := db.WithContext(c.Request.Context()).Scopes(tenantScope(c))
+	if id := c.Query("policy_id"); id != "" {
+		query = query.Where("id = ?", id)
+	} else {
+		query = query.Where("enabled = ?", true)
+	}
+	var policies []RetentionPolicy
+	if err := query.Order("name").Find(&policies).Error; err != nil {
+		logCtx(c).Errorf("Error loading retention policies: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to preview retention"})
+		return
+	}
+	if len(policies) == 0 && c.Query("policy_id") != "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Retention policy not found"})
+		return
+	}
+
+	now := time.Now()
+	previews := make([]gin.H, 0, len(policies))
+	for _, p := range policies {
+		records := func() *gorm.DB {
+			return db.WithContext(c.Request.Context()).Unscoped().Model(&Employee{}).Scopes(p.scope(now))
+		}
+		var matched int64
+		ids := []uint{}
+		err := records().Count(&matched).Error
+		if err == nil {
+			err = records().Order("updated_at").Order("id").Limit(retentionPreviewSample).Pluck("id", &ids).Error
+		}
+		if err != nil {
+			logCtx(c).Errorf("Error previewing retention policy %s: %v", p.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to preview retention"})
+			return
+		}
+		previews = append(previews, gin.H{
+			"policy_id":  p.ID,
+			"name":       p.Name,
+			"action":     p.Action,
+			"enabled":    p.Enabled,
+			"cutoff":     p.cutoff(now),
+			"matched":    matched,
+			"record_ids": ids,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"dry_run": true, "policies": previews})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+func TestRetentionPreviewAndApply(t *testing.T) {
+	tenant, key := newTestTenant(t)
+	email := func(name string) string { return name + "@" + tenant + ".example.com" }
+	data := "id,first_name,last_name,email,age,gender,department,company,salary,date_joined,is_active\n"
+	for _, row := range []struct{ name, company, active string }{
+		{"match", "Acme", "false"},
+		{"active", "Acme", "true"},
+		{"other-company", "Globex", "false"},
+		{"other-import", "Acme", "false"},
+		{"recent", "Acme", "false"},
+	} {
+		data += fmt.Sprintf(",Test,Person,%s,40,F,Engineering,%s,5000,2019-01-01,%s\n", email(row.name), row.company, row.active)
+	}
+	job := uploadTestCSV(t, key, data)
+	if job.Status != jobCompleted || job.RowsInserted != 5 {
+		t.Fatalf("import = %+v, want 5 rows inserted", job)
+	}
+	ids := map[string]uint{}
+	var records []Employee
+	if err := db.Where("tenant_id = ?", tenant).Find(&records).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range records {
+		ids[e.Email] = e.ID
+	}
+	var match Employee
+	if err := db.First(&match, ids[email("match")]).Error; err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().AddDate(-3, 0, 0)
+	err := db.Exec("UPDATE employees SET updated_at = ? WHERE tenant_id = ? AND email <> ?", old, tenant, email("recent")).Error
+	if err == nil {
+		err = db.Exec("UPDATE employees SET import_job_id = '' WHERE id = ?", ids[email("other-import")]).Error
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var policy RetentionPolicy
+	w := testCall(t, http.MethodPost, "/retention/policies", bearer(key), gin.H{
+		"name": "inactive acme", "company_id": match.CompanyID, "import_job_id": job.ID,
+		"inactive_only": true, "max_age_days": 365, "enabled": false,
+	})
+	decodeResponse(t, w, http.StatusCreated, &policy)
+
+	var preview struct {
+		Policies []struct {
+			Matched   int64  `json:"matched"`
+			RecordIDs []uint `json:"record_ids"`
+		} `json:"policies"`
+	}
+	decodeResponse(t, testCall(t, http.MethodGet, "/retention/preview?policy_id="+policy.ID, bearer(key), nil), http.StatusOK, &preview)
+	if len(preview.Policies) != 1 || preview.Policies[0].Matched != 1 || preview.Policies[0].RecordIDs[0] != match.ID {
+		t.Fatalf("preview = %+v, want record %d alone", preview, match.ID)
+	}
+	var count int64
+	db.Unscoped().Model(&Employee{}).Where("tenant_id = ?", tenant).Count(&count)
+	if count != 5 {
+		t.Fatalf("preview left %d of 5 records", count)
+	}
+
+	var run struct {
+		Purged int64 `json:"purged"`
+	}
+	decodeResponse(t, testCall(t, http.MethodPost, "/retention/policies/"+policy.ID+"/run", bearer(key), nil), http.StatusOK, &run)
+	if run.Purged != 1 {
+		t.Errorf("purged %d records, want 1", run.Purged)
+	}
+	db.Unscoped().Model(&Employee{}).Where("id = ?", match.ID).Count(&count)
+	if count != 0 {
+		t.Error("matching record survived")
+	}
+	db.Model(&EmployeeVersion{}).Where("employee_id = ?", match.ID).Count(&count)
+	if count != 0 {
+		t.Errorf("%d versions of the deleted record survived", count)
+	}
+	db.Unscoped().Model(&Employee{}).Where("tenant_id = ?", tenant).Count(&count)
+	if count != 4 {
+		t.Errorf("%d records left, want the 4 the policy doesn't select", count)
+	}
+
+	w = testCall(t, http.MethodPost, "/retention/policies", bearer(key), gin.H{
+		"name": "anonymize old", "max_age_days": 365, "action": retentionAnonymize, "enabled": false,
+	})
+	decodeResponse(t, w, http.StatusCreated, &policy)
+	decodeResponse(t, testCall(t, http.MethodPost, "/retention/policies/"+policy.ID+"/run", bearer(key), nil), http.StatusOK, &run)
+	if run.Purged != 3 {
+		t.Errorf("anonymized %d records, want 3", run.Purged)
+	}
+	var recent Employee
+	if err := db.First(&recent, ids[email("recent")]).Error; err != nil {
+		t.Fatal(err)
+	}
+	if recent.AnonymizedAt != nil || recent.Email != email("recent") {
+		t.Errorf("record updated after the cutoff was anonymized: %+v", recent)
+	}
+	db.Unscoped().Model(&Employee{}).Where("tenant_id = ? AND anonymized_at IS NOT NULL AND email IS NULL", tenant).Count(&count)
+	if count != 3 {
+		t.Errorf("%d records anonymized, want 3", count)
+	}
+	decodeResponse(t, testCall(t, http.MethodGet, "/retention/preview?policy_id="+policy.ID, bearer(key), nil), http.StatusOK, &preview)
+	if preview.Policies[0].Matched != 0 {
+		t.Errorf("anonymized records still match: %+v", preview)
+	}
+}
+
+func TestRetentionClaimOncePerInterval(t *testing.T) {
+	tenant, _ := newTestTenant(t)
+	p := RetentionPolicy{ID: uuid.NewString(), TenantID: tenant, Name: "claim", MaxAgeDays: 1, Action: retentionDelete}
+	if err := db.Create(&p).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	for _, tc := range []struct {
+		at   time.Time
+		want bool
+	}{
+		{now, true},
+		{now.Add(time.Minute), false},
+		{now.Add(20 * time.Minute), false},
+		{now.Add(time.Hour), true},
+	} {
+		claimed, err := claimRetentionPolicy(p.ID, tc.at, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed != tc.want {
+			t.Errorf("claim %s after the first = %v, want %v", tc.at.Sub(now), claimed, tc.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	backoffConstant    = "constant"
+	backoffExponential = "exponential"
+)
+
+// retryPolicy bounds retries by attempts and, when timeout is set, by total
+// elapsed time.
+type retryPolicy struct {
+	attempts    int
+	base, max   time.Duration
+	exponential bool
+	jitter      float64
+	timeout     time.Duration
+}
+
+func dbRetryPolicy() retryPolicy {
+	return retryPolicy{
+		attempts:    cfg.DB.ConnectAttempts,
+		base:        cfg.DB.ConnectRetryInterval,
+		max:         cfg.DB.ConnectMaxInterval,
+		exponential: cfg.DB.ConnectBackoff == backoffExponential,
+		jitter:      cfg.DB.ConnectJitter,
+		timeout:     cfg.DB.ConnectTimeout,
+	}
+}
+
+// delay is the wait after the given zero-based attempt. Jitter spreads it by
+// up to ±jitter so replicas restarting together don't reconnect in lockstep.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := p.base
+	if p.exponential {
+		for i := 0; i < attempt && d < p.max; i++ {
+			d *= 2
+		}
+	}
+	if p.max > 0 && d > p.max {
+		d = p.max
+	}
+	if p.jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.jitter * float64(d))
+	}
+	return d
+}
+
+// do runs fn until it succeeds or fails with an error retryable rejects, the
+// attempts or the timeout run out, or ctx is done. The last error is returned.
+func (p retryPolicy) do(ctx context.Context, op string, retryable func(error) bool, fn func() error) error {
+	var deadline time.Time
+	if p.timeout > 0 {
+		deadline = time.Now().Add(p.timeout)
+	}
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !retryable(err) || attempt+1 >= p.attempts {
+			return err
+		}
+		wait := p.delay(attempt)
+		if !deadline.IsZero() && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		logCtx(ctx).Warnf("%s failed, retrying in %s (%d/%d): %v", op, wait.Round(time.Millisecond), attempt+1, p.attempts, err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+	}
+}
+
+func anyError(error) bool { return true }
+
+// isConnectionError reports failures caused by losing the database rather than
+// by the statement itself, which are worth retrying on a fresh connection.
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	var connectErr *pgconn.ConnectError
+	switch {
+	case errors.Is(err, driver.ErrBadConn), errors.Is(err, sql.ErrConnDone), errors.Is(err, mysql.ErrInvalidConn):
+		return true
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return true
+	case errors.As(err, &connectErr), errors.As(err, &netErr):
+		return true
+	}
+	return pgconn.SafeToRetry(err)
+}
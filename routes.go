@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Access levels shown in the route index.
+const (
+	authPublic     = "public"
+	authAdminIPs   = "admin IP filter"
+	authSignedURL  = "signed URL"
+	authSession    = "authenticated"
+	authViewer     = "viewer"
+	authEditor     = "editor"
+	authAdmin      = "admin role"
+	authAdminToken = "admin token"
+)
+
+type routeDoc struct {
+	auth        string
+	description string
+}
+
+// routeDocs describes each "METHOD path" for the index at /. The index lists
+// whatever is actually registered; a route missing here still shows up, marked
+// undocumented, and is logged as a warning.
+var routeDocs = map[string]routeDoc{
+	"GET /":                             {authPublic, "This route index"},
+	"GET /healthz":                      {authPublic, "Process health"},
+	"GET /livez":                        {authPublic, "Liveness probe"},
+	"GET /readyz":                       {authPublic, "Readiness probe (database and migrations)"},
+	"GET /metrics":                      {authAdminIPs, "Prometheus metrics"},
+	"GET /version":                      {authAdminIPs, "Build version, commit and config profile"},
+	"GET /auth/oidc/login":              {authPublic, "Start an OpenID Connect login"},
+	"GET /auth/oidc/callback":           {authPublic, "OpenID Connect redirect target, returns an ID token"},
+	"POST /auth/login":                  {authPublic, "Log in with username and password; failed attempts are limited per instance"},
+	"POST /auth/refresh":                {authPublic, "Rotate a refresh token for a new access token"},
+	"POST /auth/logout":                 {authSession, "Revoke the current session"},
+	"GET /auth/csrf":                    {authSession, "CSRF token for cookie-based sessions"},
+	"POST /upload":                      {authEditor, "Upload a CSV file for import (?priority=0-9, ?callback_url=, ?date_format=auto|iso|mdy|dmy|excel); small files are imported before responding; a repeated Idempotency-Key returns the original job"},
+	"GET /records":                      {authViewer, "Get paginated records (?updated_since= a date or timestamp, to sync only rows changed since; ?department=, ?company= by name or ?department_id=, ?company_id=; ?extra.<column>= by an unmapped CSV column); each carries computed TenureYears and AgeBand"},
+	"POST /records":                     {authEditor, "Create a record; invalid fields are answered with 422 and a code per rule broken"},
+	"PUT /records/:id":                  {authEditor, "Replace a record's fields, validated as on create"},
+	"GET /records/:id/as-of":            {authViewer, "A record as it was at the end of ?date= (YYYY-MM-DD) or at an RFC 3339 timestamp"},
+	"POST /records/anonymize":           {authAdmin, "Irreversibly scrub names, emails and records.pii_extra from the records a filter selects, their versions and the audit log"},
+	"POST /records/forget":              {authAdmin, "Hard-delete every trace of a person by email, from records, versions, audit, datasets and kept files, and redact it from its import jobs' logs; returns a signed deletion certificate"},
+	"POST /records/forget/verify":       {authAdmin, "Check that a deletion certificate was issued under records.certificate_key and is unaltered"},
+	"GET /retention/policies":           {authViewer, "List the tenant's retention policies"},
+	"POST /retention/policies":          {authAdmin, "Create a retention policy purging records unchanged for max_age_days (optionally of company_id, import_job_id or inactive_only) by delete or anonymize"},
+	"GET /retention/policies/:id":       {authViewer, "Get a retention policy and its last run"},
+	"PUT /retention/policies/:id":       {authAdmin, "Replace a retention policy's settings"},
+	"DELETE /retention/policies/:id":    {authAdmin, "Delete a retention policy"},
+	"POST /retention/policies/:id/run":  {authAdmin, "Apply a retention policy now"},
+	"GET /retention/preview":            {authViewer, "Dry run of the enabled retention policies, or ?policy_id=: how many records each would purge now, and the first of them"},
+	"POST /records/merge":               {authEditor, "Merge duplicate_ids into survivor_id, taking each field by precedence (survivor or newest), and delete the duplicates"},
+	"GET /validation-rules":             {authAdmin, "List the tenant's validation rules, optionally ?enabled="},
+	"POST /validation-rules":            {authAdmin, "Add a validation rule (required, range, length or pattern) applied to imports and record writes"},
+	"PUT /validation-rules/:id":         {authAdmin, "Replace a validation rule; running imports keep the rules they started with"},
+	"DELETE /validation-rules/:id":      {authAdmin, "Delete a validation rule"},
+	"GET /allowed-values":               {authViewer, "List the values allowed for gender and department, optionally ?field="},
+	"GET /allowed-values/unknown":       {authViewer, "Count stored ?field= values that are not an allowed value's canonical spelling"},
+	"POST /allowed-values":              {authAdmin, "Allow a gender or department value, with aliases rewritten to it on import and record writes"},
+	"PUT /allowed-values/:id":           {authAdmin, "Replace an allowed value and its aliases"},
+	"DELETE /allowed-values/:id":        {authAdmin, "Delete an allowed value; a field with none left takes any value"},
+	"GET /departments":                  {authViewer, "List departments with their record counts (?q= to search names)"},
+	"GET /departments/:id":              {authViewer, "Get a department with its record count"},
+	"POST /departments":                 {authEditor, "Add a department"},
+	"PUT /departments/:id":              {authEditor, "Rename a department, on every record that has it"},
+	"DELETE /departments/:id":           {authEditor, "Delete a department no record has"},
+	"GET /companies":                    {authViewer, "List companies with their record counts (?q= to search names)"},
+	"GET /companies/:id":                {authViewer, "Get a company with its record count"},
+	"POST /companies":                   {authEditor, "Add a company"},
+	"PUT /companies/:id":                {authEditor, "Rename a company, on every record that has it"},
+	"DELETE /companies/:id":             {authEditor, "Delete a company no record has"},
+	"GET /analytics/salary":             {authViewer, "Summarize salaries by ?group_by= (none, department, company, currency, tenure, age_band), converted to ?currency= (default currency.reporting)"},
+	"POST /outliers/scan":               {authEditor, "Flag salaries far from their department's mean and impossible ages into the review queue"},
+	"GET /outliers":                     {authViewer, "Page through flagged outliers (?status= open (default), accepted, fixed or all; ?field= salary or age)"},
+	"POST /outliers/:id/accept":         {authEditor, "Mark an outlier as a correct value, so later scans skip it"},
+	"POST /outliers/:id/fix":            {authEditor, "Correct the record's flagged field to the body's value"},
+	"GET /datasets":                     {authViewer, "List the tenant's registered datasets"},
+	"POST /datasets":                    {authAdmin, "Register a dataset schema (name, typed columns and their checks) and provision its table"},
+	"GET /datasets/:name":               {authViewer, "Get a dataset's schema and row count"},
+	"DELETE /datasets/:name":            {authAdmin, "Delete a dataset and drop its table"},
+	"POST /datasets/:name/upload":       {authEditor, "Import a CSV into a dataset, matching columns by header; runs within the request"},
+	"GET /datasets/:name/records":       {authViewer, "Get paginated dataset rows (?sort=, ?<column>= filters)"},
+	"GET /count":                        {authViewer, "Get total record count"},
+	"GET /audit":                        {authAdmin, "Query the API access audit log (?record_id= for the history of one record)"},
+	"POST /exports":                     {authViewer, "Start an asynchronous CSV export of records, as they are or as they were at ?as_of="},
+	"GET /exports/:id":                  {authViewer, "Export status and a signed, expiring download URL"},
+	"GET /jobs":                         {authViewer, "List import jobs, filtered by status, file, checksum, creator or date, with each quality score to compare a source's imports over time"},
+	"GET /jobs/events":                  {authViewer, "Stream lifecycle events of the tenant's jobs (server-sent events)"},
+	"GET /jobs/:id":                     {authViewer, "Import job details, live progress and throughput breakdown"},
+	"GET /jobs/:id/logs":                {authViewer, "Log entries written while processing an import, filtered by level"},
+	"POST /jobs/:id/retry":              {authEditor, "Re-run a failed, interrupted or cancelled import from its checkpoint or the start"},
+	"POST /jobs/:id/cancel":             {authEditor, "Stop an import, drain its workers and record the rows inserted so far"},
+	"POST /jobs/:id/pause":              {authEditor, "Hold a running import's reader; in-flight batches still commit"},
+	"POST /jobs/:id/resume":             {authEditor, "Continue a paused import where it stopped"},
+	"GET /schedules":                    {authViewer, "List scheduled imports"},
+	"POST /schedules":                   {authAdmin, "Create a scheduled import from a cron expression and source"},
+	"GET /schedules/:id":                {authViewer, "Scheduled import with its next and last run"},
+	"PUT /schedules/:id":                {authAdmin, "Replace a scheduled import's cron, source and options"},
+	"DELETE /schedules/:id":             {authAdmin, "Delete a scheduled import"},
+	"POST /schedules/:id/run":           {authEditor, "Run a scheduled import now without moving its next run"},
+	"GET /exports/download/:id":         {authSignedURL, "Download an export"},
+	"GET /logs":                         {authAdminToken, "Search application logs, newest first by default (?sort=time|level, ?order=asc|desc, ?job_id=, ?msg=, ?regex=, ?field.<name>=, ?query=, ?page=, ?limit= up to 1000)"},
+	"GET /logs/stats":                   {authAdminToken, "Log counts per level and time bucket (?interval=minute|hour|day) with the top recurring errors"},
+	"GET /logs/latency":                 {authAdminToken, "Request counts, 5xx error rates and p50/p95/p99 latency from the access log (?group_by=route|method|status)"},
+	"GET /logs/slow-queries":            {authAdminToken, "Slow queries from the log grouped by route and SQL, slowest in total first (?top= up to 100)"},
+	"GET /logs/download":                {authAdminToken, "Download the raw log lines matching the /logs filters as a gzipped file"},
+	"GET /logs/tail":                    {authAdminToken, "Stream new log entries matching the /logs filters (server-sent events)"},
+	"GET /admin/tenants":                {authAdminToken, "List tenants"},
+	"POST /admin/tenants":               {authAdminToken, "Create a tenant"},
+	"GET /admin/tenants/:id/api-keys":   {authAdminToken, "List a tenant's API keys"},
+	"POST /admin/tenants/:id/api-keys":  {authAdminToken, "Issue a tenant API key"},
+	"DELETE /admin/api-keys/:id":        {authAdminToken, "Revoke an API key"},
+	"PUT /admin/api-keys/:id/callback":  {authAdminToken, "Set or clear the default job webhook of an API key"},
+	"POST /admin/tenants/:id/users":     {authAdminToken, "Create a local user account"},
+	"PUT /admin/users/:id":              {authAdminToken, "Change a local user's password or disable them, ending their sessions"},
+	"POST /admin/db/rotate-credentials": {authAdminToken, "Reload database credentials from the secrets backend"},
+	"GET /admin/db/stats":               {authAdminToken, "Database connection pool statistics"},
+	"GET /admin/db/index-advisor":       {authAdminToken, "Costliest statements from pg_stat_statements, with suggested indexes for the columns they filter or sort on (?top= up to 100, ?min_mean_ms=; Postgres only)"},
+	"GET /admin/log-level":              {authAdminToken, "Read the runtime log level"},
+	"PUT /admin/log-level":              {authAdminToken, "Change the log level at runtime"},
+	"POST /admin/config/reload":         {authAdminToken, "Reload runtime-safe settings from the config sources"},
+	"POST /admin/logs/cleanup":          {authAdminToken, "Apply log.retention now: remove old rotated log files and stored log entries"},
+	"GET /admin/workers":                {authAdminToken, "Read this instance's insert workers and batch size"},
+	"PUT /admin/workers":                {authAdminToken, "Change insert workers and batch size on this instance, for running imports too"},
+	"GET /admin/maintenance":            {authAdminToken, "Read maintenance mode"},
+	"PUT /admin/maintenance":            {authAdminToken, "Toggle maintenance mode, which rejects writes with 503"},
+	"GET /admin/features":               {authAdminToken, "Feature flags and how each is resolved"},
+	"PUT /admin/features/:name":         {authAdminToken, "Override a feature flag"},
+	"DELETE /admin/features/:name":      {authAdminToken, "Clear a feature flag override"},
+	"GET /debug/vars":                   {authAdminToken, "Runtime, heap and per-import memory diagnostics"},
+	"GET /debug/pprof/*name":            {authAdminToken, "Go runtime profiles via net/http/pprof"},
+	"POST /debug/pprof/symbol":          {authAdminToken, "pprof symbol lookup"},
+}
+
+// routeIndex serves the registered routes of r, sorted by path and method.
+// The list is built on first use, once every route has been registered.
+func routeIndex(r *gin.Engine) gin.HandlerFunc {
+	index := sync.OnceValue(func() []gin.H { return listRoutes(r) })
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"message": "Welcome to the API", "routes": index()})
+	}
+}
+
+func listRoutes(r *gin.Engine) []gin.H {
+	var routes []gin.H
+	for _, route := range r.Routes() {
+		entry := gin.H{"method": route.Method, "path": route.Path}
+		if doc, ok := routeDocs[route.Method+" "+route.Path]; ok {
+			entry["auth"], entry["description"] = doc.auth, doc.description
+		} else {
+			entry["description"] = "undocumented"
+			logr.Warnf("Route %s %s has no entry in routeDocs", route.Method, route.Path)
+		}
+		routes = append(routes, entry)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i]["path"] != routes[j]["path"] {
+			return routes[i]["path"].(string) < routes[j]["path"].(string)
+		}
+		return routes[i]["method"].(string) < routes[j]["method"].(string)
+	})
+	return routes
+}
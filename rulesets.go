@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	ruleRequired = "required"
+	ruleRange    = "range"
+	ruleLength   = "length"
+	rulePattern  = "pattern"
+
+	severityWarn   = "warn"
+	severityReject = "reject"
+
+	maxRulePatternLen = 256
+)
+
+var ruleNamePattern = regexp.MustCompile(`^[a-z0-9_.-]{1,64}$`)
+
+// ValidationRule is a tenant's own check on employee records, applied on
+// top of the built-in rules by imports and record writes. Rows breaking a
+// reject rule fail; a warn rule only logs them.
+type ValidationRule struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	TenantID string `gorm:"size:64;not null;uniqueIndex:idx_validation_rules_tenant_name" json:"tenant_id"`
+	// Name is the code reported when the rule is broken.
+	Name  string `gorm:"size:64;not null;uniqueIndex:idx_validation_rules_tenant_name" json:"name"`
+	Field string `gorm:"size:32;not null" json:"field"`
+	// Type is required, range (min/max of a number), length (min/max
+	// characters) or pattern (a regex the value must match).
+	Type      string     `gorm:"size:16;not null" json:"type"`
+	Params    ruleParams `gorm:"type:text;serializer:json" json:"params"`
+	Severity  string     `gorm:"size:8;not null" json:"severity"`
+	Enabled   bool       `gorm:"not null;default:true" json:"enabled"`
+	CreatedBy string     `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+}
+
+type ruleParams struct {
+	Min     *float64 `json:"min,omitempty"`
+	Max     *float64 `json:"max,omitempty"`
+	Pattern string   `json:"pattern,omitempty"`
+}
+
+// ruleFields are the employee columns rules can check, and whether each
+// holds text.
+var ruleFields = map[string]bool{
+	"first_name": true, "last_name": true, "email": true, "gender": true,
+	"department": true, "company": true, "age": false, "salary": false,
+	"date_joined": false,
+}
+
+// ruleFieldValue returns the field as text, or as a number for age and
+// salary. present is false for blank text and a missing date.
+func ruleFieldValue(e *Employee, field string) (text string, number float64, present bool) {
+	switch field {
+	case "first_name":
+		text = e.FirstName
+	case "last_name":
+		text = e.LastName
+	case "email":
+		text = e.Email
+	case "gender":
+		text = e.Gender
+	case "department":
+		text = e.Department
+	case "company":
+		text = e.Company
+	case "age":
+		return "", float64(e.Age), true
+	case "salary":
+		return "", e.Salary, true
+	case "date_joined":
+		return "", 0, e.DateJoined != nil
+	}
+	return text, 0, strings.TrimSpace(text) != ""
+}
+
+// compiledRule is a rule ready to check records.
+type compiledRule struct {
+	ValidationRule
+	re *regexp.Regexp
+}
+
+// compile checks the rule is well-formed, normalizing its field name.
+func (r *ValidationRule) compile() (compiledRule, error) {
+	if !ruleNamePattern.MatchString(r.Name) {
+		return compiledRule{}, errors.New("name must be 1-64 lowercase letters, digits, _, . or -")
+	}
+	field := ""
+	for column := range ruleFields {
+		if normalizeFieldName(column) == normalizeFieldName(r.Field) {
+			field = column
+		}
+	}
+	if field == "" {
+		return compiledRule{}, fmt.Errorf("field %q is not an employee field", r.Field)
+	}
+	r.Field = field
+	switch r.Severity {
+	case severityWarn, severityReject:
+	default:
+		return compiledRule{}, fmt.Errorf("severity must be %s or %s", severityWarn, severityReject)
+	}
+
+	text, p := ruleFields[field], r.Params
+	rule := compiledRule{ValidationRule: *r}
+	switch r.Type {
+	case ruleRequired:
+		if !text && field != "date_joined" {
+			return rule, fmt.Errorf("%s is always present, it can't be required", field)
+		}
+	case ruleRange:
+		if text || field == "date_joined" {
+			return rule, fmt.Errorf("range applies to age and salary, not %s", field)
+		}
+		fallthrough
+	case ruleLength:
+		if r.Type == ruleLength && !text {
+			return rule, fmt.Errorf("length applies to text fields, not %s", field)
+		}
+		if p.Min == nil && p.Max == nil {
+			return rule, fmt.Errorf("%s needs params.min, params.max or both", r.Type)
+		}
+		if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+			return rule, errors.New("params.min must not be above params.max")
+		}
+	case rulePattern:
+		if !text {
+			return rule, fmt.Errorf("pattern applies to text fields, not %s", field)
+		}
+		if p.Pattern == "" || len(p.Pattern) > maxRulePatternLen {
+			return rule, fmt.Errorf("params.pattern must be 1-%d characters", maxRulePatternLen)
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return rule, fmt.Errorf("params.pattern: %v", err)
+		}
+		rule.re = re
+	default:
+		return rule, fmt.Errorf("type must be %s, %s, %s or %s", ruleRequired, ruleRange, ruleLength, rulePattern)
+	}
+	return rule, nil
+}
+
+// check returns the error reported when e breaks the rule, or nil. Rules
+// other than required pass a blank value.
+func (r compiledRule) check(e *Employee) *validationError {
+	text, number, present := ruleFieldValue(e, r.Field)
+	fail := func(format string, args ...interface{}) *validationError {
+		return &validationError{Field: r.Field, Code: r.Name, Message: fmt.Sprintf(format, args...)}
+	}
+	if !present {
+		if r.Type == ruleRequired {
+			return fail("%s is required", r.Field)
+		}
+		return nil
+	}
+	p := r.Params
+	switch r.Type {
+	case ruleRange:
+		if p.Min != nil && number < *p.Min {
+			return fail("%s %v is below %v", r.Field, number, *p.Min)
+		}
+		if p.Max != nil && number > *p.Max {
+			return fail("%s %v is above %v", r.Field, number, *p.Max)
+		}
+	case ruleLength:
+		n := float64(len([]rune(text)))
+		if p.Min != nil && n < *p.Min {
+			return fail("%s has %v characters, fewer than %v", r.Field, n, *p.Min)
+		}
+		if p.Max != nil && n > *p.Max {
+			return fail("%s has %v characters, more than %v", r.Field, n, *p.Max)
+		}
+	case rulePattern:
+		if !r.re.MatchString(text) {
+			return fail("%s %q does not match %s", r.Field, text, p.Pattern)
+		}
+	}
+	return nil
+}
+
+// ruleSet is the enabled rules of one tenant.
+type ruleSet []compiledRule
+
+// loadRuleSet reads the tenant's enabled rules. Rules were checked when
+// saved, so one that no longer compiles is only logged and skipped.
+func loadRuleSet(ctx context.Context, tenantID string) (ruleSet, error) {
+	var rules []ValidationRule
+	if err := db.WithContext(ctx).Where("tenant_id = ? AND enabled = ?", tenantID, true).Order("name").Find(&rules).Error; err != nil {
+		return nil, err
+	}
+	set := make(ruleSet, 0, len(rules))
+	for _, r := range rules {
+		rule, err := r.compile()
+		if err != nil {
+			logCtx(ctx).Errorf("Skipping validation rule %s of tenant %s: %v", r.Name, tenantID, err)
+			continue
+		}
+		set = append(set, rule)
+	}
+	return set, nil
+}
+
+// check returns what e breaks of the reject rules and of the warn rules.
+func (s ruleSet) check(e *Employee) (rejects, warnings validationErrors) {
+	for _, r := range s {
+		if v := r.check(e); v != nil {
+			if r.Severity == severityReject {
+				rejects = append(rejects, *v)
+			} else {
+				warnings = append(warnings, *v)
+			}
+		}
+	}
+	return rejects, warnings
+}
+
+type validationRuleRequest struct {
+	Name     string     `json:"name" binding:"required"`
+	Field    string     `json:"field" binding:"required"`
+	Type     string     `json:"type" binding:"required"`
+	Params   ruleParams `json:"params"`
+	Severity string     `json:"severity"`
+	Enabled  *bool      `json:"enabled"`
+}
+
+// apply validates req and copies it onto r. Severity defaults to reject.
+func (req validationRuleRequest) apply(r *ValidationRule) error {
+	r.Name, r.Field, r.Type, r.Params = req.Name, req.Field, req.Type, req.Params
+	r.Severity = req.Severity
+	if r.Severity == "" {
+		r.Severity = severityReject
+	}
+	r.Enabled = req.Enabled == nil || *req.Enabled
+	_, err := r.compile()
+	return err
+}
+
+// saveValidationRule creates or updates a rule, answering 409 if the tenant
+// has another rule of the same name.
+func saveValidationRule(c *gin.Context, r *ValidationRule, status int) {
+	var other ValidationRule
+	err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Select("id").
+		Where("name = ? AND id <> ?", r.Name, r.ID).Take(&other).Error
+	if err == nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Another rule has this name", "id": other.ID})
+		return
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = db.WithContext(c.Request.Context()).Save(r).Error
+	}
+	if err != nil {
+		logCtx(c).Errorf("Error saving validation rule %s: %v", r.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save validation rule"})
+		return
+	}
+	logCtx(c).Infof("Saved validation rule %s (%s %s on %s) for tenant %s", r.Name, r.Severity, r.Type, r.Field, r.TenantID)
+	c.JSON(status, r)
+}
+
+func createValidationRule(c *gin.Context) {
+	var req validationRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r := ValidationRule{TenantID: tenantID(c), CreatedBy: c.GetString(ctxActor)}
+	if err := req.apply(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	saveValidationRule(c, &r, http.StatusCreated)
+}
+
+func listValidationRules(c *gin.Context) {
+	query := db.WithContext(c.Request.Context()).Scopes(tenantScope(c))
+	if enabled := c.Query("enabled"); enabled != "" {
+		b, err := strconv.ParseBool(enabled)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid enabled, expected true or false"})
+			return
+		}
+		query = query.Where("enabled = ?", b)
+	}
+	rules := []ValidationRule{}
+	if err := query.Order("name").Find(&rules).Error; err != nil {
+		logCtx(c).Errorf("Error listing validation rules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list validation rules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": rules})
+}
+
+// updateValidationRule replaces a rule. Imports already running keep the
+// rules they started with.
+func updateValidationRule(c *gin.Context) {
+	var req validationRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var r ValidationRule
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&r, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Validation rule not found"})
+		return
+	}
+	if err := req.apply(&r); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	saveValidationRule(c, &r, http.StatusOK)
+}
+
+func deleteValidationRule(c *gin.Context) {
+	result := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Delete(&ValidationRule{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		logCtx(c).Errorf("Error deleting validation rule %s: %v", c.Param("id"), result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete validation rule"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Validation rule not found"})
+		return
+	}
+	setRowsAffected(c, result.RowsAffected)
+	logCtx(c).Infof("Deleted validation rule %s", c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "Validation rule deleted"})
+}
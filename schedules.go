@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// misfireRunOnce catches up with a single run when the scheduler missed
+	// one or more runs by more than schedules.misfire_grace.
+	misfireRunOnce = "run_once"
+	// misfireSkip drops missed runs and waits for the next one.
+	misfireSkip = "skip"
+
+	scheduleFetchTimeout = time.Hour
+)
+
+// errScheduleSource marks runs that failed because the source couldn't be
+// read, as opposed to failures on our side.
+var errScheduleSource = errors.New("source unavailable")
+
+// Schedule imports a file from Source on a cron schedule.
+type Schedule struct {
+	ID       string `gorm:"primaryKey;size:36" json:"id"`
+	TenantID string `gorm:"size:64;not null;index" json:"tenant_id"`
+	Name     string `gorm:"size:128;not null" json:"name"`
+	// Cron is a standard five-field expression or descriptor such as @daily,
+	// evaluated in the service time zone unless it starts with CRON_TZ=.
+	Cron string `gorm:"size:128;not null" json:"cron"`
+	// Source is an http(s) URL, an s3:// location or a file in
+	// schedules.source_dir.
+	Source      string     `gorm:"not null" json:"source"`
+	Priority    int        `gorm:"not null;default:5" json:"priority"`
+	CallbackURL string     `json:"callback_url,omitempty"`
+	Misfire     string     `gorm:"size:16;not null;default:'run_once'" json:"misfire"`
+	Enabled     bool       `gorm:"not null;default:true" json:"enabled"`
+	NextRunAt   *time.Time `gorm:"index" json:"next_run_at,omitempty"`
+	LastRunAt   *time.Time `json:"last_run_at,omitempty"`
+	LastJobID   string     `gorm:"size:36" json:"last_job_id,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	CreatedBy   string     `json:"created_by"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// nextRun returns the first time after t that expr fires, truncated to the
+// second so it compares equal after a round trip through any database.
+func nextRun(expr string, t time.Time) (time.Time, error) {
+	if !strings.HasPrefix(expr, "CRON_TZ=") && !strings.HasPrefix(expr, "TZ=") {
+		expr = "CRON_TZ=" + cfg.Location().String() + " " + expr
+	}
+	sched, err := cron.ParseStandard(expr)
+	if err != nil {
+		return time.Time{}, err
+	}
+	next := sched.Next(t)
+	if next.IsZero() {
+		return time.Time{}, fmt.Errorf("cron expression never fires")
+	}
+	return next.UTC().Truncate(time.Second), nil
+}
+
+// validScheduleSource checks that the scheduler is allowed to read source.
+func validScheduleSource(source string) error {
+	if strings.HasPrefix(source, "s3://") {
+		if cfg.Upload.Backend != storageS3 {
+			return fmt.Errorf("s3:// sources need upload.backend s3")
+		}
+		if _, key, ok := parseS3Location(source); !ok || key == "" {
+			return fmt.Errorf("source must be s3://bucket/key")
+		}
+		return nil
+	}
+	if strings.Contains(source, "://") {
+		u, err := url.Parse(source)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("source must be an http(s) URL, an s3:// location or a file name")
+		}
+		if len(cfg.Schedules.AllowedHosts) == 0 {
+			return nil
+		}
+		for _, host := range cfg.Schedules.AllowedHosts {
+			if strings.EqualFold(u.Hostname(), host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("source host %q is not in schedules.allowed_hosts", u.Hostname())
+	}
+	if cfg.Schedules.SourceDir == "" {
+		return fmt.Errorf("file sources are disabled, schedules.source_dir is not set")
+	}
+	if !filepath.IsLocal(source) {
+		return fmt.Errorf("file source %q must be a relative path inside schedules.source_dir", source)
+	}
+	return nil
+}
+
+// openScheduleSource opens source for reading and returns the file name to
+// record on the job.
+func openScheduleSource(ctx context.Context, source string) (io.ReadCloser, string, error) {
+	switch {
+	case strings.HasPrefix(source, "s3://"):
+		_, key, _ := parseS3Location(source)
+		r, err := uploads.Open(ctx, source)
+		return r, path.Base(key), err
+	case strings.Contains(source, "://"):
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, source, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, "", fmt.Errorf("fetching %s: %s", source, resp.Status)
+		}
+		name := path.Base(resp.Request.URL.Path)
+		if name == "/" || name == "." {
+			name = resp.Request.URL.Hostname() + ".csv"
+		}
+		return resp.Body, name, nil
+	}
+	f, err := os.Open(filepath.Join(cfg.Schedules.SourceDir, source))
+	return f, filepath.Base(source), err
+}
+
+type byteCounter int64
+
+func (n *byteCounter) Write(p []byte) (int, error) {
+	*n += byteCounter(len(p))
+	return len(p), nil
+}
+
+// runSchedule copies the schedule's source into upload storage, records an
+// import job for it and starts the import, as an upload would.
+func runSchedule(ctx context.Context, s Schedule) (ImportJob, error) {
+	fetchCtx, cancel := context.WithTimeout(ctx, scheduleFetchTimeout)
+	defer cancel()
+	src, name, err := openScheduleSource(fetchCtx, s.Source)
+	if err != nil {
+		return ImportJob{}, fmt.Errorf("%w: %v", errScheduleSource, err)
+	}
+	defer src.Close()
+
+	job := ImportJob{
+		ID:           uuid.NewString(),
+		TenantID:     s.TenantID,
+		CreatedBy:    "schedule:" + s.Name,
+		OriginalName: name,
+		Priority:     s.Priority,
+		CallbackURL:  s.CallbackURL,
+	}
+	ctx = withJobID(ctx, job.ID)
+	hash := sha256.New()
+	var size byteCounter
+	job.StoredPath, err = uploads.Save(fetchCtx, job.ID+".csv", io.TeeReader(src, io.MultiWriter(hash, &size)))
+	if err != nil {
+		return ImportJob{}, fmt.Errorf("copying source to upload storage: %w", err)
+	}
+	job.Checksum = hex.EncodeToString(hash.Sum(nil))
+	job.Size = int64(size)
+
+	if err := db.WithContext(ctx).Create(&job).Error; err != nil {
+		if err := uploads.Remove(context.WithoutCancel(ctx), job.StoredPath); err != nil {
+			logCtx(ctx).Warnf("Error removing %s: %v", job.StoredPath, err)
+		}
+		return ImportJob{}, fmt.Errorf("recording import job: %w", err)
+	}
+	logCtx(ctx).Infof("Schedule %s (%s) fetched %s into job %s", s.ID, s.Name, s.Source, job.ID)
+	publishJobEvent(ctx, newJobStreamEvent(job, "import.created", jobPending))
+	dispatchImport(ctx, job)
+	return job, nil
+}
+
+// recordScheduleRun stores the outcome of a run on the schedule and alerts
+// chat when the run couldn't start an import.
+func recordScheduleRun(ctx context.Context, s Schedule, job ImportJob, runErr error) {
+	now := time.Now().UTC()
+	updates := map[string]interface{}{"last_run_at": &now, "last_job_id": job.ID, "last_error": ""}
+	if runErr != nil {
+		logCtx(ctx).Errorf("Scheduled import %s (%s) failed: %v", s.ID, s.Name, runErr)
+		updates["last_error"] = runErr.Error()
+		sendChatAlert(ctx, chatAlert{
+			Event: "schedule.failed",
+			Title: fmt.Sprintf("Scheduled import %s failed", s.Name),
+			Text:  fmt.Sprintf("Schedule %s (tenant %s) could not start an import from %s: %v", s.ID, s.TenantID, s.Source, runErr),
+		})
+	}
+	if err := db.WithContext(ctx).Model(&Schedule{}).Where("id = ?", s.ID).Updates(updates).Error; err != nil {
+		logCtx(ctx).Errorf("Error recording run of schedule %s: %v", s.ID, err)
+	}
+}
+
+// startScheduler checks for due schedules every schedules.poll_interval.
+// Each instance runs it; a run is claimed by advancing next_run_at with a
+// conditional update, so only one instance starts it.
+func startScheduler() {
+	if cfg.Schedules.PollInterval == 0 {
+		logr.Info("Scheduler disabled on this instance")
+		return
+	}
+	go func() {
+		for range time.Tick(cfg.Schedules.PollInterval) {
+			runDueSchedules()
+		}
+	}()
+}
+
+func runDueSchedules() {
+	maintenance.RLock()
+	paused := maintenance.enabled
+	maintenance.RUnlock()
+	if paused {
+		// Runs due now are picked up, subject to misfire handling, once
+		// maintenance ends.
+		return
+	}
+
+	now := time.Now().UTC()
+	var due []Schedule
+	if err := db.Where("enabled = ? AND next_run_at <= ?", true, now).Find(&due).Error; err != nil {
+		logr.Errorf("Error loading due schedules: %v", err)
+		return
+	}
+	for _, s := range due {
+		next, err := nextRun(s.Cron, now)
+		if err != nil {
+			logr.Errorf("Disabling schedule %s with invalid cron %q: %v", s.ID, s.Cron, err)
+			db.Model(&Schedule{}).Where("id = ?", s.ID).Updates(map[string]interface{}{"enabled": false, "last_error": err.Error()})
+			continue
+		}
+		claim := db.Model(&Schedule{}).Where("id = ? AND next_run_at = ?", s.ID, s.NextRunAt).Update("next_run_at", next)
+		if claim.Error != nil {
+			logr.Errorf("Error claiming schedule %s: %v", s.ID, claim.Error)
+			continue
+		}
+		if claim.RowsAffected == 0 {
+			continue // another instance took it
+		}
+
+		if late := now.Sub(*s.NextRunAt); late > cfg.Schedules.MisfireGrace && s.Misfire == misfireSkip {
+			logr.Warnf("Skipping run of schedule %s (%s) due at %s, missed by %s", s.ID, s.Name, s.NextRunAt.Format(time.RFC3339), late.Round(time.Second))
+			continue
+		}
+		if s.LastJobID != "" {
+			var last ImportJob
+			if err := db.Select("status").First(&last, "id = ?", s.LastJobID).Error; err == nil &&
+				(last.Status == jobPending || last.Status == jobQueued || last.Status == jobRunning || last.Status == jobPaused) {
+				logr.Warnf("Skipping run of schedule %s (%s), its previous job %s is still %s", s.ID, s.Name, s.LastJobID, last.Status)
+				continue
+			}
+		}
+		go func(s Schedule) {
+			// Logs of the fetch and the import share a request ID, as they
+			// would for an upload.
+			ctx := context.WithValue(importCtx, requestIDKey{}, "schedule-"+uuid.NewString())
+			job, err := runSchedule(ctx, s)
+			recordScheduleRun(ctx, s, job, err)
+		}(s)
+	}
+}
+
+type scheduleRequest struct {
+	Name        string `json:"name" binding:"required"`
+	Cron        string `json:"cron" binding:"required"`
+	Source      string `json:"source" binding:"required"`
+	Priority    *int   `json:"priority"`
+	CallbackURL string `json:"callback_url"`
+	Misfire     string `json:"misfire"`
+	Enabled     *bool  `json:"enabled"`
+}
+
+// apply validates req and copies it onto s, computing the next run.
+func (req scheduleRequest) apply(s *Schedule) error {
+	next, err := nextRun(req.Cron, time.Now())
+	if err != nil {
+		return fmt.Errorf("invalid cron expression: %v", err)
+	}
+	if err := validScheduleSource(req.Source); err != nil {
+		return err
+	}
+	priority := defaultImportPriority
+	if req.Priority != nil {
+		priority = *req.Priority
+	}
+	if priority < minImportPriority || priority > maxImportPriority {
+		return fmt.Errorf("invalid priority, must be %d to %d", minImportPriority, maxImportPriority)
+	}
+	if req.CallbackURL != "" {
+		if err := validCallbackURL(req.CallbackURL); err != nil {
+			return err
+		}
+	}
+	switch req.Misfire {
+	case "":
+		req.Misfire = misfireRunOnce
+	case misfireRunOnce, misfireSkip:
+	default:
+		return fmt.Errorf("misfire must be %s or %s", misfireRunOnce, misfireSkip)
+	}
+
+	s.Name = req.Name
+	s.Cron = req.Cron
+	s.Source = req.Source
+	s.Priority = priority
+	s.CallbackURL = req.CallbackURL
+	s.Misfire = req.Misfire
+	s.Enabled = req.Enabled == nil || *req.Enabled
+	s.NextRunAt = &next
+	return nil
+}
+
+func createSchedule(c *gin.Context) {
+	var req scheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s := Schedule{ID: uuid.NewString(), TenantID: tenantID(c), CreatedBy: c.GetString(ctxActor)}
+	if err := req.apply(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.WithContext(c.Request.Context()).Create(&s).Error; err != nil {
+		logCtx(c).Errorf("Error creating schedule %s: %v", s.Name, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create schedule"})
+		return
+	}
+	logCtx(c).Infof("Created schedule %s (%s) %q from %s", s.ID, s.Name, s.Cron, s.Source)
+	c.JSON(http.StatusCreated, s)
+}
+
+func listSchedules(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 1000 {
+		limit = 50
+	}
+
+	query := db.WithContext(c.Request.Context()).Model(&Schedule{}).Scopes(tenantScope(c))
+	if enabled := c.Query("enabled"); enabled != "" {
+		b, err := strconv.ParseBool(enabled)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid enabled, expected true or false"})
+			return
+		}
+		query = query.Where("enabled = ?", b)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		logCtx(c).Errorf("Error counting schedules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list schedules"})
+		return
+	}
+	var schedules []Schedule
+	if err := query.Order("name").Limit(limit).Offset((page - 1) * limit).Find(&schedules).Error; err != nil {
+		logCtx(c).Errorf("Error listing schedules: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list schedules"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"total": total, "page": page, "limit": limit, "schedules": schedules})
+}
+
+func findSchedule(c *gin.Context) (Schedule, bool) {
+	var s Schedule
+	if err := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).First(&s, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return s, false
+	}
+	return s, true
+}
+
+func getSchedule(c *gin.Context) {
+	if s, ok := findSchedule(c); ok {
+		c.JSON(http.StatusOK, s)
+	}
+}
+
+// updateSchedule replaces a schedule's settings and recomputes its next run.
+func updateSchedule(c *gin.Context) {
+	var req scheduleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	if err := req.apply(&s); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := db.WithContext(c.Request.Context()).Save(&s).Error; err != nil {
+		logCtx(c).Errorf("Error updating schedule %s: %v", s.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update schedule"})
+		return
+	}
+	logCtx(c).Infof("Updated schedule %s (%s) %q from %s", s.ID, s.Name, s.Cron, s.Source)
+	c.JSON(http.StatusOK, s)
+}
+
+func deleteSchedule(c *gin.Context) {
+	result := db.WithContext(c.Request.Context()).Scopes(tenantScope(c)).Delete(&Schedule{}, "id = ?", c.Param("id"))
+	if result.Error != nil {
+		logCtx(c).Errorf("Error deleting schedule %s: %v", c.Param("id"), result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete schedule"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Schedule not found"})
+		return
+	}
+	setRowsAffected(c, result.RowsAffected)
+	logCtx(c).Infof("Deleted schedule %s", c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule deleted"})
+}
+
+// runScheduleNow starts an import from the schedule's source immediately,
+// leaving its next scheduled run unchanged.
+func runScheduleNow(c *gin.Context) {
+	s, ok := findSchedule(c)
+	if !ok {
+		return
+	}
+	job, err := runSchedule(c.Request.Context(), s)
+	recordScheduleRun(c.Request.Context(), s, job, err)
+	if err != nil {
+		if errors.Is(err, errScheduleSource) {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start scheduled import"})
+		return
+	}
+	tagRequestWithJob(c, job.ID)
+	logCtx(c).Infof("Schedule %s run by %s as job %s", s.ID, c.GetString(ctxActor), job.ID)
+	c.JSON(http.StatusOK, gin.H{"message": "Schedule triggered, processing started", "job_id": job.ID})
+}
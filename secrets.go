@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+)
+
+type DBCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type credentialSource interface {
+	Fetch(ctx context.Context) (DBCredentials, error)
+	Name() string
+}
+
+// envCredentials reads DB_USER/DB_PASSWORD, or the password from DB_PASSWORD_FILE
+// so that mounted Docker/Kubernetes secrets are re-read after rotation.
+type envCredentials struct {
+	user         string
+	password     string
+	passwordFile string
+}
+
+func (e envCredentials) Name() string { return "env" }
+
+func (e envCredentials) Fetch(ctx context.Context) (DBCredentials, error) {
+	creds := DBCredentials{Username: e.user, Password: e.password}
+	if e.passwordFile != "" {
+		b, err := os.ReadFile(e.passwordFile)
+		if err != nil {
+			return DBCredentials{}, fmt.Errorf("reading password file: %w", err)
+		}
+		creds.Password = strings.TrimSpace(string(b))
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return DBCredentials{}, fmt.Errorf("DB_USER and DB_PASSWORD (or DB_PASSWORD_FILE) must be set")
+	}
+	return creds, nil
+}
+
+type vaultCredentials struct {
+	addr   string
+	token  string
+	path   string
+	client *http.Client
+}
+
+func (v vaultCredentials) Name() string { return "vault" }
+
+func (v vaultCredentials) Fetch(ctx context.Context) (DBCredentials, error) {
+	url := strings.TrimRight(v.addr, "/") + "/v1/" + strings.TrimLeft(v.path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return DBCredentials{}, err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return DBCredentials{}, fmt.Errorf("vault request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return DBCredentials{}, fmt.Errorf("vault returned status %d for %s", resp.StatusCode, v.path)
+	}
+
+	// KV v2 nests the secret under data.data, KV v1 puts it directly under data.
+	var body struct {
+		Data struct {
+			Data *DBCredentials `json:"data"`
+			DBCredentials
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return DBCredentials{}, fmt.Errorf("decoding vault response: %w", err)
+	}
+	creds := body.Data.DBCredentials
+	if body.Data.Data != nil {
+		creds = *body.Data.Data
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return DBCredentials{}, fmt.Errorf("vault secret %s has no username/password", v.path)
+	}
+	return creds, nil
+}
+
+type awsSecretsCredentials struct {
+	secretID string
+	client   *secretsmanager.Client
+}
+
+func (a awsSecretsCredentials) Name() string { return "aws" }
+
+func (a awsSecretsCredentials) Fetch(ctx context.Context) (DBCredentials, error) {
+	out, err := a.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(a.secretID)})
+	if err != nil {
+		return DBCredentials{}, fmt.Errorf("fetching secret %s: %w", a.secretID, err)
+	}
+	var creds DBCredentials
+	if err := json.Unmarshal([]byte(aws.ToString(out.SecretString)), &creds); err != nil {
+		return DBCredentials{}, fmt.Errorf("decoding secret %s: %w", a.secretID, err)
+	}
+	if creds.Username == "" || creds.Password == "" {
+		return DBCredentials{}, fmt.Errorf("secret %s has no username/password", a.secretID)
+	}
+	return creds, nil
+}
+
+func newCredentialSource(conf DBConfig) (credentialSource, error) {
+	switch conf.SecretsBackend {
+	case "", "env":
+		return envCredentials{user: conf.User, password: conf.Password, passwordFile: conf.PasswordFile}, nil
+	case "vault":
+		if conf.VaultAddr == "" || conf.VaultToken == "" || conf.VaultSecretPath == "" {
+			return nil, fmt.Errorf("vault backend requires VAULT_ADDR, VAULT_TOKEN and VAULT_SECRET_PATH")
+		}
+		return vaultCredentials{
+			addr:   conf.VaultAddr,
+			token:  conf.VaultToken,
+			path:   conf.VaultSecretPath,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	case "aws":
+		if conf.AWSSecretID == "" {
+			return nil, fmt.Errorf("aws backend requires AWS_SECRET_ID")
+		}
+		var opts []func(*awsconfig.LoadOptions) error
+		if conf.AWSRegion != "" {
+			opts = append(opts, awsconfig.WithRegion(conf.AWSRegion))
+		}
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("loading AWS config: %w", err)
+		}
+		return awsSecretsCredentials{secretID: conf.AWSSecretID, client: secretsmanager.NewFromConfig(awsCfg)}, nil
+	}
+	return nil, fmt.Errorf("unknown secrets backend %q", conf.SecretsBackend)
+}
+
+// credentialCache re-fetches credentials from the backend once they are older
+// than ttl. Each new pool connection asks the cache, so a rotated password is
+// picked up without restarting the process.
+type credentialCache struct {
+	source  credentialSource
+	ttl     time.Duration
+	mu      sync.Mutex
+	creds   DBCredentials
+	fetched time.Time
+}
+
+var dbCredentials *credentialCache
+
+func newCredentialCache(source credentialSource, ttl time.Duration) *credentialCache {
+	return &credentialCache{source: source, ttl: ttl}
+}
+
+func (cc *credentialCache) Get(ctx context.Context) (DBCredentials, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if !cc.fetched.IsZero() && time.Since(cc.fetched) < cc.ttl {
+		return cc.creds, nil
+	}
+
+	creds, err := cc.source.Fetch(ctx)
+	if err != nil {
+		if !cc.fetched.IsZero() {
+			logCtx(ctx).Warnf("Failed to refresh database credentials from %s, using cached values: %v", cc.source.Name(), err)
+			return cc.creds, nil
+		}
+		return DBCredentials{}, err
+	}
+	if !cc.fetched.IsZero() && creds != cc.creds {
+		logCtx(ctx).Infof("Database credentials rotated (source: %s)", cc.source.Name())
+	}
+	cc.creds = creds
+	cc.fetched = time.Now()
+	return creds, nil
+}
+
+func (cc *credentialCache) Invalidate() {
+	cc.mu.Lock()
+	cc.fetched = time.Time{}
+	cc.mu.Unlock()
+}
+
+func (cc *credentialCache) beforeConnect(ctx context.Context, connCfg *pgx.ConnConfig) error {
+	creds, err := cc.Get(ctx)
+	if err != nil {
+		return err
+	}
+	connCfg.User = creds.Username
+	connCfg.Password = creds.Password
+	return nil
+}
+
+func (cc *credentialCache) beforeConnectMySQL(ctx context.Context, mc *mysql.Config) error {
+	creds, err := cc.Get(ctx)
+	if err != nil {
+		return err
+	}
+	mc.User = creds.Username
+	mc.Passwd = creds.Password
+	return nil
+}
+
+func rotateDBCredentials(c *gin.Context) {
+	dbCredentials.Invalidate()
+	if _, err := dbCredentials.Get(c.Request.Context()); err != nil {
+		logCtx(c).Errorf("Error reloading database credentials: %v", err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to reload database credentials"})
+		return
+	}
+	logCtx(c).Info("Database credentials reloaded on request")
+	c.JSON(http.StatusOK, gin.H{"message": "Credentials reloaded; new connections will use them"})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runServer serves until SIGINT/SIGTERM, then fails readiness for
+// server.shutdown_delay, stops accepting requests, waits for in-flight
+// requests and finally drains running imports. SIGHUP reloads the
+// configuration.
+func runServer(handler http.Handler, addr string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	watchReloadSignal(ctx)
+
+	httpServer := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	servers := []*http.Server{httpServer}
+	httpServer.RegisterOnShutdown(jobEvents.close)
+	httpServer.RegisterOnShutdown(logTail.close)
+	errCh := make(chan error, 2)
+
+	if cfg.TLS.Enabled() {
+		httpsServer, httpHandler := tlsServers(handler)
+		httpServer.Handler = httpHandler
+		httpsServer.RegisterOnShutdown(jobEvents.close)
+		httpsServer.RegisterOnShutdown(logTail.close)
+		servers = append(servers, httpsServer)
+		go func() {
+			logr.Infof("Starting HTTPS server on %s", httpsServer.Addr)
+			errCh <- listenTLS(httpsServer)
+		}()
+	}
+	go func() {
+		logr.Infof("Starting server on %s", addr)
+		errCh <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	case <-ctx.Done():
+		logr.Info("Shutdown signal received, draining requests")
+	}
+	stop()
+	shuttingDown.Store(true)
+	budget := newShutdownBudget(cfg.Server.TerminationGracePeriod)
+
+	if delay := budget.cap(cfg.Server.ShutdownDelay); delay > 0 {
+		logr.Infof("Failing readiness for %s before closing listeners", delay)
+		time.Sleep(delay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), budget.cap(cfg.Server.ShutdownTimeout))
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			logr.Errorf("Error shutting down server on %s: %v", srv.Addr, err)
+		}
+	}
+
+	drainImports(budget.cap(cfg.Import.DrainTimeout))
+	flushLogStore()
+	flushLogShipping()
+	shutdownTracing()
+	logr.Info("Server stopped")
+	return nil
+}
+
+// shutdownBudget shares what is left of the termination grace period between
+// the shutdown phases, keeping a margin for checkpointing imports and
+// flushing telemetry before the kubelet sends SIGKILL.
+type shutdownBudget struct {
+	deadline time.Time
+}
+
+const shutdownMargin = 3 * time.Second
+
+func newShutdownBudget(grace time.Duration) shutdownBudget {
+	if grace <= 0 {
+		return shutdownBudget{}
+	}
+	return shutdownBudget{deadline: time.Now().Add(grace - shutdownMargin)}
+}
+
+func (b shutdownBudget) cap(d time.Duration) time.Duration {
+	if b.deadline.IsZero() {
+		return d
+	}
+	return max(min(d, time.Until(b.deadline)), 0)
+}
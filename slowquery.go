@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	gormlogger "gorm.io/gorm/logger"
+)
+
+const (
+	slowQuerySource = "slow_query"
+	maxSlowQuerySQL = 2000
+	// maxSlowQueries caps the slow queries /logs/slow-queries holds while it
+	// waits to learn their routes.
+	maxSlowQueries = 100000
+)
+
+// slowQueryLogger is the GORM logger. It logs queries slower than
+// db.slow_query_threshold to the application log, with placeholders in
+// place of bound values, which carry employee PII. Query errors are left to
+// the callers, which log them with more context.
+type slowQueryLogger struct{}
+
+func (l slowQueryLogger) LogMode(gormlogger.LogLevel) gormlogger.Interface { return l }
+
+func (slowQueryLogger) Info(ctx context.Context, msg string, args ...interface{}) {
+	logCtx(ctx).Infof(msg, args...)
+}
+
+func (slowQueryLogger) Warn(ctx context.Context, msg string, args ...interface{}) {
+	logCtx(ctx).Warnf(msg, args...)
+}
+
+func (slowQueryLogger) Error(ctx context.Context, msg string, args ...interface{}) {
+	logCtx(ctx).Errorf(msg, args...)
+}
+
+func (slowQueryLogger) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	threshold := cfg.DB.SlowQueryThreshold
+	elapsed := time.Since(begin)
+	if threshold <= 0 || elapsed < threshold {
+		return
+	}
+	sql, rows := fc()
+	logCtx(ctx).WithFields(logrus.Fields{
+		"source":      slowQuerySource,
+		"sql":         truncate(sql, maxSlowQuerySQL),
+		"duration_ms": elapsed.Milliseconds(),
+		"rows":        rows,
+	}).Warnf("Slow query took %s", elapsed.Round(time.Millisecond))
+}
+
+// ParamsFilter drops the bound values from the SQL handed to Trace.
+func (slowQueryLogger) ParamsFilter(ctx context.Context, sql string, params ...interface{}) (string, []interface{}) {
+	return sql, nil
+}
+
+type slowQueryGroup struct {
+	Route     string    `json:"route"`
+	SQL       string    `json:"sql"`
+	Count     int       `json:"count"`
+	TotalMs   int64     `json:"total_ms"`
+	AvgMs     float64   `json:"avg_ms"`
+	MaxMs     int64     `json:"max_ms"`
+	MaxRows   int64     `json:"max_rows"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type slowQuery struct {
+	requestID string
+	jobID     string
+	sql       string
+	ms, rows  int64
+	time      time.Time
+}
+
+// logSlowQueries groups the slow-query entries matching the /logs filters by
+// route and SQL, slowest in total first. A query's route comes from the
+// access log entry of the request it ran in; queries run by imports are
+// grouped under "import" and other background work under "background".
+func logSlowQueries(c *gin.Context) {
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	top, _ := strconv.Atoi(c.DefaultQuery("top", "20"))
+	if top < 1 || top > 100 {
+		top = 20
+	}
+
+	segments, err := logSegmentsBetween(filter.start, filter.end)
+	if err != nil {
+		logCtx(c).Errorf("Error listing log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+
+	var queries []slowQuery
+	routes := map[string]string{} // request ID → route, for the requests with slow queries
+	skipped, err := scanLogSegments(c.Request.Context(), segments, func(line []byte) bool {
+		if len(line) == 0 {
+			return true
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return true
+		}
+		requestID, _ := entry["request_id"].(string)
+		switch entry["source"] {
+		case "access":
+			// The access entry is written when the request ends, after its
+			// queries.
+			if _, ok := routes[requestID]; ok {
+				method, _ := entry["method"].(string)
+				route, _ := entry["route"].(string)
+				routes[requestID] = method + " " + route
+			}
+		case slowQuerySource:
+			if !filter.match(c, entry) || len(queries) >= maxSlowQueries {
+				return true
+			}
+			q := slowQuery{requestID: requestID}
+			q.jobID, _ = entry["job_id"].(string)
+			q.sql, _ = entry["sql"].(string)
+			ms, _ := entry["duration_ms"].(float64)
+			rows, _ := entry["rows"].(float64)
+			q.ms, q.rows = int64(ms), int64(rows)
+			q.time, _ = logEntryTime(entry)
+			queries = append(queries, q)
+			if requestID != "" {
+				if _, ok := routes[requestID]; !ok {
+					routes[requestID] = ""
+				}
+			}
+		}
+		return true
+	})
+	if err != nil {
+		logCtx(c).Errorf("Error reading log files: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read log file"})
+		return
+	}
+	if skipped > 0 {
+		logCtx(c).Warnf("Skipped %d log lines longer than %d bytes", skipped, maxLogLineBytes)
+	}
+
+	groups := map[[2]string]*slowQueryGroup{}
+	for _, q := range queries {
+		route := routes[q.requestID]
+		switch {
+		case route != "":
+		case q.jobID != "":
+			route = "import"
+		default:
+			route = "background"
+		}
+		key := [2]string{route, q.sql}
+		g, ok := groups[key]
+		if !ok {
+			g = &slowQueryGroup{Route: route, SQL: q.sql, FirstSeen: q.time}
+			groups[key] = g
+		}
+		g.Count++
+		g.TotalMs += q.ms
+		if q.ms > g.MaxMs {
+			g.MaxMs = q.ms
+		}
+		if q.rows > g.MaxRows {
+			g.MaxRows = q.rows
+		}
+		if q.time.Before(g.FirstSeen) {
+			g.FirstSeen = q.time
+		}
+		if q.time.After(g.LastSeen) {
+			g.LastSeen = q.time
+		}
+	}
+
+	result := make([]*slowQueryGroup, 0, len(groups))
+	for _, g := range groups {
+		g.AvgMs = float64(g.TotalMs) / float64(g.Count)
+		result = append(result, g)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TotalMs != result[j].TotalMs {
+			return result[i].TotalMs > result[j].TotalMs
+		}
+		return result[i].Route+result[i].SQL < result[j].Route+result[j].SQL
+	})
+	if len(result) > top {
+		result = result[:top]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"threshold_ms": cfg.DB.SlowQueryThreshold.Milliseconds(),
+		"total":        len(queries),
+		"queries":      result,
+	})
+}
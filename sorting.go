@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm/clause"
+)
+
+var employeeSortColumns = map[string]string{
+	"id":          "id",
+	"first_name":  "first_name",
+	"last_name":   "last_name",
+	"email":       "email",
+	"age":         "age",
+	"gender":      "gender",
+	"department":  "department",
+	"company":     "company",
+	"salary":      "salary",
+	"currency":    "currency",
+	"date_joined": "date_joined",
+	"is_active":   "is_active",
+	"created_at":  "created_at",
+	"updated_at":  "updated_at",
+	// Computed by withComputedFields.
+	"tenure_years": "tenure_years",
+}
+
+type sortDirection string
+
+const (
+	sortAsc  sortDirection = "asc"
+	sortDesc sortDirection = "desc"
+)
+
+func parseSortDirection(s string) (sortDirection, error) {
+	switch sortDirection(strings.ToLower(strings.TrimSpace(s))) {
+	case sortAsc:
+		return sortAsc, nil
+	case sortDesc:
+		return sortDesc, nil
+	}
+	return "", fmt.Errorf("invalid order %q: must be asc or desc", s)
+}
+
+// parseSort reads the sort/order query parameters and resolves them against a
+// whitelist of columns, so user input never reaches the ORDER BY clause directly.
+func parseSort(c *gin.Context, columns map[string]string, defaultSort string) (clause.OrderByColumn, error) {
+	key := strings.ToLower(strings.TrimSpace(c.DefaultQuery("sort", defaultSort)))
+	column, ok := columns[key]
+	if !ok {
+		return clause.OrderByColumn{}, fmt.Errorf("invalid sort column %q", key)
+	}
+	dir, err := parseSortDirection(c.DefaultQuery("order", string(sortAsc)))
+	if err != nil {
+		return clause.OrderByColumn{}, err
+	}
+	return clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: dir == sortDesc}, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// startupHandler lets the server bind before the database is reachable so a
+// Kubernetes startup probe can watch progress. Until install completes only
+// the probes answer; /readyz and every other route return 503.
+type startupHandler struct {
+	app  atomic.Value // http.Handler
+	boot http.Handler
+}
+
+func newStartupHandler() *startupHandler {
+	boot := gin.New()
+	boot.GET("/healthz", healthz)
+	boot.GET("/livez", livez)
+	boot.GET("/readyz", func(c *gin.Context) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "checks": gin.H{"startup": "in progress"}})
+	})
+	boot.NoRoute(func(c *gin.Context) {
+		c.Header("Retry-After", "5")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Service is starting"})
+	})
+	return &startupHandler{boot: boot}
+}
+
+func (h *startupHandler) install(setup func() http.Handler) {
+	start := time.Now()
+	h.app.Store(setup())
+	logr.Infof("Startup completed in %s", time.Since(start).Round(time.Millisecond))
+}
+
+func (h *startupHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if app, ok := h.app.Load().(http.Handler); ok {
+		app.ServeHTTP(w, r)
+		return
+	}
+	h.boot.ServeHTTP(w, r)
+}
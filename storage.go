@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	storageLocal = "local"
+	storageS3    = "s3"
+)
+
+// uploadStore keeps uploaded files until their import has run. Save returns
+// the location recorded as ImportJob.StoredPath, which Open and Remove accept.
+type uploadStore interface {
+	Save(ctx context.Context, name string, r io.Reader) (string, error)
+	Open(ctx context.Context, location string) (io.ReadCloser, error)
+	// OpenAt opens the file for reading from the given byte offset.
+	OpenAt(ctx context.Context, location string, offset int64) (io.ReadCloser, error)
+	Remove(ctx context.Context, location string) error
+}
+
+var uploads uploadStore
+
+func initUploads() {
+	store, err := newUploadStore(cfg.Upload)
+	if err != nil {
+		logr.Fatalf("Invalid upload storage configuration: %v", err)
+	}
+	uploads = store
+	logr.Infof("Storing uploads in %s", cfg.Upload.Backend)
+}
+
+func newUploadStore(conf UploadConfig) (uploadStore, error) {
+	switch conf.Backend {
+	case "", storageLocal:
+		if err := os.MkdirAll(conf.Dir, os.ModePerm); err != nil {
+			return nil, fmt.Errorf("creating upload directory: %w", err)
+		}
+		return localStore{dir: conf.Dir}, nil
+	case storageS3:
+		var opts []func(*awsconfig.LoadOptions) error
+		if conf.S3.Region != "" {
+			opts = append(opts, awsconfig.WithRegion(conf.S3.Region))
+		}
+		awsCfg, err := awsconfig.LoadDefaultConfig(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("loading AWS config: %w", err)
+		}
+		client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+			if conf.S3.Endpoint != "" {
+				o.BaseEndpoint = aws.String(conf.S3.Endpoint)
+			}
+			o.UsePathStyle = conf.S3.PathStyle
+		})
+		return s3Store{client: client, uploader: manager.NewUploader(client), bucket: conf.S3.Bucket, prefix: conf.S3.Prefix}, nil
+	}
+	return nil, fmt.Errorf("unknown upload backend %q", conf.Backend)
+}
+
+type localStore struct {
+	dir string
+}
+
+func (l localStore) Save(_ context.Context, name string, r io.Reader) (string, error) {
+	path := filepath.Join(l.dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(path)
+		return "", err
+	}
+	return path, f.Close()
+}
+
+func (l localStore) Open(_ context.Context, location string) (io.ReadCloser, error) {
+	if strings.HasPrefix(location, "s3://") {
+		return nil, fmt.Errorf("%s is in S3 but upload.backend is local", location)
+	}
+	return os.Open(location)
+}
+
+func (l localStore) OpenAt(_ context.Context, location string, offset int64) (io.ReadCloser, error) {
+	if strings.HasPrefix(location, "s3://") {
+		return nil, fmt.Errorf("%s is in S3 but upload.backend is local", location)
+	}
+	return openFileAt(location, offset)
+}
+
+func openFileAt(path string, offset int64) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (l localStore) Remove(_ context.Context, location string) error {
+	return os.Remove(location)
+}
+
+// s3Store keeps uploads in a bucket so they survive the container. Locations
+// are s3://bucket/key; plain paths (jobs queued before switching backends,
+// or files given to the import command) are still read from disk.
+type s3Store struct {
+	client   *s3.Client
+	uploader *manager.Uploader
+	bucket   string
+	prefix   string
+}
+
+func (s s3Store) Save(ctx context.Context, name string, r io.Reader) (string, error) {
+	key := s.prefix + name
+	_, err := s.uploader.Upload(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        r,
+		ContentType: aws.String("text/csv"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("uploading to s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return "s3://" + s.bucket + "/" + key, nil
+}
+
+func (s s3Store) Open(ctx context.Context, location string) (io.ReadCloser, error) {
+	bucket, key, ok := parseS3Location(location)
+	if !ok {
+		return os.Open(location)
+	}
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", location, err)
+	}
+	return out.Body, nil
+}
+
+// OpenAt fetches the object from offset with a ranged GET.
+func (s s3Store) OpenAt(ctx context.Context, location string, offset int64) (io.ReadCloser, error) {
+	bucket, key, ok := parseS3Location(location)
+	if !ok {
+		return openFileAt(location, offset)
+	}
+	input := &s3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)}
+	if offset > 0 {
+		input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	}
+	out, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s from byte %d: %w", location, offset, err)
+	}
+	return out.Body, nil
+}
+
+func (s s3Store) Remove(ctx context.Context, location string) error {
+	bucket, key, ok := parseS3Location(location)
+	if !ok {
+		return os.Remove(location)
+	}
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+	return err
+}
+
+func parseS3Location(location string) (bucket, key string, ok bool) {
+	rest, ok := strings.CutPrefix(location, "s3://")
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, "/")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultTenantID = "default"
+
+	ctxTenant   = "tenant_id"
+	ctxAPIKeyID = "api_key_id"
+)
+
+type Tenant struct {
+	ID        string    `gorm:"primaryKey;size:64" json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type APIKey struct {
+	ID       uint   `gorm:"primaryKey" json:"id"`
+	Name     string `json:"name"`
+	TenantID string `gorm:"size:64;not null;index" json:"tenant_id"`
+	Prefix   string `gorm:"size:12" json:"prefix"`
+	KeyHash  string `gorm:"size:64;uniqueIndex" json:"-"`
+	Role     string `gorm:"size:16;not null;default:'editor'" json:"role"`
+	Scopes   string `json:"scopes"`
+	// CallbackURL is the default webhook for jobs uploaded with the key.
+	CallbackURL string     `json:"callback_url,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateAPIKey() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "mk_" + hex.EncodeToString(buf), nil
+}
+
+// requireAPIKey resolves the caller's API key and binds the request to the
+// key's tenant. Every tenant-owned query must go through tenantScope.
+func requireAPIKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := credentialFromRequest(c)
+
+		var apiKey APIKey
+		err := db.Where("key_hash = ? AND revoked_at IS NULL", hashAPIKey(key)).First(&apiKey).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			logCtx(c).Warnf("Rejected invalid API key from %s", c.ClientIP())
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			return
+		}
+		if err != nil {
+			logCtx(c).Errorf("Error looking up API key: %v", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to authenticate request"})
+			return
+		}
+
+		c.Set(ctxTenant, apiKey.TenantID)
+		c.Set(ctxRole, apiKey.Role)
+		c.Set(ctxScopes, parseScopes(apiKey.Scopes))
+		c.Set(ctxAPIKeyID, apiKey.ID)
+		c.Set(ctxCallbackURL, apiKey.CallbackURL)
+		c.Set(ctxActor, "apikey:"+apiKey.Name)
+		c.Next()
+	}
+}
+
+// requireAdminToken guards operator endpoints that manage tenants and keys.
+// They are disabled entirely when no admin token is configured.
+func requireAdminToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.Auth.AdminToken == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin endpoints are disabled"})
+			return
+		}
+		token := c.GetHeader("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Auth.AdminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin token"})
+			return
+		}
+		c.Set(ctxActor, "admin")
+		c.Next()
+	}
+}
+
+func tenantID(c *gin.Context) string {
+	return c.GetString(ctxTenant)
+}
+
+func tenantScope(c *gin.Context) func(*gorm.DB) *gorm.DB {
+	tid := tenantID(c)
+	return func(tx *gorm.DB) *gorm.DB {
+		return tx.Where("tenant_id = ?", tid)
+	}
+}
+
+func ensureDefaultTenant() error {
+	return db.Where(Tenant{ID: defaultTenantID}).FirstOrCreate(&Tenant{ID: defaultTenantID, Name: "Default"}).Error
+}
+
+func createTenant(c *gin.Context) {
+	var req struct {
+		ID   string `json:"id" binding:"required"`
+		Name string `json:"name"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenant := Tenant{ID: strings.ToLower(strings.TrimSpace(req.ID)), Name: req.Name}
+	if err := db.Create(&tenant).Error; err != nil {
+		logCtx(c).Errorf("Error creating tenant %s: %v", tenant.ID, err)
+		c.JSON(http.StatusConflict, gin.H{"error": "Failed to create tenant"})
+		return
+	}
+	logCtx(c).Infof("Created tenant %s", tenant.ID)
+	c.JSON(http.StatusCreated, tenant)
+}
+
+func listTenants(c *gin.Context) {
+	var tenants []Tenant
+	if err := db.Order("id").Find(&tenants).Error; err != nil {
+		logCtx(c).Errorf("Error listing tenants: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list tenants"})
+		return
+	}
+	c.JSON(http.StatusOK, tenants)
+}
+
+func createAPIKey(c *gin.Context) {
+	var req struct {
+		Name        string   `json:"name" binding:"required"`
+		Role        string   `json:"role"`
+		Scopes      []string `json:"scopes"`
+		CallbackURL string   `json:"callback_url"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Role == "" {
+		req.Role = roleEditor
+	}
+	if !validRole(req.Role) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid role, must be viewer, editor or admin"})
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := validCallbackURL(req.CallbackURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	var tenant Tenant
+	if err := db.First(&tenant, "id = ?", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+
+	key, err := generateAPIKey()
+	if err != nil {
+		logCtx(c).Errorf("Error generating API key: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate API key"})
+		return
+	}
+	apiKey := APIKey{
+		Name:        req.Name,
+		TenantID:    tenant.ID,
+		Prefix:      key[:11],
+		KeyHash:     hashAPIKey(key),
+		Role:        req.Role,
+		Scopes:      strings.Join(req.Scopes, ","),
+		CallbackURL: req.CallbackURL,
+	}
+	if err := db.Create(&apiKey).Error; err != nil {
+		logCtx(c).Errorf("Error storing API key for tenant %s: %v", tenant.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+
+	logCtx(c).Infof("Created API key %s for tenant %s", apiKey.Prefix, tenant.ID)
+	// The plaintext key is only ever returned here; only its hash is stored.
+	c.JSON(http.StatusCreated, gin.H{"api_key": apiKey, "key": key})
+}
+
+func listAPIKeys(c *gin.Context) {
+	var keys []APIKey
+	if err := db.Where("tenant_id = ?", c.Param("id")).Order("id").Find(&keys).Error; err != nil {
+		logCtx(c).Errorf("Error listing API keys: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+	c.JSON(http.StatusOK, keys)
+}
+
+func revokeAPIKey(c *gin.Context) {
+	now := time.Now().UTC()
+	result := db.Model(&APIKey{}).Where("id = ? AND revoked_at IS NULL", c.Param("id")).Update("revoked_at", &now)
+	if result.Error != nil {
+		logCtx(c).Errorf("Error revoking API key %s: %v", c.Param("id"), result.Error)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke API key"})
+		return
+	}
+	if result.RowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	logCtx(c).Infof("Revoked API key %s", c.Param("id"))
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	tenantA, keyA := newTestTenant(t)
+	tenantB, keyB := newTestTenant(t)
+	createTestRecord(t, keyA, "ann@"+tenantA+".example.com")
+	idB := createTestRecord(t, keyB, "bob@"+tenantB+".example.com")
+
+	asOf := fmt.Sprintf("/records/%d/as-of?date=%s", idB, time.Now().AddDate(0, 0, 1).Format("2006-01-02"))
+	decodeResponse(t, testCall(t, http.MethodGet, asOf, bearer(keyB), nil), http.StatusOK, nil)
+	decodeResponse(t, testCall(t, http.MethodGet, asOf, bearer(keyA), nil), http.StatusNotFound, nil)
+
+	w := testCall(t, http.MethodPut, fmt.Sprintf("/records/%d", idB), bearer(keyA), testRecordBody("mallory@"+tenantA+".example.com"))
+	decodeResponse(t, w, http.StatusNotFound, nil)
+
+	w = testCall(t, http.MethodGet, "/records", bearer(keyA), nil)
+	decodeResponse(t, w, http.StatusOK, nil)
+	if !strings.Contains(w.Body.String(), tenantA) || strings.Contains(w.Body.String(), tenantB) {
+		t.Errorf("tenant A's record list doesn't hold just its own record: %s", w.Body.String())
+	}
+
+	var created struct {
+		Export ExportJob `json:"export"`
+	}
+	decodeResponse(t, testCall(t, http.MethodPost, "/exports", bearer(keyB), nil), http.StatusAccepted, &created)
+	waitForExport(t, keyB, created.Export.ID)
+	decodeResponse(t, testCall(t, http.MethodGet, "/exports/"+created.Export.ID, bearer(keyA), nil), http.StatusNotFound, nil)
+
+	decodeResponse(t, testCall(t, http.MethodPost, "/exports", bearer(keyA), nil), http.StatusAccepted, &created)
+	job, url := waitForExport(t, keyA, created.Export.ID)
+	if job.Status != exportCompleted || job.RowCount != 1 {
+		t.Fatalf("tenant A's export = %+v, want completed with its 1 record", job)
+	}
+	w = testCall(t, http.MethodGet, url, nil, nil)
+	decodeResponse(t, w, http.StatusOK, nil)
+	if !strings.Contains(w.Body.String(), tenantA) || strings.Contains(w.Body.String(), tenantB) {
+		t.Errorf("tenant A's export doesn't hold just its own record: %s", w.Body.String())
+	}
+}
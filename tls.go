@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+func (t TLSConfig) Enabled() bool {
+	return (t.CertFile != "" && t.KeyFile != "") || len(t.AutocertDomains) > 0
+}
+
+// tlsServers returns the HTTPS server and the handler for the plain HTTP
+// listener, which either redirects or serves the app.
+func tlsServers(r http.Handler) (*http.Server, http.Handler) {
+	httpsServer := &http.Server{
+		Addr:              cfg.TLS.Addr,
+		Handler:           r,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+
+	httpHandler := r
+	if cfg.TLS.RedirectHTTP {
+		httpHandler = httpsRedirectHandler(cfg.TLS.Addr)
+	}
+
+	if len(cfg.TLS.AutocertDomains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.TLS.AutocertDomains...),
+			Cache:      autocert.DirCache(cfg.TLS.AutocertCacheDir),
+			Email:      cfg.TLS.AutocertEmail,
+		}
+		httpsServer.TLSConfig = m.TLSConfig()
+		httpsServer.TLSConfig.MinVersion = tls.VersionTLS12
+		// The HTTP-01 challenge must be answered on the plain HTTP listener.
+		httpHandler = m.HTTPHandler(httpHandler)
+	}
+	return httpsServer, httpHandler
+}
+
+func listenTLS(srv *http.Server) error {
+	if len(cfg.TLS.AutocertDomains) > 0 {
+		return srv.ListenAndServeTLS("", "")
+	}
+	return srv.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+}
+
+func httpsRedirectHandler(tlsAddr string) http.Handler {
+	_, tlsPort, _ := net.SplitHostPort(tlsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != "" && tlsPort != "443" {
+			host = net.JoinHostPort(host, tlsPort)
+		}
+		http.Redirect(w, req, "https://"+host+req.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
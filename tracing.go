@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	gormtracing "gorm.io/plugin/opentelemetry/tracing"
+)
+
+const tracerName = "Mini_Project"
+
+// tracerProvider is nil when tracing is disabled; the global no-op provider is
+// used in that case so instrumentation can stay unconditional.
+var tracerProvider *sdktrace.TracerProvider
+
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// initTracing installs an OTLP/HTTP exporter when tracing.endpoint is set.
+func initTracing() {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if cfg.Tracing.Endpoint == "" {
+		return
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.Tracing.Endpoint)}
+	if u, err := url.Parse(cfg.Tracing.Endpoint); err == nil && strings.Trim(u.Path, "/") == "" {
+		opts = append(opts, otlptracehttp.WithURLPath("/v1/traces"))
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		logr.Fatalf("Failed to create OTLP trace exporter: %v", err)
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(cfg.Tracing.ServiceName)))
+	if err != nil {
+		logr.Fatalf("Failed to build tracing resource: %v", err)
+	}
+
+	tracerProvider = sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Tracing.SampleRatio))),
+	)
+	otel.SetTracerProvider(tracerProvider)
+	logr.Infof("Exporting traces to %s (sample ratio %.2f)", cfg.Tracing.Endpoint, cfg.Tracing.SampleRatio)
+}
+
+// instrumentDB adds a span to every GORM query. Bound values are left out of
+// the recorded SQL because they carry employee PII.
+func instrumentDB() {
+	if err := db.Use(gormtracing.NewPlugin(gormtracing.WithoutMetrics(), gormtracing.WithoutQueryVariables())); err != nil {
+		logr.Fatalf("Failed to enable database tracing: %v", err)
+	}
+}
+
+func tracingMiddleware() gin.HandlerFunc {
+	return otelgin.Middleware(cfg.Tracing.ServiceName, otelgin.WithFilter(func(r *http.Request) bool {
+		return !unauditedPaths[r.URL.Path]
+	}))
+}
+
+// shutdownTracing flushes buffered spans, including those of imports that
+// were drained after the HTTP servers stopped.
+func shutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		logr.Errorf("Error flushing traces: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+const (
+	minEmployeeAge = 16
+	maxEmployeeAge = 100
+)
+
+// Validation error codes, reported with row errors and in 422 responses.
+const (
+	codeMissingEmail     = "missing_email"
+	codeInvalidEmail     = "invalid_email"
+	codeMissingFirstName = "missing_first_name"
+	codeMissingLastName  = "missing_last_name"
+	codeAgeOutOfRange    = "age_out_of_range"
+	codeNegativeSalary   = "negative_salary"
+	codeInvalidCurrency  = "invalid_currency"
+	codeInvalidDate      = "invalid_date"
+)
+
+// validationError is one rule an employee record breaks.
+type validationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// validationErrors is every rule a record breaks, in field order.
+type validationErrors []validationError
+
+// Error joins the errors as "code: message; ...", for row errors.
+func (errs validationErrors) Error() string {
+	parts := make([]string, len(errs))
+	for i, e := range errs {
+		parts[i] = e.Code + ": " + e.Message
+	}
+	return strings.Join(parts, "; ")
+}
+
+// validationCodes lists the codes of errs.
+func validationCodes(errs validationErrors) []string {
+	codes := make([]string, len(errs))
+	for i, e := range errs {
+		codes[i] = e.Code
+	}
+	return codes
+}
+
+// validateEmployee checks a record against the rules applied to every
+// write, whether by import or through the API. It returns nil for a valid
+// record.
+func validateEmployee(e *Employee) validationErrors {
+	var errs validationErrors
+	add := func(field, code, format string, args ...interface{}) {
+		errs = append(errs, validationError{Field: field, Code: code, Message: fmt.Sprintf(format, args...)})
+	}
+	if strings.TrimSpace(e.FirstName) == "" {
+		add("FirstName", codeMissingFirstName, "first name is required")
+	}
+	if strings.TrimSpace(e.LastName) == "" {
+		add("LastName", codeMissingLastName, "last name is required")
+	}
+	if e.Email == "" {
+		add("Email", codeMissingEmail, "email is required")
+	} else if !validEmail(e.Email) {
+		add("Email", codeInvalidEmail, "%q is not a valid email address", e.Email)
+	}
+	if e.Age < minEmployeeAge || e.Age > maxEmployeeAge {
+		add("Age", codeAgeOutOfRange, "age %d is not within %d-%d", e.Age, minEmployeeAge, maxEmployeeAge)
+	}
+	if e.Salary < 0 {
+		add("Salary", codeNegativeSalary, "salary %v is negative", e.Salary)
+	}
+	if !validCurrency(e.Currency) {
+		add("Currency", codeInvalidCurrency, "%q is not a 3-letter currency code", e.Currency)
+	}
+	return errs
+}
+
+// validEmail accepts a bare address whose domain has a dot; mail.ParseAddress
+// alone would also take display names and single-label domains.
+func validEmail(s string) bool {
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return false
+	}
+	domain := s[strings.LastIndexByte(s, '@')+1:]
+	return strings.Contains(domain, ".")
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Set at build time, e.g.
+//
+//	go build -ldflags "-X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo falls back to the VCS stamp Go embeds when the binary was built
+// from a checkout without ldflags.
+func buildInfo() gin.H {
+	rev, built := commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+			case s.Key == "vcs.time" && built == "":
+				built = s.Value
+			}
+		}
+	}
+	return gin.H{
+		"version":    version,
+		"commit":     rev,
+		"build_date": built,
+		"go_version": runtime.Version(),
+	}
+}
+
+func getVersion(c *gin.Context) {
+	info := buildInfo()
+	info["profile"] = cfg.Profile
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// What a version of an employee records. A baseline is the state of a
+// record when versioning began.
+const (
+	versionBaseline = "baseline"
+	versionCreate   = "create"
+	versionUpdate   = "update"
+	versionDelete   = "delete"
+	// versionUpsert versions the rows of an upsert as created or updated;
+	// it isn't recorded itself.
+	versionUpsert = "upsert"
+)
+
+// EmployeeVersion is an employee record as it was from RecordedAt until
+// its next version. A delete version holds the record as it was deleted,
+// with DeletedAt set.
+type EmployeeVersion struct {
+	ID           uint      `gorm:"primaryKey"`
+	EmployeeID   uint      `gorm:"not null;index"`
+	Operation    string    `gorm:"size:16;not null"`
+	RecordedAt   time.Time `gorm:"not null;index"`
+	TenantID     string    `gorm:"size:64;not null;index"`
+	FirstName    string
+	LastName     string
+	Email        string `gorm:"size:254"`
+	Age          int
+	Gender       string
+	DepartmentID *uint
+	CompanyID    *uint
+	Salary       float64
+	Currency     string `gorm:"size:3"`
+	Extra        extraAttributes
+	DateJoined   *time.Time
+	IsActive     bool
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+	DeletedAt    *time.Time
+	AnonymizedAt *time.Time
+}
+
+// versionedColumns are the columns of employees each version copies.
+const versionedColumns = "tenant_id, first_name, last_name, email, age, gender, department_id, company_id, " +
+	"salary, currency, extra, date_joined, is_active, created_at, updated_at, deleted_at, anonymized_at"
+
+// versionIDsKey holds the IDs of the employees an update or delete is about
+// to change, found before it runs.
+const versionIDsKey = "versions:ids"
+
+// registerVersioning adds the GORM callbacks that copy each employee row
+// written into employee_versions, in the transaction of the write. They
+// work on a whole statement, so a batch of an import is versioned by one
+// INSERT ... SELECT rather than a hook per row. Raw SQL, which only
+// migrations and partition maintenance run on employees, isn't versioned.
+func registerVersioning(tx *gorm.DB) error {
+	cb := tx.Callback()
+	if err := cb.Create().After("gorm:create").Register("versions:create", versionCreated); err != nil {
+		return err
+	}
+	if err := cb.Update().Before("gorm:update").Register("versions:find_updated", findVersioned); err != nil {
+		return err
+	}
+	if err := cb.Update().After("gorm:update").Register("versions:update", versionUpdated); err != nil {
+		return err
+	}
+	return cb.Delete().Before("gorm:delete").Register("versions:delete", versionDeleted)
+}
+
+func isVersioned(tx *gorm.DB) bool {
+	return tx.Error == nil && tx.Statement.Schema != nil && tx.Statement.Schema.Name == "Employee"
+}
+
+// versionCreated versions the rows a create wrote. An insert versions the
+// rows GORM filled in IDs for, which on a conflict left unchanged are only
+// those inserted; each ID is checked against the row's email, as a dialect
+// without RETURNING counts IDs on from the first. An upsert doesn't reliably
+// return the IDs of the rows it updated, so its rows are found by email and
+// versioned as created or updated.
+func versionCreated(tx *gorm.DB) {
+	if !isVersioned(tx) || tx.RowsAffected == 0 {
+		return
+	}
+	session := tx.Session(&gorm.Session{NewDB: true})
+	if isUpsert(tx) {
+		emails := map[string][]string{}
+		eachEmployee(tx, func(e *Employee) {
+			if e.Email != "" {
+				emails[e.TenantID] = append(emails[e.TenantID], e.Email)
+			}
+		})
+		var ids []uint
+		for tenant, list := range emails {
+			var found []uint
+			if err := session.Model(&Employee{}).Where("tenant_id = ? AND email IN ?", tenant, list).Pluck("id", &found).Error; err != nil {
+				tx.AddError(err)
+				return
+			}
+			ids = append(ids, found...)
+		}
+		tx.AddError(writeEmployeeVersions(session, versionUpsert, ids))
+		return
+	}
+
+	var ids []uint
+	emails := map[uint]string{}
+	eachEmployee(tx, func(e *Employee) {
+		switch {
+		case e.ID == 0:
+		case e.Email == "":
+			ids = append(ids, e.ID)
+		default:
+			emails[e.ID] = e.Email
+		}
+	})
+	if len(emails) > 0 {
+		unchecked := make([]uint, 0, len(emails))
+		for id := range emails {
+			unchecked = append(unchecked, id)
+		}
+		var found []Employee
+		if err := session.Unscoped().Select("id", "email").Where("id IN ?", unchecked).Find(&found).Error; err != nil {
+			tx.AddError(err)
+			return
+		}
+		for _, e := range found {
+			if emails[e.ID] == e.Email {
+				ids = append(ids, e.ID)
+			}
+		}
+	}
+	tx.AddError(writeEmployeeVersions(session, versionCreate, ids))
+}
+
+// isUpsert reports whether the statement updates the rows its insert
+// conflicts with.
+func isUpsert(tx *gorm.DB) bool {
+	c, ok := tx.Statement.Clauses["ON CONFLICT"]
+	if !ok {
+		return false
+	}
+	conflict, ok := c.Expression.(clause.OnConflict)
+	return ok && (len(conflict.DoUpdates) > 0 || conflict.UpdateAll)
+}
+
+// findVersioned notes the IDs of the rows an update or delete is about to
+// change: the model's own, or those its conditions select.
+func findVersioned(tx *gorm.DB) {
+	if !isVersioned(tx) {
+		return
+	}
+	var ids []uint
+	eachEmployee(tx, func(e *Employee) {
+		if e.ID != 0 {
+			ids = append(ids, e.ID)
+		}
+	})
+	if where, ok := tx.Statement.Clauses["WHERE"]; ok && len(ids) == 0 {
+		err := tx.Session(&gorm.Session{NewDB: true}).Unscoped().Model(&Employee{}).
+			Clauses(where.Expression).Pluck("id", &ids).Error
+		if err != nil {
+			tx.AddError(err)
+			return
+		}
+	}
+	tx.InstanceSet(versionIDsKey, ids)
+}
+
+func versionUpdated(tx *gorm.DB) {
+	if !isVersioned(tx) || tx.RowsAffected == 0 {
+		return
+	}
+	if ids, ok := tx.InstanceGet(versionIDsKey); ok {
+		tx.AddError(writeEmployeeVersions(tx.Session(&gorm.Session{NewDB: true}), versionUpdate, ids.([]uint)))
+	}
+}
+
+// versionDeleted versions the rows a delete is about to remove, or mark
+// deleted, while they can still be read.
+func versionDeleted(tx *gorm.DB) {
+	findVersioned(tx)
+	if ids, ok := tx.InstanceGet(versionIDsKey); ok && tx.Error == nil {
+		tx.AddError(writeEmployeeVersions(tx.Session(&gorm.Session{NewDB: true}), versionDelete, ids.([]uint)))
+	}
+}
+
+// eachEmployee calls fn with each employee of the statement's model, one
+// or a slice.
+func eachEmployee(tx *gorm.DB, fn func(e *Employee)) {
+	rv := tx.Statement.ReflectValue
+	switch rv.Kind() {
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < rv.Len(); i++ {
+			if e, ok := reflect.Indirect(rv.Index(i)).Addr().Interface().(*Employee); ok {
+				fn(e)
+			}
+		}
+	case reflect.Struct:
+		if rv.CanAddr() {
+			if e, ok := rv.Addr().Interface().(*Employee); ok {
+				fn(e)
+			}
+		}
+	}
+}
+
+// writeEmployeeVersions copies the employees of ids, as they are now, into
+// employee_versions.
+func writeEmployeeVersions(tx *gorm.DB, operation string, ids []uint) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	now := time.Now().UTC()
+	op, columns := "?", versionedColumns
+	args := []interface{}{operation, now}
+	switch operation {
+	case versionUpsert:
+		// Rows an upsert updated keep the time they were created.
+		op, args = "CASE WHEN created_at = updated_at THEN ? ELSE ? END", []interface{}{versionCreate, versionUpdate, now}
+	case versionDelete:
+		columns = strings.Replace(columns, "deleted_at", "COALESCE(deleted_at, ?)", 1)
+		args = append(args, now)
+	}
+	args = append(args, ids)
+	return tx.Exec("INSERT INTO employee_versions (employee_id, operation, recorded_at, "+versionedColumns+") "+
+		"SELECT id, "+op+", ?, "+columns+" FROM employees WHERE id IN ?", args...).Error
+}
+
+// employeesAsOf reads employees as they were at t, from the latest version
+// of each recorded before it. The versions stand in for employees under
+// its name, so the scopes of employees apply to them; records deleted by t
+// are left out as deleted ones are now. Department and company names are
+// today's.
+func employeesAsOf(tx *gorm.DB, t time.Time) *gorm.DB {
+	session := tx.Session(&gorm.Session{NewDB: true})
+	latest := session.Model(&EmployeeVersion{}).Select("MAX(id)").Where("recorded_at < ?", t).Group("employee_id")
+	versions := session.Model(&EmployeeVersion{}).Select("employee_id AS id, "+versionedColumns).Where("id IN (?)", latest)
+	return tx.Table("(?) AS employees", versions)
+}
+
+// parseAsOf reads an as-of time: the end of a YYYY-MM-DD day, or an exact
+// timestamp, in the configured time zone.
+func parseAsOf(s string) (time.Time, error) {
+	t, day, err := parseDayOrTime(s, cfg.Location())
+	if err == nil && day {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+// asOfDay is the day tenure is counted up to for records as of t, the last
+// one t includes.
+func asOfDay(t time.Time) time.Time {
+	return t.Add(-time.Nanosecond).In(cfg.Location())
+}
+
+// getRecordAsOf returns a record as it was at the end of ?date=, or at an
+// exact timestamp; 404 if it didn't exist then or had been deleted.
+func getRecordAsOf(c *gin.Context) {
+	t, err := parseAsOf(c.Query("date"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date, expected YYYY-MM-DD or an RFC 3339 timestamp"})
+		return
+	}
+	var e Employee
+	err = employeesAsOf(db.WithContext(c.Request.Context()), t).
+		Scopes(tenantScope(c), withComputedFieldsOn(asOfDay(t))).First(&e, "id = ?", c.Param("id")).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Record not found as of " + c.Query("date")})
+		return
+	}
+	if err != nil {
+		logCtx(c).Errorf("Error reading record %s as of %s: %v", c.Param("id"), t, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read record"})
+		return
+	}
+	setAuditRecord(c, e.ID)
+	respondRecord(c, http.StatusOK, e)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	ctxCallbackURL         = "callback_url"
+)
+
+// jobEvent is the payload sent when an import reaches a final state.
+type jobEvent struct {
+	Event        string    `json:"event"`
+	JobID        string    `json:"job_id"`
+	TenantID     string    `json:"tenant_id"`
+	FileName     string    `json:"file_name"`
+	Status       string    `json:"status"`
+	RowsRead     int64     `json:"rows_read"`
+	RowsInserted int64     `json:"rows_inserted"`
+	RowsUpdated  int64     `json:"rows_updated"`
+	RowsSkipped  int64     `json:"rows_skipped"`
+	RowsFailed   int64     `json:"rows_failed"`
+	Error        string    `json:"error,omitempty"`
+	JobURL       string    `json:"job_url"`
+	FinishedAt   time.Time `json:"finished_at"`
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// validCallbackURL checks a callback against webhooks.allowed_hosts so
+// uploaders can't point the server at arbitrary internal addresses.
+func validCallbackURL(raw string) error {
+	if cfg.Webhooks.SigningSecret == "" {
+		return fmt.Errorf("callbacks are disabled, webhooks.signing_secret is not set")
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("callback_url must be an http(s) URL")
+	}
+	if len(cfg.Webhooks.AllowedHosts) == 0 {
+		return nil
+	}
+	for _, host := range cfg.Webhooks.AllowedHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("callback_url host %q is not in webhooks.allowed_hosts", u.Hostname())
+}
+
+func signWebhook(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(cfg.Webhooks.SigningSecret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// sendWebhook posts event to the job's callback URL in the background,
+// retrying failed deliveries with backoff.
+func sendWebhook(ctx context.Context, callbackURL string, event jobEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logCtx(ctx).Errorf("Error encoding webhook for job %s: %v", event.JobID, err)
+		return
+	}
+	policy := retryPolicy{attempts: cfg.Webhooks.Attempts, base: 2 * time.Second, max: time.Minute, exponential: true, jitter: 0.2}
+	go func() {
+		err := policy.do(ctx, "Delivering webhook for job "+event.JobID, anyError, func() error {
+			timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set(webhookTimestampHeader, timestamp)
+			req.Header.Set(webhookSignatureHeader, signWebhook(timestamp, body))
+			resp, err := webhookClient.Do(req)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				return fmt.Errorf("callback returned %s", resp.Status)
+			}
+			return nil
+		})
+		if err != nil {
+			logCtx(ctx).Errorf("Giving up on webhook for job %s to %s: %v", event.JobID, callbackURL, err)
+			return
+		}
+		logCtx(ctx).Infof("Delivered %s webhook for job %s", event.Event, event.JobID)
+	}()
+}
+
+// setAPIKeyCallback sets or, with an empty URL, clears the callback used for
+// uploads made with the key that don't give their own callback_url.
+func setAPIKeyCallback(c *gin.Context) {
+	var req struct {
+		CallbackURL string `json:"callback_url"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.CallbackURL != "" {
+		if err := validCallbackURL(req.CallbackURL); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	var apiKey APIKey
+	if err := db.First(&apiKey, "id = ? AND revoked_at IS NULL", c.Param("id")).Error; err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		return
+	}
+	if err := db.Model(&apiKey).Update("callback_url", req.CallbackURL).Error; err != nil {
+		logCtx(c).Errorf("Error updating callback of API key %s: %v", c.Param("id"), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update API key"})
+		return
+	}
+	logCtx(c).Infof("Set callback of API key %s to %q", c.Param("id"), req.CallbackURL)
+	c.JSON(http.StatusOK, gin.H{"message": "Callback updated", "callback_url": req.CallbackURL})
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+func getWorkers(c *gin.Context) {
+	running, _ := insertPool.size()
+	c.JSON(http.StatusOK, gin.H{
+		"workers":         cfg.Import.Workers,
+		"running_workers": running,
+		"batch_size":      cfg.Import.BatchSize,
+	})
+}
+
+// setWorkers changes the insert pool size and batch size on this instance,
+// so operators can throttle imports while the database is struggling. Both
+// apply to running imports; a config reload puts back the configured values.
+func setWorkers(c *gin.Context) {
+	var req struct {
+		Workers   *int `json:"workers"`
+		BatchSize *int `json:"batch_size"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Workers == nil && req.BatchSize == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Set workers, batch_size or both"})
+		return
+	}
+	if req.Workers != nil && *req.Workers < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "workers must be at least 1"})
+		return
+	}
+	if req.BatchSize != nil && *req.BatchSize < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "batch_size must be at least 1"})
+		return
+	}
+
+	reloadMu.Lock()
+	previous := cfg.Import
+	next := *cfg
+	if req.Workers != nil {
+		next.Import.Workers = *req.Workers
+	}
+	if req.BatchSize != nil {
+		next.Import.BatchSize = *req.BatchSize
+	}
+	cfg = &next
+	if next.Import.Workers != previous.Workers {
+		insertPool.resize(next.Import.Workers)
+	}
+	reloadMu.Unlock()
+
+	if cfg.DB.MaxOpenConns > 0 && cfg.DB.MaxOpenConns <= next.Import.Workers {
+		logCtx(c).Warnf("db.max_open_conns (%d) does not leave room for API traffic alongside %d import workers", cfg.DB.MaxOpenConns, next.Import.Workers)
+	}
+	logCtx(c).Warnf("Insert workers changed from %d to %d and batch size from %d to %d by %s",
+		previous.Workers, next.Import.Workers, previous.BatchSize, next.Import.BatchSize, c.GetString(ctxActor))
+	c.JSON(http.StatusOK, gin.H{
+		"workers":    next.Import.Workers,
+		"batch_size": next.Import.BatchSize,
+		"previous":   gin.H{"workers": previous.Workers, "batch_size": previous.BatchSize},
+	})
+}
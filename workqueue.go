@@ -0,0 +1,363 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+)
+
+const (
+	queueLocal = "local"
+	queueRedis = "redis"
+)
+
+// errLeaseLost stops an import whose lease expired, typically after this
+// instance was cut off from Redis. The job is left to the instance that
+// picked it up again, so nothing is recorded for it here.
+var errLeaseLost = errors.New("lease lost to another instance")
+
+// redisQueue shares import jobs between instances. Jobs wait in a sorted set
+// ordered by priority, then age. An instance with a free import slot pops one
+// and holds a lease on it, renewed by heartbeats; a job whose lease runs out
+// was orphaned by a crashed instance and is put back in the queue to resume
+// from its last recorded checkpoint.
+type redisQueue struct {
+	client   *redis.Client
+	prefix   string
+	instance string
+}
+
+// jobQueue is nil with queue.backend local: jobs run where they are created.
+var jobQueue *redisQueue
+
+var (
+	// popScript takes the next job and its lease in one step, so a job can't
+	// be lost between the two.
+	popScript = redis.NewScript(`
+local popped = redis.call('ZPOPMIN', KEYS[1])
+if #popped == 0 then return false end
+redis.call('ZADD', KEYS[2], ARGV[1], popped[1])
+redis.call('HSET', KEYS[3], popped[1], ARGV[2])
+return popped[1]`)
+
+	// renewScript extends a lease only while this instance still owns it.
+	renewScript = redis.NewScript(`
+if redis.call('HGET', KEYS[2], ARGV[1]) ~= ARGV[3] then return 0 end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+return 1`)
+
+	// reapScript removes expired leases and returns job ID, owner pairs.
+	reapScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local out = {}
+for _, id in ipairs(ids) do
+  redis.call('ZREM', KEYS[1], id)
+  table.insert(out, id)
+  table.insert(out, redis.call('HGET', KEYS[2], id) or '')
+  redis.call('HDEL', KEYS[2], id)
+end
+return out`)
+)
+
+func initJobQueue() {
+	if cfg.Queue.Backend != queueRedis {
+		return
+	}
+	opts, err := redis.ParseURL(cfg.Queue.RedisURL)
+	if err != nil {
+		logr.Fatalf("Invalid queue.redis_url: %v", err)
+	}
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		logr.Fatalf("Failed to connect to Redis at %s: %v", opts.Addr, err)
+	}
+	host, _ := os.Hostname()
+	jobQueue = &redisQueue{client: client, prefix: cfg.Queue.KeyPrefix, instance: host + "-" + uuid.NewString()[:8]}
+	if cfg.Upload.Backend != storageS3 {
+		logr.Warn("queue.backend is redis but uploads are stored locally; every instance must share upload.dir")
+	}
+	go jobQueue.consume()
+	go jobQueue.reap()
+	go jobQueue.listenForControl()
+	go jobQueue.listenForEvents()
+	logr.Infof("Sharing imports through Redis at %s as %s", opts.Addr, jobQueue.instance)
+}
+
+func (q *redisQueue) key(name string) string { return q.prefix + name }
+
+func (q *redisQueue) leaseExpiry() float64 {
+	return float64(time.Now().Add(cfg.Queue.LeaseTTL).UnixMilli())
+}
+
+// enqueue adds the job to the shared queue. The score sorts higher
+// priorities first and, within a priority, older jobs first.
+func (q *redisQueue) enqueue(ctx context.Context, job ImportJob) error {
+	score := float64(maxImportPriority-job.Priority)*1e13 + float64(time.Now().UnixMilli())
+	return q.client.ZAdd(ctx, q.key("queue"), redis.Z{Score: score, Member: job.ID}).Err()
+}
+
+// dispatchImport hands a new or retried job to the shared queue, or runs it
+// here with the local backend or when Redis is unreachable.
+func dispatchImport(ctx context.Context, job ImportJob) {
+	if jobQueue == nil {
+		startImport(ctx, job)
+		return
+	}
+	if err := db.WithContext(ctx).Model(&ImportJob{}).Where("id = ?", job.ID).Update("status", jobQueued).Error; err != nil {
+		logCtx(ctx).Errorf("Error marking import job %s as queued: %v", job.ID, err)
+	}
+	if err := jobQueue.enqueue(ctx, job); err != nil {
+		logCtx(ctx).Errorf("Error queueing import job %s in Redis, running it here: %v", job.ID, err)
+		startImport(ctx, job)
+		return
+	}
+	logCtx(ctx).Infof("Import job %s queued for any instance", job.ID)
+	publishJobEvent(ctx, newJobStreamEvent(job, "import.queued", jobQueued))
+}
+
+// consume pops jobs while this instance has free import slots, until
+// shutdown.
+func (q *redisQueue) consume() {
+	keys := []string{q.key("queue"), q.key("leases"), q.key("owners")}
+	for {
+		if err := importSlots.acquire(importCtx, maxImportPriority, func() {}); err != nil {
+			return
+		}
+		id, err := popScript.Run(importCtx, q.client, keys, q.leaseExpiry(), q.instance).Text()
+		if err != nil {
+			importSlots.release()
+			if !errors.Is(err, redis.Nil) && importCtx.Err() == nil {
+				logr.Errorf("Error taking a job from the Redis queue: %v", err)
+			}
+			select {
+			case <-importCtx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+		q.run(id)
+	}
+}
+
+// run processes a job popped from the queue on this instance. The caller
+// holds an import slot, which is released when the job ends.
+func (q *redisQueue) run(id string) {
+	var job ImportJob
+	err := db.First(&job, "id = ?", id).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		// Keep the lease; once it expires the job is requeued.
+		logJob(id).Errorf("Error loading import job %s taken from the Redis queue: %v", id, err)
+		importSlots.release()
+		return
+	}
+	if err == nil && job.Status != jobQueued && job.Status != jobPending {
+		err = fmt.Errorf("job is %s", job.Status)
+	}
+	if err != nil {
+		logJob(id).Warnf("Dropping import job %s from the Redis queue: %v", id, err)
+		q.release(id)
+		importSlots.release()
+		return
+	}
+
+	ctx, run := registerImport(context.Background(), job)
+	go func() {
+		defer run.finish(job.ID)
+		defer importSlots.release()
+		defer q.release(job.ID)
+		stop := q.heartbeat(ctx, job.ID, run.cancel)
+		defer stop()
+		logCtx(ctx).Infof("Picked up import job %s from the Redis queue", job.ID)
+		processCSV(ctx, job)
+		// A job paused when the instance stopped stays interrupted until
+		// someone retries it.
+		if importCtx.Err() != nil && !run.gate.isPaused() {
+			q.handOver(job)
+		}
+	}()
+}
+
+// handOver puts a job this instance stopped for shutdown back in the queue so
+// another instance resumes it.
+func (q *redisQueue) handOver(job ImportJob) {
+	ctx := context.Background()
+	result := db.Model(&ImportJob{}).Where("id = ? AND status = ?", job.ID, jobInterrupted).
+		Updates(map[string]interface{}{"status": jobQueued, "finished_at": nil})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+	if err := q.enqueue(ctx, job); err != nil {
+		logJob(job.ID).Errorf("Error handing import job %s over to another instance: %v", job.ID, err)
+		db.Model(&ImportJob{}).Where("id = ?", job.ID).Update("status", jobInterrupted)
+		return
+	}
+	logJob(job.ID).Infof("Handed import job %s over to another instance", job.ID)
+}
+
+// heartbeat renews the job's lease until stop is called, cancelling the
+// import with errLeaseLost if another instance has taken it over.
+func (q *redisQueue) heartbeat(ctx context.Context, id string, cancel context.CancelCauseFunc) (stop func()) {
+	done := make(chan struct{})
+	keys := []string{q.key("leases"), q.key("owners")}
+	go func() {
+		ticker := time.NewTicker(cfg.Queue.LeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				owned, err := renewScript.Run(context.Background(), q.client, keys, id, q.leaseExpiry(), q.instance).Int()
+				if err != nil {
+					logCtx(ctx).Warnf("Error renewing lease on import job %s: %v", id, err)
+					continue
+				}
+				if owned == 0 {
+					logCtx(ctx).Errorf("Lease on import job %s expired and was taken over, stopping", id)
+					cancel(errLeaseLost)
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (q *redisQueue) release(id string) {
+	ctx := context.Background()
+	owner, err := q.client.HGet(ctx, q.key("owners"), id).Result()
+	if err != nil || owner != q.instance {
+		return
+	}
+	if _, err := q.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.ZRem(ctx, q.key("leases"), id)
+		p.HDel(ctx, q.key("owners"), id)
+		return nil
+	}); err != nil {
+		logJob(id).Warnf("Error releasing lease on import job %s: %v", id, err)
+	}
+}
+
+// reap requeues jobs whose lease has expired. Every instance reaps; the
+// script hands each expired lease to exactly one of them.
+func (q *redisQueue) reap() {
+	keys := []string{q.key("leases"), q.key("owners")}
+	ticker := time.NewTicker(cfg.Queue.LeaseTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-importCtx.Done():
+			return
+		case <-ticker.C:
+		}
+		expired, err := reapScript.Run(importCtx, q.client, keys, time.Now().UnixMilli()).StringSlice()
+		if err != nil {
+			if importCtx.Err() == nil {
+				logr.Errorf("Error checking for expired import leases: %v", err)
+			}
+			continue
+		}
+		for i := 0; i+1 < len(expired); i += 2 {
+			q.requeueOrphan(expired[i], expired[i+1])
+		}
+	}
+}
+
+func (q *redisQueue) requeueOrphan(id, owner string) {
+	var job ImportJob
+	if err := db.First(&job, "id = ?", id).Error; err != nil {
+		logJob(id).Errorf("Error loading orphaned import job %s: %v", id, err)
+		return
+	}
+	if job.Status == jobPaused {
+		// Resuming elsewhere would silently unpause it.
+		now := time.Now().UTC()
+		db.Model(&ImportJob{}).Where("id = ? AND status = ?", id, jobPaused).
+			Updates(map[string]interface{}{"status": jobInterrupted, "error": "interrupted while paused; retry to resume", "finished_at": &now})
+		logJob(id).Warnf("Import job %s was paused on instance %s, which stopped; left interrupted", id, owner)
+		return
+	}
+	if job.Status != jobRunning && job.Status != jobQueued && job.Status != jobPending {
+		return
+	}
+	result := db.Model(&ImportJob{}).Where("id = ? AND status = ?", id, job.Status).Update("status", jobQueued)
+	if result.Error != nil || result.RowsAffected == 0 {
+		return
+	}
+	if err := q.enqueue(context.Background(), job); err != nil {
+		logJob(id).Errorf("Error requeueing orphaned import job %s: %v", id, err)
+		db.Model(&ImportJob{}).Where("id = ?", id).Update("status", jobInterrupted)
+		return
+	}
+	logJob(id).Warnf("Requeued import job %s orphaned by instance %s, resuming after row %d", id, owner, job.CheckpointRow)
+}
+
+// removeQueued takes a job that is still waiting out of the queue. It
+// reports false if an instance has already picked it up.
+func (q *redisQueue) removeQueued(ctx context.Context, id string) (bool, error) {
+	n, err := q.client.ZRem(ctx, q.key("queue"), id).Result()
+	return n > 0, err
+}
+
+// control asks whichever instance runs the job to cancel, pause or resume
+// it.
+func (q *redisQueue) control(ctx context.Context, action, id, actor string) error {
+	return q.client.Publish(ctx, q.key("control"), action+" "+id+" "+actor).Err()
+}
+
+func (q *redisQueue) listenForControl() {
+	sub := q.client.Subscribe(importCtx, q.key("control"))
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		action, rest, _ := strings.Cut(msg.Payload, " ")
+		id, actor, _ := strings.Cut(rest, " ")
+		v, ok := runningImports.Load(id)
+		if !ok {
+			continue
+		}
+		run := v.(*runningImport)
+		logJob(id).Warnf("Import job %s: %s requested by %s through another instance", id, action, actor)
+		switch action {
+		case "cancel":
+			run.cancel(fmt.Errorf("%w by %s", errImportCancelled, actor))
+		case "pause":
+			run.gate.pause()
+		case "resume":
+			run.gate.resume()
+		}
+	}
+}
+
+// publishEvent sends a job event to every instance's GET /jobs/events
+// streams, this one's included.
+func (q *redisQueue) publishEvent(ctx context.Context, e jobStreamEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return q.client.Publish(ctx, q.key("events"), data).Err()
+}
+
+func (q *redisQueue) listenForEvents() {
+	sub := q.client.Subscribe(importCtx, q.key("events"))
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		var e jobStreamEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+			logr.Warnf("Ignoring malformed job event from Redis: %v", err)
+			continue
+		}
+		jobEvents.deliver(e)
+	}
+}